@@ -140,6 +140,16 @@ func (ft FileType) Table() string {
 	}
 }
 
+// keySchema returns the schema of the keys of the files of this type, nil if keys are not composite
+func (ft FileType) keySchema() *recsplit.KeySchema {
+	switch ft {
+	case AccountHistory, CodeHistory, StorageHistory:
+		return recsplit.TxNumKeySchema
+	default:
+		return nil
+	}
+}
+
 func ParseFileType(s string) (FileType, bool) {
 	switch s {
 	case "account":
@@ -566,7 +576,9 @@ func (c *Changes) deleteFiles() error {
 	return nil
 }
 
-func buildIndex(d *compress.Decompressor, idxPath, tmpDir string, count int) (*recsplit.Index, error) {
+// buildIndex indexes the keys of the key-value file. Keys of the files with schema (changeset files, with
+// recsplit.TxNumKeySchema) are added by their parts, the same way they are looked up; nil schema adds keys as they are
+func buildIndex(d *compress.Decompressor, idxPath, tmpDir string, count int, schema *recsplit.KeySchema) (*recsplit.Index, error) {
 	var rs *recsplit.RecSplit
 	var err error
 	if rs, err = recsplit.NewRecSplit(recsplit.RecSplitArgs{
@@ -578,34 +590,31 @@ func buildIndex(d *compress.Decompressor, idxPath, tmpDir string, count int) (*r
 		StartSeed: []uint64{0x106393c187cae21a, 0x6453cec3f7376937, 0x643e521ddbd2be98, 0x3740c6412f6572cb, 0x717d47562f1ce470, 0x4cd6eb4c63befb7c, 0x9bfd8c5e18c8da73,
 			0x082f20e10092a9a3, 0x2ada2ce68d21defc, 0xe33cb4f3e7c6466b, 0x3980be458c509c59, 0xc466fd9584828e8c, 0x45f0aabe1a61ede6, 0xf6e7b8b33ad9b98d,
 			0x4ef95e25f4b4983d, 0x81175195173b92d3, 0x4e50927d8dd15978, 0x1ea2099d1fafae7f, 0x425c8a06fbaaa815, 0xcd4216006c74052a},
-		IndexFile: idxPath,
+		IndexFile:       idxPath,
+		FingerprintBits: recsplit.DefaultFingerprintBits,
 	}); err != nil {
 		return nil, err
 	}
 	defer rs.Close()
 	word := make([]byte, 0, 256)
+	var parts []recsplit.KeyPart
 	var pos uint64
 	g := d.MakeGetter()
-	for {
-		g.Reset(0)
-		for g.HasNext() {
-			word, _ = g.Next(word[:0])
-			if err = rs.AddKey(word, pos); err != nil {
-				return nil, err
-			}
-			// Skip value
-			pos = g.Skip()
+	for g.HasNext() {
+		word, _ = g.Next(word[:0])
+		if schema == nil {
+			err = rs.AddKey(word, pos)
+		} else if parts, err = schema.AppendParts(parts[:0], word); err == nil {
+			err = rs.AddKeyParts(schema, pos, parts...)
 		}
-		if err = rs.Build(); err != nil {
-			if rs.Collision() {
-				log.Info("Building recsplit. Collision happened. It's ok. Restarting...")
-				rs.ResetNextSalt()
-			} else {
-				return nil, err
-			}
-		} else {
-			break
+		if err != nil {
+			return nil, err
 		}
+		// Skip value
+		pos = g.Skip()
+	}
+	if err = rs.Build(); err != nil {
+		return nil, err
 	}
 	var idx *recsplit.Index
 	if idx, err = recsplit.OpenIndex(idxPath); err != nil {
@@ -729,12 +738,13 @@ func (c *Changes) produceChangeSets(blockFrom, blockTo uint64, historyType, bitm
 	if err = c.rewind(); err != nil {
 		return nil, nil, nil, nil, fmt.Errorf("produceChangeSets rewind: %w", err)
 	}
-	var txKey = make([]byte, 8, 60)
+	var txKey = make([]byte, 0, 60)
 	for b, txNum, e = c.nextTx(); b && e == nil; b, txNum, e = c.nextTx() {
-		binary.BigEndian.PutUint64(txKey[:8], txNum)
 		for key, before, after, b, e = c.nextTriple(key[:0], before[:0], after[:0]); b && e == nil; key, before, after, b, e = c.nextTriple(key[:0], before[:0], after[:0]) {
 			totalRecords++
-			txKey = append(txKey[:8], key...)
+			if txKey, err = recsplit.TxNumKeySchema.AppendKey(txKey[:0], recsplit.U64(txNum), recsplit.Bytes(key)); err != nil {
+				return nil, nil, nil, nil, fmt.Errorf("produceChangeSets key: %w", err)
+			}
 			// In the inital files and most merged file, the txKey is added to the file, but it gets removed in the final merge
 			if err = comp.AddUncompressedWord(txKey); err != nil {
 				return nil, nil, nil, nil, fmt.Errorf("produceChangeSets AddWord key: %w", err)
@@ -770,7 +780,7 @@ func (c *Changes) produceChangeSets(blockFrom, blockTo uint64, historyType, bitm
 	if d, err = compress.NewDecompressor(chsetDatPath); err != nil {
 		return nil, nil, nil, nil, fmt.Errorf("produceChangeSets changeset decompressor: %w", err)
 	}
-	if index, err = buildIndex(d, chsetIdxPath, c.dir, totalRecords); err != nil {
+	if index, err = buildIndex(d, chsetIdxPath, c.dir, totalRecords, historyType.keySchema()); err != nil {
 		return nil, nil, nil, nil, fmt.Errorf("produceChangeSets changeset buildIndex: %w", err)
 	}
 	// Create bitmap files
@@ -818,7 +828,7 @@ func (c *Changes) produceChangeSets(blockFrom, blockTo uint64, historyType, bitm
 		return nil, nil, nil, nil, fmt.Errorf("produceChangeSets bitmap decompressor: %w", err)
 	}
 
-	bitmapI, err := buildIndex(bitmapD, bitmapIdxPath, c.dir, len(idxKeys))
+	bitmapI, err := buildIndex(bitmapD, bitmapIdxPath, c.dir, len(idxKeys), nil /* schema */)
 	if err != nil {
 		return nil, nil, nil, nil, fmt.Errorf("produceChangeSets bitmap buildIndex: %w", err)
 	}
@@ -1614,35 +1624,30 @@ func (a *Aggregator) reduceHistoryFiles(fType FileType, item *byEndBlockItem) er
 		StartSeed: []uint64{0x106393c187cae21a, 0x6453cec3f7376937, 0x643e521ddbd2be98, 0x3740c6412f6572cb, 0x717d47562f1ce470, 0x4cd6eb4c63befb7c, 0x9bfd8c5e18c8da73,
 			0x082f20e10092a9a3, 0x2ada2ce68d21defc, 0xe33cb4f3e7c6466b, 0x3980be458c509c59, 0xc466fd9584828e8c, 0x45f0aabe1a61ede6, 0xf6e7b8b33ad9b98d,
 			0x4ef95e25f4b4983d, 0x81175195173b92d3, 0x4e50927d8dd15978, 0x1ea2099d1fafae7f, 0x425c8a06fbaaa815, 0xcd4216006c74052a},
-		IndexFile: idxPath,
+		IndexFile:       idxPath,
+		FingerprintBits: recsplit.DefaultFingerprintBits,
 	}); err != nil {
 		return fmt.Errorf("reduceHistoryFiles NewRecSplit: %w", err)
 	}
 	g1 := d.MakeGetter()
-	for {
-		g.Reset(0)
-		g1.Reset(0)
-		var lastOffset uint64
-		for g.HasNext() {
-			key, _ = g.Next(key[:0])
-			g.Skip() // Skip value
-			_, pos := g1.Next(nil)
-			//fmt.Printf("reduce2 [%s.%d-%d] [%x]==>%d\n", fType.String(), item.startBlock, item.endBlock, key, lastOffset)
-			if err = rs.AddKey(key, lastOffset); err != nil {
-				return fmt.Errorf("reduceHistoryFiles %p AddKey: %w", rs, err)
-			}
-			lastOffset = pos
-		}
-		if err = rs.Build(); err != nil {
-			if rs.Collision() {
-				log.Info("Building reduceHistoryFiles. Collision happened. It's ok. Restarting...")
-				rs.ResetNextSalt()
-			} else {
-				return fmt.Errorf("reduceHistoryFiles Build: %w", err)
-			}
-		} else {
-			break
+	g.Reset(0)
+	var lastOffset uint64
+	var parts []recsplit.KeyPart
+	for g.HasNext() {
+		key, _ = g.Next(key[:0])
+		g.Skip() // Skip value
+		_, pos := g1.Next(nil)
+		//fmt.Printf("reduce2 [%s.%d-%d] [%x]==>%d\n", fType.String(), item.startBlock, item.endBlock, key, lastOffset)
+		if parts, err = recsplit.TxNumKeySchema.AppendParts(parts[:0], key); err == nil {
+			err = rs.AddKeyParts(recsplit.TxNumKeySchema, lastOffset, parts...)
+		}
+		if err != nil {
+			return fmt.Errorf("reduceHistoryFiles %p AddKey: %w", rs, err)
 		}
+		lastOffset = pos
+	}
+	if err = rs.Build(); err != nil {
+		return fmt.Errorf("reduceHistoryFiles Build: %w", err)
 	}
 	if err = item.decompressor.Close(); err != nil {
 		return fmt.Errorf("reduceHistoryFiles close decompressor: %w", err)
@@ -1956,7 +1961,11 @@ func (a *Aggregator) readFromFiles(fType FileType, lock bool, blockNum uint64, f
 		if item.index.Empty() {
 			return true
 		}
-		offset := item.indexReader.Lookup(filekey)
+		offset, ok := item.indexReader.LookupExists(filekey)
+		if !ok {
+			atomic.AddUint64(&a.fileMisses, 1)
+			return true
+		}
 		g := item.getter
 		g.Reset(offset)
 		if g.HasNext() {
@@ -2920,7 +2929,7 @@ func (a *Aggregator) computeAggregation(fType FileType,
 	item2.getterMerge = item2.decompressor.MakeGetter()
 	if withIndex {
 		idxPath := filepath.Join(a.diffDir, fmt.Sprintf("%s.%d-%d.idx", fType.String(), aggFrom, aggTo))
-		if item2.index, err = buildIndex(item2.decompressor, idxPath, a.diffDir, count); err != nil {
+		if item2.index, err = buildIndex(item2.decompressor, idxPath, a.diffDir, count, fType.keySchema()); err != nil {
 			return nil, fmt.Errorf("mergeIntoStateFile buildIndex %s [%d-%d]: %w", fType.String(), aggFrom, aggTo, err)
 		}
 		item2.indexReader = recsplit.NewIndexReader(item2.index)
@@ -2941,7 +2950,7 @@ func createDatAndIndex(treeName string, diffDir string, bt *btree.BTree, blockFr
 		return nil, nil, fmt.Errorf("createDatAndIndex %s decompressor: %w", treeName, err)
 	}
 	var index *recsplit.Index
-	if index, err = buildIndex(d, idxPath, diffDir, count); err != nil {
+	if index, err = buildIndex(d, idxPath, diffDir, count, nil /* schema */); err != nil {
 		return nil, nil, fmt.Errorf("createDatAndIndex %s buildIndex: %w", treeName, err)
 	}
 	return d, index, nil
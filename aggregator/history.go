@@ -17,7 +17,6 @@
 package aggregator
 
 import (
-	"encoding/binary"
 	"fmt"
 	"io/fs"
 	"os"
@@ -237,9 +236,6 @@ func (hr *HistoryReader) searchInHistory(bitmapType, historyType FileType, key [
 	if trace {
 		fmt.Printf("found in tx %d, endBlock %d\n", foundTxNum, foundEndBlock)
 	}
-	var lookupKey = make([]byte, len(key)+8)
-	binary.BigEndian.PutUint64(lookupKey, foundTxNum)
-	copy(lookupKey[8:], key)
 	var historyItem *byEndBlockItem
 	hr.search.endBlock = foundEndBlock
 	hr.search.startBlock = foundEndBlock - 499_999
@@ -248,9 +244,9 @@ func (hr *HistoryReader) searchInHistory(bitmapType, historyType FileType, key [
 	} else {
 		return false, nil, fmt.Errorf("no %s file found for %d", historyType.String(), foundEndBlock)
 	}
-	offset := historyItem.indexReader.Lookup(lookupKey)
+	offset := historyItem.indexReader.LookupParts(recsplit.TxNumKeySchema, recsplit.U64(foundTxNum), recsplit.Bytes(key))
 	if trace {
-		fmt.Printf("Lookup [%x] in %s.[%d-%d].idx = %d\n", lookupKey, historyType.String(), historyItem.startBlock, historyItem.endBlock, offset)
+		fmt.Printf("Lookup [%x] tx %d in %s.[%d-%d].idx = %d\n", key, foundTxNum, historyType.String(), historyItem.startBlock, historyItem.endBlock, offset)
 	}
 	historyItem.getter.Reset(offset)
 	v, _ := historyItem.getter.Next(nil)
@@ -25,19 +25,14 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"math/bits"
 	"os"
 	"path/filepath"
-	"sort"
-	"sync"
 	"time"
 
-	"github.com/flanglet/kanzi-go/transform"
 	"github.com/ledgerwatch/erigon-lib/common"
 	dir2 "github.com/ledgerwatch/erigon-lib/common/dir"
 	"github.com/ledgerwatch/erigon-lib/etl"
-	"github.com/ledgerwatch/erigon-lib/patricia"
 	"github.com/ledgerwatch/log/v3"
 )
 
@@ -57,15 +52,9 @@ type Compressor struct {
 	tmpDir                     string // temporary directory to use for ETL when building dictionary
 	workers                    int
 
-	// Buffer for "superstring" - transformation of superstrings where each byte of a word, say b,
-	// is turned into 2 bytes, 0x01 and b, and two zero bytes 0x00 0x00 are inserted after each word
-	// this is needed for using ordinary (one string) suffix sorting algorithm instead of a generalised (many superstrings) suffix
-	// sorting algorithm
-	superstring      []byte
-	superstrings     chan []byte
-	wg               *sync.WaitGroup
-	suffixCollectors []*etl.Collector
-	wordsCount       uint64
+	trainer    *DictionaryTrainer // Builds dictionary from the added words, nil if external dictionary is used
+	opts       segmentOptions     // Optional features of the output file
+	wordsCount uint64
 
 	ctx       context.Context
 	logPrefix string
@@ -75,6 +64,17 @@ type Compressor struct {
 }
 
 func NewCompressor(ctx context.Context, logPrefix, outputFile, tmpDir string, minPatternScore uint64, workers int, lvl log.Lvl) (*Compressor, error) {
+	cfg := CompressorCfgBalanced
+	cfg.MinPatternScore, cfg.Workers = minPatternScore, workers
+	return NewCompressorWithCfg(ctx, logPrefix, outputFile, tmpDir, cfg, lvl)
+}
+
+// NewCompressorWithCfg creates compressor with given settings of dictionary building, usually one of the presets
+// (CompressorCfgFast, CompressorCfgBalanced, CompressorCfgMax), possibly adjusted
+func NewCompressorWithCfg(ctx context.Context, logPrefix, outputFile, tmpDir string, cfg CompressorCfg, lvl log.Lvl) (*Compressor, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
 	dir2.MustExist(tmpDir)
 	dir, fileName := filepath.Split(outputFile)
 	tmpOutFilePath := filepath.Join(dir, fileName) + ".tmp"
@@ -90,38 +90,101 @@ func NewCompressor(ctx context.Context, logPrefix, outputFile, tmpDir string, mi
 		return nil, err
 	}
 
-	// Collector for dictionary superstrings (sorted by their score)
-	superstrings := make(chan []byte, workers*2)
-	wg := &sync.WaitGroup{}
-	wg.Add(workers)
-	suffixCollectors := make([]*etl.Collector, workers)
-	for i := 0; i < workers; i++ {
-		collector := etl.NewCollector(compressLogPrefix, tmpDir, etl.NewSortableBuffer(etl.BufferOptimalSize/2))
-		suffixCollectors[i] = collector
-		go processSuperstring(superstrings, collector, minPatternScore, wg)
-	}
-
 	return &Compressor{
 		uncompressedFile: uncompressedFile,
 		tmpOutFilePath:   tmpOutFilePath,
 		outputFile:       outputFile,
 		tmpDir:           tmpDir,
 		logPrefix:        logPrefix,
-		workers:          workers,
+		workers:          cfg.Workers,
 		ctx:              ctx,
-		superstrings:     superstrings,
-		suffixCollectors: suffixCollectors,
+		trainer:          NewDictionaryTrainerWithCfg(ctx, tmpDir, cfg),
 		lvl:              lvl,
-		wg:               wg,
 	}, nil
 }
 
 func (c *Compressor) Close() {
 	c.uncompressedFile.Close()
-	for _, collector := range c.suffixCollectors {
-		collector.Close()
+	if c.trainer != nil {
+		c.trainer.Close()
+	}
+}
+
+// SetMemoryBudget makes the collectors of dictionary building workers share given memory budget
+// (possibly with collectors of other compressors). Needs to be called before adding words
+func (c *Compressor) SetMemoryBudget(budget *etl.MemoryBudget) {
+	if c.trainer != nil {
+		c.trainer.SetMemoryBudget(budget)
 	}
-	c.suffixCollectors = nil
+}
+
+// SetDictionary makes compressor use given external dictionary instead of building its own.
+// Resulting file references the dictionary by its hash and file name, and Decompressor loads it from the
+// same directory as the compressed file. Dictionary must be saved (or loaded), and this needs to be called
+// before adding words
+func (c *Compressor) SetDictionary(dict *Dictionary) error {
+	if dict.filePath == "" {
+		return fmt.Errorf("dictionary needs to be saved before compressing against it")
+	}
+	if c.wordsCount > 0 {
+		return fmt.Errorf("dictionary needs to be set before adding words")
+	}
+	if c.trainer != nil {
+		c.trainer.Close()
+		c.trainer = nil
+	}
+	c.opts.dict = dict
+	return nil
+}
+
+// SetChecksums makes compressor write the file in versioned format, with checksums of the header and of
+// every block of words. Decompressor checks the footer and the header when opening such files,
+// and Decompressor.Verify checks all the blocks
+func (c *Compressor) SetChecksums(checksums bool) {
+	c.opts.checksums = checksums
+}
+
+// SetWordOffsets makes compressor write the file in versioned format, with offsets of all the words,
+// so that words can be accessed by their numbers (see Decompressor.WordAt and Getter.ResetToWord)
+// without building an external index
+func (c *Compressor) SetWordOffsets(wordOffsets bool) {
+	c.opts.wordOffsets = wordOffsets
+}
+
+// SetChunkSize makes compressor write the file in versioned format, with boundaries of chunks of words of
+// (roughly) given size in bytes, so that the words can be decompressed in parallel (see Decompressor.SplitWords).
+// Size 0 disables chunks
+func (c *Compressor) SetChunkSize(size uint64) {
+	c.opts.chunkSize = size
+}
+
+// SetKeySamples declares that words are records of recordWords consecutive words, the first of which is the key,
+// and that records are added in the order of their keys. Compressor writes the file in versioned format,
+// with keys of every n-th record, so that records can be found by key without an external index
+// (see Getter.Seek). Adding a record with smaller key than the previous one fails. Needs to be called
+// before adding words
+func (c *Compressor) SetKeySamples(every, recordWords int) error {
+	if every < 1 || recordWords < 1 {
+		return fmt.Errorf("invalid key sampling: every %d records of %d words", every, recordWords)
+	}
+	if c.wordsCount > 0 {
+		return fmt.Errorf("key sampling needs to be set before adding words")
+	}
+	c.opts.keySamples = &keySampler{every: uint64(every), recordWords: uint64(recordWords)}
+	return nil
+}
+
+// SetEntropyCoder makes compressor encode the words with the secondary coder (see EntropyCoder), and write
+// the file in versioned format, with ID of the coder in the header. The coder has to be registered
+// (see RegisterEntropyCoder), so that the file can be opened. Nil coder turns the secondary coding off
+func (c *Compressor) SetEntropyCoder(coder EntropyCoder) error {
+	if coder != nil {
+		if _, ok := LookupEntropyCoder(coder.ID()); !ok {
+			return fmt.Errorf("entropy coder %d is not registered", coder.ID())
+		}
+	}
+	c.opts.coder = coder
+	return nil
 }
 
 func (c *Compressor) SetTrace(trace bool) {
@@ -131,21 +194,24 @@ func (c *Compressor) SetTrace(trace bool) {
 func (c *Compressor) Count() int { return int(c.wordsCount) }
 
 func (c *Compressor) AddWord(word []byte) error {
-	c.wordsCount++
-
-	if len(c.superstring)+2*len(word)+2 > superstringLimit {
-		c.superstrings <- c.superstring
-		c.superstring = nil
+	if c.opts.keySamples != nil {
+		if err := c.opts.keySamples.addWord(c.wordsCount, word); err != nil {
+			return err
+		}
 	}
-	for _, a := range word {
-		c.superstring = append(c.superstring, 1, a)
+	c.wordsCount++
+	if c.trainer != nil {
+		c.trainer.AddWord(word)
 	}
-	c.superstring = append(c.superstring, 0, 0)
-
 	return c.uncompressedFile.Append(word)
 }
 
 func (c *Compressor) AddUncompressedWord(word []byte) error {
+	if c.opts.keySamples != nil {
+		if err := c.opts.keySamples.addWord(c.wordsCount, word); err != nil {
+			return err
+		}
+	}
 	c.wordsCount++
 	return c.uncompressedFile.AppendUncompressed(word)
 }
@@ -154,15 +220,12 @@ func (c *Compressor) Compress() error {
 	c.uncompressedFile.w.Flush()
 	logEvery := time.NewTicker(20 * time.Second)
 	defer logEvery.Stop()
-	if len(c.superstring) > 0 {
-		c.superstrings <- c.superstring
-	}
-	close(c.superstrings)
-	c.wg.Wait()
-
-	db, err := DictionaryBuilderFromCollectors(c.ctx, compressLogPrefix, c.tmpDir, c.suffixCollectors)
-	if err != nil {
 
+	var db *DictionaryBuilder
+	var err error
+	if c.opts.dict != nil {
+		db = c.opts.dict.builder()
+	} else if db, err = c.trainer.build(); err != nil {
 		return err
 	}
 	if c.trace {
@@ -173,7 +236,7 @@ func (c *Compressor) Compress() error {
 	}
 
 	defer os.Remove(c.tmpOutFilePath)
-	if err := reducedict(c.ctx, c.trace, c.logPrefix, c.tmpOutFilePath, c.uncompressedFile, c.workers, db, c.lvl); err != nil {
+	if err := reducedict(c.ctx, c.trace, c.logPrefix, c.tmpOutFilePath, c.uncompressedFile, c.workers, db, c.opts, c.lvl); err != nil {
 		return err
 	}
 
@@ -188,39 +251,7 @@ func (c *Compressor) Compress() error {
 	return nil
 }
 
-type CompressorSequential struct {
-	outputFile      string // File where to output the dictionary and compressed data
-	tmpDir          string // temporary directory to use for ETL when building dictionary
-	minPatternScore uint64 //minimum score (per superstring) required to consider including pattern into the dictionary
-	// Buffer for "superstring" - transformation of superstrings where each byte of a word, say b,
-	// is turned into 2 bytes, 0x01 and b, and two zero bytes 0x00 0x00 are inserted after each word
-	// this is needed for using ordinary (one string) suffix sorting algorithm instead of a generalised (many superstrings) suffix
-	// sorting algorithm
-	superstring []byte
-	divsufsort  *transform.DivSufSort       // Instance of DivSufSort - algorithm for building suffix array for the superstring
-	suffixarray []int32                     // Suffix array - output for divsufsort algorithm
-	lcp         []int32                     // LCP array (Longest Common Prefix)
-	collector   *etl.Collector              // Collector used to handle very large sets of superstrings
-	numBuf      [binary.MaxVarintLen64]byte // Buffer for producing var int serialisation
-	collectBuf  []byte                      // Buffer for forming key to call collector
-	dictBuilder DictionaryBuilder           // Priority queue that selects dictionary patterns with highest scores, and then sorts them by scores
-	pt          patricia.PatriciaTree       // Patricia tree of dictionary patterns
-	mf          patricia.MatchFinder        // Match finder to use together with patricia tree (it stores search context and buffers matches)
-	ring        *Ring                       // Cycling ring for dynamic programming algorithm determining optimal coverage of word by dictionary patterns
-	wordFile    *os.File                    // Temporary file to keep superstrings in for the second pass
-	wordW       *bufio.Writer               // Bufferred writer for temporary file
-	interFile   *os.File                    // File to write intermediate compression to
-	interW      *bufio.Writer               // Buffered writer associate to interFile
-	patterns    []int                       // Buffer of pattern ids (used in the dynamic programming algorithm to remember patterns corresponding to dynamic cells)
-	uncovered   []int                       // Buffer of intervals that are not covered by patterns
-	posMap      map[uint64]uint64           // Counter of use for each position within compressed word (for building huffman code for positions)
-
-	wordsCount, emptyWordsCount uint64
-}
-
 // superstringLimit limits how large can one "superstring" get before it is processed
-// CompressorSequential allocates 7 bytes for each uint of superstringLimit. For example,
-// superstingLimit 16m will result in 112Mb being allocated for various arrays
 const superstringLimit = 16 * 1024 * 1024
 
 // minPatternLen is minimum length of pattern we consider to be included into the dictionary
@@ -234,6 +265,74 @@ const maxDictPatterns = 1 * 1024 * 1024
 //nolint
 const compressLogPrefix = "compress"
 
+// CompressorCfg controls how dictionary of patterns is built, trading build time and memory for compression ratio
+type CompressorCfg struct {
+	MinPatternScore  uint64 // Minimum score (per superstring) required to consider including pattern into the dictionary
+	MinPatternLen    int    // Patterns shorter than this are not considered
+	MaxPatternLen    int    // Patterns longer than this are not considered
+	MaxDictPatterns  int    // Maximum number of patterns in the initial (not reduced) dictionary
+	SuperstringLimit int    // Size of superstrings (twice the size of words in them) processed at once
+	SamplingRate     int    // Only every n-th word is used to build the dictionary, all the words are compressed
+	// Workers is the number of goroutines building the dictionary and compressing the words. With 1 worker,
+	// everything is done in the calling goroutine, in the order the words were added. Compressed file is
+	// byte-identical for any number of workers, so snapshots can be reproduced on other machines
+	Workers int
+}
+
+var (
+	// CompressorCfgFast builds small dictionary from a sample of the words, for the data that compresses poorly
+	// or needs to be compressed quickly
+	CompressorCfgFast = CompressorCfg{
+		MinPatternScore:  4 * MinPatternScore,
+		MinPatternLen:    8,
+		MaxPatternLen:    64,
+		MaxDictPatterns:  64 * 1024,
+		SuperstringLimit: 4 * 1024 * 1024,
+		SamplingRate:     4,
+		Workers:          1,
+	}
+	// CompressorCfgBalanced is what NewCompressor uses
+	CompressorCfgBalanced = CompressorCfg{
+		MinPatternScore:  MinPatternScore,
+		MinPatternLen:    minPatternLen,
+		MaxPatternLen:    maxPatternLen,
+		MaxDictPatterns:  maxDictPatterns,
+		SuperstringLimit: superstringLimit,
+		SamplingRate:     1,
+		Workers:          1,
+	}
+	// CompressorCfgMax builds large dictionary with long patterns, for the best ratio of files that are built once
+	// and read often
+	CompressorCfgMax = CompressorCfg{
+		MinPatternScore:  MinPatternScore / 4,
+		MinPatternLen:    4,
+		MaxPatternLen:    256,
+		MaxDictPatterns:  4 * 1024 * 1024,
+		SuperstringLimit: 64 * 1024 * 1024,
+		SamplingRate:     1,
+		Workers:          1,
+	}
+)
+
+func (cfg CompressorCfg) validate() error {
+	if cfg.MinPatternLen < 1 || cfg.MaxPatternLen < cfg.MinPatternLen {
+		return fmt.Errorf("invalid pattern length bounds: [%d, %d]", cfg.MinPatternLen, cfg.MaxPatternLen)
+	}
+	if cfg.MaxDictPatterns < 1 {
+		return fmt.Errorf("invalid maximum number of dictionary patterns: %d", cfg.MaxDictPatterns)
+	}
+	if cfg.SuperstringLimit < 2*cfg.MaxPatternLen+2 {
+		return fmt.Errorf("superstring limit %d is too small for patterns of length %d", cfg.SuperstringLimit, cfg.MaxPatternLen)
+	}
+	if cfg.SamplingRate < 1 {
+		return fmt.Errorf("invalid sampling rate: %d", cfg.SamplingRate)
+	}
+	if cfg.Workers < 1 {
+		return fmt.Errorf("invalid number of workers: %d", cfg.Workers)
+	}
+	return nil
+}
+
 type DictionaryBuilder struct {
 	limit         int
 	lastWord      []byte
@@ -671,616 +770,6 @@ func (r *Ring) Truncate(i int) {
 	r.tail = (r.head + i) & (len(r.cells) - 1)
 }
 
-func NewCompressorSequential(logPrefix, outputFile string, tmpDir string, minPatternScore uint64) (*CompressorSequential, error) {
-	c := &CompressorSequential{
-		minPatternScore: minPatternScore,
-		outputFile:      outputFile,
-		tmpDir:          tmpDir,
-		superstring:     make([]byte, 0, superstringLimit), // Allocate enough, so we never need to resize
-		suffixarray:     make([]int32, superstringLimit),
-		lcp:             make([]int32, superstringLimit/2),
-		collectBuf:      make([]byte, 8, 256),
-		ring:            NewRing(),
-		patterns:        make([]int, 0, 32),
-		uncovered:       make([]int, 0, 32),
-		posMap:          make(map[uint64]uint64),
-	}
-	var err error
-	if c.divsufsort, err = transform.NewDivSufSort(); err != nil {
-		return nil, err
-	}
-	if c.wordFile, err = ioutil.TempFile(c.tmpDir, "superstrings-"); err != nil {
-		return nil, err
-	}
-	c.wordW = bufio.NewWriterSize(c.wordFile, etl.BufIOSize)
-	c.collector = etl.NewCollector(logPrefix, tmpDir, etl.NewSortableBuffer(etl.BufferOptimalSize/2))
-	return c, nil
-}
-
-// AddWord needs to be called repeatedly to provide all the superstrings to compress
-func (c *CompressorSequential) AddWord(word []byte) error {
-	c.wordsCount++
-	if len(word) == 0 {
-		c.emptyWordsCount++
-	}
-	if len(c.superstring)+2*len(word)+2 > superstringLimit {
-		// Adding this word would make superstring go over the limit
-		if err := c.processSuperstring(); err != nil {
-			return fmt.Errorf("buildDictNextWord: error processing superstring: %w", err)
-		}
-	}
-	for _, b := range word {
-		c.superstring = append(c.superstring, 1, b)
-	}
-	c.superstring = append(c.superstring, 0, 0)
-	n := binary.PutUvarint(c.numBuf[:], uint64(len(word)))
-	if _, err := c.wordW.Write(c.numBuf[:n]); err != nil {
-		return err
-	}
-	if len(word) > 0 {
-		if _, err := c.wordW.Write(word); err != nil {
-			return err
-		}
-	}
-	return nil
-}
-
-func (c *CompressorSequential) Compress() error {
-	if c.wordW != nil {
-		if err := c.wordW.Flush(); err != nil {
-			return err
-		}
-	}
-	if err := c.buildDictionary(); err != nil {
-		return err
-	}
-	if err := c.findMatches(); err != nil {
-		return err
-	}
-	if err := c.optimiseCodes(); err != nil {
-		return err
-	}
-	return nil
-}
-
-func (c *CompressorSequential) Close() {
-	c.collector.Close()
-	c.wordFile.Close()
-	c.interFile.Close()
-}
-
-func (c *CompressorSequential) findMatches() error {
-	// Build patricia tree out of the patterns in the dictionary, for further matching in individual superstrings
-	// Allocate temporary initial codes to the patterns so that patterns with higher scores get smaller code
-	// This helps reduce the size of intermediate compression
-	for i, p := range c.dictBuilder.items {
-		p.code = uint64(len(c.dictBuilder.items) - i - 1)
-		c.pt.Insert(p.word, p)
-	}
-	var err error
-	if c.interFile, err = ioutil.TempFile(c.tmpDir, "inter-compress-"); err != nil {
-		return err
-	}
-	c.interW = bufio.NewWriterSize(c.interFile, etl.BufIOSize)
-	if _, err := c.wordFile.Seek(0, 0); err != nil {
-		return err
-	}
-	defer os.Remove(c.wordFile.Name())
-	defer c.wordFile.Close()
-	r := bufio.NewReaderSize(c.wordFile, etl.BufIOSize)
-	var readBuf []byte
-	l, e := binary.ReadUvarint(r)
-	for ; e == nil; l, e = binary.ReadUvarint(r) {
-		c.posMap[l+1]++
-		c.posMap[0]++
-		if int(l) > len(readBuf) {
-			readBuf = make([]byte, l)
-		}
-		if _, e := io.ReadFull(r, readBuf[:l]); e != nil {
-			return e
-		}
-		word := readBuf[:l]
-		// Encode length of the word as var int for the intermediate compression
-		n := binary.PutUvarint(c.numBuf[:], uint64(len(word)))
-		if _, err := c.interW.Write(c.numBuf[:n]); err != nil {
-			return err
-		}
-		if len(word) > 0 {
-			matches := c.mf.FindLongestMatches(word)
-			if len(matches) == 0 {
-				n = binary.PutUvarint(c.numBuf[:], 0)
-				if _, err := c.interW.Write(c.numBuf[:n]); err != nil {
-					return err
-				}
-				if _, err := c.interW.Write(word); err != nil {
-					return err
-				}
-				continue
-			}
-			c.ring.Reset()
-			c.patterns = append(c.patterns[:0], 0, 0) // Sentinel entry - no meaning
-			lastF := matches[len(matches)-1]
-			for j := lastF.Start; j < lastF.End; j++ {
-				d := c.ring.PushBack()
-				d.optimStart = j + 1
-				d.coverStart = len(word)
-				d.compression = 0
-				d.patternIdx = 0
-				d.score = 0
-			}
-			// Starting from the last match
-			for i := len(matches); i > 0; i-- {
-				f := matches[i-1]
-				p := f.Val.(*Pattern)
-				firstCell := c.ring.Get(0)
-				maxCompression := firstCell.compression
-				maxScore := firstCell.score
-				maxCell := firstCell
-				var maxInclude bool
-				for e := 0; e < c.ring.Len(); e++ {
-					cell := c.ring.Get(e)
-					comp := cell.compression - 4
-					if cell.coverStart >= f.End {
-						comp += f.End - f.Start
-					} else {
-						comp += cell.coverStart - f.Start
-					}
-					score := cell.score + p.score
-					if comp > maxCompression || (comp == maxCompression && score > maxScore) {
-						maxCompression = comp
-						maxScore = score
-						maxInclude = true
-						maxCell = cell
-					} else if cell.optimStart > f.End {
-						c.ring.Truncate(e)
-						break
-					}
-				}
-				d := c.ring.PushFront()
-				d.optimStart = f.Start
-				d.score = maxScore
-				d.compression = maxCompression
-				if maxInclude {
-					d.coverStart = f.Start
-					d.patternIdx = len(c.patterns)
-					c.patterns = append(c.patterns, i-1, maxCell.patternIdx)
-				} else {
-					d.coverStart = maxCell.coverStart
-					d.patternIdx = maxCell.patternIdx
-				}
-			}
-			optimCell := c.ring.Get(0)
-			// Count number of patterns
-			var patternCount uint64
-			patternIdx := optimCell.patternIdx
-			for patternIdx != 0 {
-				patternCount++
-				patternIdx = c.patterns[patternIdx+1]
-			}
-			n = binary.PutUvarint(c.numBuf[:], patternCount)
-			if _, err := c.interW.Write(c.numBuf[:n]); err != nil {
-				return err
-			}
-			patternIdx = optimCell.patternIdx
-			lastStart := 0
-			var lastUncovered int
-			c.uncovered = c.uncovered[:0]
-			for patternIdx != 0 {
-				pattern := c.patterns[patternIdx]
-				p := matches[pattern].Val.(*Pattern)
-				if matches[pattern].Start > lastUncovered {
-					c.uncovered = append(c.uncovered, lastUncovered, matches[pattern].Start)
-				}
-				lastUncovered = matches[pattern].End
-				// Starting position
-				c.posMap[uint64(matches[pattern].Start-lastStart+1)]++
-				lastStart = matches[pattern].Start
-				n = binary.PutUvarint(c.numBuf[:], uint64(matches[pattern].Start))
-				if _, err := c.interW.Write(c.numBuf[:n]); err != nil {
-					return err
-				}
-				// Code
-				n = binary.PutUvarint(c.numBuf[:], p.code)
-				if _, err := c.interW.Write(c.numBuf[:n]); err != nil {
-					return err
-				}
-				p.uses++
-				patternIdx = c.patterns[patternIdx+1]
-			}
-			if len(word) > lastUncovered {
-				c.uncovered = append(c.uncovered, lastUncovered, len(word))
-			}
-			// Add uncoded input
-			for i := 0; i < len(c.uncovered); i += 2 {
-				if _, err := c.interW.Write(word[c.uncovered[i]:c.uncovered[i+1]]); err != nil {
-					return err
-				}
-			}
-		}
-	}
-	if e != nil && !errors.Is(e, io.EOF) {
-		return e
-	}
-	if err = c.interW.Flush(); err != nil {
-		return err
-	}
-	return nil
-}
-
-// optimises coding for patterns and positions
-func (c *CompressorSequential) optimiseCodes() error {
-	if _, err := c.interFile.Seek(0, 0); err != nil {
-		return err
-	}
-	defer os.Remove(c.interFile.Name())
-	defer c.interFile.Close()
-	// Select patterns with non-zero use and sort them by increasing frequency of use (in preparation for building Huffman tree)
-	var patternList PatternList
-	for _, p := range c.dictBuilder.items {
-		if p.uses > 0 {
-			patternList = append(patternList, p)
-		}
-	}
-	sort.Sort(&patternList)
-
-	i := 0 // Will be going over the patternList
-	// Build Huffman tree for codes
-	var codeHeap PatternHeap
-	heap.Init(&codeHeap)
-	tieBreaker := uint64(0)
-	for codeHeap.Len()+(patternList.Len()-i) > 1 {
-		// New node
-		h := &PatternHuff{
-			tieBreaker: tieBreaker,
-		}
-		if codeHeap.Len() > 0 && (i >= patternList.Len() || codeHeap[0].uses < patternList[i].uses) {
-			// Take h0 from the heap
-			h.h0 = heap.Pop(&codeHeap).(*PatternHuff)
-			h.h0.AddZero()
-			h.uses += h.h0.uses
-		} else {
-			// Take p0 from the list
-			h.p0 = patternList[i]
-			h.p0.code = 0
-			h.p0.codeBits = 1
-			h.uses += h.p0.uses
-			i++
-		}
-		if codeHeap.Len() > 0 && (i >= patternList.Len() || codeHeap[0].uses < patternList[i].uses) {
-			// Take h1 from the heap
-			h.h1 = heap.Pop(&codeHeap).(*PatternHuff)
-			h.h1.AddOne()
-			h.uses += h.h1.uses
-		} else {
-			// Take p1 from the list
-			h.p1 = patternList[i]
-			h.p1.code = 1
-			h.p1.codeBits = 1
-			h.uses += h.p1.uses
-			i++
-		}
-		tieBreaker++
-		heap.Push(&codeHeap, h)
-	}
-	if codeHeap.Len() > 0 {
-		root := heap.Pop(&codeHeap).(*PatternHuff) // Root node of huffman tree
-		root.SetDepth(0)
-	}
-	// Calculate total size of the dictionary
-	var patternsSize uint64
-	for _, p := range patternList {
-		ns := binary.PutUvarint(c.numBuf[:], uint64(p.depth))    // Length of the word's depth
-		n := binary.PutUvarint(c.numBuf[:], uint64(len(p.word))) // Length of the word's length
-		patternsSize += uint64(ns + n + len(p.word))
-	}
-	// Start writing to result file
-	cf, err := os.Create(c.outputFile)
-	if err != nil {
-		return err
-	}
-	defer cf.Close()
-	defer cf.Sync()
-	cw := bufio.NewWriterSize(cf, etl.BufIOSize)
-	defer cw.Flush()
-	// 1-st, output amount of words and emptyWords in file
-	binary.BigEndian.PutUint64(c.numBuf[:], c.wordsCount)
-	if _, err = cw.Write(c.numBuf[:8]); err != nil {
-		return err
-	}
-	binary.BigEndian.PutUint64(c.numBuf[:], c.emptyWordsCount)
-	if _, err = cw.Write(c.numBuf[:8]); err != nil {
-		return err
-	}
-	// 2-nd, output dictionary size
-	binary.BigEndian.PutUint64(c.numBuf[:], patternsSize) // Dictionary size
-	if _, err = cw.Write(c.numBuf[:8]); err != nil {
-		return err
-	}
-	// 3-rd, write all the pattens, with their depths
-	sort.Sort(&patternList)
-	for _, p := range patternList {
-		ns := binary.PutUvarint(c.numBuf[:], uint64(p.depth))
-		if _, err = cw.Write(c.numBuf[:ns]); err != nil {
-			return err
-		}
-		n := binary.PutUvarint(c.numBuf[:], uint64(len(p.word)))
-		if _, err = cw.Write(c.numBuf[:n]); err != nil {
-			return err
-		}
-		if _, err = cw.Write(p.word); err != nil {
-			return err
-		}
-		//fmt.Printf("[comp] depth=%d, code=[%b], pattern=[%x]\n", p.depth, p.code, p.word)
-	}
-	var positionList PositionList
-	pos2code := make(map[uint64]*Position)
-	for pos, uses := range c.posMap {
-		p := &Position{pos: pos, uses: uses, code: pos, codeBits: 0}
-		positionList = append(positionList, p)
-		pos2code[pos] = p
-	}
-	sort.Sort(&positionList)
-	i = 0 // Will be going over the positionList
-	// Build Huffman tree for codes
-	var posHeap PositionHeap
-	heap.Init(&posHeap)
-	tieBreaker = uint64(0)
-	for posHeap.Len()+(positionList.Len()-i) > 1 {
-		// New node
-		h := &PositionHuff{
-			tieBreaker: tieBreaker,
-		}
-		if posHeap.Len() > 0 && (i >= positionList.Len() || posHeap[0].uses < positionList[i].uses) {
-			// Take h0 from the heap
-			h.h0 = heap.Pop(&posHeap).(*PositionHuff)
-			h.h0.AddZero()
-			h.uses += h.h0.uses
-		} else {
-			// Take p0 from the list
-			h.p0 = positionList[i]
-			h.p0.code = 0
-			h.p0.codeBits = 1
-			h.uses += h.p0.uses
-			i++
-		}
-		if posHeap.Len() > 0 && (i >= positionList.Len() || posHeap[0].uses < positionList[i].uses) {
-			// Take h1 from the heap
-			h.h1 = heap.Pop(&posHeap).(*PositionHuff)
-			h.h1.AddOne()
-			h.uses += h.h1.uses
-		} else {
-			// Take p1 from the list
-			h.p1 = positionList[i]
-			h.p1.code = 1
-			h.p1.codeBits = 1
-			h.uses += h.p1.uses
-			i++
-		}
-		tieBreaker++
-		heap.Push(&posHeap, h)
-	}
-	if posHeap.Len() > 0 {
-		posRoot := heap.Pop(&posHeap).(*PositionHuff)
-		posRoot.SetDepth(0)
-	}
-	// Calculate the size of pos dictionary
-	var posSize uint64
-	for _, p := range positionList {
-		ns := binary.PutUvarint(c.numBuf[:], uint64(p.depth)) // Length of the position's depth
-		n := binary.PutUvarint(c.numBuf[:], p.pos)
-		posSize += uint64(ns + n)
-	}
-	// First, output dictionary size
-	binary.BigEndian.PutUint64(c.numBuf[:], posSize) // Dictionary size
-	if _, err = cw.Write(c.numBuf[:8]); err != nil {
-		return err
-	}
-	sort.Sort(&positionList)
-	// Write all the positions and their depths
-	for _, p := range positionList {
-		ns := binary.PutUvarint(c.numBuf[:], uint64(p.depth))
-		if _, err = cw.Write(c.numBuf[:ns]); err != nil {
-			return err
-		}
-		n := binary.PutUvarint(c.numBuf[:], p.pos)
-		if _, err = cw.Write(c.numBuf[:n]); err != nil {
-			return err
-		}
-	}
-	r := bufio.NewReaderSize(c.interFile, etl.BufIOSize)
-	var hc HuffmanCoder
-	hc.w = cw
-	l, e := binary.ReadUvarint(r)
-	for ; e == nil; l, e = binary.ReadUvarint(r) {
-		posCode := pos2code[l+1]
-		if posCode != nil {
-			if e = hc.encode(posCode.code, posCode.codeBits); e != nil {
-				return e
-			}
-		}
-		if l == 0 {
-			if e = hc.flush(); e != nil {
-				return e
-			}
-		} else {
-			var pNum uint64 // Number of patterns
-			if pNum, e = binary.ReadUvarint(r); e != nil {
-				return e
-			}
-			// Now reading patterns one by one
-			var lastPos uint64
-			var lastUncovered int
-			var uncoveredCount int
-			for i := 0; i < int(pNum); i++ {
-				var pos uint64 // Starting position for pattern
-				if pos, e = binary.ReadUvarint(r); e != nil {
-					return e
-				}
-				posCode = pos2code[pos-lastPos+1]
-				lastPos = pos
-				if posCode != nil {
-					if e = hc.encode(posCode.code, posCode.codeBits); e != nil {
-						return e
-					}
-				}
-				var code uint64 // Code of the pattern
-				if code, e = binary.ReadUvarint(r); e != nil {
-					return e
-				}
-				patternCode := c.dictBuilder.items[len(c.dictBuilder.items)-1-int(code)]
-				if int(pos) > lastUncovered {
-					uncoveredCount += int(pos) - lastUncovered
-				}
-				lastUncovered = int(pos) + len(patternCode.word)
-				if e = hc.encode(patternCode.code, patternCode.codeBits); e != nil {
-					return e
-				}
-			}
-			if int(l) > lastUncovered {
-				uncoveredCount += int(l) - lastUncovered
-			}
-			// Terminating position and flush
-			posCode = pos2code[0]
-			if posCode != nil {
-				if e = hc.encode(posCode.code, posCode.codeBits); e != nil {
-					return e
-				}
-			}
-			if e = hc.flush(); e != nil {
-				return e
-			}
-			// Copy uncovered characters
-			if uncoveredCount > 0 {
-				if _, e = io.CopyN(cw, r, int64(uncoveredCount)); e != nil {
-					return e
-				}
-			}
-		}
-	}
-	if e != nil && !errors.Is(e, io.EOF) {
-		return e
-	}
-	return nil
-}
-
-func (c *CompressorSequential) buildDictionary() error {
-	if len(c.superstring) > 0 {
-		// Process any residual superstrings
-		if err := c.processSuperstring(); err != nil {
-			return fmt.Errorf("buildDictionary: error processing superstring: %w", err)
-		}
-	}
-	c.dictBuilder.Reset(maxDictPatterns)
-	if err := c.collector.Load(nil, "", c.dictBuilder.loadFunc, etl.TransformArgs{}); err != nil {
-		return err
-	}
-	c.dictBuilder.finish()
-	c.collector.Close()
-	// Sort dictionary inside the dictionary bilder in the order of increasing scores
-	sort.Sort(&c.dictBuilder)
-	return nil
-}
-
-func (c *CompressorSequential) processSuperstring() error {
-	c.divsufsort.ComputeSuffixArray(c.superstring, c.suffixarray[:len(c.superstring)])
-	// filter out suffixes that start with odd positions - we reuse the first half of sa.suffixarray for that
-	// because it won't be used after filtration
-	n := len(c.superstring) / 2
-	saFiltered := c.suffixarray[:n]
-	j := 0
-	for _, s := range c.suffixarray[:len(c.superstring)] {
-		if (s & 1) == 0 {
-			saFiltered[j] = s >> 1
-			j++
-		}
-	}
-	// Now create an inverted array - we reuse the second half of sa.suffixarray for that
-	saInverted := c.suffixarray[:n]
-	for i := 0; i < n; i++ {
-		saInverted[saFiltered[i]] = int32(i)
-	}
-	// Create LCP array (Kasai's algorithm)
-	var k int
-	// Process all suffixes one by one starting from
-	// first suffix in superstring
-	for i := 0; i < n; i++ {
-		/* If the current suffix is at n-1, then we don’t
-		   have next substring to consider. So lcp is not
-		   defined for this substring, we put zero. */
-		if saInverted[i] == int32(n-1) {
-			k = 0
-			continue
-		}
-
-		/* j contains index of the next substring to
-		   be considered  to compare with the present
-		   substring, i.e., next string in suffix array */
-		j := int(saFiltered[saInverted[i]+1])
-
-		// Directly start matching from k'th index as
-		// at-least k-1 characters will match
-		for i+k < n && j+k < n && c.superstring[(i+k)*2] != 0 && c.superstring[(j+k)*2] != 0 && c.superstring[(i+k)*2+1] == c.superstring[(j+k)*2+1] {
-			k++
-		}
-
-		c.lcp[saInverted[i]] = int32(k) // lcp for the present suffix.
-
-		// Deleting the starting character from the string.
-		if k > 0 {
-			k--
-		}
-	}
-	// Walk over LCP array and compute the scores of the strings
-	b := saInverted
-	j = 0
-	for i := 0; i < n-1; i++ {
-		// Only when there is a drop in LCP value
-		if c.lcp[i+1] >= c.lcp[i] {
-			j = i
-			continue
-		}
-		for l := c.lcp[i]; l > c.lcp[i+1]; l-- {
-			if l < minPatternLen || l > maxPatternLen {
-				continue
-			}
-			// Go back
-			var isNew bool
-			for j > 0 && c.lcp[j-1] >= l {
-				j--
-				isNew = true
-			}
-			if !isNew {
-				break
-			}
-			window := i - j + 2
-			copy(b, saFiltered[j:i+2])
-			sort.Slice(b[:window], func(i1, i2 int) bool { return b[i1] < b[i2] })
-			repeats := 1
-			lastK := 0
-			for k := 1; k < window; k++ {
-				if b[k] >= b[lastK]+l {
-					repeats++
-					lastK = k
-				}
-			}
-			score := uint64(repeats * int(l-4))
-			if score >= c.minPatternScore {
-				// Dictionary key is the concatenation of the score and the dictionary word (to later aggregate the scores from multiple chunks)
-				c.collectBuf = c.collectBuf[:8]
-				for s := int32(0); s < l; s++ {
-					c.collectBuf = append(c.collectBuf, c.superstring[(saFiltered[i]+s)*2+1])
-				}
-				binary.BigEndian.PutUint64(c.collectBuf[:8], score)
-				if err := c.collector.Collect(c.collectBuf[8:], c.collectBuf[:8]); err != nil { // key will be copied by Collect function
-					return fmt.Errorf("collecting %x with score %d: %w", c.collectBuf[8:], score, err)
-				}
-			}
-		}
-	}
-	c.superstring = c.superstring[:0]
-	return nil
-}
-
 type DictAggregator struct {
 	lastWord      []byte
 	lastWordScore uint64
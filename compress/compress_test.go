@@ -17,6 +17,7 @@
 package compress
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"hash/crc32"
@@ -166,3 +167,402 @@ func TestCompressDict1(t *testing.T) {
 		t.Errorf("result file hash changed, %d", cs)
 	}
 }
+
+func TestCompressWithExternalDictionary(t *testing.T) {
+	tmpDir := t.TempDir()
+	trainer := NewDictionaryTrainer(context.Background(), tmpDir, 1, 2)
+	defer trainer.Close()
+	for i := 0; i < 100; i++ {
+		trainer.AddWord([]byte(fmt.Sprintf("%d longlongword %d", i, i)))
+	}
+	dict, err := trainer.Train()
+	require.NoError(t, err)
+	require.NotZero(t, dict.Len())
+	dictPath := filepath.Join(tmpDir, "shared.dict")
+	require.NoError(t, dict.Save(dictPath))
+
+	// Many small segments compressed against the same dictionary
+	for s := 0; s < 3; s++ {
+		file := filepath.Join(tmpDir, fmt.Sprintf("compressed%d", s))
+		c, err := NewCompressor(context.Background(), t.Name(), file, tmpDir, 1, 2, log.LvlDebug)
+		require.NoError(t, err)
+		require.NoError(t, c.SetDictionary(dict))
+		for i := 0; i < 10; i++ {
+			require.NoError(t, c.AddWord([]byte(fmt.Sprintf("%d longlongword %d", s*10+i, i))))
+			require.NoError(t, c.AddWord(nil))
+		}
+		require.NoError(t, c.Compress())
+		c.Close()
+
+		d, err := NewDecompressor(file)
+		require.NoError(t, err)
+		require.Equal(t, 20, d.Count())
+		g := d.MakeGetter()
+		for i := 0; i < 10; i++ {
+			require.True(t, g.HasNext())
+			word, _ := g.Next(nil)
+			require.Equal(t, fmt.Sprintf("%d longlongword %d", s*10+i, i), string(word))
+			word, _ = g.Next(nil)
+			require.Empty(t, word)
+		}
+		require.False(t, g.HasNext())
+		require.NoError(t, d.Close())
+	}
+
+	// Already loaded dictionary can be shared by decompressors
+	loaded, err := LoadDictionary(dictPath)
+	require.NoError(t, err)
+	require.Equal(t, dict.Hash(), loaded.Hash())
+	d, err := NewDecompressorWithDictionary(filepath.Join(tmpDir, "compressed0"), loaded)
+	require.NoError(t, err)
+	word, _ := d.MakeGetter().Next(nil)
+	require.Equal(t, "0 longlongword 0", string(word))
+	require.NoError(t, d.Close())
+
+	// Dictionary with different hash is rejected
+	other := &Dictionary{patterns: [][]byte{[]byte("other")}, scores: []uint64{1}}
+	require.NoError(t, other.Save(filepath.Join(tmpDir, "other.dict")))
+	_, err = NewDecompressorWithDictionary(filepath.Join(tmpDir, "compressed0"), other)
+	require.ErrorContains(t, err, "hash mismatch")
+
+	// Dictionary name leading out of the directory of the segment is rejected
+	data, err := os.ReadFile(filepath.Join(tmpDir, "compressed2"))
+	require.NoError(t, err)
+	nameAt := bytes.Index(data, []byte("shared.dict"))
+	require.Positive(t, nameAt)
+	copy(data[nameAt:], "../red.dict")
+	require.NoError(t, os.WriteFile(filepath.Join(tmpDir, "traversal"), data, 0644))
+	_, err = NewDecompressor(filepath.Join(tmpDir, "traversal"))
+	require.ErrorContains(t, err, "invalid external dictionary name")
+
+	// Missing dictionary is reported
+	require.NoError(t, os.Remove(dictPath))
+	_, err = NewDecompressor(filepath.Join(tmpDir, "compressed1"))
+	require.ErrorContains(t, err, "external dictionary")
+
+	// Unsaved dictionary can't be referenced
+	c, err := NewCompressor(context.Background(), t.Name(), filepath.Join(tmpDir, "compressed"), tmpDir, 1, 1, log.LvlDebug)
+	require.NoError(t, err)
+	defer c.Close()
+	require.Error(t, c.SetDictionary(&Dictionary{}))
+}
+
+func TestStreamCompressor(t *testing.T) {
+	tmpDir := t.TempDir()
+	trainer := NewDictionaryTrainer(context.Background(), tmpDir, 1, 2)
+	defer trainer.Close()
+	for i := 0; i < 100; i++ {
+		trainer.AddWord([]byte(fmt.Sprintf("%d longlongword %d", i, i)))
+	}
+	dict, err := trainer.Train()
+	require.NoError(t, err)
+	require.NoError(t, dict.Save(filepath.Join(tmpDir, "shared.dict")))
+
+	word := func(i int) []byte {
+		switch i % 4 {
+		case 0:
+			return nil
+		case 1:
+			return []byte(fmt.Sprintf("uncompressed %d", i))
+		}
+		return []byte(fmt.Sprintf("%d longlongword %d", i, i))
+	}
+	add := func(c *StreamCompressor, i int) {
+		if i%4 == 1 {
+			require.NoError(t, c.AddUncompressedWord(word(i)))
+			return
+		}
+		require.NoError(t, c.AddWord(word(i)))
+	}
+	file := filepath.Join(tmpDir, "compressed")
+	c, err := OpenStreamCompressor(context.Background(), t.Name(), file, dict, 7, log.LvlDebug)
+	require.NoError(t, err)
+	for i := 0; i < 30; i++ {
+		add(c, i)
+	}
+	require.Equal(t, 30, c.Count())
+	require.Equal(t, 28, c.DurableCount())
+	c.Close()
+
+	// Interrupted write of a chunk is discarded, words which were not flushed are lost
+	f, err := os.OpenFile(file+".stream", os.O_WRONLY|os.O_APPEND, 0644)
+	require.NoError(t, err)
+	_, err = f.Write([]byte{0, 0, 0, 100, 0, 0})
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	c, err = OpenStreamCompressor(context.Background(), t.Name(), file, dict, 7, log.LvlDebug)
+	require.NoError(t, err)
+	defer c.Close()
+	require.Equal(t, 28, c.Count())
+	for i := 28; i < 50; i++ {
+		add(c, i)
+	}
+	require.NoError(t, c.Flush())
+	require.Equal(t, 50, c.DurableCount())
+	c.SetWordOffsets(true)
+	require.NoError(t, c.Seal())
+	_, err = os.Stat(file + ".stream")
+	require.True(t, os.IsNotExist(err))
+
+	d, err := NewDecompressor(file)
+	require.NoError(t, err)
+	defer d.Close()
+	require.Equal(t, 50, d.Count())
+	require.Equal(t, 13, d.EmptyWordsCount())
+	g := d.MakeGetter()
+	for i := 0; i < 50; i++ {
+		require.True(t, g.HasNext())
+		var w []byte
+		if i%4 == 1 {
+			w, _ = g.NextUncompressed()
+		} else {
+			w, _ = g.Next(nil)
+		}
+		require.Equal(t, string(word(i)), string(w))
+	}
+	require.False(t, g.HasNext())
+	w, err := d.WordAt(42, nil)
+	require.NoError(t, err)
+	require.Equal(t, string(word(42)), string(w))
+
+	// Stream can only be continued with the same dictionary
+	other := &Dictionary{patterns: [][]byte{[]byte("other")}, scores: []uint64{1}}
+	require.NoError(t, other.Save(filepath.Join(tmpDir, "other.dict")))
+	c2, err := OpenStreamCompressor(context.Background(), t.Name(), filepath.Join(tmpDir, "other"), dict, 7, log.LvlDebug)
+	require.NoError(t, err)
+	require.NoError(t, c2.AddWord(word(2)))
+	require.NoError(t, c2.Flush())
+	c2.Close()
+	_, err = OpenStreamCompressor(context.Background(), t.Name(), filepath.Join(tmpDir, "other"), other, 7, log.LvlDebug)
+	require.ErrorContains(t, err, "another dictionary")
+}
+
+func TestCompressorCfgPresets(t *testing.T) {
+	tmpDir := t.TempDir()
+	for name, cfg := range map[string]CompressorCfg{"fast": CompressorCfgFast, "balanced": CompressorCfgBalanced, "max": CompressorCfgMax} {
+		cfg.MinPatternScore = 1
+		cfg.Workers = 2
+		file := filepath.Join(tmpDir, name)
+		c, err := NewCompressorWithCfg(context.Background(), t.Name(), file, tmpDir, cfg, log.LvlDebug)
+		require.NoError(t, err)
+		for i := 0; i < 100; i++ {
+			require.NoError(t, c.AddWord([]byte(fmt.Sprintf("%d longlongword %d", i, i))))
+		}
+		require.NoError(t, c.Compress())
+		c.Close()
+
+		d, err := NewDecompressor(file)
+		require.NoError(t, err)
+		g := d.MakeGetter()
+		for i := 0; i < 100; i++ {
+			word, _ := g.Next(nil)
+			require.Equal(t, fmt.Sprintf("%d longlongword %d", i, i), string(word), name)
+		}
+		require.False(t, g.HasNext())
+		require.NoError(t, d.Close())
+	}
+
+	cfg := CompressorCfgBalanced
+	cfg.MaxPatternLen = cfg.MinPatternLen - 1
+	_, err := NewCompressorWithCfg(context.Background(), t.Name(), filepath.Join(tmpDir, "invalid"), tmpDir, cfg, log.LvlDebug)
+	require.ErrorContains(t, err, "pattern length")
+	cfg = CompressorCfgBalanced
+	cfg.SamplingRate = 0
+	_, err = NewCompressorWithCfg(context.Background(), t.Name(), filepath.Join(tmpDir, "invalid"), tmpDir, cfg, log.LvlDebug)
+	require.ErrorContains(t, err, "sampling rate")
+}
+
+func TestMergeSegments(t *testing.T) {
+	tmpDir := t.TempDir()
+	// Every fourth word is added uncompressed, and must stay readable by NextUncompressed after merge
+	compress := func(file string, dict *Dictionary, words []string) *Decompressor {
+		c, err := NewCompressor(context.Background(), t.Name(), file, tmpDir, 1, 2, log.LvlDebug)
+		require.NoError(t, err)
+		defer c.Close()
+		if dict != nil {
+			require.NoError(t, c.SetDictionary(dict))
+		}
+		for i, w := range words {
+			if i%4 == 0 {
+				require.NoError(t, c.AddUncompressedWord([]byte(w)))
+			} else {
+				require.NoError(t, c.AddWord([]byte(w)))
+			}
+		}
+		require.NoError(t, c.Compress())
+		d, err := NewDecompressor(file)
+		require.NoError(t, err)
+		return d
+	}
+	words := func(s int) []string {
+		var ws []string
+		for i := 0; i < 100; i++ {
+			ws = append(ws, fmt.Sprintf("%d longlongword %d segment%d", i, i, s))
+		}
+		return ws
+	}
+	// Keeps every other word, and appends '!' to the words of the second segment, keeping their mode
+	merge := func(segment int, wordNum uint64, word []byte) ([]byte, bool, bool, error) {
+		if wordNum%2 == 1 {
+			return nil, false, false, nil
+		}
+		if segment == 1 {
+			return append(word, '!'), wordNum%4 != 0, true, nil
+		}
+		return word, false, true, nil
+	}
+	check := func(d *Decompressor) {
+		g := d.MakeGetter()
+		for s := 0; s < 2; s++ {
+			for i, w := range words(s) {
+				if i%2 == 1 {
+					continue
+				}
+				if s == 1 {
+					w += "!"
+				}
+				require.True(t, g.HasNext())
+				var word []byte
+				if i%4 == 0 {
+					word, _ = g.NextUncompressed()
+				} else {
+					word, _ = g.Next(nil)
+				}
+				require.Equal(t, w, string(word))
+			}
+		}
+		require.False(t, g.HasNext())
+	}
+
+	// Segments with embedded dictionaries: patterns are united
+	segments := []*Decompressor{
+		compress(filepath.Join(tmpDir, "embedded0"), nil, words(0)),
+		compress(filepath.Join(tmpDir, "embedded1"), nil, words(1)),
+	}
+	file := filepath.Join(tmpDir, "merged")
+	c, err := NewCompressor(context.Background(), t.Name(), file, tmpDir, 1, 2, log.LvlDebug)
+	require.NoError(t, err)
+	c.SetChecksums(true)
+	require.NoError(t, MergeSegments(c, segments, merge))
+	c.Close()
+	d, err := NewDecompressor(file)
+	require.NoError(t, err)
+	require.NoError(t, d.Verify())
+	require.Nil(t, d.dictionary)
+	check(d)
+	var united int
+	d.forEachPattern(func(uint64, []byte) { united++ })
+	require.NotZero(t, united)
+	require.NoError(t, d.Close())
+
+	// Patterns left out of the limited united dictionary are turned into uncovered bytes
+	cfg := CompressorCfgBalanced
+	cfg.MaxDictPatterns = 2
+	c, err = NewCompressorWithCfg(context.Background(), t.Name(), file, tmpDir, cfg, log.LvlDebug)
+	require.NoError(t, err)
+	require.NoError(t, MergeSegments(c, segments, merge))
+	c.Close()
+	d, err = NewDecompressor(file)
+	require.NoError(t, err)
+	united = 0
+	d.forEachPattern(func(uint64, []byte) { united++ })
+	require.LessOrEqual(t, united, 2)
+	check(d)
+	require.NoError(t, d.Close())
+	for _, s := range segments {
+		require.NoError(t, s.Close())
+	}
+
+	// Segments compressed against the same external dictionary: it is reused
+	trainer := NewDictionaryTrainer(context.Background(), tmpDir, 1, 2)
+	defer trainer.Close()
+	for _, w := range words(0) {
+		trainer.AddWord([]byte(w))
+	}
+	dict, err := trainer.Train()
+	require.NoError(t, err)
+	require.NoError(t, dict.Save(filepath.Join(tmpDir, "shared.dict")))
+	segments = []*Decompressor{
+		compress(filepath.Join(tmpDir, "external0"), dict, words(0)),
+		compress(filepath.Join(tmpDir, "external1"), dict, words(1)),
+	}
+	c, err = NewCompressor(context.Background(), t.Name(), file, tmpDir, 1, 2, log.LvlDebug)
+	require.NoError(t, err)
+	require.NoError(t, MergeSegments(c, segments, merge))
+	c.Close()
+	d, err = NewDecompressor(file)
+	require.NoError(t, err)
+	require.NotNil(t, d.dictionary)
+	require.Equal(t, dict.Hash(), d.dictionary.Hash())
+	check(d)
+	require.NoError(t, d.Close())
+
+	// Words are not compressed again, so single segment is reproduced as it is
+	c, err = NewCompressor(context.Background(), t.Name(), file, tmpDir, 1, 2, log.LvlDebug)
+	require.NoError(t, err)
+	require.NoError(t, MergeSegments(c, segments[:1], nil))
+	c.Close()
+	expected, err := os.ReadFile(segments[0].FilePath())
+	require.NoError(t, err)
+	merged, err := os.ReadFile(file)
+	require.NoError(t, err)
+	require.Equal(t, expected, merged)
+	for _, s := range segments {
+		require.NoError(t, s.Close())
+	}
+}
+
+func TestCompressDeterministic(t *testing.T) {
+	tmpDir := t.TempDir()
+	var expected []byte
+	for _, workers := range []int{1, 2, 4, 8} {
+		cfg := CompressorCfgBalanced
+		cfg.MinPatternScore, cfg.Workers = 1, workers
+		cfg.SuperstringLimit = 4 * 1024 // Many superstrings, processed by different workers
+		file := filepath.Join(tmpDir, fmt.Sprintf("compressed%d", workers))
+		c, err := NewCompressorWithCfg(context.Background(), t.Name(), file, tmpDir, cfg, log.LvlDebug)
+		require.NoError(t, err)
+		for i := 0; i < 10_000; i++ {
+			if i%7 == 0 {
+				require.NoError(t, c.AddUncompressedWord([]byte(fmt.Sprintf("uncompressed %d", i))))
+				continue
+			}
+			require.NoError(t, c.AddWord([]byte(fmt.Sprintf("%d longlongword %d %s", i%97, i, loremStrings[i%len(loremStrings)]))))
+		}
+		require.NoError(t, c.Compress())
+		c.Close()
+		data, err := os.ReadFile(file)
+		require.NoError(t, err)
+		if expected == nil {
+			expected = data
+			continue
+		}
+		require.Equal(t, expected, data, "workers %d", workers)
+	}
+}
+
+func TestDictionaryTrainerWorkers(t *testing.T) {
+	tmpDir := t.TempDir()
+	var expected *Dictionary
+	for _, workers := range []int{1, 4} {
+		cfg := CompressorCfgBalanced
+		cfg.MinPatternScore, cfg.Workers = 1, workers
+		cfg.SuperstringLimit = 4 * 1024
+		trainer := NewDictionaryTrainerWithCfg(context.Background(), tmpDir, cfg)
+		if workers == 1 {
+			require.Nil(t, trainer.superstrings, "single worker must not start goroutines")
+		}
+		for i := 0; i < 10_000; i++ {
+			trainer.AddWord([]byte(fmt.Sprintf("%d longlongword %d %s", i%97, i, loremStrings[i%len(loremStrings)])))
+		}
+		dict, err := trainer.Train()
+		require.NoError(t, err)
+		trainer.Close()
+		require.NotZero(t, dict.Len())
+		if expected == nil {
+			expected = dict
+			continue
+		}
+		require.Equal(t, expected.Hash(), dict.Hash(), "workers %d", workers)
+	}
+}
@@ -21,9 +21,11 @@ import (
 	"encoding/binary"
 	"fmt"
 	"os"
+	"sort"
 
 	"github.com/ledgerwatch/erigon-lib/common/dbg"
 	"github.com/ledgerwatch/erigon-lib/mmap"
+	"github.com/ledgerwatch/erigon-lib/recsplit/eliasfano32"
 )
 
 type codeword struct {
@@ -54,21 +56,42 @@ type Decompressor struct {
 	dict           *patternTable
 	posDict        *posTable
 	wordsStart     uint64 // Offset of whether the superstrings actually start
+	wordsEnd       uint64 // Offset where the superstrings end (and the footer starts, if there is one)
 	size           int64
+	dictionary     *Dictionary    // External dictionary, if file is compressed against one
+	footer         *segmentFooter // Checksums, if file has them
+	wordOffsets    *eliasfano32.EliasFano
+	hasOffsets     bool
+	chunks         []wordsChunk   // Boundaries of independently decompressible parts of words, if file has them
+	keySamples     *keySamples    // Samples of keys of sorted records, if file has them
+	patternsData   []byte         // Encoded pattern dictionary, to enumerate patterns when merging files
+	words          []byte         // Words to decode, mapped from the file
+	coder          EntropyCoder   // Secondary entropy coder, if words are encoded by one
+	blocks         *entropyBlocks // Blocks of words encoded by the secondary entropy coder, decoded when read
 
 	wordsCount, emptyWordsCount uint64
 }
 
 func NewDecompressor(compressedFile string) (*Decompressor, error) {
+	return NewDecompressorWithDictionary(compressedFile, nil)
+}
+
+// NewDecompressorWithDictionary opens file compressed against external dictionary, which is already loaded
+// (and may be shared by many decompressors). Hash of the dictionary must match the one recorded in the file.
+// If dict is nil, external dictionary (if file needs one) is loaded from the directory of the file
+func NewDecompressorWithDictionary(compressedFile string, dict *Dictionary) (_ *Decompressor, err error) {
 	d := &Decompressor{
 		compressedFile: compressedFile,
 	}
 
-	var err error
 	defer func() {
 		if rec := recover(); rec != nil {
 			err = fmt.Errorf("decompressing file: %s, %+v, trace: %s", compressedFile, rec, dbg.Stack())
 		}
+		// Mapping and file are released on any error, including the ones found after mapping
+		if err != nil {
+			_ = d.Close()
+		}
 	}()
 
 	d.f, err = os.Open(compressedFile)
@@ -89,10 +112,39 @@ func NewDecompressor(compressedFile string) (*Decompressor, error) {
 
 	// read patterns from file
 	d.data = d.mmapHandle1[:d.size]
-	d.wordsCount = binary.BigEndian.Uint64(d.data[:8])
-	d.emptyWordsCount = binary.BigEndian.Uint64(d.data[8:16])
-	dictSize := binary.BigEndian.Uint64(d.data[16:24])
-	data := d.data[24 : 24+dictSize]
+	hdr, hdrSize, err := parseSegmentHeader(d.data)
+	if err != nil {
+		return nil, fmt.Errorf("decompressing file: %s, %w", compressedFile, err)
+	}
+	d.wordsCount = hdr.wordsCount
+	d.emptyWordsCount = hdr.emptyWordsCount
+	if hdr.has(flagExternalDict) {
+		if d.dictionary, err = resolveDictionary(compressedFile, &hdr, dict); err != nil {
+			return nil, fmt.Errorf("decompressing file: %s, %w", compressedFile, err)
+		}
+	}
+	dictStart := uint64(hdrSize) + 8
+	dictSize := binary.BigEndian.Uint64(d.data[hdrSize:dictStart])
+	d.wordsEnd = uint64(d.size)
+	if hdr.has(flagChecksums) {
+		// Fail fast on truncated or damaged files, before parsing the dictionaries and without reading the words
+		posDictStart := dictStart + dictSize
+		if posDictStart+8 > uint64(d.size) {
+			return nil, fmt.Errorf("decompressing file: %s, pattern dictionary goes beyond the end of file", compressedFile)
+		}
+		wordsStart := posDictStart + 8 + binary.BigEndian.Uint64(d.data[posDictStart:])
+		footer, footerStart, err := parseSegmentFooter(d.data, wordsStart)
+		if err != nil {
+			return nil, fmt.Errorf("decompressing file: %s, %w", compressedFile, err)
+		}
+		d.footer, d.wordsEnd = &footer, footerStart
+	}
+	data := d.data[dictStart : dictStart+dictSize]
+	d.patternsData = data
+	var externalPatterns [][]byte
+	if d.dictionary != nil {
+		externalPatterns = d.dictionary.patterns
+	}
 	var depths []uint64
 	var patterns [][]byte
 	var i uint64
@@ -108,6 +160,14 @@ func NewDecompressor(compressedFile string) (*Decompressor, error) {
 		i += uint64(ns)
 		l, n := binary.Uvarint(data[i:])
 		i += uint64(n)
+		if hdr.has(flagExternalDict) {
+			// Pattern is referenced by its index in the external dictionary
+			if l >= uint64(len(externalPatterns)) {
+				return nil, fmt.Errorf("decompressing file: %s, pattern %d is not in external dictionary of %d patterns", compressedFile, l, len(externalPatterns))
+			}
+			patterns = append(patterns, externalPatterns[l])
+			continue
+		}
 		patterns = append(patterns, data[i:i+l])
 		//fmt.Printf("depth = %d, pattern = [%x]\n", d, data[i:i+l])
 		i += l
@@ -130,7 +190,7 @@ func NewDecompressor(compressedFile string) (*Decompressor, error) {
 	}
 
 	// read positions
-	pos := 24 + dictSize
+	pos := dictStart + dictSize
 	dictSize = binary.BigEndian.Uint64(d.data[pos : pos+8])
 	data = d.data[pos+8 : pos+8+dictSize]
 	var posDepths []uint64
@@ -168,6 +228,55 @@ func NewDecompressor(compressedFile string) (*Decompressor, error) {
 		buildPosTable(posDepths, poss, d.posDict, 0, 0, 0, posMaxDepth)
 	}
 	d.wordsStart = pos + 8 + dictSize
+	if d.wordsStart > d.wordsEnd {
+		return nil, fmt.Errorf("decompressing file: %s, words start beyond the end of file", compressedFile)
+	}
+	if hdr.has(flagWordOffsets) {
+		var wordsSize uint64
+		if d.wordOffsets, wordsSize, err = parseWordOffsets(d.data[d.wordsStart:d.wordsEnd]); err != nil {
+			return nil, fmt.Errorf("decompressing file: %s, %w", compressedFile, err)
+		}
+		if d.wordOffsets != nil && d.wordOffsets.Count() != d.wordsCount {
+			return nil, fmt.Errorf("decompressing file: %s, %d word offsets for %d words", compressedFile, d.wordOffsets.Count(), d.wordsCount)
+		}
+		d.wordsEnd = d.wordsStart + wordsSize
+		d.hasOffsets = true
+	}
+	if hdr.has(flagChunks) {
+		var wordsSize uint64
+		if d.chunks, wordsSize, err = parseWordsChunks(d.data[d.wordsStart:d.wordsEnd], d.wordsCount); err != nil {
+			return nil, fmt.Errorf("decompressing file: %s, %w", compressedFile, err)
+		}
+		d.wordsEnd = d.wordsStart + wordsSize
+	}
+	if hdr.has(flagKeySamples) {
+		var wordsSize uint64
+		if d.keySamples, wordsSize, err = parseKeySamples(d.data[d.wordsStart:d.wordsEnd]); err != nil {
+			return nil, fmt.Errorf("decompressing file: %s, %w", compressedFile, err)
+		}
+		d.wordsEnd = d.wordsStart + wordsSize
+	}
+	d.words = d.data[d.wordsStart:d.wordsEnd]
+	if hdr.has(flagEntropyCoder) {
+		var ok bool
+		if d.coder, ok = LookupEntropyCoder(hdr.coder); !ok {
+			return nil, fmt.Errorf("decompressing file: %s, unknown entropy coder %d", compressedFile, hdr.coder)
+		}
+		if d.blocks, err = parseEntropyBlocks(d.coder, d.words); err != nil {
+			return nil, fmt.Errorf("decompressing file: %s, %w", compressedFile, err)
+		}
+	}
+	// Offsets refer to the decoded words, so they can only be checked now
+	wordsSize := d.wordsSize()
+	if d.wordOffsets != nil && d.wordOffsets.Max() > wordsSize {
+		return nil, fmt.Errorf("decompressing file: %s, word offsets go beyond the words of size %d", compressedFile, wordsSize)
+	}
+	if len(d.chunks) > 0 && d.chunks[len(d.chunks)-1].offset >= wordsSize {
+		return nil, fmt.Errorf("decompressing file: %s, chunks go beyond the words of size %d", compressedFile, wordsSize)
+	}
+	if d.keySamples != nil && len(d.keySamples.offsets) > 0 && d.keySamples.offsets[len(d.keySamples.offsets)-1] >= wordsSize {
+		return nil, fmt.Errorf("decompressing file: %s, key samples go beyond the words of size %d", compressedFile, wordsSize)
+	}
 	return d, nil
 }
 
@@ -272,6 +381,9 @@ func (d *Decompressor) Close() error {
 	if err := mmap.Munmap(d.mmapHandle1, d.mmapHandle2); err != nil {
 		return err
 	}
+	if d.f == nil { // Failed to open
+		return nil
+	}
 	if err := d.f.Close(); err != nil {
 		return err
 	}
@@ -280,6 +392,55 @@ func (d *Decompressor) Close() error {
 
 func (d *Decompressor) FilePath() string { return d.compressedFile }
 
+// HasChecksums tells whether the file was written with checksums
+func (d *Decompressor) HasChecksums() bool { return d.footer != nil }
+
+// Verify scans the whole file to detect damage. For files with checksums, it checks checksums of all
+// blocks of words. For files without them, it only checks that all the words can be decoded, and that
+// their number matches the header
+func (d *Decompressor) Verify() (err error) {
+	if d.footer != nil {
+		// Blocks cover the words, and the word offsets following them
+		if err = d.footer.verifyBlocks(d.data[d.wordsStart : d.wordsStart+d.footer.wordsSize]); err != nil {
+			return fmt.Errorf("verifying file: %s, %w", d.compressedFile, err)
+		}
+		return nil
+	}
+	defer func() {
+		if rec := recover(); rec != nil {
+			err = fmt.Errorf("verifying file: %s, decoding failed: %+v", d.compressedFile, rec)
+		}
+	}()
+	var count uint64
+	for g := d.MakeGetter(); g.HasNext(); count++ {
+		g.Skip()
+		if g.base+g.dataP > g.end {
+			return fmt.Errorf("verifying file: %s, word %d goes beyond the end of file", d.compressedFile, count)
+		}
+	}
+	if count != d.wordsCount {
+		return fmt.Errorf("verifying file: %s, expected %d words, found %d", d.compressedFile, d.wordsCount, count)
+	}
+	return nil
+}
+
+// HasKeySamples tells whether the file consists of sorted records with sampled keys, so that Getter.Seek can be used
+func (d *Decompressor) HasKeySamples() bool { return d.keySamples != nil }
+
+// HasWordOffsets tells whether the file was written with word offsets, so that words can be accessed by their numbers
+func (d *Decompressor) HasWordOffsets() bool { return d.hasOffsets }
+
+// WordAt extracts word number i (counting from 0) and appends it to the given buf. It requires word offsets
+// in the file (see Compressor.SetWordOffsets). Decompressor can be used by multiple goroutines concurrently
+func (d *Decompressor) WordAt(i uint64, buf []byte) ([]byte, error) {
+	g := d.MakeGetter()
+	if err := g.ResetToWord(i); err != nil {
+		return buf, err
+	}
+	buf, _ = g.Next(buf)
+	return buf, nil
+}
+
 //WithReadAhead - Expect read in sequential order. (Hence, pages in the given range can be aggressively read ahead, and may be freed soon after they are accessed.)
 func (d *Decompressor) WithReadAhead(f func() error) error {
 	_ = mmap.MadviseSequential(d.mmapHandle1)
@@ -291,10 +452,18 @@ func (d *Decompressor) WithReadAhead(f func() error) error {
 // The full state of the getter can be captured by saving dataP, and dataBit
 type Getter struct {
 	data        []byte
-	dataP       uint64
-	dataBit     int // Value 0..7 - position of the bit
+	dataP       uint64 // Position in data, the offset in the words is base+dataP
+	dataBit     int    // Value 0..7 - position of the bit
+	base        uint64 // Offset of data in the words, non-zero only for files with secondary entropy coder
+	end         uint64 // Offset in the words at which HasNext returns false
+	blocks      *entropyBlocks
 	patternDict *patternTable
 	posDict     *posTable
+	wordOffsets *eliasfano32.EliasFano
+	hasOffsets  bool
+	wordsCount  uint64
+	keySamples  *keySamples
+	keyBuf      []byte // Buffer for the keys decompressed by Seek
 	fName       string
 	trace       bool
 }
@@ -315,6 +484,9 @@ func (g *Getter) nextPos(clean bool) uint64 {
 	var l byte
 	var pos uint64
 	for l == 0 {
+		if g.blocks != nil && g.dataP+2 > uint64(len(g.data)) {
+			g.extend(g.dataP, 2)
+		}
 		code := uint16(g.data[g.dataP]) >> g.dataBit
 		if 8-g.dataBit < table.bitLen && int(g.dataP)+1 < len(g.data) {
 			code |= uint16(g.data[g.dataP+1]) << (8 - g.dataBit)
@@ -342,6 +514,9 @@ func (g *Getter) nextPattern() []byte {
 	var l byte
 	var pattern []byte
 	for l == 0 {
+		if g.blocks != nil && g.dataP+2 > uint64(len(g.data)) {
+			g.extend(g.dataP, 2)
+		}
 		code := uint16(g.data[g.dataP]) >> g.dataBit
 		if 8-g.dataBit < table.bitLen && int(g.dataP)+1 < len(g.data) {
 			code |= uint16(g.data[g.dataP+1]) << (8 - g.dataBit)
@@ -369,22 +544,131 @@ func (d *Decompressor) EmptyWordsCount() int { return int(d.emptyWordsCount) }
 // Getter is not thread-safe, but there can be multiple getters used simultaneously and concurrently
 // for the same decompressor
 func (d *Decompressor) MakeGetter() *Getter {
-	return &Getter{patternDict: d.dict, posDict: d.posDict, data: d.data[d.wordsStart:], fName: d.compressedFile}
+	g := &Getter{patternDict: d.dict, posDict: d.posDict, fName: d.compressedFile, end: d.wordsSize(),
+		wordOffsets: d.wordOffsets, hasOffsets: d.hasOffsets, wordsCount: d.wordsCount, keySamples: d.keySamples}
+	if d.blocks != nil {
+		g.blocks = d.blocks
+	} else {
+		g.data = d.words
+	}
+	return g
+}
+
+// wordsSize returns the size of the words, after decoding by the secondary entropy coder if there is one
+func (d *Decompressor) wordsSize() uint64 {
+	if d.blocks != nil {
+		return d.blocks.size
+	}
+	return uint64(len(d.words))
+}
+
+// maxCodeBytes is the upper bound of the length of one Huffman code of position or pattern, in bytes
+const maxCodeBytes = 8
+
+// window makes sure, for files with secondary entropy coder, that the code of the length of the word at dataP
+// is decoded into data. Words are then decoded into data by extend as they are read. The window is moved
+// only here, at the start of the word, so that positions within the word stay valid while it is read
+func (g *Getter) window() {
+	if g.dataP+2*maxCodeBytes <= uint64(len(g.data)) {
+		return
+	}
+	pos := g.base + g.dataP
+	if pos >= g.blocks.size {
+		return
+	}
+	first := pos / entropyBlockSize
+	g.data = g.blocks.block(first)
+	g.base = first * entropyBlockSize
+	g.dataP = pos - g.base
+	g.extend(g.dataP, 2*maxCodeBytes)
+}
+
+// extend makes sure that data covers need bytes from position from (or up to the end of words),
+// by appending the blocks following the window
+func (g *Getter) extend(from, need uint64) {
+	end := g.base + from + need
+	if end > g.blocks.size {
+		end = g.blocks.size
+	}
+	for g.base+uint64(len(g.data)) < end {
+		next := g.blocks.block((g.base + uint64(len(g.data))) / entropyBlockSize)
+		// Blocks are shared by getters, so the first block is copied rather than appended to
+		g.data = append(g.data[:len(g.data):len(g.data)], next...)
+	}
 }
 
 func (g *Getter) Reset(offset uint64) {
-	g.dataP = offset
+	if g.blocks != nil && (offset < g.base || offset >= g.base+uint64(len(g.data))) {
+		g.base, g.data = offset, nil
+	}
+	g.dataP = offset - g.base
 	g.dataBit = 0
 }
 
+// ResetToWord moves getter to the beginning of word number i (counting from 0), using word offsets of the file
+func (g *Getter) ResetToWord(i uint64) error {
+	if !g.hasOffsets {
+		return fmt.Errorf("file %s has no word offsets", g.fName)
+	}
+	if i >= g.wordsCount {
+		return fmt.Errorf("word %d is out of range, file %s has %d words", i, g.fName, g.wordsCount)
+	}
+	g.Reset(g.wordOffsets.Get(i))
+	return nil
+}
+
+// Seek moves getter to the beginning of the first record whose key is greater than or equal to the given key,
+// and returns true. If there is no such record, it returns false. It requires key samples in the file
+// (see Compressor.SetKeySamples). Binary search over the samples is followed by the scan of at most
+// the number of records between two samples
+func (g *Getter) Seek(key []byte) (bool, error) {
+	ks := g.keySamples
+	if ks == nil {
+		return false, fmt.Errorf("file %s has no key samples", g.fName)
+	}
+	// The last sample with the key not greater than the given one
+	i := sort.Search(len(ks.keys), func(i int) bool { return bytes.Compare(ks.keys[i], key) > 0 })
+	var offset uint64
+	if i > 0 {
+		offset = ks.offsets[i-1]
+	}
+	g.Reset(offset)
+	for g.HasNext() {
+		offset = g.base + g.dataP
+		g.keyBuf, _ = g.Next(g.keyBuf[:0])
+		if bytes.Compare(g.keyBuf, key) >= 0 {
+			g.Reset(offset)
+			return true, nil
+		}
+		for j := uint64(1); j < ks.recordWords && g.HasNext(); j++ {
+			g.Skip()
+		}
+	}
+	return false, nil
+}
+
+// SeekPrefix moves getter to the beginning of the first record whose key is greater than or equal to the prefix
+// (see Seek), and returns true if the key of that record starts with the prefix. Records with the prefix,
+// if there are any, follow one another from there
+func (g *Getter) SeekPrefix(prefix []byte) (bool, error) {
+	found, err := g.Seek(prefix)
+	if err != nil || !found {
+		return false, err
+	}
+	return g.MatchPrefix(prefix), nil
+}
+
 func (g *Getter) HasNext() bool {
-	return g.dataP < uint64(len(g.data))
+	return g.base+g.dataP < g.end
 }
 
 // Next extracts a compressed word from current offset in the file
 // and appends it to the given buf, returning the result of appending
 // After extracting next word, it moves to the beginning of the next one
 func (g *Getter) Next(buf []byte) ([]byte, uint64) {
+	if g.blocks != nil {
+		g.window()
+	}
 	savePos := g.dataP
 	wordLen := g.nextPos(true)
 	wordLen-- // because when create huffman tree we do ++ , because 0 is terminator
@@ -393,7 +677,7 @@ func (g *Getter) Next(buf []byte) ([]byte, uint64) {
 			g.dataP++
 			g.dataBit = 0
 		}
-		return buf, g.dataP
+		return buf, g.base + g.dataP
 	}
 	bufPos := len(buf) // Tracking position in buf where to insert part of the word
 	lastUncovered := len(buf)
@@ -415,6 +699,9 @@ func (g *Getter) Next(buf []byte) ([]byte, uint64) {
 		g.dataBit = 0
 	}
 	postLoopPos := g.dataP
+	if g.blocks != nil {
+		g.extend(postLoopPos, wordLen) // Uncovered bytes are not more than the word
+	}
 	g.dataP = savePos
 	g.dataBit = 0
 	g.nextPos(true /* clean */) // Reset the state of huffman reader
@@ -436,10 +723,13 @@ func (g *Getter) Next(buf []byte) ([]byte, uint64) {
 	}
 	g.dataP = postLoopPos
 	g.dataBit = 0
-	return buf, postLoopPos
+	return buf, g.base + postLoopPos
 }
 
 func (g *Getter) NextUncompressed() ([]byte, uint64) {
+	if g.blocks != nil {
+		g.window()
+	}
 	wordLen := g.nextPos(true)
 	wordLen-- // because when create huffman tree we do ++ , because 0 is terminator
 	if wordLen == 0 {
@@ -447,7 +737,7 @@ func (g *Getter) NextUncompressed() ([]byte, uint64) {
 			g.dataP++
 			g.dataBit = 0
 		}
-		return g.data[g.dataP:g.dataP], g.dataP
+		return g.data[g.dataP:g.dataP], g.base + g.dataP
 	}
 	g.nextPos(false)
 	if g.dataBit > 0 {
@@ -455,12 +745,18 @@ func (g *Getter) NextUncompressed() ([]byte, uint64) {
 		g.dataBit = 0
 	}
 	pos := g.dataP
+	if g.blocks != nil {
+		g.extend(pos, wordLen)
+	}
 	g.dataP += wordLen
-	return g.data[pos:g.dataP], g.dataP
+	return g.data[pos:g.dataP], g.base + g.dataP
 }
 
 // Skip moves offset to the next word and returns the new offset.
 func (g *Getter) Skip() uint64 {
+	if g.blocks != nil {
+		g.window()
+	}
 	l := g.nextPos(true)
 	l-- // because when create huffman tree we do ++ , because 0 is terminator
 	if l == 0 {
@@ -468,7 +764,7 @@ func (g *Getter) Skip() uint64 {
 			g.dataP++
 			g.dataBit = 0
 		}
-		return g.dataP
+		return g.base + g.dataP
 	}
 	wordLen := int(l)
 
@@ -494,10 +790,13 @@ func (g *Getter) Skip() uint64 {
 	}
 	// Uncovered characters
 	g.dataP += add
-	return g.dataP
+	return g.base + g.dataP
 }
 
 func (g *Getter) SkipUncompressed() uint64 {
+	if g.blocks != nil {
+		g.window()
+	}
 	wordLen := g.nextPos(true)
 	wordLen-- // because when create huffman tree we do ++ , because 0 is terminator
 	if wordLen == 0 {
@@ -505,7 +804,7 @@ func (g *Getter) SkipUncompressed() uint64 {
 			g.dataP++
 			g.dataBit = 0
 		}
-		return g.dataP
+		return g.base + g.dataP
 	}
 	g.nextPos(false)
 	if g.dataBit > 0 {
@@ -513,12 +812,15 @@ func (g *Getter) SkipUncompressed() uint64 {
 		g.dataBit = 0
 	}
 	g.dataP += wordLen
-	return g.dataP
+	return g.base + g.dataP
 }
 
 // Match returns true and next offset if the word at current offset fully matches the buf
 // returns false and current offset otherwise.
 func (g *Getter) Match(buf []byte) (bool, uint64) {
+	if g.blocks != nil {
+		g.window()
+	}
 	savePos := g.dataP
 	wordLen := g.nextPos(true)
 	wordLen-- // because when create huffman tree we do ++ , because 0 is terminator
@@ -531,7 +833,7 @@ func (g *Getter) Match(buf []byte) (bool, uint64) {
 		if lenBuf != 0 {
 			g.dataP, g.dataBit = savePos, 0
 		}
-		return lenBuf == int(wordLen), g.dataP
+		return lenBuf == int(wordLen), g.base + g.dataP
 	}
 
 	var bufPos int
@@ -541,7 +843,7 @@ func (g *Getter) Match(buf []byte) (bool, uint64) {
 		pattern := g.nextPattern()
 		if lenBuf < bufPos+len(pattern) || !bytes.Equal(buf[bufPos:bufPos+len(pattern)], pattern) {
 			g.dataP, g.dataBit = savePos, 0
-			return false, savePos
+			return false, g.base + savePos
 		}
 	}
 	if g.dataBit > 0 {
@@ -549,6 +851,9 @@ func (g *Getter) Match(buf []byte) (bool, uint64) {
 		g.dataBit = 0
 	}
 	postLoopPos := g.dataP
+	if g.blocks != nil {
+		g.extend(postLoopPos, wordLen) // Uncovered bytes are not more than the word
+	}
 	g.dataP, g.dataBit = savePos, 0
 	g.nextPos(true /* clean */) // Reset the state of huffman decoder
 	// Second pass - we check spaces not covered by the patterns
@@ -560,7 +865,7 @@ func (g *Getter) Match(buf []byte) (bool, uint64) {
 			dif := uint64(bufPos - lastUncovered)
 			if lenBuf < bufPos || !bytes.Equal(buf[lastUncovered:bufPos], g.data[postLoopPos:postLoopPos+dif]) {
 				g.dataP, g.dataBit = savePos, 0
-				return false, savePos
+				return false, g.base + savePos
 			}
 			postLoopPos += dif
 		}
@@ -570,20 +875,23 @@ func (g *Getter) Match(buf []byte) (bool, uint64) {
 		dif := wordLen - uint64(lastUncovered)
 		if lenBuf < int(wordLen) || !bytes.Equal(buf[lastUncovered:wordLen], g.data[postLoopPos:postLoopPos+dif]) {
 			g.dataP, g.dataBit = savePos, 0
-			return false, savePos
+			return false, g.base + savePos
 		}
 		postLoopPos += dif
 	}
 	if lenBuf != int(wordLen) {
 		g.dataP, g.dataBit = savePos, 0
-		return false, savePos
+		return false, g.base + savePos
 	}
 	g.dataP, g.dataBit = postLoopPos, 0
-	return true, postLoopPos
+	return true, g.base + postLoopPos
 }
 
 // MatchPrefix only checks if the word at the current offset has a buf prefix. Does not move offset to the next word.
 func (g *Getter) MatchPrefix(prefix []byte) bool {
+	if g.blocks != nil {
+		g.window()
+	}
 	savePos := g.dataP
 	defer func() {
 		g.dataP, g.dataBit = savePos, 0
@@ -627,6 +935,9 @@ func (g *Getter) MatchPrefix(prefix []byte) bool {
 		g.dataBit = 0
 	}
 	postLoopPos := g.dataP
+	if g.blocks != nil {
+		g.extend(postLoopPos, wordLen) // Uncovered bytes are not more than the word
+	}
 	g.dataP, g.dataBit = savePos, 0
 	g.nextPos(true /* clean */) // Reset the state of huffman decoder
 	// Second pass - we check spaces not covered by the patterns
@@ -17,10 +17,13 @@
 package compress
 
 import (
+	"context"
 	"fmt"
 	"os"
+	"path/filepath"
 	"testing"
 
+	"github.com/ledgerwatch/log/v3"
 	"github.com/stretchr/testify/require"
 )
 
@@ -96,3 +99,46 @@ func BenchmarkDecompressTorrent(t *testing.B) {
 		}
 	}
 }
+
+// BenchmarkDecompressEntropyCoder compares sizes of files and speed of opening and reading them (which decodes
+// the blocks of words) with different secondary coders
+func BenchmarkDecompressEntropyCoder(b *testing.B) {
+	for _, bench := range []struct {
+		name string
+		id   uint8
+	}{{"none", 0}, {"ans", CoderANS}, {"huffman", CoderHuffman}} {
+		b.Run(bench.name, func(b *testing.B) {
+			tmpDir := b.TempDir()
+			file := filepath.Join(tmpDir, "compressed")
+			c, err := NewCompressor(context.Background(), b.Name(), file, tmpDir, 1, 2, log.LvlError)
+			require.NoError(b, err)
+			defer c.Close()
+			if bench.id != 0 {
+				coder, _ := LookupEntropyCoder(bench.id)
+				require.NoError(b, c.SetEntropyCoder(coder))
+			} else {
+				c.SetChecksums(true) // Versioned format, like the files with coders
+			}
+			var wordsSize int
+			for i := 0; i < 100_000; i++ {
+				w := fmt.Sprintf("%d longlongword %d", i%977, i)
+				wordsSize += len(w)
+				require.NoError(b, c.AddWord([]byte(w)))
+			}
+			require.NoError(b, c.Compress())
+			st, err := os.Stat(file)
+			require.NoError(b, err)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				d, err := NewDecompressor(file)
+				require.NoError(b, err)
+				g := d.MakeGetter()
+				for g.HasNext() {
+					g.Skip()
+				}
+				d.Close()
+			}
+			b.ReportMetric(float64(wordsSize)/float64(st.Size()), "ratio")
+		})
+	}
+}
@@ -20,11 +20,14 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"math/rand"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"testing"
 
+	"github.com/ledgerwatch/erigon-lib/common"
 	"github.com/ledgerwatch/log/v3"
 	"github.com/stretchr/testify/require"
 )
@@ -229,3 +232,443 @@ func TestDecompressTorrent(t *testing.T) {
 		require.NotZero(t, sz)
 	}
 }
+
+func TestDecompressVerify(t *testing.T) {
+	d := prepareLoremDict(t)
+	require.False(t, d.HasChecksums())
+	require.NoError(t, d.Verify())
+	require.NoError(t, d.Close())
+
+	tmpDir := t.TempDir()
+	file := filepath.Join(tmpDir, "compressed")
+	c, err := NewCompressor(context.Background(), t.Name(), file, tmpDir, 1, 2, log.LvlDebug)
+	require.NoError(t, err)
+	defer c.Close()
+	c.SetChecksums(true)
+	for k, w := range loremStrings {
+		require.NoError(t, c.AddWord([]byte(fmt.Sprintf("%s %d", w, k))))
+	}
+	require.NoError(t, c.Compress())
+
+	d, err = NewDecompressor(file)
+	require.NoError(t, err)
+	require.True(t, d.HasChecksums())
+	require.NoError(t, d.Verify())
+	g := d.MakeGetter()
+	for k, w := range loremStrings {
+		require.True(t, g.HasNext())
+		word, _ := g.Next(nil)
+		require.Equal(t, fmt.Sprintf("%s %d", w, k), string(word))
+	}
+	require.False(t, g.HasNext())
+	wordsStart, wordsEnd := d.wordsStart, d.wordsEnd
+	require.NoError(t, d.Close())
+
+	data, err := os.ReadFile(file)
+	require.NoError(t, err)
+	damaged := filepath.Join(tmpDir, "damaged")
+
+	// Damaged word is found by Verify
+	corrupted := common.Copy(data)
+	corrupted[(wordsStart+wordsEnd)/2] ^= 0xff
+	require.NoError(t, os.WriteFile(damaged, corrupted, 0644))
+	d, err = NewDecompressor(damaged)
+	require.NoError(t, err)
+	require.ErrorContains(t, d.Verify(), "checksum mismatch in block 0")
+	require.NoError(t, d.Close())
+
+	// Damaged header and truncated file fail on open
+	corrupted = common.Copy(data)
+	corrupted[wordsStart-1] ^= 0xff
+	require.NoError(t, os.WriteFile(damaged, corrupted, 0644))
+	_, err = NewDecompressor(damaged)
+	require.ErrorContains(t, err, "header checksum mismatch")
+	require.NoError(t, os.WriteFile(damaged, data[:len(data)-1], 0644))
+	_, err = NewDecompressor(damaged)
+	require.ErrorContains(t, err, "truncated")
+}
+
+func TestDecompressDamagedHeader(t *testing.T) {
+	d := prepareLoremDict(t)
+	file := d.FilePath()
+	require.NoError(t, d.Close())
+	data, err := os.ReadFile(file)
+	require.NoError(t, err)
+	_, hdrSize, err := parseSegmentHeader(data)
+	require.NoError(t, err)
+	// File without checksums: damaged header either opens, or fails (possibly by recovered panic) with error
+	damaged := filepath.Join(t.TempDir(), "damaged")
+	var failed int
+	for i := 0; i < hdrSize+16; i++ {
+		corrupted := common.Copy(data)
+		corrupted[i] ^= 0xff
+		require.NoError(t, os.WriteFile(damaged, corrupted, 0644))
+		d, err := NewDecompressor(damaged)
+		if err != nil {
+			require.Nil(t, d)
+			failed++
+			continue
+		}
+		require.NotNil(t, d, "byte %d", i)
+		require.NoError(t, d.Close())
+	}
+	require.NotZero(t, failed)
+}
+
+func TestDecompressWordAt(t *testing.T) {
+	d := prepareLoremDict(t)
+	require.False(t, d.HasWordOffsets())
+	_, err := d.WordAt(0, nil)
+	require.ErrorContains(t, err, "no word offsets")
+	require.NoError(t, d.Close())
+
+	for _, checksums := range []bool{false, true} {
+		tmpDir := t.TempDir()
+		file := filepath.Join(tmpDir, "compressed")
+		c, err := NewCompressor(context.Background(), t.Name(), file, tmpDir, 1, 2, log.LvlDebug)
+		require.NoError(t, err)
+		c.SetChecksums(checksums)
+		c.SetWordOffsets(true)
+		for k, w := range loremStrings {
+			if k%5 == 0 {
+				require.NoError(t, c.AddWord(nil))
+				continue
+			}
+			require.NoError(t, c.AddWord([]byte(fmt.Sprintf("%s %d", w, k))))
+		}
+		require.NoError(t, c.Compress())
+		c.Close()
+
+		d, err = NewDecompressor(file)
+		require.NoError(t, err)
+		require.True(t, d.HasWordOffsets())
+		require.NoError(t, d.Verify())
+		expected := func(k int) string {
+			if k%5 == 0 {
+				return ""
+			}
+			return fmt.Sprintf("%s %d", loremStrings[k], k)
+		}
+		// Sequential reading is not affected by the offsets
+		g := d.MakeGetter()
+		for k := range loremStrings {
+			word, _ := g.Next(nil)
+			require.Equal(t, expected(k), string(word))
+		}
+		require.False(t, g.HasNext())
+		// Random access, in reverse order
+		for k := len(loremStrings) - 1; k >= 0; k-- {
+			word, err := d.WordAt(uint64(k), nil)
+			require.NoError(t, err)
+			require.Equal(t, expected(k), string(word))
+			require.NoError(t, g.ResetToWord(uint64(k)))
+			word, _ = g.Next(nil)
+			require.Equal(t, expected(k), string(word))
+		}
+		require.ErrorContains(t, g.ResetToWord(uint64(len(loremStrings))), "out of range")
+		require.NoError(t, d.Close())
+	}
+}
+
+func TestDecompressParallel(t *testing.T) {
+	tmpDir := t.TempDir()
+	file := filepath.Join(tmpDir, "compressed")
+	c, err := NewCompressor(context.Background(), t.Name(), file, tmpDir, 1, 2, log.LvlDebug)
+	require.NoError(t, err)
+	defer c.Close()
+	c.SetChunkSize(64)
+	c.SetWordOffsets(true)
+	const count = 1000
+	for i := 0; i < count; i++ {
+		require.NoError(t, c.AddWord([]byte(fmt.Sprintf("%s %d", loremStrings[i%len(loremStrings)], i))))
+	}
+	require.NoError(t, c.Compress())
+
+	d, err := NewDecompressor(file)
+	require.NoError(t, err)
+	defer d.Close()
+	require.NoError(t, d.Verify())
+	ranges := d.SplitWords(4)
+	require.Len(t, ranges, 4)
+	var next uint64
+	for _, r := range ranges {
+		require.Equal(t, next, r.FirstWord)
+		next += r.WordsCount
+	}
+	require.Equal(t, uint64(count), next)
+
+	words := make([]string, count)
+	offsets := make([]uint64, count)
+	var mu sync.Mutex
+	nextInRange := map[int]uint64{} // Words of each range must come in order
+	for i, r := range ranges {
+		nextInRange[i] = r.FirstWord
+	}
+	require.NoError(t, d.ForEachParallel(context.Background(), 4, func(wordNum uint64, word []byte, offset uint64) error {
+		words[wordNum], offsets[wordNum] = string(word), offset
+		mu.Lock()
+		defer mu.Unlock()
+		for i, r := range ranges {
+			if wordNum >= r.FirstWord && wordNum < r.FirstWord+r.WordsCount {
+				if nextInRange[i] != wordNum {
+					return fmt.Errorf("word %d out of order, expected %d", wordNum, nextInRange[i])
+				}
+				nextInRange[i]++
+			}
+		}
+		return nil
+	}))
+	g := d.MakeGetter()
+	for i := 0; i < count; i++ {
+		require.Equal(t, fmt.Sprintf("%s %d", loremStrings[i%len(loremStrings)], i), words[i])
+		g.Reset(offsets[i])
+		word, _ := g.Next(nil)
+		require.Equal(t, words[i], string(word))
+	}
+
+	// Files without chunks are not split, and errors stop the iteration
+	require.Len(t, prepareLoremDict(t).SplitWords(4), 1)
+	require.ErrorContains(t, d.ForEachParallel(context.Background(), 4, func(uint64, []byte, uint64) error {
+		return fmt.Errorf("stop")
+	}), "stop")
+}
+
+func TestDecompressSeek(t *testing.T) {
+	tmpDir := t.TempDir()
+	file := filepath.Join(tmpDir, "compressed")
+	c, err := NewCompressor(context.Background(), t.Name(), file, tmpDir, 1, 2, log.LvlDebug)
+	require.NoError(t, err)
+	defer c.Close()
+	require.NoError(t, c.SetKeySamples(4, 2))
+	const count = 100
+	key := func(i int) []byte { return []byte(fmt.Sprintf("key%03d", 2*i)) }
+	for i := 0; i < count; i++ {
+		require.NoError(t, c.AddUncompressedWord(key(i)))
+		require.NoError(t, c.AddWord([]byte(fmt.Sprintf("value %s %d", loremStrings[i%len(loremStrings)], i))))
+	}
+	require.ErrorContains(t, c.AddUncompressedWord([]byte("key000")), "not sorted")
+	require.NoError(t, c.Compress())
+
+	d, err := NewDecompressor(file)
+	require.NoError(t, err)
+	defer d.Close()
+	require.True(t, d.HasKeySamples())
+	g := d.MakeGetter()
+	for i := 0; i < count; i++ {
+		// Exact key
+		found, err := g.Seek(key(i))
+		require.NoError(t, err)
+		require.True(t, found)
+		require.True(t, g.HasNext())
+		k, _ := g.Next(nil)
+		require.Equal(t, string(key(i)), string(k))
+		v, _ := g.Next(nil)
+		require.Equal(t, fmt.Sprintf("value %s %d", loremStrings[i%len(loremStrings)], i), string(v))
+		// Key in between lands at the next record
+		found, err = g.Seek([]byte(fmt.Sprintf("key%03d", 2*i-1)))
+		require.NoError(t, err)
+		require.True(t, found)
+		ok, _ := g.Match(key(i))
+		require.True(t, ok)
+	}
+	found, err := g.Seek([]byte("key999"))
+	require.NoError(t, err)
+	require.False(t, found)
+	found, err = g.SeekPrefix([]byte("key1"))
+	require.NoError(t, err)
+	require.True(t, found)
+	k, _ := g.Next(nil)
+	require.Equal(t, "key100", string(k))
+	found, err = g.SeekPrefix([]byte("kez"))
+	require.NoError(t, err)
+	require.False(t, found)
+
+	_, err = prepareLoremDict(t).MakeGetter().Seek([]byte("key"))
+	require.ErrorContains(t, err, "no key samples")
+}
+
+func TestDecompressReport(t *testing.T) {
+	tmpDir := t.TempDir()
+	file := filepath.Join(tmpDir, "compressed")
+	c, err := NewCompressor(context.Background(), t.Name(), file, tmpDir, 1, 2, log.LvlDebug)
+	require.NoError(t, err)
+	defer c.Close()
+	var wordsBytes uint64
+	for i := 0; i < 100; i++ {
+		word := []byte(fmt.Sprintf("%d longlongword %d", i, i))
+		wordsBytes += uint64(len(word))
+		require.NoError(t, c.AddWord(word))
+		require.NoError(t, c.AddUncompressedWord([]byte("abc")))
+		require.NoError(t, c.AddWord(nil))
+	}
+	wordsBytes += 100 * 3
+	require.NoError(t, c.Compress())
+
+	trainer := NewDictionaryTrainer(context.Background(), tmpDir, 1, 2)
+	defer trainer.Close()
+	for i := 0; i < 100; i++ {
+		trainer.AddWord([]byte(fmt.Sprintf("%d longlongword %d", i, i)))
+	}
+	dict, err := trainer.Train()
+	require.NoError(t, err)
+	dictReport := dict.Report(5)
+	require.Equal(t, dict.Len(), dictReport.Patterns)
+	require.Len(t, dictReport.TopPatterns, 5)
+	require.GreaterOrEqual(t, dictReport.TopPatterns[0].Score, dictReport.TopPatterns[4].Score)
+
+	d, err := NewDecompressor(file)
+	require.NoError(t, err)
+	defer d.Close()
+	r, err := d.Report(3)
+	require.NoError(t, err)
+	require.Equal(t, uint64(300), r.Words)
+	require.Equal(t, uint64(100), r.EmptyWords)
+	require.Equal(t, uint64(100), r.UncompressedWords)
+	require.InDelta(t, 0.5, r.UncompressedShare(), 0.001)
+	require.Equal(t, wordsBytes, r.WordsBytes)
+	require.Len(t, r.TopPatterns, 3)
+	require.GreaterOrEqual(t, r.TopPatterns[0].Uses, r.TopPatterns[2].Uses)
+	require.Less(t, r.UncoveredBytes, r.WordsBytes)
+	require.Positive(t, r.TopPatterns[0].BytesSaved)
+	var patterns int
+	for _, n := range r.PatternCodeLens {
+		patterns += n
+	}
+	require.Equal(t, r.Patterns, patterns)
+	require.Contains(t, r.String(), "uncompressed 100")
+}
+
+func TestDecompressEntropyCoder(t *testing.T) {
+	expected := func(k int) string {
+		if k%5 == 0 {
+			return ""
+		}
+		return fmt.Sprintf("%s %d", loremStrings[k], k)
+	}
+	for _, id := range []uint8{CoderANS, CoderHuffman} {
+		coder, ok := LookupEntropyCoder(id)
+		require.True(t, ok)
+		tmpDir := t.TempDir()
+		file := filepath.Join(tmpDir, "compressed")
+		c, err := NewCompressor(context.Background(), t.Name(), file, tmpDir, 1, 2, log.LvlDebug)
+		require.NoError(t, err)
+		require.NoError(t, c.SetEntropyCoder(coder))
+		c.SetChecksums(true)
+		c.SetWordOffsets(true)
+		for k := range loremStrings {
+			require.NoError(t, c.AddWord([]byte(expected(k))))
+		}
+		require.NoError(t, c.Compress())
+		c.Close()
+
+		d, err := NewDecompressor(file)
+		require.NoError(t, err)
+		require.NoError(t, d.Verify())
+		g := d.MakeGetter()
+		for k := range loremStrings {
+			word, _ := g.Next(nil)
+			require.Equal(t, expected(k), string(word))
+		}
+		require.False(t, g.HasNext())
+		for k := len(loremStrings) - 1; k >= 0; k-- {
+			word, err := d.WordAt(uint64(k), nil)
+			require.NoError(t, err)
+			require.Equal(t, expected(k), string(word))
+		}
+
+		// Patterns of the words are read from the secondary coded blocks when merging
+		merged := filepath.Join(tmpDir, "merged")
+		c, err = NewCompressor(context.Background(), t.Name(), merged, tmpDir, 1, 2, log.LvlDebug)
+		require.NoError(t, err)
+		require.NoError(t, c.SetEntropyCoder(coder))
+		require.NoError(t, MergeSegments(c, []*Decompressor{d, d}, nil))
+		c.Close()
+		m, err := NewDecompressor(merged)
+		require.NoError(t, err)
+		g = m.MakeGetter()
+		for i := 0; i < 2*len(loremStrings); i++ {
+			word, _ := g.Next(nil)
+			require.Equal(t, expected(i%len(loremStrings)), string(word))
+		}
+		require.False(t, g.HasNext())
+		require.NoError(t, m.Close())
+		require.NoError(t, d.Close())
+	}
+	require.Panics(t, func() { RegisterEntropyCoder(kanziCoder{id: CoderANS}) })
+	require.Panics(t, func() { RegisterEntropyCoder(kanziCoder{}) })
+}
+
+func TestDecompressEntropyCoderLazy(t *testing.T) {
+	rnd := rand.New(rand.NewSource(42))
+	random := func(n int) []byte {
+		b := make([]byte, n)
+		rnd.Read(b)
+		return b
+	}
+	// Large words span several blocks, the uncompressed one is read by NextUncompressed
+	var words [][]byte
+	for k := 0; k < 1000; k++ {
+		words = append(words, []byte(fmt.Sprintf("%d longlongword %d", k%97, k)))
+	}
+	words = append(words, random(entropyBlockSize+entropyBlockSize/2))
+	for k := 0; k < 1000; k++ {
+		words = append(words, random(100))
+	}
+	bigUncompressed := len(words)
+	words = append(words, random(2*entropyBlockSize+100))
+	words = append(words, []byte("last"))
+
+	coder, ok := LookupEntropyCoder(CoderHuffman)
+	require.True(t, ok)
+	tmpDir := t.TempDir()
+	file := filepath.Join(tmpDir, "compressed")
+	c, err := NewCompressor(context.Background(), t.Name(), file, tmpDir, 1, 2, log.LvlDebug)
+	require.NoError(t, err)
+	require.NoError(t, c.SetEntropyCoder(coder))
+	c.SetWordOffsets(true)
+	for i, w := range words {
+		if i == bigUncompressed {
+			require.NoError(t, c.AddUncompressedWord(w))
+		} else {
+			require.NoError(t, c.AddWord(w))
+		}
+	}
+	require.NoError(t, c.Compress())
+	c.Close()
+
+	d, err := NewDecompressor(file)
+	require.NoError(t, err)
+	defer d.Close()
+	require.Greater(t, len(d.blocks.blocks), 3)
+	require.Zero(t, d.blocks.decoded, "opening must not decode the words")
+
+	g := d.MakeGetter()
+	word, _ := g.Next(nil)
+	require.Equal(t, words[0], word)
+	require.Equal(t, 1, d.blocks.decoded)
+	last, err := d.WordAt(uint64(len(words)-1), nil)
+	require.NoError(t, err)
+	require.Equal(t, words[len(words)-1], last)
+	require.Equal(t, 2, d.blocks.decoded)
+
+	g.Reset(0)
+	for i, w := range words {
+		var word []byte
+		if i == bigUncompressed {
+			word, _ = g.NextUncompressed()
+		} else {
+			word, _ = g.Next(nil)
+		}
+		require.Equal(t, w, word, "word %d", i)
+	}
+	require.False(t, g.HasNext())
+	for i := len(words) - 1; i >= 0; i-- {
+		if i == bigUncompressed {
+			continue
+		}
+		word, err := d.WordAt(uint64(i), nil)
+		require.NoError(t, err)
+		require.Equal(t, words[i], word, "word %d", i)
+	}
+	require.NoError(t, d.Verify())
+}
@@ -0,0 +1,335 @@
+/*
+   Copyright 2022 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package compress
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/ledgerwatch/erigon-lib/etl"
+)
+
+// Dictionary file format:
+//
+//	magic (4 bytes) | version (1 byte) | number of patterns (8 bytes)
+//	patterns, each encoded as score (uvarint), length (uvarint) and bytes
+//	sha256 of everything above (32 bytes)
+//
+// The trailing hash identifies the dictionary, and is recorded in the segments compressed against it
+const (
+	dictMagic    = "\xffDIC"
+	dictVersion1 = 1
+)
+
+// Dictionary is a set of patterns trained once from sample data. It can be persisted as a standalone file,
+// and many segments can be compressed against it by reference (see Compressor.SetDictionary), instead of
+// building and embedding their own dictionaries. This improves compression of small segments
+type Dictionary struct {
+	patterns [][]byte // Sorted by decreasing score, index of pattern is its code in the segments
+	scores   []uint64
+	hash     [32]byte
+	filePath string // File the dictionary was saved to or loaded from
+}
+
+func newDictionary(db *DictionaryBuilder) *Dictionary {
+	d := &Dictionary{}
+	db.ForEach(func(score uint64, word []byte) {
+		d.patterns = append(d.patterns, word)
+		d.scores = append(d.scores, score)
+	})
+	return d
+}
+
+func (d *Dictionary) Len() int { return len(d.patterns) }
+
+// Hash returns sha256 of the dictionary file content. It is only known after dictionary is saved or loaded
+func (d *Dictionary) Hash() [32]byte { return d.hash }
+
+func (d *Dictionary) FilePath() string { return d.filePath }
+
+// ForEach iterates over patterns in the order of decreasing scores
+func (d *Dictionary) ForEach(f func(score uint64, word []byte)) {
+	for i, p := range d.patterns {
+		f(d.scores[i], p)
+	}
+}
+
+// builder creates DictionaryBuilder with the same patterns, which yields them in the same order
+func (d *Dictionary) builder() *DictionaryBuilder {
+	db := &DictionaryBuilder{limit: len(d.patterns), items: make([]*Pattern, len(d.patterns))}
+	for i, p := range d.patterns {
+		db.items[len(d.patterns)-1-i] = &Pattern{word: p, score: d.scores[i]}
+	}
+	return db
+}
+
+func (d *Dictionary) encode() []byte {
+	var buf bytes.Buffer
+	var numBuf [binary.MaxVarintLen64]byte
+	buf.WriteString(dictMagic)
+	buf.WriteByte(dictVersion1)
+	binary.BigEndian.PutUint64(numBuf[:], uint64(len(d.patterns)))
+	buf.Write(numBuf[:8])
+	for i, p := range d.patterns {
+		n := binary.PutUvarint(numBuf[:], d.scores[i])
+		buf.Write(numBuf[:n])
+		n = binary.PutUvarint(numBuf[:], uint64(len(p)))
+		buf.Write(numBuf[:n])
+		buf.Write(p)
+	}
+	hash := sha256.Sum256(buf.Bytes())
+	buf.Write(hash[:])
+	return buf.Bytes()
+}
+
+// Save persists dictionary into the file. File is first written under temporary name,
+// and then renamed, so that readers never see partially written dictionary
+func (d *Dictionary) Save(filePath string) error {
+	data := d.encode()
+	tmpPath := filePath + ".tmp"
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpPath)
+	if _, err = f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmpPath, filePath); err != nil {
+		return fmt.Errorf("renaming: %w", err)
+	}
+	copy(d.hash[:], data[len(data)-sha256.Size:])
+	d.filePath = filePath
+	return nil
+}
+
+func LoadDictionary(filePath string) (*Dictionary, error) {
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	d, err := decodeDictionary(data)
+	if err != nil {
+		return nil, fmt.Errorf("dictionary %s: %w", filePath, err)
+	}
+	d.filePath = filePath
+	return d, nil
+}
+
+func decodeDictionary(data []byte) (*Dictionary, error) {
+	if len(data) < len(dictMagic)+1+8+sha256.Size || string(data[:len(dictMagic)]) != dictMagic {
+		return nil, fmt.Errorf("not a dictionary file")
+	}
+	if v := data[len(dictMagic)]; v != dictVersion1 {
+		return nil, fmt.Errorf("unsupported dictionary version: %d", v)
+	}
+	content := data[:len(data)-sha256.Size]
+	d := &Dictionary{}
+	if d.hash = sha256.Sum256(content); !bytes.Equal(d.hash[:], data[len(content):]) {
+		return nil, fmt.Errorf("dictionary hash mismatch")
+	}
+	i := len(dictMagic) + 1
+	count := binary.BigEndian.Uint64(content[i:])
+	i += 8
+	d.patterns = make([][]byte, 0, count)
+	d.scores = make([]uint64, 0, count)
+	for j := uint64(0); j < count; j++ {
+		score, n := binary.Uvarint(content[i:])
+		if n <= 0 {
+			return nil, fmt.Errorf("reading score of pattern %d", j)
+		}
+		i += n
+		l, n := binary.Uvarint(content[i:])
+		if n <= 0 || uint64(len(content)-i-n) < l {
+			return nil, fmt.Errorf("reading pattern %d", j)
+		}
+		i += n
+		d.patterns = append(d.patterns, content[i:i+int(l)])
+		d.scores = append(d.scores, score)
+		i += int(l)
+	}
+	if i != len(content) {
+		return nil, fmt.Errorf("unexpected %d bytes after patterns", len(content)-i)
+	}
+	return d, nil
+}
+
+// DictionaryTrainer builds dictionary of patterns from the words added to it,
+// the same way Compressor does for the words it compresses
+type DictionaryTrainer struct {
+	ctx    context.Context
+	tmpDir string
+
+	// Buffer for "superstring" - transformation of superstrings where each byte of a word, say b,
+	// is turned into 2 bytes, 0x01 and b, and two zero bytes 0x00 0x00 are inserted after each word
+	// this is needed for using ordinary (one string) suffix sorting algorithm instead of a generalised (many superstrings) suffix
+	// sorting algorithm
+	superstring      []byte
+	superstrings     chan []byte
+	cfg              CompressorCfg
+	wordsCount       uint64
+	wg               *sync.WaitGroup
+	suffixCollectors []*etl.Collector
+	processor        *superstringProcessor // Processes superstrings in the calling goroutine, set only with 1 worker
+	closed           bool
+}
+
+func NewDictionaryTrainer(ctx context.Context, tmpDir string, minPatternScore uint64, workers int) *DictionaryTrainer {
+	cfg := CompressorCfgBalanced
+	cfg.MinPatternScore, cfg.Workers = minPatternScore, workers
+	return NewDictionaryTrainerWithCfg(ctx, tmpDir, cfg)
+}
+
+// NewDictionaryTrainerWithCfg creates trainer with given settings of dictionary building, see CompressorCfg
+func NewDictionaryTrainerWithCfg(ctx context.Context, tmpDir string, cfg CompressorCfg) *DictionaryTrainer {
+	workers := cfg.Workers
+	if workers == 1 {
+		// No goroutines, superstrings are processed in the order they are filled
+		collector := etl.NewCollector(compressLogPrefix, tmpDir, etl.NewSortableBuffer(etl.BufferOptimalSize/2))
+		return &DictionaryTrainer{
+			ctx:              ctx,
+			tmpDir:           tmpDir,
+			cfg:              cfg,
+			suffixCollectors: []*etl.Collector{collector},
+			processor:        newSuperstringProcessor(collector, cfg),
+		}
+	}
+	// Collector for dictionary superstrings (sorted by their score)
+	superstrings := make(chan []byte, workers*2)
+	wg := &sync.WaitGroup{}
+	wg.Add(workers)
+	suffixCollectors := make([]*etl.Collector, workers)
+	for i := 0; i < workers; i++ {
+		collector := etl.NewCollector(compressLogPrefix, tmpDir, etl.NewSortableBuffer(etl.BufferOptimalSize/2))
+		suffixCollectors[i] = collector
+		go processSuperstring(superstrings, collector, cfg, wg)
+	}
+	return &DictionaryTrainer{
+		ctx:              ctx,
+		tmpDir:           tmpDir,
+		cfg:              cfg,
+		superstrings:     superstrings,
+		wg:               wg,
+		suffixCollectors: suffixCollectors,
+	}
+}
+
+// SetMemoryBudget makes the collectors of trainer's workers share given memory budget
+func (t *DictionaryTrainer) SetMemoryBudget(budget *etl.MemoryBudget) {
+	for _, collector := range t.suffixCollectors {
+		collector.SetMemoryBudget(budget)
+	}
+}
+
+// AddWord adds word to the training data. With sampling rate n (see CompressorCfg), only every n-th word is used
+func (t *DictionaryTrainer) AddWord(word []byte) {
+	t.wordsCount++
+	if (t.wordsCount-1)%uint64(t.cfg.SamplingRate) != 0 {
+		return
+	}
+	if len(t.superstring)+2*len(word)+2 > t.cfg.SuperstringLimit {
+		t.flushSuperstring()
+	}
+	for _, a := range word {
+		t.superstring = append(t.superstring, 1, a)
+	}
+	t.superstring = append(t.superstring, 0, 0)
+}
+
+// flushSuperstring hands the filled superstring over to the workers, or processes it right away with 1 worker
+func (t *DictionaryTrainer) flushSuperstring() {
+	if t.processor != nil {
+		t.processor.process(t.superstring)
+		t.superstring = t.superstring[:0]
+		return
+	}
+	t.superstrings <- t.superstring
+	t.superstring = nil
+}
+
+// finishWorkers sends residual superstring to the workers and waits for them to process everything
+func (t *DictionaryTrainer) finishWorkers() {
+	if t.closed {
+		return
+	}
+	if len(t.superstring) > 0 {
+		t.flushSuperstring()
+	}
+	if t.processor == nil {
+		close(t.superstrings)
+		t.wg.Wait()
+	}
+	t.closed = true
+}
+
+func (t *DictionaryTrainer) build() (*DictionaryBuilder, error) {
+	t.finishWorkers()
+	return dictionaryBuilderFromCollectors(t.ctx, compressLogPrefix, t.tmpDir, t.suffixCollectors, t.cfg.MaxDictPatterns)
+}
+
+// Train builds dictionary from all the words added so far. Dictionary needs to be saved
+// before segments can be compressed against it
+func (t *DictionaryTrainer) Train() (*Dictionary, error) {
+	db, err := t.build()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	return newDictionary(db), nil
+}
+
+func (t *DictionaryTrainer) Close() {
+	t.finishWorkers()
+	for _, collector := range t.suffixCollectors {
+		collector.Close()
+	}
+	t.suffixCollectors = nil
+}
+
+// resolveDictionary returns external dictionary referenced by the segment header. If dictionary is not given,
+// it is loaded from the directory of the segment file. In both cases, its hash must match the one in the header
+func resolveDictionary(segmentPath string, h *segmentHeader, dict *Dictionary) (*Dictionary, error) {
+	if dict == nil {
+		// Name comes from the file, and must not lead out of the directory of the segment
+		if h.dictName == "" || filepath.IsAbs(h.dictName) || strings.ContainsAny(h.dictName, `/\`) || strings.Contains(h.dictName, "..") {
+			return nil, fmt.Errorf("invalid external dictionary name %q", h.dictName)
+		}
+		var err error
+		if dict, err = LoadDictionary(filepath.Join(filepath.Dir(segmentPath), h.dictName)); err != nil {
+			return nil, fmt.Errorf("loading external dictionary: %w", err)
+		}
+	}
+	if dict.hash != h.dictHash {
+		return nil, fmt.Errorf("external dictionary hash mismatch: expected %x, got %x", h.dictHash, dict.hash)
+	}
+	return dict, nil
+}
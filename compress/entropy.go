@@ -0,0 +1,299 @@
+/*
+   Copyright 2022 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package compress
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+
+	kanzi "github.com/flanglet/kanzi-go"
+	"github.com/flanglet/kanzi-go/bitstream"
+	"github.com/flanglet/kanzi-go/entropy"
+)
+
+// EntropyCoder is the secondary coder, applied to the words of the file after substitution of patterns and
+// Huffman coding of patterns and positions. It mostly helps with the bytes not covered by patterns, which are
+// otherwise stored as they are. Words are encoded in blocks of entropyBlockSize bytes, which are decoded
+// when they are read. Reading files with secondary coder costs decoding of the blocks, so they suit cold files
+// better than the ones read often
+type EntropyCoder interface {
+	// ID is recorded in the header of the file, and is used to find the coder when the file is opened.
+	// 0 is reserved for files without secondary coder
+	ID() uint8
+	// Encode appends encoding of src to dst
+	Encode(dst, src []byte) ([]byte, error)
+	// Decode appends decodedSize bytes decoded from src to dst
+	Decode(dst, src []byte, decodedSize int) ([]byte, error)
+}
+
+// IDs of the built-in secondary coders
+const (
+	CoderANS     uint8 = 1 // Order 0 asymmetric numeral systems (range variant)
+	CoderHuffman uint8 = 2 // Canonical Huffman coding of bytes
+)
+
+const entropyBlockSize = 1024 * 1024
+
+var (
+	codersLock sync.RWMutex
+	coders     = map[uint8]EntropyCoder{}
+)
+
+func init() {
+	RegisterEntropyCoder(kanziCoder{id: CoderANS, newEncoder: func(bs kanzi.OutputBitStream) (kanzi.EntropyEncoder, error) {
+		return entropy.NewANSRangeEncoder(bs, 0)
+	}, newDecoder: func(bs kanzi.InputBitStream) (kanzi.EntropyDecoder, error) {
+		return entropy.NewANSRangeDecoder(bs, 0)
+	}})
+	RegisterEntropyCoder(kanziCoder{id: CoderHuffman, newEncoder: func(bs kanzi.OutputBitStream) (kanzi.EntropyEncoder, error) {
+		return entropy.NewHuffmanEncoder(bs)
+	}, newDecoder: func(bs kanzi.InputBitStream) (kanzi.EntropyDecoder, error) {
+		return entropy.NewHuffmanDecoder(bs)
+	}})
+}
+
+// RegisterEntropyCoder makes coder available for compression and decompression. It panics if ID is 0
+// or is already taken by another coder
+func RegisterEntropyCoder(coder EntropyCoder) {
+	codersLock.Lock()
+	defer codersLock.Unlock()
+	if coder.ID() == 0 {
+		panic("entropy coder ID 0 is reserved")
+	}
+	if _, ok := coders[coder.ID()]; ok {
+		panic(fmt.Sprintf("entropy coder ID %d is already registered", coder.ID()))
+	}
+	coders[coder.ID()] = coder
+}
+
+// LookupEntropyCoder returns registered coder with given ID
+func LookupEntropyCoder(id uint8) (EntropyCoder, bool) {
+	codersLock.RLock()
+	defer codersLock.RUnlock()
+	coder, ok := coders[id]
+	return coder, ok
+}
+
+// kanziCoder adapts entropy codecs of kanzi to EntropyCoder
+type kanziCoder struct {
+	id         uint8
+	newEncoder func(bs kanzi.OutputBitStream) (kanzi.EntropyEncoder, error)
+	newDecoder func(bs kanzi.InputBitStream) (kanzi.EntropyDecoder, error)
+}
+
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
+
+func (c kanziCoder) ID() uint8 { return c.id }
+
+func (c kanziCoder) Encode(dst, src []byte) (res []byte, err error) {
+	defer func() {
+		if rec := recover(); rec != nil {
+			err = fmt.Errorf("entropy coder %d: %+v", c.id, rec)
+		}
+	}()
+	buf := bytes.NewBuffer(dst)
+	obs, err := bitstream.NewDefaultOutputBitStream(nopWriteCloser{buf}, 64*1024)
+	if err != nil {
+		return nil, err
+	}
+	enc, err := c.newEncoder(obs)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = enc.Write(src); err != nil {
+		return nil, err
+	}
+	enc.Dispose()
+	if _, err = obs.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (c kanziCoder) Decode(dst, src []byte, decodedSize int) (res []byte, err error) {
+	defer func() {
+		if rec := recover(); rec != nil {
+			err = fmt.Errorf("entropy coder %d: %+v", c.id, rec)
+		}
+	}()
+	ibs, err := bitstream.NewDefaultInputBitStream(io.NopCloser(bytes.NewReader(src)), 64*1024)
+	if err != nil {
+		return nil, err
+	}
+	dec, err := c.newDecoder(ibs)
+	if err != nil {
+		return nil, err
+	}
+	start := len(dst)
+	if cap(dst)-start < decodedSize {
+		newDst := make([]byte, start, start+decodedSize)
+		copy(newDst, dst)
+		dst = newDst
+	}
+	dst = dst[:start+decodedSize]
+	n, err := dec.Read(dst[start:])
+	if err != nil {
+		return nil, err
+	}
+	if n != decodedSize {
+		return nil, fmt.Errorf("entropy coder %d: decoded %d bytes instead of %d", c.id, n, decodedSize)
+	}
+	dec.Dispose()
+	return dst, nil
+}
+
+// entropyWriter encodes everything written to it in blocks, each prepended by its decoded and encoded sizes (uvarints)
+type entropyWriter struct {
+	w       io.Writer
+	coder   EntropyCoder
+	block   []byte
+	encoded []byte
+}
+
+func newEntropyWriter(w io.Writer, coder EntropyCoder) *entropyWriter {
+	return &entropyWriter{w: w, coder: coder, block: make([]byte, 0, entropyBlockSize)}
+}
+
+func (ew *entropyWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		l := entropyBlockSize - len(ew.block)
+		if l > len(p) {
+			l = len(p)
+		}
+		ew.block = append(ew.block, p[:l]...)
+		p = p[l:]
+		if len(ew.block) == entropyBlockSize {
+			if err := ew.flushBlock(); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return n, nil
+}
+
+func (ew *entropyWriter) flushBlock() error {
+	if len(ew.block) == 0 {
+		return nil
+	}
+	var err error
+	if ew.encoded, err = ew.coder.Encode(ew.encoded[:0], ew.block); err != nil {
+		return err
+	}
+	var numBuf [2 * binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(numBuf[:], uint64(len(ew.block)))
+	n += binary.PutUvarint(numBuf[n:], uint64(len(ew.encoded)))
+	if _, err = ew.w.Write(numBuf[:n]); err != nil {
+		return err
+	}
+	if _, err = ew.w.Write(ew.encoded); err != nil {
+		return err
+	}
+	ew.block = ew.block[:0]
+	return nil
+}
+
+// entropyCacheBlocks is the number of decoded blocks of words cached by the file, for all its getters
+const entropyCacheBlocks = 4
+
+// entropyBlock is the position of one block of words written by entropyWriter
+type entropyBlock struct {
+	start       uint64 // Offset of the encoded bytes of the block, after its sizes
+	encodedSize uint64
+	decodedSize int
+}
+
+type decodedBlock struct {
+	idx  int
+	data []byte
+}
+
+// entropyBlocks gives access to the words encoded by the secondary entropy coder. Blocks are decoded when getters
+// first read them, and few most recently used blocks are cached. Decoded blocks are never reused for other blocks,
+// so that the words returned by getters (see Getter.NextUncompressed) stay valid
+type entropyBlocks struct {
+	coder   EntropyCoder
+	data    []byte // Encoded blocks, mapped from the file
+	blocks  []entropyBlock
+	size    uint64 // Size of the decoded words
+	lock    sync.Mutex
+	cache   []decodedBlock // Most recently used last
+	decoded int            // Number of times blocks have been decoded
+}
+
+// parseEntropyBlocks reads the sizes of all the blocks of words written by entropyWriter, without decoding them.
+// All the blocks, except for the last one, are of entropyBlockSize when decoded, so that the block of any
+// offset in the decoded words is known
+func parseEntropyBlocks(coder EntropyCoder, data []byte) (*entropyBlocks, error) {
+	eb := &entropyBlocks{coder: coder, data: data}
+	var pos uint64
+	for i := 0; pos < uint64(len(data)); i++ {
+		if i > 0 && eb.blocks[i-1].decodedSize != entropyBlockSize {
+			return nil, fmt.Errorf("block %d of %d bytes is not the last one", i-1, eb.blocks[i-1].decodedSize)
+		}
+		decodedSize, n := binary.Uvarint(data[pos:])
+		if n <= 0 || decodedSize == 0 || decodedSize > entropyBlockSize {
+			return nil, fmt.Errorf("reading decoded size of block %d", i)
+		}
+		pos += uint64(n)
+		encodedSize, n := binary.Uvarint(data[pos:])
+		if n <= 0 || encodedSize > uint64(len(data))-pos-uint64(n) {
+			return nil, fmt.Errorf("reading encoded size of block %d", i)
+		}
+		pos += uint64(n)
+		eb.blocks = append(eb.blocks, entropyBlock{start: pos, encodedSize: encodedSize, decodedSize: int(decodedSize)})
+		eb.size += decodedSize
+		pos += encodedSize
+	}
+	return eb, nil
+}
+
+// block returns decoded block number i. It panics if the block can't be decoded, like getters do on damaged words
+func (eb *entropyBlocks) block(i uint64) []byte {
+	eb.lock.Lock()
+	for j := len(eb.cache) - 1; j >= 0; j-- {
+		if cached := eb.cache[j]; cached.idx == int(i) {
+			copy(eb.cache[j:], eb.cache[j+1:])
+			eb.cache[len(eb.cache)-1] = cached
+			eb.lock.Unlock()
+			return cached.data
+		}
+	}
+	eb.decoded++
+	eb.lock.Unlock()
+	// Decoding is done without the lock, so that getters reading other blocks are not blocked
+	b := eb.blocks[i]
+	data, err := eb.coder.Decode(nil, eb.data[b.start:b.start+b.encodedSize], b.decodedSize)
+	if err != nil {
+		panic(fmt.Errorf("decoding block %d: %w", i, err))
+	}
+	if len(data) != b.decodedSize {
+		panic(fmt.Errorf("decoding block %d: expected %d bytes, got %d", i, b.decodedSize, len(data)))
+	}
+	eb.lock.Lock()
+	if len(eb.cache) == entropyCacheBlocks {
+		eb.cache = append(eb.cache[:0], eb.cache[1:]...)
+	}
+	eb.cache = append(eb.cache, decodedBlock{idx: int(i), data: data})
+	eb.lock.Unlock()
+	return data
+}
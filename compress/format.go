@@ -0,0 +1,568 @@
+/*
+   Copyright 2022 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package compress
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/ledgerwatch/erigon-lib/common"
+	"github.com/ledgerwatch/erigon-lib/etl"
+	"github.com/ledgerwatch/erigon-lib/recsplit/eliasfano32"
+)
+
+// Segment files come in two formats. Legacy format starts with the number of words (8 bytes),
+// and is still produced by default. Versioned format starts with segmentMagic, followed by
+// the version and flags, which describe optional features of the file.
+// Because the first byte of the magic is 0xff, versioned file can't be mistaken for a legacy file
+// (that would require more than 2^63 words)
+//
+// Versioned format (version 1):
+//
+//	magic (4 bytes) | version (1 byte) | flags (1 byte) | entropy coder ID (1 byte) | reserved (1 byte)
+//	words count (8 bytes) | empty words count (8 bytes)
+//	if flagExternalDict: dictionary hash (32 bytes) | dictionary file name length (2 bytes) | dictionary file name
+//	pattern dictionary size (8 bytes) | patterns
+//	position dictionary size (8 bytes) | positions
+//	words (blocks encoded by the secondary entropy coder, if flagEntropyCoder is set)
+//	if flagKeySamples: key samples | words in record (8 bytes) | number of samples (8 bytes) | size of key samples (8 bytes)
+//	if flagChunks: chunks of words (16 bytes each) | number of chunks (8 bytes)
+//	if flagWordOffsets: Elias-Fano encoded offsets of the words | size of the offsets (8 bytes)
+//	if flagChecksums: checksums of blocks of words (4 bytes each) | footer
+//
+// Patterns are encoded as depth and pattern itself (length and bytes), or, if flagExternalDict is set,
+// depth and index of the pattern in the external dictionary.
+// Footer is: words size (8 bytes) | block size (4 bytes) | checksum of everything before the words (4 bytes) |
+// checksum of block checksums and the footer fields above (4 bytes) | segmentMagic (4 bytes).
+// Chunk is the number of its first word (8 bytes) and offset of that word (8 bytes). Chunks split the words
+// into parts of roughly equal size, which can be decompressed independently.
+// Key sample is offset of the record (uvarint), length of its key (uvarint) and the key. Records are groups of
+// consecutive words, the first of which is the key, and records are sorted by their keys.
+// Block of words encoded by the entropy coder is its decoded size (uvarint), encoded size (uvarint) and
+// the encoded bytes. Sections after the words are not encoded.
+// Offsets are relative to the beginning of the words (decoded, if flagEntropyCoder is set). Key samples, chunks and word offsets are covered by the
+// checksums of blocks of words.
+// All checksums are CRC32 (Castagnoli)
+const (
+	segmentMagic        = "\xffSEG"
+	segmentVersion1     = 1
+	segmentFixedHdrSize = 8 + 8 + 8 // magic+version+flags+reserved, words count, empty words count
+	segmentFooterSize   = 8 + 4 + 4 + 4 + 4
+
+	// checksumBlockSize is the size of blocks of words covered by individual checksums
+	checksumBlockSize = 1024 * 1024
+)
+
+// Flags of the versioned segment format
+const (
+	flagExternalDict uint8 = 1 << iota // Patterns reference external dictionary instead of being embedded
+	flagChecksums                      // File ends with checksums of the header and of blocks of words
+	flagWordOffsets                    // Words are followed by their offsets, for random access by word number
+	flagChunks                         // Words are followed by boundaries of chunks, for parallel decompression
+	flagKeySamples                     // Words are sorted records, followed by samples of their keys, for search by key
+	flagEntropyCoder                   // Words are encoded by the secondary entropy coder, with ID recorded in the header
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// segmentOptions are optional features of the segment file. Files without any of them are written in legacy format
+type segmentOptions struct {
+	dict        *Dictionary  // External dictionary to reference instead of embedding patterns
+	checksums   bool         // Write checksums of the header and of every block of words
+	wordOffsets bool         // Write offsets of all the words
+	chunkSize   uint64       // If not 0, write boundaries of chunks of words of (roughly) this size
+	keySamples  *keySampler  // If not nil, write samples of keys of the records
+	coder       EntropyCoder // If not nil, encode words with this secondary coder
+}
+
+func (o segmentOptions) header(wordsCount, emptyWordsCount uint64) segmentHeader {
+	h := segmentHeader{wordsCount: wordsCount, emptyWordsCount: emptyWordsCount}
+	if o.dict != nil {
+		h.flags |= flagExternalDict
+		h.dictHash = o.dict.hash
+		h.dictName = filepath.Base(o.dict.filePath)
+	}
+	if o.checksums {
+		h.flags |= flagChecksums
+	}
+	if o.wordOffsets {
+		h.flags |= flagWordOffsets
+	}
+	if o.chunkSize > 0 {
+		h.flags |= flagChunks
+	}
+	if o.keySamples != nil {
+		h.flags |= flagKeySamples
+	}
+	if o.coder != nil {
+		h.flags |= flagEntropyCoder
+		h.coder = o.coder.ID()
+	}
+	if h.flags != 0 {
+		h.version = segmentVersion1
+	}
+	return h
+}
+
+// segmentHeader is the part of segment file preceding pattern and position dictionaries
+type segmentHeader struct {
+	version         uint8 // 0 for the legacy format
+	flags           uint8
+	coder           uint8 // ID of the secondary entropy coder, if flagEntropyCoder is set
+	wordsCount      uint64
+	emptyWordsCount uint64
+	dictHash        [32]byte // Hash of the external dictionary, if flagExternalDict is set
+	dictName        string   // File name (without directory) of the external dictionary
+}
+
+func (h *segmentHeader) has(flag uint8) bool { return h.flags&flag != 0 }
+
+func (h *segmentHeader) write(w io.Writer) error {
+	var numBuf [8]byte
+	if h.version > 0 {
+		copy(numBuf[:4], segmentMagic)
+		numBuf[4] = h.version
+		numBuf[5] = h.flags
+		numBuf[6], numBuf[7] = h.coder, 0
+		if _, err := w.Write(numBuf[:]); err != nil {
+			return err
+		}
+	}
+	binary.BigEndian.PutUint64(numBuf[:], h.wordsCount)
+	if _, err := w.Write(numBuf[:]); err != nil {
+		return err
+	}
+	binary.BigEndian.PutUint64(numBuf[:], h.emptyWordsCount)
+	if _, err := w.Write(numBuf[:]); err != nil {
+		return err
+	}
+	if h.has(flagExternalDict) {
+		if _, err := w.Write(h.dictHash[:]); err != nil {
+			return err
+		}
+		binary.BigEndian.PutUint16(numBuf[:2], uint16(len(h.dictName)))
+		if _, err := w.Write(numBuf[:2]); err != nil {
+			return err
+		}
+		if _, err := io.WriteString(w, h.dictName); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseSegmentHeader reads header from the beginning of the segment file and returns number of bytes it occupies
+func parseSegmentHeader(data []byte) (h segmentHeader, n int, err error) {
+	if len(data) >= 4 && string(data[:4]) == segmentMagic {
+		if len(data) < segmentFixedHdrSize {
+			return h, 0, fmt.Errorf("segment header is too short: %d", len(data))
+		}
+		h.version, h.flags, h.coder = data[4], data[5], data[6]
+		if h.version != segmentVersion1 {
+			return h, 0, fmt.Errorf("unsupported segment version: %d", h.version)
+		}
+		if h.has(flagEntropyCoder) != (h.coder != 0) {
+			return h, 0, fmt.Errorf("entropy coder ID %d does not match the flags %b", h.coder, h.flags)
+		}
+		n = 8
+	}
+	if len(data) < n+16 {
+		return h, 0, fmt.Errorf("segment header is too short: %d", len(data))
+	}
+	h.wordsCount = binary.BigEndian.Uint64(data[n:])
+	h.emptyWordsCount = binary.BigEndian.Uint64(data[n+8:])
+	n += 16
+	if h.has(flagExternalDict) {
+		if len(data) < n+32+2 {
+			return h, 0, fmt.Errorf("segment header is too short: %d", len(data))
+		}
+		copy(h.dictHash[:], data[n:])
+		nameLen := int(binary.BigEndian.Uint16(data[n+32:]))
+		n += 32 + 2
+		if len(data) < n+nameLen {
+			return h, 0, fmt.Errorf("segment header is too short: %d", len(data))
+		}
+		h.dictName = string(data[n : n+nameLen])
+		n += nameLen
+	}
+	return h, n, nil
+}
+
+// checksumWriter passes everything through to the underlying writer, computing checksum of the header
+// (everything written before startWords is called), and checksums of every block of words
+type checksumWriter struct {
+	w         io.Writer
+	header    hash.Hash32
+	block     hash.Hash32
+	inWords   bool
+	blockLen  int
+	blocks    []uint32
+	wordsSize uint64
+}
+
+func newChecksumWriter(w io.Writer) *checksumWriter {
+	return &checksumWriter{w: w, header: crc32.New(crcTable), block: crc32.New(crcTable)}
+}
+
+func (cw *checksumWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	if !cw.inWords {
+		cw.header.Write(p[:n])
+		return n, err
+	}
+	cw.wordsSize += uint64(n)
+	for q := p[:n]; len(q) > 0; {
+		l := checksumBlockSize - cw.blockLen
+		if l > len(q) {
+			l = len(q)
+		}
+		cw.block.Write(q[:l])
+		cw.blockLen += l
+		q = q[l:]
+		if cw.blockLen == checksumBlockSize {
+			cw.blocks = append(cw.blocks, cw.block.Sum32())
+			cw.block.Reset()
+			cw.blockLen = 0
+		}
+	}
+	return n, err
+}
+
+func (cw *checksumWriter) startWords() { cw.inWords = true }
+
+// writeFooter writes block checksums and the footer. It must be called after all the words are written
+func (cw *checksumWriter) writeFooter() error {
+	if cw.blockLen > 0 {
+		cw.blocks = append(cw.blocks, cw.block.Sum32())
+		cw.block.Reset()
+		cw.blockLen = 0
+	}
+	footer := make([]byte, 4*len(cw.blocks)+segmentFooterSize-4)
+	for i, c := range cw.blocks {
+		binary.BigEndian.PutUint32(footer[4*i:], c)
+	}
+	fixed := footer[4*len(cw.blocks):]
+	binary.BigEndian.PutUint64(fixed, cw.wordsSize)
+	binary.BigEndian.PutUint32(fixed[8:], checksumBlockSize)
+	binary.BigEndian.PutUint32(fixed[12:], cw.header.Sum32())
+	binary.BigEndian.PutUint32(fixed[16:], crc32.Checksum(footer[:len(footer)-4], crcTable))
+	footer = append(footer, segmentMagic...)
+	_, err := cw.w.Write(footer)
+	return err
+}
+
+// segmentFooter is parsed footer of the file with checksums
+type segmentFooter struct {
+	wordsSize      uint64
+	blockSize      uint64
+	headerChecksum uint32
+	blocks         []byte // Checksums of blocks, 4 bytes each
+}
+
+// parseSegmentFooter checks integrity of the footer, and that it is consistent with the size of the file,
+// so that truncated files are detected without reading the words. It returns the footer and offset of its beginning
+func parseSegmentFooter(data []byte, wordsStart uint64) (f segmentFooter, footerStart uint64, err error) {
+	size := uint64(len(data))
+	if size < wordsStart+segmentFooterSize || string(data[size-4:]) != segmentMagic {
+		return f, 0, fmt.Errorf("segment footer not found, file may be truncated")
+	}
+	fixed := data[size-segmentFooterSize:]
+	f.wordsSize = binary.BigEndian.Uint64(fixed)
+	f.blockSize = uint64(binary.BigEndian.Uint32(fixed[8:]))
+	f.headerChecksum = binary.BigEndian.Uint32(fixed[12:])
+	if f.blockSize == 0 {
+		return f, 0, fmt.Errorf("invalid checksum block size in segment footer")
+	}
+	blocks := (f.wordsSize + f.blockSize - 1) / f.blockSize
+	if wordsStart+f.wordsSize+4*blocks+segmentFooterSize != size {
+		return f, 0, fmt.Errorf("segment size mismatch: words start at %d, words size %d, %d blocks, file size %d, file may be truncated",
+			wordsStart, f.wordsSize, blocks, size)
+	}
+	footerStart = wordsStart + f.wordsSize
+	f.blocks = data[footerStart : footerStart+4*blocks]
+	if crc32.Checksum(data[footerStart:size-8], crcTable) != binary.BigEndian.Uint32(fixed[16:]) {
+		return f, 0, fmt.Errorf("segment footer checksum mismatch")
+	}
+	if crc32.Checksum(data[:wordsStart], crcTable) != f.headerChecksum {
+		return f, 0, fmt.Errorf("segment header checksum mismatch")
+	}
+	return f, footerStart, nil
+}
+
+// verifyBlocks checks checksums of all the blocks of words
+func (f *segmentFooter) verifyBlocks(words []byte) error {
+	for i := uint64(0); i*f.blockSize < uint64(len(words)); i++ {
+		end := (i + 1) * f.blockSize
+		if end > uint64(len(words)) {
+			end = uint64(len(words))
+		}
+		if crc32.Checksum(words[i*f.blockSize:end], crcTable) != binary.BigEndian.Uint32(f.blocks[4*i:]) {
+			return fmt.Errorf("checksum mismatch in block %d (words offsets %d-%d)", i, i*f.blockSize, end)
+		}
+	}
+	return nil
+}
+
+// wordOffsetsWriter accumulates offsets of the words in a temporary file (number of words may be too large
+// to keep them in memory), and then writes them as Elias-Fano sequence followed by its size
+type wordOffsetsWriter struct {
+	f      *os.File
+	w      *bufio.Writer
+	count  uint64
+	offset uint64 // Offset of the next word
+	last   uint64 // Offset of the last word added
+}
+
+func newWordOffsetsWriter(tmpPath string) (*wordOffsetsWriter, error) {
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return nil, fmt.Errorf("create word offsets file: %w", err)
+	}
+	return &wordOffsetsWriter{f: f, w: bufio.NewWriterSize(f, etl.BufIOSize)}, nil
+}
+
+// add records the word of given encoded size, which starts right after the previous one
+func (ow *wordOffsetsWriter) add(size uint64) error {
+	var numBuf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(numBuf[:], ow.offset-ow.last)
+	if _, err := ow.w.Write(numBuf[:n]); err != nil {
+		return err
+	}
+	ow.last = ow.offset
+	ow.offset += size
+	ow.count++
+	return nil
+}
+
+func (ow *wordOffsetsWriter) writeTo(w io.Writer) error {
+	var numBuf [8]byte
+	if ow.count == 0 {
+		_, err := w.Write(numBuf[:])
+		return err
+	}
+	if err := ow.w.Flush(); err != nil {
+		return err
+	}
+	if _, err := ow.f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	ef := eliasfano32.NewEliasFano(ow.count, ow.last)
+	r := bufio.NewReaderSize(ow.f, etl.BufIOSize)
+	var offset uint64
+	for i := uint64(0); i < ow.count; i++ {
+		delta, err := binary.ReadUvarint(r)
+		if err != nil {
+			return err
+		}
+		offset += delta
+		ef.AddOffset(offset)
+	}
+	ef.Build()
+	cw := &countingWriter{w: w}
+	if err := ef.Write(cw); err != nil {
+		return err
+	}
+	binary.BigEndian.PutUint64(numBuf[:], cw.n)
+	_, err := w.Write(numBuf[:])
+	return err
+}
+
+func (ow *wordOffsetsWriter) close() {
+	ow.f.Close()
+	os.Remove(ow.f.Name())
+}
+
+type countingWriter struct {
+	w io.Writer
+	n uint64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += uint64(n)
+	return n, err
+}
+
+// parseWordOffsets reads offsets of the words from the end of the words section,
+// and returns them (nil if there are no words) with the offset where the words end
+func parseWordOffsets(words []byte) (*eliasfano32.EliasFano, uint64, error) {
+	if len(words) < 8 {
+		return nil, 0, fmt.Errorf("word offsets not found")
+	}
+	size := binary.BigEndian.Uint64(words[len(words)-8:])
+	if size > uint64(len(words))-8 {
+		return nil, 0, fmt.Errorf("word offsets size %d goes beyond the words of size %d", size, len(words))
+	}
+	end := uint64(len(words)) - 8 - size
+	if size == 0 {
+		return nil, end, nil
+	}
+	if size < 16 {
+		return nil, 0, fmt.Errorf("word offsets are too short: %d", size)
+	}
+	ef, n := eliasfano32.ReadEliasFano(words[end:])
+	if uint64(n) != size {
+		return nil, 0, fmt.Errorf("word offsets size mismatch: expected %d, got %d", size, n)
+	}
+	return ef, end, nil
+}
+
+// wordsChunk is the boundary of the part of words, which can be decompressed independently
+type wordsChunk struct {
+	firstWord uint64 // Number of the first word of the chunk
+	offset    uint64 // Offset of the first word of the chunk, relative to the beginning of the words
+}
+
+func writeWordsChunks(w io.Writer, chunks []wordsChunk) error {
+	var numBuf [16]byte
+	for _, ch := range chunks {
+		binary.BigEndian.PutUint64(numBuf[:], ch.firstWord)
+		binary.BigEndian.PutUint64(numBuf[8:], ch.offset)
+		if _, err := w.Write(numBuf[:]); err != nil {
+			return err
+		}
+	}
+	binary.BigEndian.PutUint64(numBuf[:], uint64(len(chunks)))
+	_, err := w.Write(numBuf[:8])
+	return err
+}
+
+// parseWordsChunks reads chunks from the end of the words section, and returns them with the offset where the words end
+func parseWordsChunks(words []byte, wordsCount uint64) ([]wordsChunk, uint64, error) {
+	if len(words) < 8 {
+		return nil, 0, fmt.Errorf("chunks not found")
+	}
+	count := binary.BigEndian.Uint64(words[len(words)-8:])
+	if count > uint64(len(words)-8)/16 {
+		return nil, 0, fmt.Errorf("%d chunks go beyond the words of size %d", count, len(words))
+	}
+	end := uint64(len(words)) - 8 - 16*count
+	chunks := make([]wordsChunk, count)
+	for i := range chunks {
+		data := words[end+16*uint64(i):]
+		chunks[i] = wordsChunk{firstWord: binary.BigEndian.Uint64(data), offset: binary.BigEndian.Uint64(data[8:])}
+		if i > 0 && (chunks[i].firstWord <= chunks[i-1].firstWord || chunks[i].offset <= chunks[i-1].offset) {
+			return nil, 0, fmt.Errorf("chunk %d is out of order", i)
+		}
+		if chunks[i].firstWord >= wordsCount {
+			return nil, 0, fmt.Errorf("chunk %d is out of range", i)
+		}
+	}
+	return chunks, end, nil
+}
+
+// keySampler checks that records are added in order of their keys, and samples every n-th key
+type keySampler struct {
+	every       uint64 // Sample keys of every n-th record
+	recordWords uint64 // Number of words in one record, the first of which is the key
+	lastKey     []byte
+	keys        [][]byte // Sampled keys, the first record is always sampled
+	wordNums    []uint64 // Numbers of words of the sampled keys
+}
+
+// addWord must be called for every word added to the compressor, with the number of that word
+func (ks *keySampler) addWord(wordNum uint64, word []byte) error {
+	if wordNum%ks.recordWords != 0 {
+		return nil
+	}
+	if wordNum > 0 && bytes.Compare(word, ks.lastKey) < 0 {
+		return fmt.Errorf("keys are not sorted: key %x of word %d is smaller than previous key %x", word, wordNum, ks.lastKey)
+	}
+	ks.lastKey = append(ks.lastKey[:0], word...)
+	if (wordNum/ks.recordWords)%ks.every == 0 {
+		ks.keys = append(ks.keys, common.Copy(word))
+		ks.wordNums = append(ks.wordNums, wordNum)
+	}
+	return nil
+}
+
+// writeKeySamples writes sampled keys with offsets of their words
+func writeKeySamples(w io.Writer, ks *keySampler, offsets []uint64) error {
+	var numBuf [binary.MaxVarintLen64]byte
+	var size uint64
+	for i, key := range ks.keys {
+		n := binary.PutUvarint(numBuf[:], offsets[i])
+		n += binary.PutUvarint(numBuf[n:], uint64(len(key)))
+		if _, err := w.Write(numBuf[:n]); err != nil {
+			return err
+		}
+		if _, err := w.Write(key); err != nil {
+			return err
+		}
+		size += uint64(n + len(key))
+	}
+	for _, v := range []uint64{ks.recordWords, uint64(len(ks.keys)), size} {
+		binary.BigEndian.PutUint64(numBuf[:], v)
+		if _, err := w.Write(numBuf[:8]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// keySamples are sampled keys of sorted records, which are used to find records by key
+type keySamples struct {
+	recordWords uint64
+	offsets     []uint64
+	keys        [][]byte
+}
+
+// parseKeySamples reads key samples from the end of the words section, and returns them with the offset where the words end
+func parseKeySamples(words []byte) (*keySamples, uint64, error) {
+	if len(words) < 24 {
+		return nil, 0, fmt.Errorf("key samples not found")
+	}
+	tail := words[len(words)-24:]
+	ks := &keySamples{recordWords: binary.BigEndian.Uint64(tail)}
+	count, size := binary.BigEndian.Uint64(tail[8:]), binary.BigEndian.Uint64(tail[16:])
+	if ks.recordWords == 0 {
+		return nil, 0, fmt.Errorf("invalid number of words in record: 0")
+	}
+	if size > uint64(len(words))-24 || count > size {
+		return nil, 0, fmt.Errorf("key samples of size %d go beyond the words of size %d", size, len(words))
+	}
+	end := uint64(len(words)) - 24 - size
+	data := words[end : end+size]
+	ks.offsets, ks.keys = make([]uint64, count), make([][]byte, count)
+	for i := range ks.keys {
+		offset, n := binary.Uvarint(data)
+		if n <= 0 {
+			return nil, 0, fmt.Errorf("reading offset of key sample %d", i)
+		}
+		data = data[n:]
+		l, n := binary.Uvarint(data)
+		if n <= 0 || l > uint64(len(data)-n) {
+			return nil, 0, fmt.Errorf("reading key sample %d", i)
+		}
+		if i > 0 && offset <= ks.offsets[i-1] {
+			return nil, 0, fmt.Errorf("offset of key sample %d is out of range", i)
+		}
+		ks.offsets[i], ks.keys[i] = offset, data[n:n+int(l)]
+		data = data[n+int(l):]
+	}
+	if len(data) != 0 {
+		return nil, 0, fmt.Errorf("unexpected %d bytes after key samples", len(data))
+	}
+	return ks, end, nil
+}
@@ -0,0 +1,322 @@
+/*
+   Copyright 2022 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package compress
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/ledgerwatch/erigon-lib/etl"
+	"github.com/ledgerwatch/erigon-lib/patricia"
+	"github.com/ledgerwatch/log/v3"
+)
+
+// MergeFunc is called for every word of the merged segments, in the order of segments and of words in them.
+// It returns the word to write into the merged segment (the word itself, or a modified one), or false to drop
+// the word. Word returned unchanged keeps its encoding from the segment. Modified word is compressed
+// against the dictionary of the merged segment if compress is true, and is added uncompressed otherwise
+type MergeFunc func(segment int, wordNum uint64, word []byte) (w []byte, compress bool, keep bool, err error)
+
+// MergeSegments writes all the words of the segments into one file, using compressor c for the options of the file,
+// which needs to be fresh (with optional features of the file already set). Instead of building new dictionary
+// from the words, the dictionaries of the segments are reused: if all of them are compressed against the same
+// external dictionary, merged file references it as well, otherwise patterns of all the segments are united,
+// with scores estimated from the lengths of their codes, and embedded into the merged file. Words are not
+// compressed again: the patterns each word is encoded with are re-mapped to their codes in the resulting
+// dictionary, and patterns left out of it (see CompressorCfg.MaxDictPatterns) are turned into uncovered bytes.
+// Only Huffman codes of patterns and positions are rebuilt. Words encoded without patterns, which include all
+// the words added by AddUncompressedWord, stay without patterns, so that readers using NextUncompressed can still
+// read them. If merge is nil, all the words are kept as they are. c still needs to be closed by the caller
+func MergeSegments(c *Compressor, segments []*Decompressor, merge MergeFunc) error {
+	if c.wordsCount > 0 {
+		return fmt.Errorf("merging segments needs fresh compressor")
+	}
+	var db *DictionaryBuilder
+	if c.opts.dict == nil {
+		if dict := sharedDictionary(segments); dict != nil {
+			if err := c.SetDictionary(dict); err != nil {
+				return err
+			}
+		} else {
+			limit := maxDictPatterns
+			if c.trainer != nil {
+				limit = c.trainer.cfg.MaxDictPatterns
+				c.trainer.Close()
+				c.trainer = nil
+			}
+			db = unitedDictionary(segments, limit)
+		}
+	}
+	if c.opts.dict != nil {
+		db = c.opts.dict.builder()
+	}
+	var pt patricia.PatriciaTree
+	code2pattern := codeTable(db, &pt)
+	codes := make(map[string]uint64, len(code2pattern))
+	for _, p := range code2pattern {
+		codes[string(p.word)] = p.code
+	}
+
+	defer os.Remove(c.tmpOutFilePath)
+	intermediatePath := c.tmpOutFilePath + ".tmp"
+	defer os.Remove(intermediatePath)
+	intermediateFile, err := os.Create(intermediatePath)
+	if err != nil {
+		return fmt.Errorf("create intermediate file: %w", err)
+	}
+	defer intermediateFile.Close()
+	w := &mergeWriter{
+		w:            bufio.NewWriterSize(intermediateFile, etl.BufIOSize),
+		code2pattern: code2pattern,
+		codes:        codes,
+		mf2:          patricia.NewMatchFinder2(&pt),
+		cellRing:     NewRing(),
+		uncovered:    make([]int, 256),
+		posMap:       map[uint64]uint64{},
+	}
+	logEvery := time.NewTicker(20 * time.Second)
+	defer logEvery.Stop()
+	var word []byte
+	var patterns []wordPattern
+	var inputSize, emptyWordsCount uint64
+	for i, d := range segments {
+		g := d.MakeGetter()
+		for wordNum := uint64(0); g.HasNext(); wordNum++ {
+			patterns = g.wordPatterns(patterns[:0])
+			word, _ = g.Next(word[:0])
+			out, compress, keep := word, false, true
+			if merge != nil {
+				if out, compress, keep, err = merge(i, wordNum, word); err != nil {
+					return err
+				}
+			}
+			if keep {
+				if c.opts.keySamples != nil {
+					if err = c.opts.keySamples.addWord(c.wordsCount, out); err != nil {
+						return err
+					}
+				}
+				c.wordsCount++
+				inputSize += 1 + uint64(len(out))
+				if len(out) == 0 {
+					emptyWordsCount++
+				}
+				if bytes.Equal(out, word) {
+					err = w.writeRemapped(out, patterns)
+				} else {
+					err = w.writeWord(out, compress)
+				}
+				if err != nil {
+					return err
+				}
+			}
+			select {
+			case <-c.ctx.Done():
+				return c.ctx.Err()
+			case <-logEvery.C:
+				log.Info(fmt.Sprintf("[%s] Merging segments", c.logPrefix), "file", d.FilePath(), "words", fmt.Sprintf("%d/%d", wordNum, d.Count()))
+			default:
+			}
+		}
+	}
+	if err = w.w.Flush(); err != nil {
+		return err
+	}
+	if _, err = intermediateFile.Seek(0, 0); err != nil {
+		return fmt.Errorf("return to the start of intermediate file: %w", err)
+	}
+	if err = writeSegment(c.logPrefix, c.tmpOutFilePath, intermediateFile, code2pattern, w.posMap, c.wordsCount, emptyWordsCount, c.opts); err != nil {
+		return err
+	}
+	if err = os.Rename(c.tmpOutFilePath, c.outputFile); err != nil {
+		return fmt.Errorf("renaming: %w", err)
+	}
+	s, err := os.Stat(c.outputFile)
+	if err != nil {
+		return fmt.Errorf("ratio: %w", err)
+	}
+	c.Ratio = CompressionRatio(float64(inputSize) / float64(s.Size()))
+	return nil
+}
+
+// wordPattern is the pattern a word is encoded with, and its position in the word
+type wordPattern struct {
+	pos  int
+	word []byte
+}
+
+// wordPatterns appends the patterns of the word at the current offset, with their positions, to the given slice,
+// without moving the getter
+func (g *Getter) wordPatterns(patterns []wordPattern) []wordPattern {
+	if g.blocks != nil {
+		g.window()
+	}
+	savePos := g.dataP
+	defer func() { g.dataP, g.dataBit = savePos, 0 }()
+	if g.nextPos(true) == 1 { // Empty word, because 0 is terminator
+		return patterns
+	}
+	var pos int
+	for p := g.nextPos(false); p != 0; p = g.nextPos(false) {
+		pos += int(p) - 1 // Positions are encoded relative to one another
+		patterns = append(patterns, wordPattern{pos: pos, word: g.nextPattern()})
+	}
+	return patterns
+}
+
+// mergeWriter writes the words of merged segments in the intermediate form, the same as reducedict does,
+// and counts the uses of patterns and positions for writeSegment
+type mergeWriter struct {
+	w            *bufio.Writer
+	code2pattern []*Pattern
+	codes        map[string]uint64 // Codes of the patterns in code2pattern, by the patterns
+	mf2          *patricia.MatchFinder2
+	cellRing     *Ring
+	output       []byte
+	uncovered    []int
+	patterns     []int
+	posMap       map[uint64]uint64
+	numBuf       [binary.MaxVarintLen64]byte
+}
+
+// writeRemapped writes the word with the patterns it was encoded with in the segment, which are found in the
+// dictionary of the merged segment. Parts of the word covered by other patterns are written as uncovered bytes
+func (w *mergeWriter) writeRemapped(word []byte, patterns []wordPattern) error {
+	w.output = w.appendUvarint(w.output[:0], uint64(len(word)))
+	if len(word) > 0 {
+		var count uint64
+		for _, p := range patterns {
+			if _, ok := w.codes[string(p.word)]; ok {
+				count++
+			}
+		}
+		w.output = w.appendUvarint(w.output, count)
+		w.uncovered = w.uncovered[:0]
+		var lastPos, lastUncovered int
+		for _, p := range patterns {
+			code, ok := w.codes[string(p.word)]
+			if !ok {
+				continue
+			}
+			if p.pos > lastUncovered {
+				w.uncovered = append(w.uncovered, lastUncovered, p.pos)
+			}
+			lastUncovered = p.pos + len(p.word)
+			w.posMap[uint64(p.pos-lastPos+1)]++
+			lastPos = p.pos
+			w.output = w.appendUvarint(w.output, uint64(p.pos))
+			w.output = w.appendUvarint(w.output, code)
+			w.code2pattern[code].uses++
+		}
+		if len(word) > lastUncovered {
+			w.uncovered = append(w.uncovered, lastUncovered, len(word))
+		}
+		for i := 0; i < len(w.uncovered); i += 2 {
+			w.output = append(w.output, word[w.uncovered[i]:w.uncovered[i+1]]...)
+		}
+	}
+	return w.flush(len(word))
+}
+
+// writeWord writes the word modified by MergeFunc, compressing it against the dictionary of the merged segment
+// if requested
+func (w *mergeWriter) writeWord(word []byte, compress bool) error {
+	w.output = w.appendUvarint(w.output[:0], uint64(len(word)))
+	if len(word) > 0 {
+		if compress {
+			w.output, w.patterns, w.uncovered = optimiseCluster(false, word, w.mf2, w.output, w.uncovered, w.patterns, w.cellRing, w.posMap)
+		} else {
+			w.output = append(append(w.output, 0), word...)
+		}
+	}
+	return w.flush(len(word))
+}
+
+func (w *mergeWriter) flush(wordLen int) error {
+	w.posMap[uint64(wordLen)+1]++
+	w.posMap[0]++
+	_, err := w.w.Write(w.output)
+	return err
+}
+
+func (w *mergeWriter) appendUvarint(buf []byte, x uint64) []byte {
+	n := binary.PutUvarint(w.numBuf[:], x)
+	return append(buf, w.numBuf[:n]...)
+}
+
+// sharedDictionary returns external dictionary, if all the segments are compressed against it
+func sharedDictionary(segments []*Decompressor) *Dictionary {
+	if len(segments) == 0 || segments[0].dictionary == nil || segments[0].dictionary.filePath == "" {
+		return nil
+	}
+	dict := segments[0].dictionary
+	for _, d := range segments[1:] {
+		if d.dictionary == nil || d.dictionary.hash != dict.hash {
+			return nil
+		}
+	}
+	return dict
+}
+
+// unitedDictionary collects patterns of all the segments, keeping at most limit patterns with the highest scores.
+// Scores are not stored in the files, so they are estimated from the depths of the Huffman codes of patterns:
+// pattern with code of depth n is used in roughly 1/2^n of the codes
+func unitedDictionary(segments []*Decompressor, limit int) *DictionaryBuilder {
+	scores := map[string]uint64{}
+	for _, d := range segments {
+		d.forEachPattern(func(depth uint64, pattern []byte) {
+			uses := d.wordsCount >> depth
+			if uses == 0 {
+				uses = 1
+			}
+			scores[string(pattern)] += uses * uint64(len(pattern))
+		})
+	}
+	patterns := make([]string, 0, len(scores))
+	for p := range scores {
+		patterns = append(patterns, p)
+	}
+	sort.Strings(patterns) // Map iteration order is random, and ties of scores are resolved by the order of patterns
+	db := &DictionaryBuilder{limit: limit}
+	for _, p := range patterns {
+		db.processWord([]byte(p), scores[p])
+	}
+	sort.Sort(db)
+	return db
+}
+
+// forEachPattern walks over the patterns of the file, with the depths of their Huffman codes
+func (d *Decompressor) forEachPattern(f func(depth uint64, pattern []byte)) {
+	data := d.patternsData
+	for i := 0; i < len(data); {
+		depth, n := binary.Uvarint(data[i:])
+		i += n
+		l, n := binary.Uvarint(data[i:])
+		i += n
+		if d.dictionary != nil {
+			f(depth, d.dictionary.patterns[l])
+			continue
+		}
+		f(depth, data[i:i+int(l)])
+		i += int(l)
+	}
+}
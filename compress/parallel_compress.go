@@ -239,25 +239,19 @@ func (cq *CompressionQueue) Pop() interface{} {
 }
 
 // reduceDict reduces the dictionary by trying the substitutions and counting frequency for each word
-func reducedict(ctx context.Context, trace bool, logPrefix, segmentFilePath string, datFile *DecompressedFile, workers int, dictBuilder *DictionaryBuilder, lvl log.Lvl) error {
+// If external dictionary is given in the options, dictBuilder must contain its patterns, and the segment
+// references them instead of embedding
+// reducedict compresses the words of datFile against the dictionary and writes them into the segment file.
+// With 1 worker, words are compressed one by one in the calling goroutine. With more workers, they are compressed
+// concurrently, and the queue puts them back into the order of datFile before writing, so the segment
+// is the same for any number of workers
+func reducedict(ctx context.Context, trace bool, logPrefix, segmentFilePath string, datFile *DecompressedFile, workers int, dictBuilder *DictionaryBuilder, opts segmentOptions, lvl log.Lvl) error {
 	logEvery := time.NewTicker(20 * time.Second)
 	defer logEvery.Stop()
 
 	// DictionaryBuilder is for sorting words by their freuency (to assign codes)
 	var pt patricia.PatriciaTree
-	code2pattern := make([]*Pattern, 0, 256)
-	dictBuilder.ForEach(func(score uint64, word []byte) {
-		p := &Pattern{
-			score:    score,
-			uses:     0,
-			code:     uint64(len(code2pattern)),
-			codeBits: 0,
-			word:     word,
-		}
-		pt.Insert(word, p)
-		code2pattern = append(code2pattern, p)
-	})
-	dictBuilder.Close()
+	code2pattern := codeTable(dictBuilder, &pt)
 	log.Debug(fmt.Sprintf("[%s] dictionary file parsed", logPrefix), "entries", len(code2pattern))
 	ch := make(chan *CompressionWord, 10_000)
 	inputSize, outputSize := atomic2.NewUint64(0), atomic2.NewUint64(0)
@@ -273,7 +267,7 @@ func reducedict(ctx context.Context, trace bool, logPrefix, segmentFilePath stri
 	heap.Init(&compressionQueue)
 	queueLimit := 128 * 1024
 
-	// For the case of workers == 1
+	// For the case of workers == 1, when no goroutines are started
 	var output = make([]byte, 0, 256)
 	var uncovered = make([]int, 256)
 	var patterns = make([]int, 0, 256)
@@ -312,6 +306,7 @@ func reducedict(ctx context.Context, trace bool, logPrefix, segmentFilePath stri
 		default:
 		}
 		if workers > 1 {
+			// Words are sent out with their order, and are written down strictly by the order (outCount)
 			// take processed words in non-blocking way and push them to the queue
 		outer:
 			for {
@@ -458,6 +453,35 @@ func reducedict(ctx context.Context, trace bool, logPrefix, segmentFilePath stri
 			posMap[l] += c
 		}
 	}
+	return writeSegment(logPrefix, segmentFilePath, intermediateFile, code2pattern, posMap, inCount, emptyWordsCount, opts)
+}
+
+// codeTable assigns initial codes to the patterns of the dictionary (in the order of the builder), and inserts them
+// into the patricia tree for matching. Dictionary builder is closed afterwards
+func codeTable(dictBuilder *DictionaryBuilder, pt *patricia.PatriciaTree) []*Pattern {
+	code2pattern := make([]*Pattern, 0, 256)
+	dictBuilder.ForEach(func(score uint64, word []byte) {
+		p := &Pattern{
+			score:    score,
+			uses:     0,
+			code:     uint64(len(code2pattern)),
+			codeBits: 0,
+			word:     word,
+		}
+		pt.Insert(word, p)
+		code2pattern = append(code2pattern, p)
+	})
+	dictBuilder.Close()
+	return code2pattern
+}
+
+// writeSegment builds Huffman codes for patterns and positions from their usage, and writes the segment file,
+// re-encoding words from the intermediate form (produced by optimiseCluster) read from r.
+// If external dictionary is given in the options, code2pattern must contain all its patterns, in the same order
+func writeSegment(logPrefix, segmentFilePath string, r io.Reader, code2pattern []*Pattern, posMap map[uint64]uint64, inCount, emptyWordsCount uint64, opts segmentOptions) error {
+	dict := opts.dict
+	var err error
+	var numBuf [binary.MaxVarintLen64]byte
 	//fmt.Printf("posMap = %v\n", posMap)
 	var patternList PatternList
 	for _, p := range code2pattern {
@@ -510,10 +534,23 @@ func reducedict(ctx context.Context, trace bool, logPrefix, segmentFilePath stri
 		root := heap.Pop(&codeHeap).(*PatternHuff)
 		root.SetDepth(0)
 	}
+	// Patterns of external dictionary are referenced by their index (which is their initial code)
+	var dictIdx map[*Pattern]uint64
+	if dict != nil {
+		dictIdx = make(map[*Pattern]uint64, len(code2pattern))
+		for idx, p := range code2pattern {
+			dictIdx[p] = uint64(idx)
+		}
+	}
 	// Calculate total size of the dictionary
 	var patternsSize uint64
 	for _, p := range patternList {
-		ns := binary.PutUvarint(numBuf[:], uint64(p.depth))    // Length of the word's depth
+		ns := binary.PutUvarint(numBuf[:], uint64(p.depth)) // Length of the word's depth
+		if dict != nil {
+			n := binary.PutUvarint(numBuf[:], dictIdx[p]) // Length of the pattern's index
+			patternsSize += uint64(ns + n)
+			continue
+		}
 		n := binary.PutUvarint(numBuf[:], uint64(len(p.word))) // Length of the word's length
 		patternsSize += uint64(ns + n + len(p.word))
 	}
@@ -522,13 +559,17 @@ func reducedict(ctx context.Context, trace bool, logPrefix, segmentFilePath stri
 		return err
 	}
 	cw := bufio.NewWriterSize(cf, etl.BufIOSize)
-	// 1-st, output amount of words - just a useful metadata
-	binary.BigEndian.PutUint64(numBuf[:], inCount) // Dictionary size
-	if _, err = cw.Write(numBuf[:8]); err != nil {
-		return err
+	var checksumW *checksumWriter
+	var fileW *bufio.Writer
+	if opts.checksums {
+		// Checksums are computed over everything that goes through the buffered writer
+		fileW = cw
+		checksumW = newChecksumWriter(fileW)
+		cw = bufio.NewWriterSize(checksumW, etl.BufIOSize)
 	}
-	binary.BigEndian.PutUint64(numBuf[:], emptyWordsCount)
-	if _, err = cw.Write(numBuf[:8]); err != nil {
+	// 1-st, output amount of words - just a useful metadata
+	hdr := opts.header(inCount, emptyWordsCount)
+	if err = hdr.write(cw); err != nil {
 		return err
 	}
 	// 2-nd, output dictionary size
@@ -544,6 +585,13 @@ func reducedict(ctx context.Context, trace bool, logPrefix, segmentFilePath stri
 		if _, err = cw.Write(numBuf[:ns]); err != nil {
 			return err
 		}
+		if dict != nil {
+			n := binary.PutUvarint(numBuf[:], dictIdx[p])
+			if _, err = cw.Write(numBuf[:n]); err != nil {
+				return err
+			}
+			continue
+		}
 		n := binary.PutUvarint(numBuf[:], uint64(len(p.word)))
 		if _, err = cw.Write(numBuf[:n]); err != nil {
 			return err
@@ -634,19 +682,50 @@ func reducedict(ctx context.Context, trace bool, logPrefix, segmentFilePath stri
 		//fmt.Printf("[comp] depth=%d, code=[%b], codeLen=%d pos=%d\n", p.depth, p.code, p.codeBits, p.pos)
 	}
 	log.Debug(fmt.Sprintf("[%s] Positional dictionary", logPrefix), "size", common.ByteCount(posSize))
+	if checksumW != nil {
+		if err = cw.Flush(); err != nil {
+			return err
+		}
+		checksumW.startWords()
+	}
+	var offsets *wordOffsetsWriter
+	if opts.wordOffsets {
+		if offsets, err = newWordOffsetsWriter(segmentFilePath + ".offsets.tmp"); err != nil {
+			return err
+		}
+		defer offsets.close()
+	}
+	var chunks []wordsChunk
+	var sampleOffsets []uint64
+	var wordsSize uint64
 	// Re-encode all the words with the use of optimised (via Huffman coding) dictionaries
 	wc := 0
+	// Words go through the secondary coder, if there is one, and the sections after them do not
+	ww := cw
+	var ew *entropyWriter
+	if opts.coder != nil {
+		ew = newEntropyWriter(cw, opts.coder)
+		ww = bufio.NewWriterSize(ew, etl.BufIOSize)
+	}
 	var hc HuffmanCoder
-	hc.w = cw
-	r := bufio.NewReaderSize(intermediateFile, etl.BufIOSize)
+	hc.w = ww
+	br := bufio.NewReaderSize(r, etl.BufIOSize)
 	var l uint64
 	var e error
-	for l, e = binary.ReadUvarint(r); e == nil; l, e = binary.ReadUvarint(r) {
+	for l, e = binary.ReadUvarint(br); e == nil; l, e = binary.ReadUvarint(br) {
+		if ks := opts.keySamples; ks != nil && len(sampleOffsets) < len(ks.wordNums) && ks.wordNums[len(sampleOffsets)] == uint64(wc) {
+			sampleOffsets = append(sampleOffsets, wordsSize)
+		}
+		if opts.chunkSize > 0 && (wc == 0 || wordsSize-chunks[len(chunks)-1].offset >= opts.chunkSize) {
+			chunks = append(chunks, wordsChunk{firstWord: uint64(wc), offset: wordsSize})
+		}
+		var wordBits, uncoveredCount int // To compute size of the encoded word, for the word offsets and chunks
 		posCode := pos2code[l+1]
 		if posCode != nil {
 			if e = hc.encode(posCode.code, posCode.codeBits); e != nil {
 				return e
 			}
+			wordBits += posCode.codeBits
 		}
 		if l == 0 {
 			if e = hc.flush(); e != nil {
@@ -654,16 +733,15 @@ func reducedict(ctx context.Context, trace bool, logPrefix, segmentFilePath stri
 			}
 		} else {
 			var pNum uint64 // Number of patterns
-			if pNum, e = binary.ReadUvarint(r); e != nil {
+			if pNum, e = binary.ReadUvarint(br); e != nil {
 				return e
 			}
 			// Now reading patterns one by one
 			var lastPos uint64
 			var lastUncovered int
-			var uncoveredCount int
 			for i := 0; i < int(pNum); i++ {
 				var pos uint64 // Starting position for pattern
-				if pos, e = binary.ReadUvarint(r); e != nil {
+				if pos, e = binary.ReadUvarint(br); e != nil {
 					return e
 				}
 				posCode = pos2code[pos-lastPos+1]
@@ -672,9 +750,10 @@ func reducedict(ctx context.Context, trace bool, logPrefix, segmentFilePath stri
 					if e = hc.encode(posCode.code, posCode.codeBits); e != nil {
 						return e
 					}
+					wordBits += posCode.codeBits
 				}
 				var code uint64 // Code of the pattern
-				if code, e = binary.ReadUvarint(r); e != nil {
+				if code, e = binary.ReadUvarint(br); e != nil {
 					return e
 				}
 				patternCode := code2pattern[code]
@@ -686,6 +765,7 @@ func reducedict(ctx context.Context, trace bool, logPrefix, segmentFilePath stri
 					if e = hc.encode(patternCode.code, patternCode.codeBits); e != nil {
 						return e
 					}
+					wordBits += patternCode.codeBits
 				}
 			}
 			if int(l) > lastUncovered {
@@ -696,16 +776,24 @@ func reducedict(ctx context.Context, trace bool, logPrefix, segmentFilePath stri
 			if e = hc.encode(posCode.code, posCode.codeBits); e != nil {
 				return e
 			}
+			wordBits += posCode.codeBits
 			if e = hc.flush(); e != nil {
 				return e
 			}
 			// Copy uncovered characters
 			if uncoveredCount > 0 {
-				if _, e = io.CopyN(cw, r, int64(uncoveredCount)); e != nil {
+				if _, e = io.CopyN(ww, br, int64(uncoveredCount)); e != nil {
 					return e
 				}
 			}
 		}
+		wordSize := uint64((wordBits+7)/8 + uncoveredCount)
+		if offsets != nil {
+			if e = offsets.add(wordSize); e != nil {
+				return e
+			}
+		}
+		wordsSize += wordSize
 		wc++
 		if wc%10_000_000 == 0 {
 			log.Info(fmt.Sprintf("[%s] Compressed", logPrefix), "millions", wc/1_000_000)
@@ -714,12 +802,43 @@ func reducedict(ctx context.Context, trace bool, logPrefix, segmentFilePath stri
 	if e != nil && !errors.Is(e, io.EOF) {
 		return e
 	}
-	if err = intermediateFile.Close(); err != nil {
-		return err
+	if ew != nil {
+		if err = ww.Flush(); err != nil {
+			return err
+		}
+		if err = ew.flushBlock(); err != nil {
+			return fmt.Errorf("encoding words: %w", err)
+		}
+	}
+	if opts.keySamples != nil {
+		if len(sampleOffsets) != len(opts.keySamples.keys) {
+			return fmt.Errorf("found %d of %d sampled keys", len(sampleOffsets), len(opts.keySamples.keys))
+		}
+		if err = writeKeySamples(cw, opts.keySamples, sampleOffsets); err != nil {
+			return fmt.Errorf("writing key samples: %w", err)
+		}
+	}
+	if opts.chunkSize > 0 {
+		if err = writeWordsChunks(cw, chunks); err != nil {
+			return fmt.Errorf("writing chunks: %w", err)
+		}
+	}
+	if offsets != nil {
+		if err = offsets.writeTo(cw); err != nil {
+			return fmt.Errorf("writing word offsets: %w", err)
+		}
 	}
 	if err = cw.Flush(); err != nil {
 		return err
 	}
+	if checksumW != nil {
+		if err = checksumW.writeFooter(); err != nil {
+			return err
+		}
+		if err = fileW.Flush(); err != nil {
+			return err
+		}
+	}
 	if err = cf.Close(); err != nil {
 		return err
 	}
@@ -730,171 +849,200 @@ func reducedict(ctx context.Context, trace bool, logPrefix, segmentFilePath stri
 // into the collector, using lock to mutual exclusion. At the end (when the input channel is closed),
 // it notifies the waitgroup before exiting, so that the caller known when all work is done
 // No error channels for now
-func processSuperstring(superstringCh chan []byte, dictCollector *etl.Collector, minPatternScore uint64, completion *sync.WaitGroup) {
+func processSuperstring(superstringCh chan []byte, dictCollector *etl.Collector, cfg CompressorCfg, completion *sync.WaitGroup) {
 	defer completion.Done()
-	dictVal := make([]byte, 8)
-	dictKey := make([]byte, maxPatternLen)
-	var lcp, sa, inv []int32
+	p := newSuperstringProcessor(dictCollector, cfg)
 	for superstring := range superstringCh {
-		if cap(sa) < len(superstring) {
-			sa = make([]int32, len(superstring))
-		} else {
-			sa = sa[:len(superstring)]
-		}
-		//log.Info("Superstring", "len", len(superstring))
-		//start := time.Now()
-		if err := sais.Sais(superstring, sa); err != nil {
-			panic(err)
-		}
-		//log.Info("Suffix array built", "in", time.Since(start))
-		// filter out suffixes that start with odd positions
-		n := len(sa) / 2
-		filtered := sa[:n]
-		//filtered := make([]int32, n)
-		var j int
-		for i := 0; i < len(sa); i++ {
-			if sa[i]&1 == 0 {
-				filtered[j] = sa[i] >> 1
-				j++
-			}
-		}
-		// Now create an inverted array
-		if cap(inv) < n {
-			inv = make([]int32, n)
-		} else {
-			inv = inv[:n]
+		p.process(superstring)
+	}
+}
+
+// superstringProcessor finds patterns in superstrings and puts their scores into the collector.
+// Buffers are reused from one superstring to the next, so processor must not be shared between goroutines
+type superstringProcessor struct {
+	cfg           CompressorCfg
+	dictCollector *etl.Collector
+	dictKey       []byte
+	dictVal       []byte
+	lcp, sa, inv  []int32
+}
+
+func newSuperstringProcessor(dictCollector *etl.Collector, cfg CompressorCfg) *superstringProcessor {
+	return &superstringProcessor{
+		cfg:           cfg,
+		dictCollector: dictCollector,
+		dictKey:       make([]byte, cfg.MaxPatternLen),
+		dictVal:       make([]byte, 8),
+	}
+}
+
+func (p *superstringProcessor) process(superstring []byte) {
+	minPatternScore, minPatternLen, maxPatternLen := p.cfg.MinPatternScore, p.cfg.MinPatternLen, p.cfg.MaxPatternLen
+	dictCollector, dictKey, dictVal := p.dictCollector, p.dictKey, p.dictVal
+	lcp, sa, inv := p.lcp, p.sa, p.inv
+	defer func() { p.lcp, p.sa, p.inv = lcp, sa, inv }()
+	if cap(sa) < len(superstring) {
+		sa = make([]int32, len(superstring))
+	} else {
+		sa = sa[:len(superstring)]
+	}
+	//log.Info("Superstring", "len", len(superstring))
+	//start := time.Now()
+	if err := sais.Sais(superstring, sa); err != nil {
+		panic(err)
+	}
+	//log.Info("Suffix array built", "in", time.Since(start))
+	// filter out suffixes that start with odd positions
+	n := len(sa) / 2
+	filtered := sa[:n]
+	//filtered := make([]int32, n)
+	var j int
+	for i := 0; i < len(sa); i++ {
+		if sa[i]&1 == 0 {
+			filtered[j] = sa[i] >> 1
+			j++
 		}
-		for i := 0; i < n; i++ {
-			inv[filtered[i]] = int32(i)
+	}
+	// Now create an inverted array
+	if cap(inv) < n {
+		inv = make([]int32, n)
+	} else {
+		inv = inv[:n]
+	}
+	for i := 0; i < n; i++ {
+		inv[filtered[i]] = int32(i)
+	}
+	//log.Info("Inverted array done")
+	var k int
+	// Process all suffixes one by one starting from
+	// first suffix in txt[]
+	if cap(lcp) < n {
+		lcp = make([]int32, n)
+	} else {
+		lcp = lcp[:n]
+	}
+	for i := 0; i < n; i++ {
+		/* If the current suffix is at n-1, then we don’t
+		   have next substring to consider. So lcp is not
+		   defined for this substring, we put zero. */
+		if inv[i] == int32(n-1) {
+			k = 0
+			continue
 		}
-		//log.Info("Inverted array done")
-		var k int
-		// Process all suffixes one by one starting from
-		// first suffix in txt[]
-		if cap(lcp) < n {
-			lcp = make([]int32, n)
-		} else {
-			lcp = lcp[:n]
-		}
-		for i := 0; i < n; i++ {
-			/* If the current suffix is at n-1, then we don’t
-			   have next substring to consider. So lcp is not
-			   defined for this substring, we put zero. */
-			if inv[i] == int32(n-1) {
-				k = 0
-				continue
-			}
 
-			/* j contains index of the next substring to
-			   be considered  to compare with the present
-			   substring, i.e., next string in suffix array */
-			j := int(filtered[inv[i]+1])
+		/* j contains index of the next substring to
+		   be considered  to compare with the present
+		   substring, i.e., next string in suffix array */
+		j := int(filtered[inv[i]+1])
 
-			// Directly start matching from k'th index as
-			// at-least k-1 characters will match
-			for i+k < n && j+k < n && superstring[(i+k)*2] != 0 && superstring[(j+k)*2] != 0 && superstring[(i+k)*2+1] == superstring[(j+k)*2+1] {
-				k++
-			}
-			lcp[inv[i]] = int32(k) // lcp for the present suffix.
+		// Directly start matching from k'th index as
+		// at-least k-1 characters will match
+		for i+k < n && j+k < n && superstring[(i+k)*2] != 0 && superstring[(j+k)*2] != 0 && superstring[(i+k)*2+1] == superstring[(j+k)*2+1] {
+			k++
+		}
+		lcp[inv[i]] = int32(k) // lcp for the present suffix.
 
-			// Deleting the starting character from the string.
-			if k > 0 {
-				k--
-			}
+		// Deleting the starting character from the string.
+		if k > 0 {
+			k--
 		}
-		//log.Info("Kasai algorithm finished")
-		// Checking LCP array
+	}
+	//log.Info("Kasai algorithm finished")
+	// Checking LCP array
 
-		if ASSERT {
-			for i := 0; i < n-1; i++ {
-				var prefixLen int
-				p1 := int(filtered[i])
-				p2 := int(filtered[i+1])
-				for p1+prefixLen < n &&
-					p2+prefixLen < n &&
-					superstring[(p1+prefixLen)*2] != 0 &&
-					superstring[(p2+prefixLen)*2] != 0 &&
-					superstring[(p1+prefixLen)*2+1] == superstring[(p2+prefixLen)*2+1] {
-					prefixLen++
-				}
-				if prefixLen != int(lcp[i]) {
-					log.Error("Mismatch", "prefixLen", prefixLen, "lcp[i]", lcp[i], "i", i)
-					break
-				}
-				l := int(lcp[i]) // Length of potential dictionary word
-				if l < 2 {
-					continue
-				}
+	if ASSERT {
+		for i := 0; i < n-1; i++ {
+			var prefixLen int
+			p1 := int(filtered[i])
+			p2 := int(filtered[i+1])
+			for p1+prefixLen < n &&
+				p2+prefixLen < n &&
+				superstring[(p1+prefixLen)*2] != 0 &&
+				superstring[(p2+prefixLen)*2] != 0 &&
+				superstring[(p1+prefixLen)*2+1] == superstring[(p2+prefixLen)*2+1] {
+				prefixLen++
+			}
+			if prefixLen != int(lcp[i]) {
+				log.Error("Mismatch", "prefixLen", prefixLen, "lcp[i]", lcp[i], "i", i)
+				break
+			}
+			l := int(lcp[i]) // Length of potential dictionary word
+			if l < 2 {
+				continue
 			}
 		}
-		//log.Info("LCP array checked")
-		// Walk over LCP array and compute the scores of the strings
-		var b = inv
-		j = 0
-		for i := 0; i < n-1; i++ {
-			// Only when there is a drop in LCP value
-			if lcp[i+1] >= lcp[i] {
-				j = i
+	}
+	//log.Info("LCP array checked")
+	// Walk over LCP array and compute the scores of the strings
+	var b = inv
+	j = 0
+	for i := 0; i < n-1; i++ {
+		// Only when there is a drop in LCP value
+		if lcp[i+1] >= lcp[i] {
+			j = i
+			continue
+		}
+		prevSkipped := false
+		for l := int(lcp[i]); l > int(lcp[i+1]) && l >= minPatternLen; l-- {
+			if l > maxPatternLen ||
+				l > 20 && (l&(l-1)) != 0 { // is power of 2
+				prevSkipped = true
 				continue
 			}
-			prevSkipped := false
-			for l := int(lcp[i]); l > int(lcp[i+1]) && l >= minPatternLen; l-- {
-				if l > maxPatternLen ||
-					l > 20 && (l&(l-1)) != 0 { // is power of 2
-					prevSkipped = true
-					continue
-				}
 
-				// Go back
-				var isNew bool
-				for j > 0 && int(lcp[j-1]) >= l {
-					j--
-					isNew = true
-				}
+			// Go back
+			var isNew bool
+			for j > 0 && int(lcp[j-1]) >= l {
+				j--
+				isNew = true
+			}
 
-				if !isNew && !prevSkipped {
-					break
-				}
+			if !isNew && !prevSkipped {
+				break
+			}
 
-				window := i - j + 2
-				copy(b, filtered[j:i+2])
-				slices.Sort(b[:window])
-				repeats := 1
-				lastK := 0
-				for k := 1; k < window; k++ {
-					if b[k] >= b[lastK]+int32(l) {
-						repeats++
-						lastK = k
-					}
+			window := i - j + 2
+			copy(b, filtered[j:i+2])
+			slices.Sort(b[:window])
+			repeats := 1
+			lastK := 0
+			for k := 1; k < window; k++ {
+				if b[k] >= b[lastK]+int32(l) {
+					repeats++
+					lastK = k
 				}
+			}
 
-				if (l < 8 || l > 64) && repeats < int(minPatternScore) {
-					prevSkipped = true
-					continue
-				}
+			if (l < 8 || l > 64) && repeats < int(minPatternScore) {
+				prevSkipped = true
+				continue
+			}
 
-				score := uint64(repeats * (l))
-				if score < minPatternScore {
-					prevSkipped = true
-					continue
-				}
+			score := uint64(repeats * (l))
+			if score < minPatternScore {
+				prevSkipped = true
+				continue
+			}
 
-				dictKey = dictKey[:l]
-				for s := 0; s < l; s++ {
-					dictKey[s] = superstring[(int(filtered[i])+s)*2+1]
-				}
-				binary.BigEndian.PutUint64(dictVal, score)
-				if err := dictCollector.Collect(dictKey, dictVal); err != nil {
-					log.Error("processSuperstring", "collect", err)
-				}
-				prevSkipped = false //nolint
-				break
+			dictKey = dictKey[:l]
+			for s := 0; s < l; s++ {
+				dictKey[s] = superstring[(int(filtered[i])+s)*2+1]
 			}
+			binary.BigEndian.PutUint64(dictVal, score)
+			if err := dictCollector.Collect(dictKey, dictVal); err != nil {
+				log.Error("processSuperstring", "collect", err)
+			}
+			prevSkipped = false //nolint
+			break
 		}
 	}
 }
 
 func DictionaryBuilderFromCollectors(ctx context.Context, logPrefix, tmpDir string, collectors []*etl.Collector) (*DictionaryBuilder, error) {
+	return dictionaryBuilderFromCollectors(ctx, logPrefix, tmpDir, collectors, maxDictPatterns)
+}
+
+func dictionaryBuilderFromCollectors(ctx context.Context, logPrefix, tmpDir string, collectors []*etl.Collector, maxDictPatterns int) (*DictionaryBuilder, error) {
 	dictCollector := etl.NewCollector(logPrefix, tmpDir, etl.NewSortableBuffer(etl.BufferOptimalSize/2))
 	defer dictCollector.Close()
 	dictAggregator := &DictAggregator{collector: dictCollector, dist: map[int]int{}}
@@ -907,7 +1055,7 @@ func DictionaryBuilderFromCollectors(ctx context.Context, logPrefix, tmpDir stri
 	if err := dictAggregator.finish(); err != nil {
 		return nil, err
 	}
-	db := &DictionaryBuilder{limit: maxDictPatterns} // Only collect 1m words with highest scores
+	db := &DictionaryBuilder{limit: maxDictPatterns} // Only collect maxDictPatterns words with highest scores
 	if err := dictCollector.Load(nil, "", db.loadFunc, etl.TransformArgs{Quit: ctx.Done()}); err != nil {
 		return nil, err
 	}
@@ -0,0 +1,112 @@
+/*
+   Copyright 2022 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package compress
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// WordRange is a part of the words of the file, which can be decompressed independently of other parts
+type WordRange struct {
+	FirstWord  uint64  // Number of the first word of the range
+	WordsCount uint64  // Number of words in the range
+	Getter     *Getter // Positioned at the first word of the range. HasNext returns false after the last word of the range
+}
+
+// SplitWords splits the words into at most n consecutive ranges of roughly equal size, at the boundaries of chunks
+// recorded by the compressor (see Compressor.SetChunkSize). Files without chunks are not split.
+// Offsets returned by getters are the same as offsets returned by getters made by MakeGetter
+func (d *Decompressor) SplitWords(n int) []WordRange {
+	size := d.wordsSize()
+	// Choose the first chunk at or after each of the n-1 split points
+	starts := []wordsChunk{{}}
+	for k, i := 1, 0; k < n && i < len(d.chunks); k++ {
+		target := uint64(k) * size / uint64(n)
+		for i < len(d.chunks) && (d.chunks[i].offset < target || d.chunks[i].offset <= starts[len(starts)-1].offset) {
+			i++
+		}
+		if i < len(d.chunks) {
+			starts = append(starts, d.chunks[i])
+		}
+	}
+	ranges := make([]WordRange, len(starts))
+	for i, start := range starts {
+		end, endWord := size, d.wordsCount
+		if i+1 < len(starts) {
+			end, endWord = starts[i+1].offset, starts[i+1].firstWord
+		}
+		g := d.MakeGetter()
+		g.end = end
+		g.Reset(start.offset)
+		ranges[i] = WordRange{FirstWord: start.firstWord, WordsCount: endWord - start.firstWord, Getter: g}
+	}
+	return ranges
+}
+
+// ForEachParallel decompresses all the words, using up to `workers` goroutines, and calls f for every word
+// with its number and offset. Calls are made concurrently from different goroutines, but the words of each range
+// (see SplitWords) come in order, one after another. Word is only valid until f returns.
+// Iteration stops at the first error, which is returned
+func (d *Decompressor) ForEachParallel(ctx context.Context, workers int, f func(wordNum uint64, word []byte, offset uint64) error) error {
+	if workers < 1 {
+		workers = 1
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var firstErr error
+	var errOnce sync.Once
+	var wg sync.WaitGroup
+	for _, r := range d.SplitWords(workers) {
+		wg.Add(1)
+		go func(r WordRange) {
+			defer wg.Done()
+			if err := r.forEach(ctx, f); err != nil {
+				errOnce.Do(func() { firstErr = err })
+				cancel()
+			}
+		}(r)
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return firstErr
+	}
+	return ctx.Err()
+}
+
+func (r WordRange) forEach(ctx context.Context, f func(wordNum uint64, word []byte, offset uint64) error) error {
+	var word []byte
+	for i, g := r.FirstWord, r.Getter; g.HasNext(); i++ {
+		if i%1024 == 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			default:
+			}
+		}
+		if i >= r.FirstWord+r.WordsCount {
+			return fmt.Errorf("range starting at word %d of file %s has more than %d words", r.FirstWord, g.fName, r.WordsCount)
+		}
+		offset := g.base + g.dataP
+		word, _ = g.Next(word[:0])
+		if err := f(i, word, offset); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,219 @@
+/*
+   Copyright 2022 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package compress
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/ledgerwatch/erigon-lib/common"
+)
+
+// DictionaryReport describes patterns of the dictionary before compression, as selected by their scores
+type DictionaryReport struct {
+	Patterns     int
+	PatternBytes uint64      // Total length of all the patterns
+	Lengths      map[int]int // Number of patterns of each length
+	TopPatterns  []PatternStats
+}
+
+// PatternStats describes one pattern. Before compression, only the score is known,
+// and the rest is filled in by the report of compressed file
+type PatternStats struct {
+	Pattern    []byte
+	Score      uint64
+	Uses       uint64
+	CodeBits   int   // Length of the Huffman code of the pattern
+	BytesSaved int64 // Bytes of the words covered by the pattern, minus the bytes taken by its codes (positions are not counted)
+}
+
+func dictionaryReport(topN int, forEach func(f func(score uint64, word []byte))) DictionaryReport {
+	r := DictionaryReport{Lengths: map[int]int{}}
+	var all []PatternStats
+	forEach(func(score uint64, word []byte) {
+		r.Patterns++
+		r.PatternBytes += uint64(len(word))
+		r.Lengths[len(word)]++
+		all = append(all, PatternStats{Pattern: word, Score: score})
+	})
+	sort.SliceStable(all, func(i, j int) bool { return all[i].Score > all[j].Score })
+	if len(all) > topN {
+		all = all[:topN]
+	}
+	r.TopPatterns = all
+	return r
+}
+
+// Report describes patterns of the dictionary, with topN patterns of the highest scores
+func (db *DictionaryBuilder) Report(topN int) DictionaryReport {
+	return dictionaryReport(topN, db.ForEach)
+}
+
+// Report describes patterns of the dictionary, with topN patterns of the highest scores
+func (d *Dictionary) Report(topN int) DictionaryReport {
+	return dictionaryReport(topN, d.ForEach)
+}
+
+// CompressionReport describes how well the words of the compressed file are covered by the patterns,
+// to help choosing settings of the compressor (see CompressorCfg) for the given type of data
+type CompressionReport struct {
+	FileSize          int64
+	Words             uint64
+	EmptyWords        uint64
+	UncompressedWords uint64 // Non-empty words not covered by any pattern
+	WordsBytes        uint64 // Total length of all the words
+	UncoveredBytes    uint64 // Bytes of the words not covered by any pattern, and stored as they are
+	Patterns          int    // Number of patterns in the dictionary of the file (only used patterns are kept there)
+	PatternCodeLens   map[int]int
+	PositionCodeLens  map[int]int
+	TopPatterns       []PatternStats // Patterns with the most uses
+}
+
+// UncompressedShare is the share of non-empty words which are not covered by any pattern
+func (r *CompressionReport) UncompressedShare() float64 {
+	if r.Words == r.EmptyWords {
+		return 0
+	}
+	return float64(r.UncompressedWords) / float64(r.Words-r.EmptyWords)
+}
+
+func (r *CompressionReport) String() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "file size %s, words %d (empty %d, uncompressed %d, %.2f%%), words size %s, uncovered %s\n",
+		common.ByteCount(uint64(r.FileSize)), r.Words, r.EmptyWords, r.UncompressedWords, 100*r.UncompressedShare(),
+		common.ByteCount(r.WordsBytes), common.ByteCount(r.UncoveredBytes))
+	fmt.Fprintf(&sb, "patterns %d, code lengths %s\n", r.Patterns, histogramString(r.PatternCodeLens))
+	fmt.Fprintf(&sb, "position code lengths %s\n", histogramString(r.PositionCodeLens))
+	for _, p := range r.TopPatterns {
+		fmt.Fprintf(&sb, "uses %d, code bits %d, saved %d bytes: [%x]\n", p.Uses, p.CodeBits, p.BytesSaved, p.Pattern)
+	}
+	return sb.String()
+}
+
+func histogramString(h map[int]int) string {
+	keys := make([]int, 0, len(h))
+	for k := range h {
+		keys = append(keys, k)
+	}
+	sort.Ints(keys)
+	parts := make([]string, len(keys))
+	for i, k := range keys {
+		parts[i] = fmt.Sprintf("%d:%d", k, h[k])
+	}
+	return strings.Join(parts, " ")
+}
+
+// Report decodes all the words of the file, and collects statistics of the use of patterns and positions,
+// with topN most used patterns
+func (d *Decompressor) Report(topN int) (r *CompressionReport, err error) {
+	defer func() {
+		if rec := recover(); rec != nil {
+			err = fmt.Errorf("reporting file: %s, decoding failed: %+v", d.compressedFile, rec)
+		}
+	}()
+	r = &CompressionReport{
+		FileSize:         d.size,
+		PatternCodeLens:  map[int]int{},
+		PositionCodeLens: map[int]int{},
+	}
+	patterns := map[string]*PatternStats{}
+	positionBits := map[uint64]int{}
+	g := d.MakeGetter()
+	// Number of bits consumed by decoding of a code is the difference of bit positions
+	bitPos := func() uint64 { return g.dataP*8 + uint64(g.dataBit) }
+	for g.HasNext() {
+		if g.blocks != nil {
+			g.window()
+		}
+		r.Words++
+		start := bitPos()
+		l := g.nextPos(false) // Words always start at byte boundary
+		positionBits[l] = int(bitPos() - start)
+		wordLen := l - 1
+		if wordLen == 0 {
+			r.EmptyWords++
+			if g.dataBit > 0 {
+				g.dataP++
+				g.dataBit = 0
+			}
+			continue
+		}
+		r.WordsBytes += wordLen
+		var bufPos, lastUncovered, patternsCount int
+		var uncovered uint64
+		for {
+			start = bitPos()
+			pos := g.nextPos(false)
+			positionBits[pos] = int(bitPos() - start)
+			if pos == 0 {
+				break
+			}
+			bufPos += int(pos) - 1
+			start = bitPos()
+			pattern := g.nextPattern()
+			codeBits := int(bitPos() - start)
+			patternsCount++
+			p, ok := patterns[string(pattern)]
+			if !ok {
+				p = &PatternStats{Pattern: pattern, CodeBits: codeBits}
+				patterns[string(pattern)] = p
+			}
+			p.Uses++
+			if bufPos > lastUncovered {
+				uncovered += uint64(bufPos - lastUncovered)
+			}
+			lastUncovered = bufPos + len(pattern)
+		}
+		if g.dataBit > 0 {
+			g.dataP++
+			g.dataBit = 0
+		}
+		if int(wordLen) > lastUncovered {
+			uncovered += wordLen - uint64(lastUncovered)
+		}
+		if patternsCount == 0 {
+			r.UncompressedWords++
+		}
+		r.UncoveredBytes += uncovered
+		g.dataP += uncovered
+	}
+	if r.Words != d.wordsCount {
+		return nil, fmt.Errorf("reporting file: %s, expected %d words, found %d", d.compressedFile, d.wordsCount, r.Words)
+	}
+	for _, bits := range positionBits {
+		r.PositionCodeLens[bits]++
+	}
+	all := make([]PatternStats, 0, len(patterns))
+	for _, p := range patterns {
+		r.PatternCodeLens[p.CodeBits]++
+		p.BytesSaved = int64(p.Uses)*int64(len(p.Pattern)) - int64(p.Uses)*int64(p.CodeBits)/8
+		all = append(all, *p)
+	}
+	r.Patterns = len(all)
+	sort.Slice(all, func(i, j int) bool {
+		if all[i].Uses != all[j].Uses {
+			return all[i].Uses > all[j].Uses
+		}
+		return string(all[i].Pattern) < string(all[j].Pattern)
+	})
+	if len(all) > topN {
+		all = all[:topN]
+	}
+	r.TopPatterns = all
+	return r, nil
+}
@@ -0,0 +1,400 @@
+/*
+   Copyright 2022 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package compress
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+
+	"github.com/ledgerwatch/erigon-lib/etl"
+	"github.com/ledgerwatch/erigon-lib/patricia"
+	"github.com/ledgerwatch/log/v3"
+)
+
+// Stream file keeps words of the StreamCompressor, already matched against the dictionary, until it is sealed:
+//
+//	magic (4 bytes) | version (1 byte) | dictionary hash (32 bytes)
+//	chunks, each is: payload size (4 bytes) | words count (4 bytes) | empty words count (4 bytes) |
+//	checksum of the payload (4 bytes) | payload
+//
+// Payload is the words in the intermediate form produced by optimiseCluster. Chunk that is not complete,
+// or doesn't match its checksum, is the result of interrupted write, and is discarded with everything after it
+const (
+	streamMagic        = "\xffSTR"
+	streamVersion1     = 1
+	streamHeaderSize   = 4 + 1 + 32
+	streamChunkHdrSize = 4 + 4 + 4 + 4
+)
+
+type streamChunk struct {
+	offset          int64 // Offset of the payload in the stream file
+	size            int64
+	wordsCount      uint64
+	emptyWordsCount uint64
+}
+
+// StreamCompressor compresses words as they arrive, against frozen external dictionary, so that segment can be
+// produced incrementally (for example, as blocks are finalised). Words are compressed in chunks of fixed number
+// of words, and every chunk is appended to the stream file (output file with ".stream" extension) and synced
+// to disk. Stream compressor opened for the same output file continues after the last durable chunk.
+// Seal turns the stream into regular segment, readable by Decompressor.
+// StreamCompressor is not thread-safe
+type StreamCompressor struct {
+	ctx        context.Context
+	logPrefix  string
+	outputFile string
+	streamPath string
+	dict       *Dictionary
+	opts       segmentOptions
+	chunkWords int
+	lvl        log.Lvl
+
+	f      *os.File
+	w      *bufio.Writer
+	chunks []streamChunk // Durable chunks
+	end    int64         // Offset of the end of the last durable chunk
+
+	code2pattern []*Pattern
+	mf2          *patricia.MatchFinder2
+	cellRing     *Ring
+	output       []byte
+	uncovered    []int
+	patterns     []int
+	posMap       map[uint64]uint64 // Not used, usage is counted from the stream file when sealing
+
+	chunk                                 []byte // Words of the current chunk, which is not durable yet
+	chunkWordsCount, chunkEmptyWordsCount uint64
+	wordsCount                            uint64
+}
+
+// OpenStreamCompressor starts new stream for the output file, or continues existing one. Dictionary must be saved,
+// and must be the same as the one the existing stream was started with
+func OpenStreamCompressor(ctx context.Context, logPrefix, outputFile string, dict *Dictionary, chunkWords int, lvl log.Lvl) (*StreamCompressor, error) {
+	if dict.filePath == "" {
+		return nil, fmt.Errorf("dictionary needs to be saved before compressing against it")
+	}
+	if chunkWords < 1 {
+		return nil, fmt.Errorf("chunk needs at least one word, got %d", chunkWords)
+	}
+	c := &StreamCompressor{
+		ctx:        ctx,
+		logPrefix:  logPrefix,
+		outputFile: outputFile,
+		streamPath: outputFile + ".stream",
+		dict:       dict,
+		opts:       segmentOptions{dict: dict},
+		chunkWords: chunkWords,
+		lvl:        lvl,
+		cellRing:   NewRing(),
+		output:     make([]byte, 0, 256),
+		uncovered:  make([]int, 256),
+		patterns:   make([]int, 0, 256),
+		posMap:     make(map[uint64]uint64),
+	}
+	var pt patricia.PatriciaTree
+	for i, word := range dict.patterns {
+		p := &Pattern{score: dict.scores[i], code: uint64(i), word: word}
+		pt.Insert(word, p)
+		c.code2pattern = append(c.code2pattern, p)
+	}
+	c.mf2 = patricia.NewMatchFinder2(&pt)
+	if err := c.open(); err != nil {
+		if c.f != nil {
+			c.f.Close()
+		}
+		return nil, fmt.Errorf("opening stream %s: %w", c.streamPath, err)
+	}
+	return c, nil
+}
+
+// open creates the stream file, or recovers durable chunks of the existing one
+func (c *StreamCompressor) open() error {
+	var err error
+	if c.f, err = os.OpenFile(c.streamPath, os.O_RDWR|os.O_CREATE, 0644); err != nil {
+		return err
+	}
+	stat, err := c.f.Stat()
+	if err != nil {
+		return err
+	}
+	if stat.Size() < streamHeaderSize {
+		// New stream, or the header itself was not written completely
+		var hdr [streamHeaderSize]byte
+		copy(hdr[:], streamMagic)
+		hdr[4] = streamVersion1
+		copy(hdr[5:], c.dict.hash[:])
+		if _, err = c.f.WriteAt(hdr[:], 0); err != nil {
+			return err
+		}
+		c.end = streamHeaderSize
+	} else if err = c.recover(stat.Size()); err != nil {
+		return err
+	}
+	// Discard incomplete chunk, if any
+	if err = c.f.Truncate(c.end); err != nil {
+		return err
+	}
+	if err = c.f.Sync(); err != nil {
+		return err
+	}
+	if _, err = c.f.Seek(c.end, io.SeekStart); err != nil {
+		return err
+	}
+	c.w = bufio.NewWriterSize(c.f, etl.BufIOSize)
+	return nil
+}
+
+func (c *StreamCompressor) recover(size int64) error {
+	var hdr [streamHeaderSize]byte
+	if _, err := c.f.ReadAt(hdr[:], 0); err != nil {
+		return err
+	}
+	if string(hdr[:4]) != streamMagic {
+		return fmt.Errorf("not a stream file")
+	}
+	if hdr[4] != streamVersion1 {
+		return fmt.Errorf("unsupported stream version: %d", hdr[4])
+	}
+	if string(hdr[5:]) != string(c.dict.hash[:]) {
+		return fmt.Errorf("stream was started with another dictionary: %x", hdr[5:])
+	}
+	c.end = streamHeaderSize
+	var chunkHdr [streamChunkHdrSize]byte
+	var payload []byte
+	for c.end+streamChunkHdrSize <= size {
+		if _, err := c.f.ReadAt(chunkHdr[:], c.end); err != nil {
+			return err
+		}
+		ch := streamChunk{
+			offset:          c.end + streamChunkHdrSize,
+			size:            int64(binary.BigEndian.Uint32(chunkHdr[:])),
+			wordsCount:      uint64(binary.BigEndian.Uint32(chunkHdr[4:])),
+			emptyWordsCount: uint64(binary.BigEndian.Uint32(chunkHdr[8:])),
+		}
+		if ch.offset+ch.size > size {
+			break
+		}
+		if cap(payload) < int(ch.size) {
+			payload = make([]byte, ch.size)
+		}
+		payload = payload[:ch.size]
+		if _, err := c.f.ReadAt(payload, ch.offset); err != nil {
+			return err
+		}
+		if crc32.Checksum(payload, crcTable) != binary.BigEndian.Uint32(chunkHdr[12:]) {
+			break
+		}
+		c.chunks = append(c.chunks, ch)
+		c.wordsCount += ch.wordsCount
+		c.end = ch.offset + ch.size
+	}
+	if c.end < size {
+		log.Warn(fmt.Sprintf("[%s] Discarding incomplete chunk of the stream", c.logPrefix), "file", c.streamPath, "bytes", size-c.end)
+	}
+	return nil
+}
+
+// SetChecksums makes sealed segment have checksums, see Compressor.SetChecksums
+func (c *StreamCompressor) SetChecksums(checksums bool) { c.opts.checksums = checksums }
+
+// SetWordOffsets makes sealed segment have word offsets, see Compressor.SetWordOffsets
+func (c *StreamCompressor) SetWordOffsets(wordOffsets bool) { c.opts.wordOffsets = wordOffsets }
+
+// SetChunkSize makes sealed segment have chunks for parallel decompression, see Compressor.SetChunkSize
+func (c *StreamCompressor) SetChunkSize(size uint64) { c.opts.chunkSize = size }
+
+// Count returns number of words added, including the ones which are not durable yet
+func (c *StreamCompressor) Count() int { return int(c.wordsCount) }
+
+// DurableCount returns number of words in the chunks synced to disk, which survive a restart
+func (c *StreamCompressor) DurableCount() int { return int(c.wordsCount - c.chunkWordsCount) }
+
+func (c *StreamCompressor) AddWord(word []byte) error {
+	return c.addWord(word, true)
+}
+
+func (c *StreamCompressor) AddUncompressedWord(word []byte) error {
+	return c.addWord(word, false)
+}
+
+func (c *StreamCompressor) addWord(word []byte, compression bool) error {
+	var numBuf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(numBuf[:], uint64(len(word)))
+	c.chunk = append(c.chunk, numBuf[:n]...)
+	if len(word) == 0 {
+		c.chunkEmptyWordsCount++
+	} else if compression {
+		c.output, c.patterns, c.uncovered = optimiseCluster(false, word, c.mf2, c.output[:0], c.uncovered, c.patterns, c.cellRing, c.posMap)
+		c.chunk = append(c.chunk, c.output...)
+	} else {
+		c.chunk = append(c.chunk, 0)
+		c.chunk = append(c.chunk, word...)
+	}
+	c.chunkWordsCount++
+	c.wordsCount++
+	if c.chunkWordsCount >= uint64(c.chunkWords) {
+		return c.Flush()
+	}
+	return nil
+}
+
+// Flush appends the current chunk (even if it is not full) to the stream file and syncs it to disk
+func (c *StreamCompressor) Flush() error {
+	if c.chunkWordsCount == 0 {
+		return nil
+	}
+	var chunkHdr [streamChunkHdrSize]byte
+	binary.BigEndian.PutUint32(chunkHdr[:], uint32(len(c.chunk)))
+	binary.BigEndian.PutUint32(chunkHdr[4:], uint32(c.chunkWordsCount))
+	binary.BigEndian.PutUint32(chunkHdr[8:], uint32(c.chunkEmptyWordsCount))
+	binary.BigEndian.PutUint32(chunkHdr[12:], crc32.Checksum(c.chunk, crcTable))
+	if _, err := c.w.Write(chunkHdr[:]); err != nil {
+		return err
+	}
+	if _, err := c.w.Write(c.chunk); err != nil {
+		return err
+	}
+	if err := c.w.Flush(); err != nil {
+		return err
+	}
+	if err := c.f.Sync(); err != nil {
+		return err
+	}
+	c.chunks = append(c.chunks, streamChunk{
+		offset:          c.end + streamChunkHdrSize,
+		size:            int64(len(c.chunk)),
+		wordsCount:      c.chunkWordsCount,
+		emptyWordsCount: c.chunkEmptyWordsCount,
+	})
+	c.end += streamChunkHdrSize + int64(len(c.chunk))
+	c.chunk = c.chunk[:0]
+	c.chunkWordsCount, c.chunkEmptyWordsCount = 0, 0
+	return nil
+}
+
+// Seal flushes the last chunk and writes all the words of the stream into the output file, which then can be
+// opened by Decompressor. Codes of patterns and positions are built from their usage in the whole stream.
+// After successful sealing, the stream file is removed
+func (c *StreamCompressor) Seal() error {
+	if err := c.Flush(); err != nil {
+		return err
+	}
+	var wordsCount, emptyWordsCount uint64
+	readers := make([]io.Reader, 0, len(c.chunks))
+	for _, ch := range c.chunks {
+		wordsCount += ch.wordsCount
+		emptyWordsCount += ch.emptyWordsCount
+		readers = append(readers, io.NewSectionReader(c.f, ch.offset, ch.size))
+	}
+	for _, p := range c.code2pattern {
+		p.uses = 0
+	}
+	posMap := make(map[uint64]uint64)
+	if err := countUses(c.ctx, bufio.NewReaderSize(io.MultiReader(readers...), etl.BufIOSize), c.code2pattern, posMap); err != nil {
+		return fmt.Errorf("counting usage in stream %s: %w", c.streamPath, err)
+	}
+	for i := range readers {
+		readers[i] = io.NewSectionReader(c.f, c.chunks[i].offset, c.chunks[i].size)
+	}
+	tmpOutFilePath := c.outputFile + ".tmp"
+	defer os.Remove(tmpOutFilePath)
+	if err := writeSegment(c.logPrefix, tmpOutFilePath, io.MultiReader(readers...), c.code2pattern, posMap, wordsCount, emptyWordsCount, c.opts); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpOutFilePath, c.outputFile); err != nil {
+		return fmt.Errorf("renaming: %w", err)
+	}
+	log.Log(c.lvl, fmt.Sprintf("[%s] Stream sealed", c.logPrefix), "file", c.outputFile, "words", wordsCount, "chunks", len(c.chunks))
+	if err := c.f.Close(); err != nil {
+		return err
+	}
+	c.f = nil
+	return os.Remove(c.streamPath)
+}
+
+// Close releases the stream file. Words which are not flushed are lost, durable chunks stay in the stream file
+func (c *StreamCompressor) Close() {
+	if c.f != nil {
+		c.f.Close()
+		c.f = nil
+	}
+}
+
+// countUses reads words in the intermediate form (produced by optimiseCluster), and counts uses of patterns
+// and positions, the same way they are counted while the words are being matched against the dictionary
+func countUses(ctx context.Context, r *bufio.Reader, code2pattern []*Pattern, posMap map[uint64]uint64) error {
+	for wc := 0; ; wc++ {
+		if wc%1_000_000 == 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			default:
+			}
+		}
+		l, err := binary.ReadUvarint(r)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		posMap[l+1]++
+		posMap[0]++
+		if l == 0 {
+			continue
+		}
+		pNum, err := binary.ReadUvarint(r)
+		if err != nil {
+			return err
+		}
+		var lastPos uint64
+		var lastUncovered, uncoveredCount int
+		for i := uint64(0); i < pNum; i++ {
+			pos, err := binary.ReadUvarint(r)
+			if err != nil {
+				return err
+			}
+			code, err := binary.ReadUvarint(r)
+			if err != nil {
+				return err
+			}
+			if code >= uint64(len(code2pattern)) {
+				return fmt.Errorf("pattern code %d is out of range of %d patterns", code, len(code2pattern))
+			}
+			posMap[pos-lastPos+1]++
+			lastPos = pos
+			p := code2pattern[code]
+			p.uses++
+			if int(pos) > lastUncovered {
+				uncoveredCount += int(pos) - lastUncovered
+			}
+			lastUncovered = int(pos) + len(p.word)
+		}
+		if int(l) > lastUncovered {
+			uncoveredCount += int(l) - lastUncovered
+		}
+		if _, err = r.Discard(uncoveredCount); err != nil {
+			return err
+		}
+	}
+}
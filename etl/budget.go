@@ -0,0 +1,87 @@
+/*
+   Copyright 2022 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package etl
+
+import (
+	"sync/atomic"
+
+	"github.com/c2h5oh/datasize"
+)
+
+// minFlushDivisor limits how early collector is forced to flush when budget is exhausted:
+// buffers smaller than 1/minFlushDivisor of the collector's share are never flushed,
+// to avoid producing many tiny files
+const minFlushDivisor = 8
+
+// MemoryBudget is shared by collectors running concurrently (for example, collectors of
+// one compressor or of one RecSplit), so that total size of their buffers stays under the limit.
+// Limit is split equally between currently registered collectors, so that flush thresholds
+// shrink when new collectors register and grow back when collectors are closed.
+// Buffer size given to each collector's constructor still acts as upper bound of its threshold.
+// MemoryBudget is safe for concurrent use
+type MemoryBudget struct {
+	limit      int64
+	used       int64 // Total size of buffers of all registered collectors, accessed atomically
+	collectors int64 // Number of registered collectors, accessed atomically
+}
+
+func NewMemoryBudget(limit datasize.ByteSize) *MemoryBudget {
+	return &MemoryBudget{limit: int64(limit.Bytes())}
+}
+
+func (b *MemoryBudget) Limit() datasize.ByteSize { return datasize.ByteSize(b.limit) }
+
+// Used returns total size of buffers of all registered collectors
+func (b *MemoryBudget) Used() datasize.ByteSize {
+	return datasize.ByteSize(atomic.LoadInt64(&b.used))
+}
+
+// Collectors returns number of currently registered collectors
+func (b *MemoryBudget) Collectors() int { return int(atomic.LoadInt64(&b.collectors)) }
+
+// Threshold returns current flush threshold of every registered collector
+func (b *MemoryBudget) Threshold() datasize.ByteSize {
+	return datasize.ByteSize(b.threshold())
+}
+
+func (b *MemoryBudget) threshold() int64 {
+	n := atomic.LoadInt64(&b.collectors)
+	if n < 1 {
+		n = 1
+	}
+	return b.limit / n
+}
+
+func (b *MemoryBudget) register()   { atomic.AddInt64(&b.collectors, 1) }
+func (b *MemoryBudget) unregister() { atomic.AddInt64(&b.collectors, -1) }
+
+func (b *MemoryBudget) add(delta int) {
+	if delta != 0 {
+		atomic.AddInt64(&b.used, int64(delta))
+	}
+}
+
+// shouldFlush decides whether buffer of given size needs to be flushed now
+func (b *MemoryBudget) shouldFlush(bufSize int) bool {
+	threshold := b.threshold()
+	if int64(bufSize) >= threshold {
+		return true
+	}
+	// Collectors that filled their buffers before others registered may be above their share,
+	// so total can go over the limit. Then everyone with reasonably large buffer flushes
+	return int64(bufSize) >= threshold/minFlushDivisor && atomic.LoadInt64(&b.used) >= b.limit
+}
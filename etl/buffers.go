@@ -47,6 +47,7 @@ type Buffer interface {
 	Put(k, v []byte)
 	Get(i int, keyBuf, valBuf []byte) ([]byte, []byte)
 	Len() int
+	Size() int
 	Reset()
 	Write(io.Writer) error
 	Sort()
@@ -49,6 +49,9 @@ type Collector struct {
 	logLvl          log.Lvl
 	bufType         int
 	logPrefix       string
+	budget          *MemoryBudget
+	bufSize         int // Size of the buffer last reported to the budget
+	progress        *Progress
 }
 
 // NewCollectorFromFiles creates collector from existing files (left over from previous unsuccessful loading)
@@ -72,7 +75,7 @@ func NewCollectorFromFiles(logPrefix, tmpdir string) (*Collector, error) {
 		}
 		dataProviders[i] = &dataProvider
 	}
-	return &Collector{dataProviders: dataProviders, allFlushed: true, autoClean: false, logPrefix: logPrefix}, nil
+	return &Collector{dataProviders: dataProviders, allFlushed: true, autoClean: false, logPrefix: logPrefix, progress: &Progress{}}, nil
 }
 
 // NewCriticalCollector does not clean up temporary files if loading has failed
@@ -83,7 +86,7 @@ func NewCriticalCollector(logPrefix, tmpdir string, sortableBuffer Buffer) *Coll
 }
 
 func NewCollector(logPrefix, tmpdir string, sortableBuffer Buffer) *Collector {
-	c := &Collector{autoClean: true, bufType: getTypeByBuffer(sortableBuffer), logPrefix: logPrefix, logLvl: log.LvlInfo}
+	c := &Collector{autoClean: true, bufType: getTypeByBuffer(sortableBuffer), logPrefix: logPrefix, logLvl: log.LvlInfo, progress: &Progress{}}
 
 	c.flushBuffer = func(currentKey []byte, canStoreInRam bool) error {
 		if sortableBuffer.Len() == 0 {
@@ -92,12 +95,17 @@ func NewCollector(logPrefix, tmpdir string, sortableBuffer Buffer) *Collector {
 		var provider dataProvider
 		var err error
 		sortableBuffer.Sort()
+		c.progress.flushed(sortableBuffer.Len())
 		if canStoreInRam && len(c.dataProviders) == 0 {
 			provider = KeepInRAM(sortableBuffer)
 			c.allFlushed = true
 		} else {
 			doFsync := !c.autoClean /* is critical collector */
+			size := sortableBuffer.Size()
 			provider, err = FlushToDisk(sortableBuffer, tmpdir, doFsync, c.logLvl)
+			if err == nil {
+				c.progress.spilled(uint64(size))
+			}
 		}
 		if err != nil {
 			return err
@@ -105,12 +113,23 @@ func NewCollector(logPrefix, tmpdir string, sortableBuffer Buffer) *Collector {
 		if provider != nil {
 			c.dataProviders = append(c.dataProviders, provider)
 		}
+		if c.budget != nil {
+			// Buffer is either reset after flushing to disk, or kept in RAM until the collector is closed
+			c.reportSize(sortableBuffer.Size())
+		}
 		return nil
 	}
 
 	c.extractNextFunc = func(originalK, k []byte, v []byte) error {
 		sortableBuffer.Put(k, v)
-		if sortableBuffer.CheckFlushSize() {
+		c.progress.extracted(k, v)
+		flush := sortableBuffer.CheckFlushSize()
+		if c.budget != nil {
+			size := sortableBuffer.Size()
+			c.reportSize(size)
+			flush = flush || c.budget.shouldFlush(size)
+		}
+		if flush {
 			if err := c.flushBuffer(originalK, false); err != nil {
 				return err
 			}
@@ -120,12 +139,42 @@ func NewCollector(logPrefix, tmpdir string, sortableBuffer Buffer) *Collector {
 	return c
 }
 
+// SetMemoryBudget registers collector with the memory budget shared with other collectors.
+// From then on, buffer is flushed when it reaches its share of the budget (or its own buffer size,
+// whichever is smaller). Collector is unregistered from the budget when closed
+func (c *Collector) SetMemoryBudget(budget *MemoryBudget) {
+	c.releaseBudget()
+	if budget == nil {
+		return
+	}
+	c.budget = budget
+	c.budget.register()
+}
+
+func (c *Collector) reportSize(size int) {
+	c.budget.add(size - c.bufSize)
+	c.bufSize = size
+}
+
+func (c *Collector) releaseBudget() {
+	if c.budget == nil {
+		return
+	}
+	c.reportSize(0)
+	c.budget.unregister()
+	c.budget = nil
+}
+
 func (c *Collector) Collect(k, v []byte) error {
 	return c.extractNextFunc(k, k, v)
 }
 
 func (c *Collector) LogLvl(v log.Lvl) { c.logLvl = v }
 
+// Progress returns statistics of collecting and loading, it can be read concurrently
+// with the goroutine using the collector
+func (c *Collector) Progress() *Progress { return c.progress }
+
 func (c *Collector) Load(db kv.RwTx, toBucket string, loadFunc LoadFunc, args TransformArgs) error {
 	defer func() {
 		if c.autoClean {
@@ -137,13 +186,14 @@ func (c *Collector) Load(db kv.RwTx, toBucket string, loadFunc LoadFunc, args Tr
 			return e
 		}
 	}
-	if err := loadFilesIntoBucket(c.logPrefix, db, toBucket, c.bufType, c.dataProviders, loadFunc, args); err != nil {
+	if err := loadFilesIntoBucket(c.logPrefix, db, toBucket, c.bufType, c.dataProviders, c.progress, loadFunc, args); err != nil {
 		return err
 	}
 	return nil
 }
 
 func (c *Collector) Close() {
+	c.releaseBudget()
 	totalSize := uint64(0)
 	for _, p := range c.dataProviders {
 		totalSize += p.Dispose()
@@ -153,65 +203,24 @@ func (c *Collector) Close() {
 	}
 }
 
-func loadFilesIntoBucket(logPrefix string, db kv.RwTx, bucket string, bufType int, providers []dataProvider, loadFunc LoadFunc, args TransformArgs) error {
+func loadFilesIntoBucket(logPrefix string, db kv.RwTx, bucket string, bufType int, providers []dataProvider, progress *Progress, loadFunc LoadFunc, args TransformArgs) error {
 	var m runtime.MemStats
+	progress.setPhase(PhaseLoad)
 
 	h := &Heap{comparator: args.Comparator}
-	heap.Init(h)
-	for i, provider := range providers {
-		if key, value, err := provider.Next(nil, nil); err == nil {
-			he := HeapElem{key, i, value}
-			heap.Push(h, he)
-		} else /* we must have at least one entry per file */ {
-			eee := fmt.Errorf("%s: error reading first readers: n=%d current=%d provider=%s err=%w",
-				logPrefix, len(providers), i, provider, err)
-			panic(eee)
-		}
-	}
-	var c kv.RwCursor
+	initHeap(logPrefix, h, providers)
 
 	currentTable := &currentTableReader{db, bucket}
 	haveSortingGuaranties := isIdentityLoadFunc(loadFunc) // user-defined loadFunc may change ordering
-	var lastKey []byte
-	if bucket != "" { // passing empty bucket name is valid case for etl when DB modification is not expected
-		var err error
-		c, err = db.RwCursor(bucket)
-		if err != nil {
-			return err
-		}
-		var errLast error
-		lastKey, _, errLast = c.Last()
-		if errLast != nil {
-			return errLast
-		}
+	bl, err := newBucketLoader(logPrefix, db, bucket, bufType, haveSortingGuaranties)
+	if err != nil {
+		return err
 	}
-	var canUseAppend bool
-	isDupSort := kv.ChaindataTablesCfg[bucket].Flags&kv.DupSort != 0 && !kv.ChaindataTablesCfg[bucket].AutoDupSortKeysConversion
 
 	logEvery := time.NewTicker(30 * time.Second)
 	defer logEvery.Stop()
 
-	i := 0
-	var prevK []byte
 	loadNextFunc := func(originalK, k, v []byte) error {
-		if i == 0 {
-			isEndOfBucket := lastKey == nil || bytes.Compare(lastKey, k) == -1
-			canUseAppend = haveSortingGuaranties && isEndOfBucket
-		}
-		i++
-
-		// SortableOldestAppearedBuffer must guarantee that only 1 oldest value of key will appear
-		// but because size of buffer is limited - each flushed file does guarantee "oldest appeared"
-		// property, but files may overlap. files are sorted, just skip repeated keys here
-		if bufType == SortableOldestAppearedBuffer {
-			if bytes.Equal(prevK, k) {
-				return nil
-			} else {
-				// Need to copy k because the underlying space will be re-used for the next key
-				prevK = common.Copy(k)
-			}
-		}
-
 		select {
 		default:
 		case <-logEvery.C:
@@ -223,36 +232,15 @@ func loadFilesIntoBucket(logPrefix string, db kv.RwTx, bucket string, bufType in
 			}
 
 			common.ReadMemStats(&m)
+			snapshot := progress.Snapshot()
+			logArs = append(logArs, snapshot.LogArgs()...)
 			logArs = append(logArs, "alloc", common.ByteCount(m.Alloc), "sys", common.ByteCount(m.Sys))
 			log.Info(fmt.Sprintf("[%s] ETL [2/2] Loading", logPrefix), logArs...)
-		}
-
-		if canUseAppend && len(v) == 0 {
-			return nil // nothing to delete after end of bucket
-		}
-		if len(v) == 0 {
-			if err := c.Delete(k, nil); err != nil {
-				return err
-			}
-			return nil
-		}
-		if canUseAppend {
-			if isDupSort {
-				if err := c.(kv.RwCursorDupSort).AppendDup(k, v); err != nil {
-					return fmt.Errorf("%s: bucket: %s, appendDup: k=%x, %w", logPrefix, bucket, k, err)
-				}
-			} else {
-				if err := c.Append(k, v); err != nil {
-					return fmt.Errorf("%s: bucket: %s, append: k=%x, v=%x, %w", logPrefix, bucket, k, v, err)
-				}
+			if args.ProgressReporter != nil {
+				args.ProgressReporter(logPrefix, snapshot)
 			}
-
-			return nil
-		}
-		if err := c.Put(k, v); err != nil {
-			return fmt.Errorf("%s: put: k=%x, %w", logPrefix, k, err)
 		}
-		return nil
+		return bl.next(originalK, k, v)
 	}
 	// Main loading loop
 	for h.Len() > 0 {
@@ -262,6 +250,7 @@ func loadFilesIntoBucket(logPrefix string, db kv.RwTx, bucket string, bufType in
 
 		element := (heap.Pop(h)).(HeapElem)
 		provider := providers[element.TimeIdx]
+		progress.loaded(element.Key, element.Value)
 		err := loadFunc(element.Key, element.Value, currentTable, loadNextFunc)
 		if err != nil {
 			return err
@@ -273,8 +262,112 @@ func loadFilesIntoBucket(logPrefix string, db kv.RwTx, bucket string, bufType in
 		}
 	}
 
-	log.Trace(fmt.Sprintf("[%s] ETL Load done", logPrefix), "bucket", bucket, "records", i)
+	progress.setPhase(PhaseDone)
+	if args.ProgressReporter != nil {
+		args.ProgressReporter(logPrefix, progress.Snapshot())
+	}
+	log.Trace(fmt.Sprintf("[%s] ETL Load done", logPrefix), "bucket", bucket, "records", bl.i)
+
+	return nil
+}
+
+// initHeap pushes the first entry of every provider into the heap
+func initHeap(logPrefix string, h *Heap, providers []dataProvider) {
+	heap.Init(h)
+	for i, provider := range providers {
+		if key, value, err := provider.Next(nil, nil); err == nil {
+			he := HeapElem{key, i, value}
+			heap.Push(h, he)
+		} else /* we must have at least one entry per file */ {
+			eee := fmt.Errorf("%s: error reading first readers: n=%d current=%d provider=%s err=%w",
+				logPrefix, len(providers), i, provider, err)
+			panic(eee)
+		}
+	}
+}
+
+// bucketLoader writes sorted entries into one bucket, using Append instead of Put
+// when all loaded keys are known to come after the last key already in the bucket
+type bucketLoader struct {
+	logPrefix             string
+	bucket                string
+	c                     kv.RwCursor
+	lastKey               []byte // last key that was in the bucket before loading
+	prevK                 []byte
+	bufType               int
+	i                     int // number of entries loaded so far
+	haveSortingGuaranties bool
+	canUseAppend          bool
+	isDupSort             bool
+}
+
+func newBucketLoader(logPrefix string, db kv.RwTx, bucket string, bufType int, haveSortingGuaranties bool) (*bucketLoader, error) {
+	bl := &bucketLoader{
+		logPrefix:             logPrefix,
+		bucket:                bucket,
+		bufType:               bufType,
+		haveSortingGuaranties: haveSortingGuaranties,
+		isDupSort:             kv.ChaindataTablesCfg[bucket].Flags&kv.DupSort != 0 && !kv.ChaindataTablesCfg[bucket].AutoDupSortKeysConversion,
+	}
+	if bucket != "" { // passing empty bucket name is valid case for etl when DB modification is not expected
+		var err error
+		bl.c, err = db.RwCursor(bucket)
+		if err != nil {
+			return nil, err
+		}
+		var errLast error
+		bl.lastKey, _, errLast = bl.c.Last()
+		if errLast != nil {
+			return nil, errLast
+		}
+	}
+	return bl, nil
+}
+
+func (bl *bucketLoader) next(_, k, v []byte) error {
+	if bl.i == 0 {
+		isEndOfBucket := bl.lastKey == nil || bytes.Compare(bl.lastKey, k) == -1
+		bl.canUseAppend = bl.haveSortingGuaranties && isEndOfBucket
+	}
+	bl.i++
 
+	// SortableOldestAppearedBuffer must guarantee that only 1 oldest value of key will appear
+	// but because size of buffer is limited - each flushed file does guarantee "oldest appeared"
+	// property, but files may overlap. files are sorted, just skip repeated keys here
+	if bl.bufType == SortableOldestAppearedBuffer {
+		if bytes.Equal(bl.prevK, k) {
+			return nil
+		} else {
+			// Need to copy k because the underlying space will be re-used for the next key
+			bl.prevK = common.Copy(k)
+		}
+	}
+
+	if bl.canUseAppend && len(v) == 0 {
+		return nil // nothing to delete after end of bucket
+	}
+	if len(v) == 0 {
+		if err := bl.c.Delete(k, nil); err != nil {
+			return err
+		}
+		return nil
+	}
+	if bl.canUseAppend {
+		if bl.isDupSort {
+			if err := bl.c.(kv.RwCursorDupSort).AppendDup(k, v); err != nil {
+				return fmt.Errorf("%s: bucket: %s, appendDup: k=%x, %w", bl.logPrefix, bl.bucket, k, err)
+			}
+		} else {
+			if err := bl.c.Append(k, v); err != nil {
+				return fmt.Errorf("%s: bucket: %s, append: k=%x, v=%x, %w", bl.logPrefix, bl.bucket, k, v, err)
+			}
+		}
+
+		return nil
+	}
+	if err := bl.c.Put(k, v); err != nil {
+		return fmt.Errorf("%s: put: k=%x, %w", bl.logPrefix, k, err)
+	}
 	return nil
 }
 
@@ -74,6 +74,11 @@ type TransformArgs struct {
 	LogDetailsExtract AdditionalLogArguments
 	LogDetailsLoad    AdditionalLogArguments
 
+	// Progress, if set, is reset and then updated by Transform, so that caller can observe it from another goroutine
+	Progress *Progress
+	// ProgressReporter, if set, is called on every log tick of extraction and loading, and when loading is done
+	ProgressReporter ProgressReporter
+
 	Comparator kv.CmpFunc
 }
 
@@ -94,9 +99,13 @@ func Transform(
 	buffer := getBufferByType(args.BufferType, bufferSize)
 	collector := NewCollector(logPrefix, tmpdir, buffer)
 	defer collector.Close()
+	if args.Progress != nil {
+		args.Progress.reset()
+		collector.progress = args.Progress
+	}
 
 	t := time.Now()
-	if err := extractBucketIntoFiles(logPrefix, db, fromBucket, args.ExtractStartKey, args.ExtractEndKey, collector, extractFunc, args.Quit, args.LogDetailsExtract); err != nil {
+	if err := extractBucketIntoFiles(logPrefix, db, fromBucket, args.ExtractStartKey, args.ExtractEndKey, collector, extractFunc, args.Quit, args.LogDetailsExtract, args.ProgressReporter); err != nil {
 		return err
 	}
 	log.Trace(fmt.Sprintf("[%s] Extraction finished", logPrefix), "took", time.Since(t))
@@ -118,7 +127,9 @@ func extractBucketIntoFiles(
 	extractFunc ExtractFunc,
 	quit <-chan struct{},
 	additionalLogArguments AdditionalLogArguments,
+	reporter ProgressReporter,
 ) error {
+	collector.progress.setPhase(PhaseExtract)
 	logEvery := time.NewTicker(30 * time.Second)
 	defer logEvery.Stop()
 	var m runtime.MemStats
@@ -146,8 +157,13 @@ func extractBucketIntoFiles(
 			}
 
 			common.ReadMemStats(&m)
+			snapshot := collector.progress.Snapshot()
+			logArs = append(logArs, snapshot.LogArgs()...)
 			logArs = append(logArs, "alloc", common.ByteCount(m.Alloc), "sys", common.ByteCount(m.Sys))
 			log.Info(fmt.Sprintf("[%s] ETL [1/2] Extracting", logPrefix), logArs...)
+			if reporter != nil {
+				reporter(logPrefix, snapshot)
+			}
 		}
 		if endkey != nil && bytes.Compare(k, endkey) >= 0 {
 			// endKey is exclusive bound: [startkey, endkey)
@@ -17,17 +17,23 @@ package etl
 
 import (
 	"bytes"
+	"context"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/c2h5oh/datasize"
+	"github.com/ledgerwatch/erigon-lib/common"
 	"github.com/ledgerwatch/erigon-lib/kv"
 	"github.com/ledgerwatch/erigon-lib/kv/memdb"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func decodeHex(in string) []byte {
@@ -105,7 +111,7 @@ func TestFileDataProviders(t *testing.T) {
 
 	collector := NewCollector(t.Name(), "", NewSortableBuffer(1))
 
-	err := extractBucketIntoFiles("logPrefix", tx, sourceBucket, nil, nil, collector, testExtractToMapFunc, nil, nil)
+	err := extractBucketIntoFiles("logPrefix", tx, sourceBucket, nil, nil, collector, testExtractToMapFunc, nil, nil, nil)
 	assert.NoError(t, err)
 
 	assert.Equal(t, 10, len(collector.dataProviders))
@@ -134,7 +140,7 @@ func TestRAMDataProviders(t *testing.T) {
 	generateTestData(t, tx, sourceBucket, 10)
 
 	collector := NewCollector(t.Name(), "", NewSortableBuffer(BufferOptimalSize))
-	err := extractBucketIntoFiles("logPrefix", tx, sourceBucket, nil, nil, collector, testExtractToMapFunc, nil, nil)
+	err := extractBucketIntoFiles("logPrefix", tx, sourceBucket, nil, nil, collector, testExtractToMapFunc, nil, nil, nil)
 	assert.NoError(t, err)
 
 	assert.Equal(t, 1, len(collector.dataProviders))
@@ -361,3 +367,267 @@ func compareBucketsDouble(t *testing.T, db kv.Tx, b1, b2 string) {
 	assert.NoError(t, err)
 	assert.Equal(t, b1Map, b2Map)
 }
+
+func TestMultiCollector(t *testing.T) {
+	_, tx := memdb.NewTestTx(t)
+	sourceBucket := kv.ChaindataTables[0]
+	destBucket1 := kv.ChaindataTables[1]
+	destBucket2 := kv.ChaindataTables[2]
+	generateTestData(t, tx, sourceBucket, 10)
+	// Pre-existing entry in the first table forces Put instead of Append there
+	err := tx.Put(destBucket1, []byte(fmt.Sprintf("%10d-key-%010d", 5, 5)), []byte("old"))
+	assert.NoError(t, err)
+
+	for _, bufferSize := range []datasize.ByteSize{1, BufferOptimalSize} {
+		collector, err := NewMultiCollector(t.Name(), "", []string{destBucket1, destBucket2}, NewSortableBuffer(bufferSize))
+		assert.NoError(t, err)
+		err = tx.ForEach(sourceBucket, nil, func(k, v []byte) error {
+			if err := collector.Collect(destBucket1, k, v); err != nil {
+				return err
+			}
+			return collector.Collect(destBucket2, append(common.Copy(k), 0xAA), append(common.Copy(v), 0xAA))
+		})
+		assert.NoError(t, err)
+		err = collector.Load(tx, IdentityLoadFunc, TransformArgs{})
+		assert.NoError(t, err)
+		compareBuckets(t, tx, sourceBucket, destBucket1, nil)
+
+		b1Map := make(map[string]string)
+		err = tx.ForEach(sourceBucket, nil, func(k, v []byte) error {
+			b1Map[fmt.Sprintf("%x", append(k, 0xAA))] = fmt.Sprintf("%x", append(v, 0xAA))
+			return nil
+		})
+		assert.NoError(t, err)
+		b2Map := make(map[string]string)
+		err = tx.ForEach(destBucket2, nil, func(k, v []byte) error {
+			b2Map[fmt.Sprintf("%x", k)] = fmt.Sprintf("%x", v)
+			return nil
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, b1Map, b2Map)
+	}
+}
+
+func TestMultiCollectorUnknownTable(t *testing.T) {
+	collector, err := NewMultiCollector(t.Name(), "", []string{kv.ChaindataTables[1]}, NewSortableBuffer(BufferOptimalSize))
+	assert.NoError(t, err)
+	defer collector.Close()
+	assert.Error(t, collector.Collect(kv.ChaindataTables[2], []byte("k"), []byte("v")))
+	_, err = NewMultiCollector(t.Name(), "", []string{kv.ChaindataTables[1], kv.ChaindataTables[1]}, NewSortableBuffer(BufferOptimalSize))
+	assert.Error(t, err)
+}
+
+func TestMemoryBudget(t *testing.T) {
+	_, tx := memdb.NewTestTx(t)
+	sourceBucket := kv.ChaindataTables[0]
+	generateTestData(t, tx, sourceBucket, 10)
+
+	// Each entry is larger than 100 bytes, so that 2 collectors sharing 1KB flush every 4 entries
+	budget := NewMemoryBudget(1024)
+	collector1 := NewCollector(t.Name(), "", NewSortableBuffer(BufferOptimalSize))
+	collector1.SetMemoryBudget(budget)
+	collector2 := NewCollector(t.Name(), "", NewSortableBuffer(BufferOptimalSize))
+	collector2.SetMemoryBudget(budget)
+	assert.Equal(t, 2, budget.Collectors())
+	assert.Equal(t, datasize.ByteSize(512), budget.Threshold())
+
+	for _, collector := range []*Collector{collector1, collector2} {
+		err := extractBucketIntoFiles("logPrefix", tx, sourceBucket, nil, nil, collector, testExtractToMapFunc, nil, nil, nil)
+		assert.NoError(t, err)
+		assert.Less(t, 1, len(collector.dataProviders))
+	}
+	assert.LessOrEqual(t, uint64(budget.Used()), uint64(budget.Limit()))
+
+	// Closing collector releases its share of the budget
+	collector1.Close()
+	assert.Equal(t, 1, budget.Collectors())
+	assert.Equal(t, datasize.ByteSize(1024), budget.Threshold())
+	collector2.Close()
+	collector2.Close()
+	assert.Equal(t, 0, budget.Collectors())
+	assert.Equal(t, datasize.ByteSize(0), budget.Used())
+
+	// Without budget, the same data fits into RAM
+	collector := NewCollector(t.Name(), "", NewSortableBuffer(BufferOptimalSize))
+	defer collector.Close()
+	err := extractBucketIntoFiles("logPrefix", tx, sourceBucket, nil, nil, collector, testExtractToMapFunc, nil, nil, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(collector.dataProviders))
+}
+
+func TestTransformProgress(t *testing.T) {
+	_, tx := memdb.NewTestTx(t)
+	sourceBucket := kv.ChaindataTables[0]
+	destBucket := kv.ChaindataTables[1]
+	generateTestData(t, tx, sourceBucket, 10)
+
+	progress := &Progress{}
+	var reported []ProgressSnapshot
+	err := Transform(
+		"logPrefix",
+		tx,
+		sourceBucket,
+		destBucket,
+		"", // temp dir
+		testExtractToMapFunc,
+		testLoadFromMapFunc,
+		TransformArgs{
+			BufferSize: 1,
+			Progress:   progress,
+			ProgressReporter: func(_ string, s ProgressSnapshot) {
+				reported = append(reported, s)
+			},
+		},
+	)
+	assert.Nil(t, err)
+	compareBuckets(t, tx, sourceBucket, destBucket, nil)
+
+	s := progress.Snapshot()
+	assert.Equal(t, PhaseDone, s.Phase)
+	assert.Equal(t, uint64(10), s.ExtractedEntries)
+	assert.Equal(t, uint64(10), s.LoadedEntries)
+	assert.Equal(t, s.ExtractedBytes, s.LoadedBytes)
+	assert.Equal(t, uint64(10), s.SpillFiles) // Every entry is larger than the buffer
+	assert.GreaterOrEqual(t, s.SpillBytes, s.ExtractedBytes)
+	assert.Equal(t, float64(100), s.LoadPercent)
+	assert.Equal(t, time.Duration(0), s.ETA)
+	// Final snapshot is always reported
+	assert.Equal(t, 1, len(reported))
+	assert.Equal(t, PhaseDone, reported[0].Phase)
+}
+
+func TestProgressDeduplicatingBuffer(t *testing.T) {
+	_, tx := memdb.NewTestTx(t)
+	destBucket := kv.ChaindataTables[1]
+	collector := NewCollector(t.Name(), "", NewAppendBuffer(BufferOptimalSize))
+	defer collector.Close()
+	for _, k := range []string{"a", "b", "a", "a"} {
+		require.NoError(t, collector.Collect([]byte(k), []byte{1}))
+	}
+	var percents []float64
+	err := collector.Load(tx, destBucket, func(k, v []byte, table CurrentTableReader, next LoadNextFunc) error {
+		percents = append(percents, collector.Progress().Snapshot().LoadPercent)
+		return next(k, k, v)
+	}, TransformArgs{})
+	require.NoError(t, err)
+	s := collector.Progress().Snapshot()
+	assert.Equal(t, uint64(4), s.ExtractedEntries)
+	assert.Equal(t, uint64(2), s.FlushedEntries)
+	assert.Equal(t, uint64(2), s.LoadedEntries)
+	// Entries merged by the buffer are not expected to be loaded
+	assert.Equal(t, []float64{50, 100}, percents)
+}
+
+func TestProgressReuse(t *testing.T) {
+	_, tx := memdb.NewTestTx(t)
+	sourceBucket := kv.ChaindataTables[0]
+	destBucket := kv.ChaindataTables[1]
+	generateTestData(t, tx, sourceBucket, 10)
+
+	progress := &Progress{}
+	var extractStart int64
+	for i := 0; i < 2; i++ {
+		err := Transform("logPrefix", tx, sourceBucket, destBucket, "", testExtractToMapFunc, testLoadFromMapFunc, TransformArgs{Progress: progress})
+		require.NoError(t, err)
+		s := progress.Snapshot()
+		assert.Equal(t, PhaseDone, s.Phase)
+		assert.Equal(t, uint64(10), s.ExtractedEntries)
+		assert.Equal(t, uint64(10), s.LoadedEntries)
+		// Timestamps are those of the last run
+		assert.Greater(t, progress.extractStart, extractStart)
+		assert.GreaterOrEqual(t, progress.loadEnd, progress.extractStart)
+		extractStart = progress.extractStart
+	}
+}
+
+func TestProgressETA(t *testing.T) {
+	p := &Progress{}
+	for i := 0; i < 4; i++ {
+		p.extracted([]byte{byte(i)}, []byte{byte(i)})
+	}
+	assert.Equal(t, PhaseExtract, p.Snapshot().Phase)
+	p.setPhase(PhaseLoad)
+	p.loadStart -= int64(time.Second) // pretend that loading started one second ago
+	p.loaded([]byte{0}, []byte{0})
+
+	s := p.Snapshot()
+	assert.Equal(t, float64(25), s.LoadPercent)
+	assert.InDelta(t, 1, s.LoadRate, 0.1)
+	assert.InDelta(t, float64(3*time.Second), float64(s.ETA), float64(300*time.Millisecond))
+}
+
+func TestPartitionedCollector(t *testing.T) {
+	_, tx := memdb.NewTestTx(t)
+	sourceBucket := kv.ChaindataTables[0]
+	destBucket := kv.ChaindataTables[1]
+	generateTestData(t, tx, sourceBucket, 100)
+
+	const n = 4
+	newCollector := func() *PartitionedCollector {
+		c, err := NewPartitionedCollector(t.Name(), "", SortableSliceBuffer, 1024, n, PrefixPartitionFunc(n))
+		require.NoError(t, err)
+		i := 0
+		err = tx.ForEach(sourceBucket, nil, func(k, v []byte) error {
+			// Spread keys over the key space, so that every partition gets some
+			i++
+			return c.Collect(append([]byte{byte(i * 256 / 101)}, k...), v)
+		})
+		require.NoError(t, err)
+		return c
+	}
+
+	c := newCollector()
+	loaded := make([][][]byte, n)
+	err := c.LoadParallel(context.Background(), 2, func(partition int) LoadFunc {
+		return func(k, v []byte, _ CurrentTableReader, next LoadNextFunc) error {
+			loaded[partition] = append(loaded[partition], common.Copy(k))
+			return nil
+		}
+	}, TransformArgs{})
+	require.NoError(t, err)
+	total := 0
+	for i, keys := range loaded {
+		assert.NotEmpty(t, keys)
+		for j, k := range keys {
+			assert.Equal(t, i, int(k[0])*n/256)
+			if j > 0 {
+				assert.Equal(t, -1, bytes.Compare(keys[j-1], k))
+			}
+		}
+		total += len(keys)
+	}
+	assert.Equal(t, 100, total)
+	c.Close()
+
+	// Load one partition after another into the same table
+	c = newCollector()
+	defer c.Close()
+	for _, p := range c.Partitions() {
+		assert.Less(t, 1, len(p.dataProviders)) // Partitions share 1KB budget, so they flush
+	}
+	require.NoError(t, c.Load(tx, destBucket, IdentityLoadFunc, TransformArgs{}))
+	count := 0
+	err = tx.ForEach(destBucket, nil, func(k, v []byte) error {
+		count++
+		sourceV, err := tx.GetOne(sourceBucket, k[1:])
+		require.NoError(t, err)
+		assert.Equal(t, sourceV, v)
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 100, count)
+
+	// Error of one partition stops loading
+	c = newCollector()
+	defer c.Close()
+	errBoom := errors.New("boom")
+	err = c.LoadParallel(context.Background(), 1, func(partition int) LoadFunc {
+		return func(k, v []byte, _ CurrentTableReader, next LoadNextFunc) error {
+			if partition == 1 {
+				return errBoom
+			}
+			return nil
+		}
+	}, TransformArgs{})
+	assert.ErrorIs(t, err, errBoom)
+}
@@ -0,0 +1,193 @@
+/*
+   Copyright 2022 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package etl
+
+import (
+	"container/heap"
+	"errors"
+	"fmt"
+	"io"
+	"runtime"
+	"time"
+
+	"github.com/ledgerwatch/erigon-lib/common"
+	"github.com/ledgerwatch/erigon-lib/kv"
+	"github.com/ledgerwatch/log/v3"
+)
+
+// MaxMultiCollectorTables is the maximum number of tables one MultiCollector can route entries to,
+// because table tag is encoded as a single byte in front of every collected key
+const MaxMultiCollectorTables = 256
+
+// MultiCollector is a Collector where each collected entry carries the tag of its target table.
+// Entries are sorted by (table, key), so that the load phase can route them to all the tables
+// in one pass over the sorted files, and use Append for every table where ordering permits.
+// It replaces several serial Collector.Load or Transform calls over the same source.
+type MultiCollector struct {
+	*Collector
+	tables   []string
+	tableIdx map[string]byte
+	keyBuf   []byte
+}
+
+func NewMultiCollector(logPrefix, tmpdir string, tables []string, sortableBuffer Buffer) (*MultiCollector, error) {
+	if len(tables) == 0 {
+		return nil, fmt.Errorf("%s: multi collector needs at least one table", logPrefix)
+	}
+	if len(tables) > MaxMultiCollectorTables {
+		return nil, fmt.Errorf("%s: too many tables for multi collector: %d, max %d", logPrefix, len(tables), MaxMultiCollectorTables)
+	}
+	tableIdx := make(map[string]byte, len(tables))
+	for i, table := range tables {
+		if _, ok := tableIdx[table]; ok {
+			return nil, fmt.Errorf("%s: duplicate table in multi collector: %s", logPrefix, table)
+		}
+		tableIdx[table] = byte(i)
+	}
+	// Collector is created only when the tables are valid, so that nothing is left to close on error
+	return &MultiCollector{
+		Collector: NewCollector(logPrefix, tmpdir, sortableBuffer),
+		tables:    tables,
+		tableIdx:  tableIdx,
+	}, nil
+}
+
+// Collect adds entry to be loaded into given table. Table must be one of the tables
+// passed to NewMultiCollector
+func (c *MultiCollector) Collect(table string, k, v []byte) error {
+	idx, ok := c.tableIdx[table]
+	if !ok {
+		return fmt.Errorf("%s: table %s is not registered in multi collector", c.logPrefix, table)
+	}
+	c.keyBuf = append(append(c.keyBuf[:0], idx), k...)
+	return c.extractNextFunc(c.keyBuf, c.keyBuf, v)
+}
+
+// Load routes sorted entries to their tables. loadFunc is invoked with the key without table tag,
+// and CurrentTableReader of the entry's table
+func (c *MultiCollector) Load(db kv.RwTx, loadFunc LoadFunc, args TransformArgs) error {
+	defer func() {
+		if c.autoClean {
+			c.Close()
+		}
+	}()
+	if !c.allFlushed {
+		if e := c.flushBuffer(nil, true); e != nil {
+			return e
+		}
+	}
+	return loadFilesIntoBuckets(c.logPrefix, db, c.tables, c.bufType, c.dataProviders, c.progress, loadFunc, args)
+}
+
+// tableTagComparator turns comparator of keys into comparator of keys prefixed by table tag
+func tableTagComparator(cmp kv.CmpFunc) kv.CmpFunc {
+	if cmp == nil {
+		return nil
+	}
+	return func(k1, k2, v1, v2 []byte) int {
+		if k1[0] != k2[0] {
+			return int(k1[0]) - int(k2[0])
+		}
+		return cmp(k1[1:], k2[1:], v1, v2)
+	}
+}
+
+func loadFilesIntoBuckets(logPrefix string, db kv.RwTx, buckets []string, bufType int, providers []dataProvider, progress *Progress, loadFunc LoadFunc, args TransformArgs) error {
+	var m runtime.MemStats
+	progress.setPhase(PhaseLoad)
+
+	h := &Heap{comparator: tableTagComparator(args.Comparator)}
+	initHeap(logPrefix, h, providers)
+
+	haveSortingGuaranties := isIdentityLoadFunc(loadFunc) // user-defined loadFunc may change ordering
+	loaders := make([]*bucketLoader, len(buckets))
+	tableReaders := make([]*currentTableReader, len(buckets))
+	for i, bucket := range buckets {
+		tableReaders[i] = &currentTableReader{db, bucket}
+	}
+	// Bucket loaders are created lazily, only for the tables that got any entries.
+	// Because entries are sorted by table tag first, every table is loaded in one go
+	var bl *bucketLoader
+
+	logEvery := time.NewTicker(30 * time.Second)
+	defer logEvery.Stop()
+
+	loadNextFunc := func(originalK, k, v []byte) error {
+		select {
+		default:
+		case <-logEvery.C:
+			logArs := []interface{}{"into", bl.bucket}
+			if args.LogDetailsLoad != nil {
+				logArs = append(logArs, args.LogDetailsLoad(k, v)...)
+			} else {
+				logArs = append(logArs, "current key", makeCurrentKeyStr(k))
+			}
+
+			common.ReadMemStats(&m)
+			snapshot := progress.Snapshot()
+			logArs = append(logArs, snapshot.LogArgs()...)
+			logArs = append(logArs, "alloc", common.ByteCount(m.Alloc), "sys", common.ByteCount(m.Sys))
+			log.Info(fmt.Sprintf("[%s] ETL [2/2] Loading", logPrefix), logArs...)
+			if args.ProgressReporter != nil {
+				args.ProgressReporter(logPrefix, snapshot)
+			}
+		}
+		return bl.next(originalK, k, v)
+	}
+	// Main loading loop
+	for h.Len() > 0 {
+		if err := common.Stopped(args.Quit); err != nil {
+			return err
+		}
+
+		element := (heap.Pop(h)).(HeapElem)
+		provider := providers[element.TimeIdx]
+		progress.loaded(element.Key, element.Value)
+		tableIdx := int(element.Key[0])
+		if tableIdx >= len(buckets) {
+			return fmt.Errorf("%s: unexpected table tag %d, tables: %d", logPrefix, tableIdx, len(buckets))
+		}
+		if loaders[tableIdx] == nil {
+			var err error
+			if loaders[tableIdx], err = newBucketLoader(logPrefix, db, buckets[tableIdx], bufType, haveSortingGuaranties); err != nil {
+				return err
+			}
+		}
+		bl = loaders[tableIdx]
+		err := loadFunc(element.Key[1:], element.Value, tableReaders[tableIdx], loadNextFunc)
+		if err != nil {
+			return err
+		}
+		if element.Key, element.Value, err = provider.Next(element.Key[:0], element.Value[:0]); err == nil {
+			heap.Push(h, element)
+		} else if !errors.Is(err, io.EOF) {
+			return fmt.Errorf("%s: error while reading next element from disk: %w", logPrefix, err)
+		}
+	}
+
+	progress.setPhase(PhaseDone)
+	if args.ProgressReporter != nil {
+		args.ProgressReporter(logPrefix, progress.Snapshot())
+	}
+	for i, l := range loaders {
+		if l != nil {
+			log.Trace(fmt.Sprintf("[%s] ETL Load done", logPrefix), "bucket", buckets[i], "records", l.i)
+		}
+	}
+
+	return nil
+}
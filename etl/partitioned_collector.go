@@ -0,0 +1,183 @@
+/*
+   Copyright 2022 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package etl
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/c2h5oh/datasize"
+	"github.com/ledgerwatch/erigon-lib/kv"
+)
+
+// PartitionFunc maps key to the number of its partition in [0, n).
+// For partitions to be loaded one after another into the same table, it must preserve ordering:
+// every key of partition i must be smaller than every key of partition j, for i < j
+type PartitionFunc func(k []byte) int
+
+// PrefixPartitionFunc splits key space into n ranges of equal size by the first 2 bytes of the key.
+// It preserves ordering, and gives balanced partitions for uniformly distributed keys, like addresses and hashes
+func PrefixPartitionFunc(n int) PartitionFunc {
+	return func(k []byte) int {
+		var prefix uint64
+		if len(k) > 0 {
+			prefix = uint64(k[0]) << 8
+		}
+		if len(k) > 1 {
+			prefix |= uint64(k[1])
+		}
+		return int(prefix * uint64(n) >> 16)
+	}
+}
+
+// PartitionedCollector routes collected entries into N independent collectors by the partition function,
+// so that each partition is sorted and merged on its own. Partitions can be loaded in parallel into
+// disjoint key ranges or separate files, or one after another into one table.
+// All partitions share one memory budget of the given buffer size
+type PartitionedCollector struct {
+	logPrefix     string
+	partitions    []*Collector
+	buffers       []Buffer
+	partitionFunc PartitionFunc
+	comparator    kv.CmpFunc
+}
+
+func NewPartitionedCollector(logPrefix, tmpdir string, bufType int, bufferSize datasize.ByteSize, n int, partitionFunc PartitionFunc) (*PartitionedCollector, error) {
+	if n < 1 {
+		return nil, fmt.Errorf("%s: partitioned collector needs at least one partition, got %d", logPrefix, n)
+	}
+	if partitionFunc == nil {
+		return nil, fmt.Errorf("%s: partitioned collector needs partition function", logPrefix)
+	}
+	c := &PartitionedCollector{
+		logPrefix:     logPrefix,
+		partitions:    make([]*Collector, n),
+		buffers:       make([]Buffer, n),
+		partitionFunc: partitionFunc,
+	}
+	budget := NewMemoryBudget(bufferSize)
+	for i := range c.partitions {
+		c.buffers[i] = getBufferByType(bufType, bufferSize)
+		c.partitions[i] = NewCollector(fmt.Sprintf("%s/%d", logPrefix, i), tmpdir, c.buffers[i])
+		c.partitions[i].SetMemoryBudget(budget)
+	}
+	return c, nil
+}
+
+// SetComparator sets custom ordering of keys for sorting buffers and merging files of every partition.
+// Partition function must be consistent with this ordering if partitions are loaded into one table
+func (c *PartitionedCollector) SetComparator(cmp kv.CmpFunc) {
+	c.comparator = cmp
+	for _, b := range c.buffers {
+		b.SetComparator(cmp)
+	}
+}
+
+func (c *PartitionedCollector) Collect(k, v []byte) error {
+	i := c.partitionFunc(k)
+	if i < 0 || i >= len(c.partitions) {
+		return fmt.Errorf("%s: partition %d of key %x is out of range [0, %d)", c.logPrefix, i, k, len(c.partitions))
+	}
+	return c.partitions[i].Collect(k, v)
+}
+
+// Partitions gives access to collectors of individual partitions, e.g. to load them into separate files
+func (c *PartitionedCollector) Partitions() []*Collector { return c.partitions }
+
+func (c *PartitionedCollector) args(args TransformArgs) TransformArgs {
+	if args.Comparator == nil {
+		args.Comparator = c.comparator
+	}
+	return args
+}
+
+// Load loads partitions one after another into the same table. With order-preserving partition function
+// entries come in sorted order, so Append is used where possible
+func (c *PartitionedCollector) Load(db kv.RwTx, toBucket string, loadFunc LoadFunc, args TransformArgs) error {
+	args = c.args(args)
+	for _, p := range c.partitions {
+		if err := p.Load(db, toBucket, loadFunc, args); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LoadParallel loads partitions concurrently, with at most `workers` partitions at a time.
+// Every partition is loaded with its own load function, created by newLoadFunc, which must write
+// to its own destination (disjoint key range of a table or a separate file), because database
+// transactions can't be shared between goroutines. CurrentTableReader passed to load functions can't be used.
+// Loading stops at the first error, and the first error is returned
+func (c *PartitionedCollector) LoadParallel(ctx context.Context, workers int, newLoadFunc func(partition int) LoadFunc, args TransformArgs) error {
+	args = c.args(args)
+	if workers < 1 {
+		workers = 1
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	args.Quit = mergeQuit(ctx, args.Quit)
+
+	var firstErr error
+	var errOnce sync.Once
+	sem := make(chan struct{}, workers)
+	var wg sync.WaitGroup
+loop:
+	for i, p := range c.partitions {
+		select {
+		case <-ctx.Done():
+			break loop
+		case sem <- struct{}{}:
+		}
+		wg.Add(1)
+		go func(i int, p *Collector) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			if err := p.Load(nil, "", newLoadFunc(i), args); err != nil {
+				errOnce.Do(func() { firstErr = fmt.Errorf("%s: loading partition %d: %w", c.logPrefix, i, err) })
+				cancel()
+			}
+		}(i, p)
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return firstErr
+	}
+	return ctx.Err()
+}
+
+// mergeQuit returns channel closed when either context is cancelled or quit channel is closed
+func mergeQuit(ctx context.Context, quit <-chan struct{}) <-chan struct{} {
+	if quit == nil {
+		return ctx.Done()
+	}
+	merged := make(chan struct{})
+	go func() {
+		defer close(merged)
+		select {
+		case <-ctx.Done():
+		case <-quit:
+		}
+	}()
+	return merged
+}
+
+func (c *PartitionedCollector) Close() {
+	for _, p := range c.partitions {
+		p.Close()
+	}
+}
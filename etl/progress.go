@@ -16,9 +16,197 @@
 
 package etl
 
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/ledgerwatch/erigon-lib/common"
+)
+
 func ProgressFromKey(k []byte) int {
 	if len(k) < 1 {
 		return 0
 	}
 	return int(float64(k[0]>>4) * 3.3)
 }
+
+type Phase uint32
+
+const (
+	PhaseIdle Phase = iota
+	PhaseExtract
+	PhaseLoad
+	PhaseDone
+)
+
+func (p Phase) String() string {
+	switch p {
+	case PhaseIdle:
+		return "idle"
+	case PhaseExtract:
+		return "extract"
+	case PhaseLoad:
+		return "load"
+	case PhaseDone:
+		return "done"
+	default:
+		return fmt.Sprintf("unknown phase %d", uint32(p))
+	}
+}
+
+// ProgressReporter receives snapshots of progress on every log tick and at the end of each phase.
+// It can be used to feed metrics or to display stage progress
+type ProgressReporter func(logPrefix string, s ProgressSnapshot)
+
+// Progress accumulates statistics of one ETL run - extraction (or collection) and loading.
+// It is updated by the goroutine running the collector and can be read concurrently via Snapshot
+type Progress struct {
+	// uint64 fields are accessed atomically and go first to be 64-bit aligned on 32-bit platforms
+	extractedEntries uint64
+	extractedBytes   uint64
+	flushedEntries   uint64
+	spillFiles       uint64
+	spillBytes       uint64
+	loadedEntries    uint64
+	loadedBytes      uint64
+	extractStart     int64 // unix nanoseconds
+	extractEnd       int64
+	loadStart        int64
+	loadEnd          int64
+	phase            uint32
+}
+
+// ProgressSnapshot is a consistent enough view of Progress at some moment
+type ProgressSnapshot struct {
+	Phase            Phase
+	ExtractedEntries uint64 // Entries collected so far
+	ExtractedBytes   uint64 // Size of keys and values collected so far
+	FlushedEntries   uint64 // Entries of the buffers flushed so far, after merging of equal keys by AppendBuffer or OldestAppearedBuffer
+	SpillFiles       uint64 // Number of buffers flushed to temporary files
+	SpillBytes       uint64 // Size of buffers flushed to temporary files, including their overhead
+	LoadedEntries    uint64 // Entries passed to the load function so far
+	LoadedBytes      uint64 // Size of keys and values passed to the load function so far
+	ExtractDuration  time.Duration
+	LoadDuration     time.Duration
+	ExtractRate      float64       // Entries per second during extraction
+	LoadRate         float64       // Entries per second during loading
+	LoadPercent      float64       // Percentage of flushed entries that have been loaded
+	ETA              time.Duration // Estimated time until loading is finished, 0 if unknown
+}
+
+// reset clears the statistics of the previous run, so that Progress can be reused
+func (p *Progress) reset() {
+	for _, counter := range []*uint64{&p.extractedEntries, &p.extractedBytes, &p.flushedEntries, &p.spillFiles, &p.spillBytes, &p.loadedEntries, &p.loadedBytes} {
+		atomic.StoreUint64(counter, 0)
+	}
+	for _, ts := range []*int64{&p.extractStart, &p.extractEnd, &p.loadStart, &p.loadEnd} {
+		atomic.StoreInt64(ts, 0)
+	}
+	atomic.StoreUint32(&p.phase, uint32(PhaseIdle))
+}
+
+func (p *Progress) Phase() Phase { return Phase(atomic.LoadUint32(&p.phase)) }
+
+func (p *Progress) setPhase(phase Phase) {
+	now := time.Now().UnixNano()
+	switch phase {
+	case PhaseExtract:
+		atomic.CompareAndSwapInt64(&p.extractStart, 0, now)
+	case PhaseLoad:
+		atomic.CompareAndSwapInt64(&p.extractEnd, 0, now)
+		atomic.CompareAndSwapInt64(&p.loadStart, 0, now)
+	case PhaseDone:
+		atomic.CompareAndSwapInt64(&p.loadEnd, 0, now)
+	}
+	atomic.StoreUint32(&p.phase, uint32(phase))
+}
+
+func (p *Progress) extracted(k, v []byte) {
+	if atomic.LoadUint32(&p.phase) == uint32(PhaseIdle) {
+		p.setPhase(PhaseExtract)
+	}
+	atomic.AddUint64(&p.extractedEntries, 1)
+	atomic.AddUint64(&p.extractedBytes, uint64(len(k)+len(v)))
+}
+
+func (p *Progress) flushed(entries int) {
+	atomic.AddUint64(&p.flushedEntries, uint64(entries))
+}
+
+func (p *Progress) spilled(bytes uint64) {
+	atomic.AddUint64(&p.spillFiles, 1)
+	atomic.AddUint64(&p.spillBytes, bytes)
+}
+
+func (p *Progress) loaded(k, v []byte) {
+	atomic.AddUint64(&p.loadedEntries, 1)
+	atomic.AddUint64(&p.loadedBytes, uint64(len(k)+len(v)))
+}
+
+func since(start, end int64, now time.Time) time.Duration {
+	if start == 0 {
+		return 0
+	}
+	if end == 0 {
+		return now.Sub(time.Unix(0, start))
+	}
+	return time.Duration(end - start)
+}
+
+func rate(count uint64, d time.Duration) float64 {
+	if d <= 0 {
+		return 0
+	}
+	return float64(count) / d.Seconds()
+}
+
+func (p *Progress) Snapshot() ProgressSnapshot {
+	now := time.Now()
+	s := ProgressSnapshot{
+		Phase:            p.Phase(),
+		ExtractedEntries: atomic.LoadUint64(&p.extractedEntries),
+		ExtractedBytes:   atomic.LoadUint64(&p.extractedBytes),
+		FlushedEntries:   atomic.LoadUint64(&p.flushedEntries),
+		SpillFiles:       atomic.LoadUint64(&p.spillFiles),
+		SpillBytes:       atomic.LoadUint64(&p.spillBytes),
+		LoadedEntries:    atomic.LoadUint64(&p.loadedEntries),
+		LoadedBytes:      atomic.LoadUint64(&p.loadedBytes),
+		ExtractDuration:  since(atomic.LoadInt64(&p.extractStart), atomic.LoadInt64(&p.extractEnd), now),
+		LoadDuration:     since(atomic.LoadInt64(&p.loadStart), atomic.LoadInt64(&p.loadEnd), now),
+	}
+	s.ExtractRate = rate(s.ExtractedEntries, s.ExtractDuration)
+	s.LoadRate = rate(s.LoadedEntries, s.LoadDuration)
+	switch s.Phase {
+	case PhaseLoad:
+		total := s.FlushedEntries
+		if total == 0 {
+			// Collector created from existing files does not flush anything
+			total = s.ExtractedEntries
+		}
+		if total > 0 {
+			s.LoadPercent = 100 * float64(s.LoadedEntries) / float64(total)
+		}
+		if s.LoadRate > 0 && total > s.LoadedEntries {
+			s.ETA = time.Duration(float64(total-s.LoadedEntries) / s.LoadRate * float64(time.Second))
+		}
+	case PhaseDone:
+		s.LoadPercent = 100
+	}
+	return s
+}
+
+// LogArgs returns the snapshot in the form suitable for passing to the logger
+func (s ProgressSnapshot) LogArgs() []interface{} {
+	switch s.Phase {
+	case PhaseExtract:
+		return []interface{}{"entries", s.ExtractedEntries, "size", common.ByteCount(s.ExtractedBytes),
+			"spill files", s.SpillFiles, "rate", fmt.Sprintf("%.0f/s", s.ExtractRate)}
+	case PhaseLoad:
+		return []interface{}{"progress", fmt.Sprintf("%.2f%%", s.LoadPercent), "rate", fmt.Sprintf("%.0f/s", s.LoadRate),
+			"eta", s.ETA.Round(time.Second)}
+	default:
+		return []interface{}{"entries", s.ExtractedEntries, "loaded", s.LoadedEntries, "spill files", s.SpillFiles,
+			"took", (s.ExtractDuration + s.LoadDuration).Round(time.Millisecond)}
+	}
+}
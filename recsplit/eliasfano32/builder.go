@@ -0,0 +1,134 @@
+/*
+   Copyright 2022 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package eliasfano32
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// builderBlockSize is the capacity of the blocks in which Builder buffers its deltas. Blocks are never
+// reallocated once full, so that adding to a long sequence does not copy everything buffered so far
+const builderBlockSize = 4096
+
+// Builder accumulates increasing values when neither their count nor the maximum is known upfront,
+// which NewEliasFano requires. Values are buffered as varint-encoded deltas (typically 1-3 bytes per value
+// instead of 8), and encoded into EliasFano only when all of them have been added
+type Builder struct {
+	blocks [][]byte
+	count  uint64
+	last   uint64
+}
+
+func NewBuilder() *Builder {
+	return &Builder{}
+}
+
+// Add appends the value to the sequence. Values must not decrease; a value equal to the previous one
+// is ignored, so that adding the same value twice is harmless, as it would be for a set
+func (b *Builder) Add(v uint64) {
+	if b.count > 0 {
+		if v == b.last {
+			return
+		}
+		if v < b.last {
+			panic(fmt.Sprintf("value %d is smaller than previous value %d", v, b.last))
+		}
+	}
+	var numBuf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(numBuf[:], v-b.last)
+	if len(b.blocks) == 0 || len(b.blocks[len(b.blocks)-1])+n > builderBlockSize {
+		if len(b.blocks) == 0 {
+			b.blocks = append(b.blocks, nil)
+		} else {
+			b.blocks = append(b.blocks, make([]byte, 0, builderBlockSize))
+		}
+	}
+	last := len(b.blocks) - 1
+	b.blocks[last] = append(b.blocks[last], numBuf[:n]...)
+	b.last = v
+	b.count++
+}
+
+// Count returns number of distinct values added so far
+func (b *Builder) Count() uint64 {
+	return b.count
+}
+
+// Max returns the largest value added so far
+func (b *Builder) Max() uint64 {
+	return b.last
+}
+
+// Iterator returns iterator over the values added so far
+func (b *Builder) Iterator() *BuilderIter {
+	return &BuilderIter{blocks: b.blocks, left: b.count}
+}
+
+func (b *Builder) Iter() Iterator { return b.Iterator() }
+
+type BuilderIter struct {
+	blocks [][]byte
+	block  int // index of the block being read
+	pos    int // position within the block being read
+	left   uint64
+	val    uint64
+}
+
+func (it *BuilderIter) HasNext() bool {
+	return it.left > 0
+}
+
+func (it *BuilderIter) Next() uint64 {
+	for it.pos == len(it.blocks[it.block]) {
+		it.block++
+		it.pos = 0
+	}
+	delta, n := binary.Uvarint(it.blocks[it.block][it.pos:])
+	it.pos += n
+	it.val += delta
+	it.left--
+	return it.val
+}
+
+// Build encodes the values added so far into EliasFano. At least one value must have been added
+func (b *Builder) Build() *EliasFano {
+	if b.count == 0 {
+		panic("no values added")
+	}
+	ef := NewEliasFano(b.count, b.last)
+	for it := b.Iterator(); it.HasNext(); {
+		ef.AddOffset(it.Next())
+	}
+	ef.Build()
+	return ef
+}
+
+// AppendBytes appends the serialised form of the values added so far, the same as the one
+// produced by EliasFano.AppendBytes for the same values
+func (b *Builder) AppendBytes(buf []byte) []byte {
+	return b.Build().AppendBytes(buf)
+}
+
+// Reset discards all added values, keeping the first block for reuse
+func (b *Builder) Reset() {
+	if len(b.blocks) > 0 {
+		b.blocks = append(b.blocks[:0], b.blocks[0][:0])
+	}
+	b.count = 0
+	b.last = 0
+}
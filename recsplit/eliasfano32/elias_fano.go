@@ -213,6 +213,43 @@ func (ef EliasFano) Search(offset uint64) (uint64, bool) {
 	return 0, false
 }
 
+// search returns index of the first value, starting from index from, which is equal or greater than given value,
+// and that value. Values are probed at exponentially growing distances from the starting index (galloping),
+// so that consecutive searches for increasing values are cheap when the values are close
+func (ef EliasFano) search(from, offset uint64) (uint64, uint64, bool) {
+	n := ef.count + 1
+	lo, hi := from, from
+	for step := uint64(1); hi < n && ef.Get(hi) < offset; step <<= 1 {
+		lo = hi + 1
+		hi += step
+	}
+	if hi > n {
+		hi = n
+	}
+	i := lo + uint64(sort.Search(int(hi-lo), func(j int) bool {
+		return ef.Get(lo+uint64(j)) >= offset
+	}))
+	if i >= n {
+		return n, 0, false
+	}
+	return i, ef.Get(i), true
+}
+
+// rank returns the number of values less than given value
+func (ef EliasFano) rank(offset uint64) uint64 {
+	return uint64(sort.Search(int(ef.count+1), func(i int) bool {
+		return ef.Get(uint64(i)) >= offset
+	}))
+}
+
+// CountInRange returns the number of values v, such that from <= v < to
+func (ef EliasFano) CountInRange(from, to uint64) uint64 {
+	if from >= to || from > ef.maxOffset {
+		return 0
+	}
+	return ef.rank(to) - ef.rank(from)
+}
+
 func (ef EliasFano) Max() uint64 {
 	return ef.maxOffset
 }
@@ -265,6 +302,46 @@ func (efi *EliasFanoIter) Next() uint64 {
 	return val
 }
 
+// ReverseIterator iterates over the values from the largest to the smallest
+func (ef *EliasFano) ReverseIterator() *EliasFanoReverseIter {
+	_, _, sel, currWord, _ := ef.get(ef.count)
+	return &EliasFanoReverseIter{
+		ef:       ef,
+		idx:      ef.count + 1,
+		upperIdx: currWord,
+		window:   ef.upperBits[currWord] & (uint64(0xffffffffffffffff) >> (63 - sel)),
+	}
+}
+
+type EliasFanoReverseIter struct {
+	ef       *EliasFano
+	idx      uint64 // Number of values not yet returned
+	upperIdx uint64 // Word of upper bits with the next value
+	window   uint64 // Bits of that word, at and below the position of the next value
+}
+
+func (efi *EliasFanoReverseIter) HasNext() bool {
+	return efi.idx > 0
+}
+
+func (efi *EliasFanoReverseIter) Next() uint64 {
+	for efi.window == 0 {
+		efi.upperIdx--
+		efi.window = efi.ef.upperBits[efi.upperIdx]
+	}
+	sel := uint64(63 - bits.LeadingZeros64(efi.window))
+	efi.window &^= uint64(1) << sel
+	efi.idx--
+	lowerIdx := efi.idx * efi.ef.l
+	idx64 := lowerIdx >> 6
+	shift := lowerIdx & 63
+	lower := efi.ef.lowerBits[idx64] >> shift
+	if shift > 0 {
+		lower |= efi.ef.lowerBits[idx64+1] << (64 - shift)
+	}
+	return (efi.upperIdx*64+sel-efi.idx)<<efi.ef.l | (lower & efi.ef.lowerBitsMask)
+}
+
 // Write outputs the state of golomb rice encoding into a writer, which can be recovered later by Read
 func (ef *EliasFano) Write(w io.Writer) error {
 	var numBuf [8]byte
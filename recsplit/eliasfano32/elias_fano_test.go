@@ -17,9 +17,13 @@
 package eliasfano32
 
 import (
+	"math"
+	"math/rand"
+	"sort"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestEliasFano(t *testing.T) {
@@ -74,3 +78,168 @@ func TestIterator(t *testing.T) {
 		i++
 	}
 }
+
+func buildEliasFano(offsets []uint64) *EliasFano {
+	ef := NewEliasFano(uint64(len(offsets)), offsets[len(offsets)-1])
+	for _, offset := range offsets {
+		ef.AddOffset(offset)
+	}
+	ef.Build()
+	return ef
+}
+
+func randomOffsets(rnd *rand.Rand, count int, maxOffset uint64) []uint64 {
+	set := map[uint64]struct{}{}
+	for len(set) < count {
+		set[uint64(rnd.Int63n(int64(maxOffset)))] = struct{}{}
+	}
+	offsets := make([]uint64, 0, count)
+	for offset := range set {
+		offsets = append(offsets, offset)
+	}
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i] < offsets[j] })
+	return offsets
+}
+
+func TestReverseIteratorAndCountInRange(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	for _, count := range []int{1, 2, 100, 5000} {
+		for _, maxOffset := range []uint64{20000, 1 << 40} {
+			offsets := randomOffsets(rnd, count, maxOffset)
+			// Sequence read from bytes, as it is used on mmapped files
+			ef, _ := ReadEliasFano(buildEliasFano(offsets).AppendBytes(nil))
+			i := len(offsets)
+			for it := ef.ReverseIterator(); it.HasNext(); {
+				i--
+				require.Equal(t, offsets[i], it.Next(), "count %d, value %d", count, i)
+			}
+			require.Equal(t, 0, i)
+			for j := 0; j < 100; j++ {
+				from, to := uint64(rnd.Int63n(int64(maxOffset))), uint64(rnd.Int63n(int64(maxOffset)))
+				if j%10 == 0 {
+					from = offsets[rnd.Intn(count)]
+				}
+				var expected uint64
+				for _, offset := range offsets {
+					if offset >= from && offset < to {
+						expected++
+					}
+				}
+				require.Equal(t, expected, ef.CountInRange(from, to), "count %d, range [%d, %d)", count, from, to)
+			}
+			require.Equal(t, uint64(count), ef.CountInRange(0, math.MaxUint64))
+		}
+	}
+}
+
+func TestIntersectUnion(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	for _, counts := range [][]int{{1}, {10, 1000}, {1000, 1000, 3000}, {50, 2000, 500, 4000}} {
+		var efs []*EliasFano
+		seen := map[uint64]int{}
+		for _, count := range counts {
+			offsets := randomOffsets(rnd, count, 10000)
+			for _, offset := range offsets {
+				seen[offset]++
+			}
+			efs = append(efs, buildEliasFano(offsets))
+		}
+		var intersection, union []uint64
+		for offset, n := range seen {
+			union = append(union, offset)
+			if n == len(counts) {
+				intersection = append(intersection, offset)
+			}
+		}
+		sort.Slice(intersection, func(i, j int) bool { return intersection[i] < intersection[j] })
+		sort.Slice(union, func(i, j int) bool { return union[i] < union[j] })
+		require.Equal(t, intersection, Intersect(nil, efs...), "counts %v", counts)
+		require.Equal(t, union, Union(nil, efs...), "counts %v", counts)
+	}
+	require.Empty(t, Intersect(nil))
+	require.Empty(t, Union(nil))
+}
+
+func TestPartitionedEliasFano(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	// Dense clusters separated by long gaps
+	skewed := func(clusters int) []uint64 {
+		var offsets []uint64
+		var offset uint64
+		for c := 0; c < clusters; c++ {
+			offset += uint64(rnd.Int63n(1 << 30))
+			for i := rnd.Intn(1000); i >= 0; i-- {
+				offset += 1 + uint64(rnd.Intn(3))
+				offsets = append(offsets, offset)
+			}
+		}
+		return offsets
+	}
+	consecutive := make([]uint64, 1000)
+	for i := range consecutive {
+		consecutive[i] = 5000 + uint64(i)
+	}
+	for _, offsets := range [][]uint64{{7}, {0, 1}, randomOffsets(rnd, 129, 1000), randomOffsets(rnd, 3000, 1<<40), consecutive, skewed(20)} {
+		count := uint64(len(offsets))
+		pef := NewPartitionedEliasFano(count, offsets[count-1])
+		for _, offset := range offsets {
+			pef.AddOffset(offset)
+		}
+		pef.Build()
+		buf := pef.AppendBytes([]byte{1, 2, 3})
+		require.True(t, IsPartitioned(buf[3:]))
+		seq, n := ReadSequence(buf[3:])
+		require.Equal(t, len(buf)-3, n)
+		require.Equal(t, count, seq.Count())
+		require.Equal(t, offsets[count-1], seq.Max())
+		for i, offset := range offsets {
+			require.Equal(t, offset, seq.Get(uint64(i)), "count %d, value %d", count, i)
+		}
+		i := 0
+		for it := seq.Iter(); it.HasNext(); i++ {
+			require.Equal(t, offsets[i], it.Next(), "count %d, value %d", count, i)
+		}
+		require.Equal(t, len(offsets), i)
+		for j := 0; j < 200; j++ {
+			v := uint64(rnd.Int63n(int64(offsets[count-1]) + 2))
+			k := sort.Search(len(offsets), func(i int) bool { return offsets[i] >= v })
+			found, ok := seq.Search(v)
+			require.Equal(t, k < len(offsets), ok, "search %d", v)
+			if ok {
+				require.Equal(t, offsets[k], found, "search %d", v)
+			}
+		}
+
+		ef := buildEliasFano(offsets)
+		efBytes := ef.AppendBytes(nil)
+		require.False(t, IsPartitioned(efBytes))
+		seq, _ = ReadSequence(efBytes)
+		require.Equal(t, ef.Get(count-1), seq.Get(count-1))
+		if count >= 1000 {
+			t.Logf("%d values: elias fano %d bytes, partitioned %d bytes", count, len(efBytes), len(buf)-3)
+		}
+	}
+}
+
+func TestBuilder(t *testing.T) {
+	rnd := rand.New(rand.NewSource(2))
+	b := NewBuilder()
+	for _, offsets := range [][]uint64{{0}, {7}, {3, 1 << 40}, randomOffsets(rnd, 100, 1000), randomOffsets(rnd, 5000, 1<<40)} {
+		b.Reset()
+		for _, offset := range offsets {
+			b.Add(offset)
+			b.Add(offset) // duplicates are ignored
+		}
+		count := uint64(len(offsets))
+		require.Equal(t, count, b.Count())
+		require.Equal(t, offsets[count-1], b.Max())
+		i := 0
+		for it := b.Iter(); it.HasNext(); i++ {
+			require.Equal(t, offsets[i], it.Next())
+		}
+		require.Equal(t, len(offsets), i)
+		// Serialised form is the same as if count and max were known upfront
+		require.Equal(t, buildEliasFano(offsets).AppendBytes([]byte{1}), b.AppendBytes([]byte{1}))
+	}
+	require.Panics(t, func() { b.Add(0) })
+}
@@ -0,0 +1,316 @@
+/*
+   Copyright 2022 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package eliasfano32
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/bits"
+	"sort"
+	"unsafe"
+)
+
+// PartitionSize is the number of values in every partition of PartitionedEliasFano, except the last one
+const PartitionSize = 128
+
+// partitionedTag is set in the highest bit of the first field (count) of serialised PartitionedEliasFano.
+// Serialised EliasFano never has it set, so both can be told apart by ReadSequence
+const partitionedTag = uint64(1) << 63
+
+// Iterator iterates over the values of a sequence in increasing order
+type Iterator interface {
+	HasNext() bool
+	Next() uint64
+}
+
+// Sequence is monotone sequence, encoded either by EliasFano or by PartitionedEliasFano
+type Sequence interface {
+	Get(i uint64) uint64
+	Search(offset uint64) (uint64, bool)
+	Max() uint64
+	Count() uint64
+	// Iter is the same as Iterator, but returns the interface
+	Iter() Iterator
+	AppendBytes(buf []byte) []byte
+}
+
+// ReadSequence reads sequence serialised by EliasFano.AppendBytes or by PartitionedEliasFano.AppendBytes
+func ReadSequence(r []byte) (Sequence, int) {
+	if IsPartitioned(r) {
+		return ReadPartitionedEliasFano(r)
+	}
+	return ReadEliasFano(r)
+}
+
+// IsPartitioned tells whether serialised sequence is PartitionedEliasFano
+func IsPartitioned(r []byte) bool {
+	return binary.BigEndian.Uint64(r)&partitionedTag != 0
+}
+
+func (ef *EliasFano) Iter() Iterator { return ef.Iterator() }
+
+// PartitionedEliasFano encodes strictly increasing sequence, split into partitions of PartitionSize values, each
+// encoded by Elias-Fano relative to its first value, with its own number of lower bits. Partitions of consecutive
+// values take no space at all. This suits skewed sequences, with dense clusters and long gaps, better than
+// EliasFano, which uses the same parameters for all the values.
+// First and last values of the partitions, and bit offsets of the partitions, are encoded by EliasFano
+type PartitionedEliasFano struct {
+	count     uint64 // Number of values - 1, as in EliasFano
+	maxOffset uint64
+	bounds    *EliasFano // First and last values of every partition, interleaved
+	offsets   *EliasFano // Bit offsets of the partitions in data
+	data      []uint64
+
+	// Building
+	values     []uint64 // Values of the current partition
+	bitOffsets []uint64
+	bitCount   uint64
+}
+
+func NewPartitionedEliasFano(count uint64, maxOffset uint64) *PartitionedEliasFano {
+	if count == 0 {
+		panic(fmt.Sprintf("too small count: %d", count))
+	}
+	partitions := (count + PartitionSize - 1) / PartitionSize
+	return &PartitionedEliasFano{
+		count:      count - 1,
+		maxOffset:  maxOffset,
+		bounds:     NewEliasFano(2*partitions, maxOffset),
+		values:     make([]uint64, 0, PartitionSize),
+		bitOffsets: make([]uint64, 0, partitions),
+	}
+}
+
+func (pef *PartitionedEliasFano) AddOffset(offset uint64) {
+	if len(pef.values) > 0 && offset <= pef.values[len(pef.values)-1] {
+		panic(fmt.Sprintf("values must be strictly increasing: %d after %d", offset, pef.values[len(pef.values)-1]))
+	}
+	pef.values = append(pef.values, offset)
+	if len(pef.values) == PartitionSize {
+		pef.addPartition()
+	}
+}
+
+// partitionParams returns the number of lower bits, and the size of upper bits of partition of k values,
+// which are not consecutive, with given universe (last value - first value)
+func partitionParams(k, universe uint64) (l uint64, upperSize uint64) {
+	if (universe+1)/k != 0 {
+		l = 63 ^ uint64(bits.LeadingZeros64((universe+1)/k))
+	}
+	return l, k + (universe >> l) + 1
+}
+
+func (pef *PartitionedEliasFano) addPartition() {
+	first, last := pef.values[0], pef.values[len(pef.values)-1]
+	pef.bounds.AddOffset(first)
+	pef.bounds.AddOffset(last)
+	pef.bitOffsets = append(pef.bitOffsets, pef.bitCount)
+	k := uint64(len(pef.values))
+	if last-first+1 != k {
+		l, upperSize := partitionParams(k, last-first)
+		size := k*l + upperSize
+		for uint64(len(pef.data))*64 < pef.bitCount+size+64 {
+			pef.data = append(pef.data, 0)
+		}
+		upperStart := pef.bitCount + k*l
+		// Lower bits go first, because setBits overwrites the rest of the word following the value
+		if l != 0 {
+			for j, v := range pef.values {
+				setBits(pef.data, pef.bitCount+uint64(j)*l, int(l), (v-first)&((uint64(1)<<l)-1))
+			}
+		}
+		for j, v := range pef.values {
+			set(pef.data, upperStart+((v-first)>>l)+uint64(j))
+		}
+		pef.bitCount += size
+	}
+	pef.values = pef.values[:0]
+}
+
+// Build finishes encoding, after all the values have been added
+func (pef *PartitionedEliasFano) Build() {
+	if len(pef.values) > 0 {
+		pef.addPartition()
+	}
+	pef.bounds.Build()
+	pef.offsets = NewEliasFano(uint64(len(pef.bitOffsets)), pef.bitCount)
+	for _, offset := range pef.bitOffsets {
+		pef.offsets.AddOffset(offset)
+	}
+	pef.offsets.Build()
+	// One extra word, so that lower bits can always be read with two words
+	for uint64(len(pef.data)) < (pef.bitCount+63)/64+1 {
+		pef.data = append(pef.data, 0)
+	}
+	pef.data = pef.data[:(pef.bitCount+63)/64+1]
+	pef.bitOffsets = nil
+	pef.values = nil
+}
+
+// partition returns number of values, first and last value of partition p
+func (pef *PartitionedEliasFano) partition(p uint64) (k, first, last uint64) {
+	k = PartitionSize
+	if p == pef.count/PartitionSize {
+		k = pef.count%PartitionSize + 1
+	}
+	first, last = pef.bounds.Get(2*p), pef.bounds.Get(2*p+1)
+	return k, first, last
+}
+
+// getInPartition returns value j of the partition p, which has k values, and given first and last value
+func (pef *PartitionedEliasFano) getInPartition(p, j, k, first, last uint64) uint64 {
+	if last-first+1 == k {
+		return first + j
+	}
+	l, _ := partitionParams(k, last-first)
+	start := pef.offsets.Get(p)
+	var lower uint64
+	if l != 0 {
+		pos := start + j*l
+		lower = pef.data[pos/64] >> (pos % 64)
+		if pos%64 > 0 {
+			lower |= pef.data[pos/64+1] << (64 - pos%64)
+		}
+		lower &= (uint64(1) << l) - 1
+	}
+	// Select j-th set bit of the upper bits
+	upperStart := start + k*l
+	currWord := upperStart / 64
+	window := pef.data[currWord] & (uint64(0xffffffffffffffff) << (upperStart % 64))
+	d := int(j)
+	for bitCount := bits.OnesCount64(window); bitCount <= d; bitCount = bits.OnesCount64(window) {
+		currWord++
+		window = pef.data[currWord]
+		d -= bitCount
+	}
+	for ; d > 0; d-- {
+		window &= window - 1
+	}
+	upper := currWord*64 + uint64(bits.TrailingZeros64(window)) - upperStart - j
+	return first + (upper<<l | lower)
+}
+
+func (pef *PartitionedEliasFano) Get(i uint64) uint64 {
+	p := i / PartitionSize
+	k, first, last := pef.partition(p)
+	return pef.getInPartition(p, i%PartitionSize, k, first, last)
+}
+
+// Search returns the value in the sequence, equal or greater than given value
+func (pef *PartitionedEliasFano) Search(offset uint64) (uint64, bool) {
+	partitions := pef.count/PartitionSize + 1
+	p := uint64(sort.Search(int(partitions), func(p int) bool {
+		return pef.bounds.Get(2*uint64(p)+1) >= offset
+	}))
+	if p == partitions {
+		return 0, false
+	}
+	k, first, last := pef.partition(p)
+	if offset <= first {
+		return first, true
+	}
+	j := uint64(sort.Search(int(k), func(j int) bool {
+		return pef.getInPartition(p, uint64(j), k, first, last) >= offset
+	}))
+	return pef.getInPartition(p, j, k, first, last), true
+}
+
+func (pef *PartitionedEliasFano) Max() uint64 {
+	return pef.maxOffset
+}
+
+func (pef *PartitionedEliasFano) Count() uint64 {
+	return pef.count + 1
+}
+
+func (pef *PartitionedEliasFano) Iterator() *PartitionedEliasFanoIter {
+	return &PartitionedEliasFanoIter{pef: pef, values: make([]uint64, 0, PartitionSize)}
+}
+
+func (pef *PartitionedEliasFano) Iter() Iterator { return pef.Iterator() }
+
+// PartitionedEliasFanoIter decodes one partition at a time
+type PartitionedEliasFanoIter struct {
+	pef    *PartitionedEliasFano
+	p      uint64   // Next partition to decode
+	values []uint64 // Decoded values of the current partition
+	j      int      // Next value of the current partition to return
+}
+
+func (it *PartitionedEliasFanoIter) HasNext() bool {
+	return it.j < len(it.values) || it.p <= it.pef.count/PartitionSize
+}
+
+func (it *PartitionedEliasFanoIter) Next() uint64 {
+	if it.j == len(it.values) {
+		k, first, last := it.pef.partition(it.p)
+		it.values = it.values[:k]
+		if last-first+1 == k {
+			for j := range it.values {
+				it.values[j] = first + uint64(j)
+			}
+		} else {
+			for j := range it.values {
+				it.values[j] = it.pef.getInPartition(it.p, uint64(j), k, first, last)
+			}
+		}
+		it.p++
+		it.j = 0
+	}
+	it.j++
+	return it.values[it.j-1]
+}
+
+// AppendBytes serialises the sequence: count - 1 with partitionedTag (8 bytes) | max value + 1 (8 bytes) |
+// number of data words (8 bytes) | bounds | offsets | data words
+func (pef *PartitionedEliasFano) AppendBytes(buf []byte) []byte {
+	var numBuf [8]byte
+	binary.BigEndian.PutUint64(numBuf[:], pef.count|partitionedTag)
+	buf = append(buf, numBuf[:]...)
+	binary.BigEndian.PutUint64(numBuf[:], pef.maxOffset+1)
+	buf = append(buf, numBuf[:]...)
+	binary.BigEndian.PutUint64(numBuf[:], uint64(len(pef.data)))
+	buf = append(buf, numBuf[:]...)
+	buf = pef.bounds.AppendBytes(buf)
+	buf = pef.offsets.AppendBytes(buf)
+	p := (*[maxDataSize]byte)(unsafe.Pointer(&pef.data[0]))
+	b := (*p)[:]
+	buf = append(buf, b[:len(pef.data)*8]...)
+	return buf
+}
+
+// Size returns the number of bytes AppendBytes appends
+func (pef *PartitionedEliasFano) Size() int {
+	return 24 + (16 + 8*len(pef.bounds.data)) + (16 + 8*len(pef.offsets.data)) + 8*len(pef.data)
+}
+
+// ReadPartitionedEliasFano reads the sequence serialised by AppendBytes, and returns the number of bytes it occupies
+func ReadPartitionedEliasFano(r []byte) (*PartitionedEliasFano, int) {
+	pef := &PartitionedEliasFano{}
+	pef.count = binary.BigEndian.Uint64(r[:8]) &^ partitionedTag
+	pef.maxOffset = binary.BigEndian.Uint64(r[8:16]) - 1
+	dataLen := binary.BigEndian.Uint64(r[16:24])
+	pos := 24
+	var n int
+	pef.bounds, n = ReadEliasFano(r[pos:])
+	pos += n
+	pef.offsets, n = ReadEliasFano(r[pos:])
+	pos += n
+	p := (*[maxDataSize / 8]uint64)(unsafe.Pointer(&r[pos]))
+	pef.data = p[:dataLen]
+	return pef, pos + 8*int(dataLen)
+}
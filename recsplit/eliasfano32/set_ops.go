@@ -0,0 +1,117 @@
+/*
+   Copyright 2022 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package eliasfano32
+
+import (
+	"container/heap"
+	"math"
+	"sort"
+)
+
+// Intersect appends values present in all the sequences to dst, in increasing order, and returns the extended dst.
+// Sequences are not decoded: candidate value is searched in each sequence in turn (galloping from the position
+// of the previous match), starting from the shortest sequence, and every mismatch moves candidate forward
+func Intersect(dst []uint64, efs ...*EliasFano) []uint64 {
+	if len(efs) == 0 {
+		return dst
+	}
+	sorted := make([]*EliasFano, len(efs))
+	copy(sorted, efs)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Count() < sorted[j].Count() })
+	pos := make([]uint64, len(sorted))
+	var candidate uint64
+	for {
+		// Number of sequences in a row, which contain the candidate
+		for j, agreed := 0, 0; agreed < len(sorted); j = (j + 1) % len(sorted) {
+			i, v, ok := sorted[j].search(pos[j], candidate)
+			if !ok {
+				return dst
+			}
+			pos[j] = i
+			if v == candidate {
+				agreed++
+			} else {
+				candidate, agreed = v, 1
+			}
+		}
+		dst = append(dst, candidate)
+		if candidate == math.MaxUint64 {
+			return dst
+		}
+		candidate++
+	}
+}
+
+// Union appends values present in any of the sequences to dst, in increasing order and without duplicates,
+// and returns the extended dst
+func Union(dst []uint64, efs ...*EliasFano) []uint64 {
+	for it := NewUnionIterator(efs...); it.HasNext(); {
+		dst = append(dst, it.Next())
+	}
+	return dst
+}
+
+// UnionIterator merges iterators of several sequences, returning values present in any of them,
+// in increasing order and without duplicates
+type UnionIterator struct {
+	h unionHeap
+}
+
+func NewUnionIterator(efs ...*EliasFano) *UnionIterator {
+	ui := &UnionIterator{h: make(unionHeap, 0, len(efs))}
+	for _, ef := range efs {
+		it := ef.Iterator()
+		ui.h = append(ui.h, unionItem{it: it, val: it.Next()}) // Sequences are never empty
+	}
+	heap.Init(&ui.h)
+	return ui
+}
+
+func (ui *UnionIterator) HasNext() bool {
+	return len(ui.h) > 0
+}
+
+func (ui *UnionIterator) Next() uint64 {
+	val := ui.h[0].val
+	for len(ui.h) > 0 && ui.h[0].val == val {
+		if it := ui.h[0].it; it.HasNext() {
+			ui.h[0].val = it.Next()
+			heap.Fix(&ui.h, 0)
+		} else {
+			heap.Pop(&ui.h)
+		}
+	}
+	return val
+}
+
+type unionItem struct {
+	it  *EliasFanoIter
+	val uint64 // Current value of the iterator
+}
+
+type unionHeap []unionItem
+
+func (h unionHeap) Len() int            { return len(h) }
+func (h unionHeap) Less(i, j int) bool  { return h[i].val < h[j].val }
+func (h unionHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *unionHeap) Push(x interface{}) { *h = append(*h, x.(unionItem)) }
+func (h *unionHeap) Pop() interface{} {
+	old := *h
+	item := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return item
+}
@@ -0,0 +1,135 @@
+/*
+   Copyright 2022 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package recsplit
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/bits"
+	"os"
+
+	"github.com/ledgerwatch/erigon-lib/etl"
+)
+
+// Features of the index, written in one byte after the start seeds. Earlier versions only wrote 0 or 1 (enums)
+const (
+	featureEnums        byte = 1 << iota // Perfect hash points to enumeration, and enumeration points to offsets
+	featureFingerprints                  // Fingerprints of the keys are stored for membership checks
+)
+
+// Fingerprints section of the index is: number of bits of each fingerprint (1 byte) | size of the section (8 bytes) |
+// fingerprints of the keys in the order of records, packed into big-endian bit stream, followed by 8 zero bytes,
+// so that every fingerprint can be read with one 8 bytes load
+const fingerprintsPadding = 8
+
+// keyFingerprint derives fingerprint of the key from both halves of its hash. The perfect hash function places the keys
+// by the high bits of bucketHash and by fingerprint, so absent key, which lands on a record of another key, has a chance
+// of 2^-bits to have the same key fingerprint
+func keyFingerprint(bucketHash, fingerprint uint64, fpBits int) uint32 {
+	return uint32(remix(bucketHash^bits.RotateLeft64(fingerprint, 32)) >> (64 - fpBits))
+}
+
+// fingerprintWriter packs key fingerprints into a temporary file while the records are written,
+// so that they can be appended to the index after all the records
+type fingerprintWriter struct {
+	f       *os.File
+	w       *bufio.Writer
+	bits    int
+	acc     uint64 // Bits not yet written
+	accBits int
+	size    uint64 // Number of bytes written
+}
+
+func newFingerprintWriter(tmpDir string, fpBits int) (*fingerprintWriter, error) {
+	f, err := os.CreateTemp(tmpDir, "recsplit-fingerprints-")
+	if err != nil {
+		return nil, err
+	}
+	return &fingerprintWriter{f: f, w: bufio.NewWriterSize(f, etl.BufIOSize), bits: fpBits}, nil
+}
+
+func (fw *fingerprintWriter) add(fp uint32) error {
+	fw.acc = fw.acc<<fw.bits | uint64(fp)
+	fw.accBits += fw.bits
+	for fw.accBits >= 8 {
+		fw.accBits -= 8
+		if err := fw.w.WriteByte(byte(fw.acc >> fw.accBits)); err != nil {
+			return err
+		}
+		fw.size++
+	}
+	fw.acc &= (1 << fw.accBits) - 1
+	return nil
+}
+
+// writeTo writes the fingerprints section into w
+func (fw *fingerprintWriter) writeTo(w io.Writer) error {
+	if fw.accBits > 0 {
+		if err := fw.w.WriteByte(byte(fw.acc << (8 - fw.accBits))); err != nil {
+			return err
+		}
+		fw.size++
+		fw.acc, fw.accBits = 0, 0
+	}
+	if err := fw.w.Flush(); err != nil {
+		return err
+	}
+	var hdr [1 + 8 + fingerprintsPadding]byte
+	hdr[0] = byte(fw.bits)
+	binary.BigEndian.PutUint64(hdr[1:], fw.size+fingerprintsPadding)
+	if _, err := w.Write(hdr[:9]); err != nil {
+		return err
+	}
+	if _, err := fw.f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := io.CopyN(w, fw.f, int64(fw.size)); err != nil {
+		return err
+	}
+	_, err := w.Write(hdr[9:])
+	return err
+}
+
+func (fw *fingerprintWriter) close() {
+	fw.f.Close()
+	os.Remove(fw.f.Name())
+}
+
+// readFingerprints parses fingerprints section of the index for keyCount keys, and returns the number of bytes it occupies
+func readFingerprints(data []byte, keyCount uint64) (fpBits int, fps []byte, n int, err error) {
+	if len(data) < 9 {
+		return 0, nil, 0, fmt.Errorf("fingerprints section is too short")
+	}
+	fpBits = int(data[0])
+	size := binary.BigEndian.Uint64(data[1:])
+	if fpBits < 1 || fpBits > 32 {
+		return 0, nil, 0, fmt.Errorf("invalid number of fingerprint bits: %d", fpBits)
+	}
+	if size != (keyCount*uint64(fpBits)+7)/8+fingerprintsPadding || size > uint64(len(data)-9) {
+		return 0, nil, 0, fmt.Errorf("fingerprints size %d does not match %d keys", size, keyCount)
+	}
+	return fpBits, data[9 : 9+size], 9 + int(size), nil
+}
+
+// fingerprintAt returns fingerprint of the key of record rec
+func fingerprintAt(fps []byte, fpBits int, rec uint64) uint32 {
+	pos := rec * uint64(fpBits)
+	v := binary.BigEndian.Uint64(fps[pos/8:]) << (pos % 8)
+	return uint32(v >> (64 - fpBits))
+}
@@ -0,0 +1,119 @@
+/*
+   Copyright 2022 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package recsplit
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+)
+
+// Index files come in two formats. Legacy (headerless) format starts with the base data ID (8 bytes), and is only read.
+// Versioned format starts with indexMagic, followed by the rest of the header, and then by the same data as
+// the legacy format. Because the first byte of the magic is 0xff, versioned file can't be mistaken for a legacy
+// file (that would require base data ID of 2^63 or more)
+//
+// Header of the versioned format (version 1):
+//
+//	magic (4 bytes) | version (1 byte) | features (1 byte) | bytes per record (1 byte) | reserved (1 byte)
+//	key count (8 bytes) | bucket count (8 bytes) | bucket size (2 bytes) | leaf size (2 bytes) | salt (4 bytes)
+//	data size (8 bytes) | data checksum (4 bytes) | header checksum (4 bytes)
+//
+// Parameters of the index are repeated in the header, and must match the ones in the data.
+// Data checksum covers everything after the header, and is only checked by Index.Verify, because that needs
+// reading the whole file. Header checksum covers the header fields before it, and is checked when index is opened.
+// All checksums are CRC32 (Castagnoli)
+const (
+	indexMagic      = "\xffRSI"
+	indexVersion1   = 1
+	indexHeaderSize = 8 + 8 + 8 + 2 + 2 + 4 + 8 + 4 + 4
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// indexHeader is the header of the versioned index file
+type indexHeader struct {
+	version      uint8
+	features     byte
+	bytesPerRec  int
+	keyCount     uint64
+	bucketCount  uint64
+	bucketSize   uint16
+	leafSize     uint16
+	salt         uint32
+	dataSize     uint64 // Size of everything after the header
+	dataChecksum uint32
+}
+
+func (h *indexHeader) encode() []byte {
+	buf := make([]byte, indexHeaderSize)
+	copy(buf, indexMagic)
+	buf[4] = h.version
+	buf[5] = h.features
+	buf[6] = byte(h.bytesPerRec)
+	binary.BigEndian.PutUint64(buf[8:], h.keyCount)
+	binary.BigEndian.PutUint64(buf[16:], h.bucketCount)
+	binary.BigEndian.PutUint16(buf[24:], h.bucketSize)
+	binary.BigEndian.PutUint16(buf[26:], h.leafSize)
+	binary.BigEndian.PutUint32(buf[28:], h.salt)
+	binary.BigEndian.PutUint64(buf[32:], h.dataSize)
+	binary.BigEndian.PutUint32(buf[40:], h.dataChecksum)
+	binary.BigEndian.PutUint32(buf[44:], crc32.Checksum(buf[:44], crcTable))
+	return buf
+}
+
+// hasIndexMagic tells whether data starts with the header of the versioned format
+func hasIndexMagic(data []byte) bool {
+	return len(data) >= len(indexMagic) && string(data[:len(indexMagic)]) == indexMagic
+}
+
+// parseIndexHeader parses and checks the header of the versioned index file, given all the data of the file
+func parseIndexHeader(data []byte) (indexHeader, error) {
+	var h indexHeader
+	if len(data) < indexHeaderSize {
+		return h, fmt.Errorf("index header is truncated: %d bytes", len(data))
+	}
+	if checksum := crc32.Checksum(data[:44], crcTable); checksum != binary.BigEndian.Uint32(data[44:]) {
+		return h, fmt.Errorf("index header checksum mismatch")
+	}
+	h.version = data[4]
+	if h.version != indexVersion1 {
+		return h, fmt.Errorf("unsupported index version %d", h.version)
+	}
+	h.features = data[5]
+	h.bytesPerRec = int(data[6])
+	h.keyCount = binary.BigEndian.Uint64(data[8:])
+	h.bucketCount = binary.BigEndian.Uint64(data[16:])
+	h.bucketSize = binary.BigEndian.Uint16(data[24:])
+	h.leafSize = binary.BigEndian.Uint16(data[26:])
+	h.salt = binary.BigEndian.Uint32(data[28:])
+	h.dataSize = binary.BigEndian.Uint64(data[32:])
+	h.dataChecksum = binary.BigEndian.Uint32(data[40:])
+	if h.dataSize != uint64(len(data)-indexHeaderSize) {
+		return h, fmt.Errorf("index data size %d does not match header %d, file is truncated or damaged", len(data)-indexHeaderSize, h.dataSize)
+	}
+	return h, nil
+}
+
+// check makes sure that parameters of the index, parsed from the data, match the header
+func (h *indexHeader) check(idx *Index) error {
+	if h.features != idx.features || h.bytesPerRec != idx.bytesPerRec || h.keyCount != idx.keyCount || h.bucketCount != idx.bucketCount ||
+		int(h.bucketSize) != idx.bucketSize || h.leafSize != idx.leafSize || h.salt != idx.salt {
+		return fmt.Errorf("index parameters do not match header")
+	}
+	return nil
+}
@@ -82,6 +82,17 @@ func (g *GolombRice) appendFixed(v uint64, log2golomb int) {
 	g.bitCount += log2golomb
 }
 
+// appendBits adds all the bits of another encoding to the end of the current encoding
+func (g *GolombRice) appendBits(src *GolombRice) {
+	for i, n := 0, src.bitCount; n > 0; i, n = i+1, n-64 {
+		if n < 64 {
+			g.appendFixed(src.data[i], n)
+		} else {
+			g.appendFixed(src.data[i], 64)
+		}
+	}
+}
+
 // Bits returns currrent number of bits in the compact encoding of the hash function representation
 func (g GolombRice) Bits() int {
 	return g.bitCount
@@ -20,9 +20,12 @@ import (
 	"bufio"
 	"encoding/binary"
 	"fmt"
+	"hash/crc32"
+	"io"
 	"math"
 	"math/bits"
 	"os"
+	"sort"
 	"unsafe"
 
 	"github.com/ledgerwatch/erigon-lib/mmap"
@@ -36,7 +39,9 @@ type Index struct {
 	f                  *os.File
 	mmapHandle1        []byte                 // mmap handle for unix (this is used to close mmap)
 	mmapHandle2        *[mmap.MaxMapSize]byte // mmap handle for windows (this is used to close mmap)
-	data               []byte                 // slice of correct size for the index to work with
+	data               []byte                 // slice of correct size for the index to work with (without header of versioned format)
+	header             *indexHeader           // Header of versioned format, nil for legacy format
+	features           byte
 	keyCount           uint64
 	bytesPerRec        int
 	recMask            uint64
@@ -44,6 +49,8 @@ type Index struct {
 	ef                 eliasfano16.DoubleEliasFano
 	enums              bool
 	offsetEf           *eliasfano32.EliasFano
+	fingerprintBits    int    // Number of bits of key fingerprints, 0 if the index has none
+	fingerprints       []byte // Packed fingerprints of the keys, in the order of records
 	baseDataID         uint64
 	bucketCount        uint64 // Number of buckets
 	bucketSize         int
@@ -64,6 +71,8 @@ func MustOpen(indexFile string) *Index {
 	return idx
 }
 
+// OpenIndex opens index file of either format. Header of versioned format is checked, and truncated or foreign
+// files are reported as errors
 func OpenIndex(indexFile string) (*Index, error) {
 	idx := &Index{
 		indexFile: indexFile,
@@ -75,18 +84,52 @@ func OpenIndex(indexFile string) (*Index, error) {
 	}
 	var stat os.FileInfo
 	if stat, err = idx.f.Stat(); err != nil {
+		idx.f.Close()
 		return nil, err
 	}
 	idx.size = stat.Size()
+	if idx.size == 0 {
+		idx.f.Close()
+		return nil, fmt.Errorf("index %s: file is empty", indexFile)
+	}
 	if idx.mmapHandle1, idx.mmapHandle2, err = mmap.Mmap(idx.f, int(idx.size)); err != nil {
+		idx.f.Close()
 		return nil, err
 	}
+	if err = idx.parse(); err != nil {
+		idx.Close()
+		return nil, fmt.Errorf("index %s: %w", indexFile, err)
+	}
+	return idx, nil
+}
+
+func (idx *Index) parse() (err error) {
+	defer func() {
+		// Positions of the sections are not checked one by one, damaged legacy file makes parsing go out of bounds
+		if rec := recover(); rec != nil {
+			err = fmt.Errorf("index is truncated or damaged: %v", rec)
+		}
+	}()
 	idx.data = idx.mmapHandle1[:idx.size]
+	if hasIndexMagic(idx.data) {
+		hdr, err := parseIndexHeader(idx.data)
+		if err != nil {
+			return err
+		}
+		idx.header = &hdr
+		idx.data = idx.data[indexHeaderSize:]
+	}
+	if len(idx.data) < 17 {
+		return fmt.Errorf("index is too short: %d bytes", len(idx.data))
+	}
 	// Read number of keys and bytes per record
 	idx.baseDataID = binary.BigEndian.Uint64(idx.data[:8])
 	idx.keyCount = binary.BigEndian.Uint64(idx.data[8:16])
 	idx.bytesPerRec = int(idx.data[16])
 	idx.recMask = (uint64(1) << (8 * idx.bytesPerRec)) - 1
+	if idx.bytesPerRec > 8 || idx.keyCount*uint64(idx.bytesPerRec) > uint64(len(idx.data)) {
+		return fmt.Errorf("invalid number of keys %d or bytes per record %d", idx.keyCount, idx.bytesPerRec)
+	}
 	offset := 16 + 1 + int(idx.keyCount)*idx.bytesPerRec
 
 	// Bucket count, bucketSize, leafSize
@@ -113,13 +156,22 @@ func OpenIndex(indexFile string) (*Index, error) {
 		idx.startSeed[i] = binary.BigEndian.Uint64(idx.data[offset:])
 		offset += 8
 	}
-	idx.enums = idx.data[offset] != 0
+	features := idx.data[offset]
+	idx.features = features
+	idx.enums = features&featureEnums != 0
 	offset++
 	if idx.enums {
 		var size int
 		idx.offsetEf, size = eliasfano32.ReadEliasFano(idx.data[offset:])
 		offset += size
 	}
+	if features&featureFingerprints != 0 {
+		var size int
+		if idx.fingerprintBits, idx.fingerprints, size, err = readFingerprints(idx.data[offset:], idx.keyCount); err != nil {
+			return err
+		}
+		offset += size
+	}
 	// Size of golomb rice params
 	golombParamSize := binary.BigEndian.Uint16(idx.data[offset:])
 	offset += 4
@@ -135,11 +187,37 @@ func OpenIndex(indexFile string) (*Index, error) {
 	}
 	l := binary.BigEndian.Uint64(idx.data[offset:])
 	offset += 8
+	if l > uint64(len(idx.data)-offset)/8 {
+		return fmt.Errorf("golomb rice data goes beyond the end of file")
+	}
 	p := (*[maxDataSize / 8]uint64)(unsafe.Pointer(&idx.data[offset]))
 	idx.grData = p[:l]
 	offset += 8 * int(l)
 	idx.ef.Read(idx.data[offset:])
-	return idx, nil
+	if idx.header != nil {
+		return idx.header.check(idx)
+	}
+	return nil
+}
+
+// Version returns version of the format of the index file, 0 for legacy (headerless) format
+func (idx *Index) Version() uint8 {
+	if idx.header == nil {
+		return 0
+	}
+	return idx.header.version
+}
+
+// Verify scans the whole file to detect damage, by checking data checksum of versioned format.
+// Legacy files have no checksums, and are not checked
+func (idx *Index) Verify() error {
+	if idx.header == nil {
+		return nil
+	}
+	if crc32.Checksum(idx.data, crcTable) != idx.header.dataChecksum {
+		return fmt.Errorf("index %s: data checksum mismatch", idx.indexFile)
+	}
+	return nil
 }
 
 func (idx *Index) Size() int64 {
@@ -148,6 +226,9 @@ func (idx *Index) Size() int64 {
 
 func (idx *Index) BaseDataID() uint64 { return idx.baseDataID }
 
+// Salt returns the salt of the hash function used for allocating keys to the buckets
+func (idx *Index) Salt() uint32 { return idx.salt }
+
 func (idx *Index) Close() error {
 	if err := mmap.Munmap(idx.mmapHandle1, idx.mmapHandle2); err != nil {
 		return err
@@ -181,7 +262,10 @@ func (idx *Index) KeyCount() uint64 {
 	return idx.keyCount
 }
 
-// Lookup is not thread-safe because it used id.hasher
+// HasFingerprints returns true if the index stores fingerprints of the keys, so that LookupExists can reject absent keys
+func (idx *Index) HasFingerprints() bool { return idx.fingerprintBits > 0 }
+
+// Lookup is safe for concurrent use
 func (idx *Index) Lookup(bucketHash, fingerprint uint64) uint64 {
 	if idx.keyCount == 0 {
 		panic("no Lookup should be done when keyCount==0, please use Empty function to guard")
@@ -189,13 +273,60 @@ func (idx *Index) Lookup(bucketHash, fingerprint uint64) uint64 {
 	if idx.keyCount == 1 {
 		return 0
 	}
-	var gr GolombRiceReader
-	gr.data = idx.grData
+	return idx.recOffset(idx.lookupRec(bucketHash, fingerprint))
+}
 
+// LookupExists is like Lookup, but also checks fingerprint of the key, if the index has them (see HasFingerprints),
+// and returns false for the keys which were not added to the index (with false positive rate of 2^-bits of
+// fingerprints). Without fingerprints, all the keys are reported as existing. It is safe to call for empty index
+func (idx *Index) LookupExists(bucketHash, fingerprint uint64) (uint64, bool) {
+	if idx.keyCount == 0 {
+		return 0, false
+	}
+	var rec uint64
+	if idx.keyCount > 1 {
+		rec = idx.lookupRec(bucketHash, fingerprint)
+	}
+	if idx.fingerprintBits > 0 && fingerprintAt(idx.fingerprints, idx.fingerprintBits, rec) != keyFingerprint(bucketHash, fingerprint, idx.fingerprintBits) {
+		return 0, false
+	}
+	if idx.keyCount == 1 {
+		return 0, true
+	}
+	return idx.recOffset(rec), true
+}
+
+func (idx *Index) recOffset(rec uint64) uint64 {
+	return binary.BigEndian.Uint64(idx.data[1+8+idx.bytesPerRec*(int(rec)+1):]) & idx.recMask
+}
+
+// recLookup is the state of the lookup of one key, after its bucket has been located
+type recLookup struct {
+	gr          GolombRiceReader
+	fingerprint uint64
+	cumKeys     uint64 // Number of keys in the preceding buckets
+	m           uint16 // Number of keys in the bucket
+}
+
+// lookupRec returns the number of the record of the key, for the index with more than one key
+func (idx *Index) lookupRec(bucketHash, fingerprint uint64) uint64 {
+	var l recLookup
+	idx.locateBucket(&l, bucketHash, fingerprint)
+	return idx.descend(&l)
+}
+
+// locateBucket reads position of the bucket of the key in Elias-Fano, and the first word of its Golomb-Rice code
+func (idx *Index) locateBucket(l *recLookup, bucketHash, fingerprint uint64) {
+	l.gr.data = idx.grData
 	bucket := remap(bucketHash, idx.bucketCount)
 	cumKeys, cumKeysNext, bitPos := idx.ef.Get3(bucket)
-	m := uint16(cumKeysNext - cumKeys) // Number of keys in this bucket
-	gr.ReadReset(int(bitPos), idx.skipBits(m))
+	l.fingerprint, l.cumKeys, l.m = fingerprint, cumKeys, uint16(cumKeysNext-cumKeys)
+	l.gr.ReadReset(int(bitPos), idx.skipBits(l.m))
+}
+
+// descend walks the Golomb-Rice code of the bucket, located by locateBucket, down to the record of the key
+func (idx *Index) descend(l *recLookup) uint64 {
+	gr, fingerprint, cumKeys, m := &l.gr, l.fingerprint, l.cumKeys, l.m
 	var level int
 	for m > idx.secondaryAggrBound { // fanout = 2
 		d := gr.ReadNext(idx.golombParam(m))
@@ -241,8 +372,7 @@ func (idx *Index) Lookup(bucketHash, fingerprint uint64) uint64 {
 		level++
 	}
 	b := gr.ReadNext(idx.golombParam(m))
-	rec := int(cumKeys) + int(remap16(remix(fingerprint+idx.startSeed[level]+b), m))
-	return binary.BigEndian.Uint64(idx.data[1+8+idx.bytesPerRec*(rec+1):]) & idx.recMask
+	return cumKeys + uint64(remap16(remix(fingerprint+idx.startSeed[level]+b), m))
 }
 
 // OrdinalLookup returns the offset of i-th element in the index
@@ -263,6 +393,47 @@ func (idx *Index) ExtractOffsets() map[uint64]uint64 {
 	return m
 }
 
+// OffsetIterator returns iterator over all the offsets stored in the index, in increasing order. For the index
+// with enums (see RecSplitArgs.Enums), the ordinal of each offset is the one accepted by OrdinalLookup. Otherwise
+// the offsets are read from the records and sorted in memory, and the ordinal is just the position in that order
+func (idx *Index) OffsetIterator() *OffsetIterator {
+	if idx.enums && idx.offsetEf != nil {
+		return &OffsetIterator{efIt: idx.offsetEf.Iterator(), count: idx.offsetEf.Count()}
+	}
+	offsets := make([]uint64, 0, idx.keyCount)
+	pos := 1 + 8 + idx.bytesPerRec
+	for rec := uint64(0); rec < idx.keyCount; rec++ {
+		offsets = append(offsets, binary.BigEndian.Uint64(idx.data[pos:])&idx.recMask)
+		pos += idx.bytesPerRec
+	}
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i] < offsets[j] })
+	return &OffsetIterator{offsets: offsets, count: uint64(len(offsets))}
+}
+
+// OffsetIterator enumerates (ordinal, offset) pairs of the index, see Index.OffsetIterator
+type OffsetIterator struct {
+	efIt    *eliasfano32.EliasFanoIter // Offsets of the index with enums
+	offsets []uint64                   // Sorted offsets of the index without enums
+	ordinal uint64
+	count   uint64
+}
+
+func (it *OffsetIterator) HasNext() bool {
+	return it.ordinal < it.count
+}
+
+func (it *OffsetIterator) Next() (ordinal, offset uint64) {
+	ordinal = it.ordinal
+	if it.efIt != nil {
+		offset = it.efIt.Next()
+	} else {
+		offset = it.offsets[ordinal]
+	}
+	it.ordinal++
+	return ordinal, offset
+}
+
+// RewriteWithOffsets writes the index in versioned format, with offsets replaced according to m
 func (idx *Index) RewriteWithOffsets(w *bufio.Writer, m map[uint64]uint64) error {
 	// New max offset
 	var maxOffset uint64
@@ -272,6 +443,31 @@ func (idx *Index) RewriteWithOffsets(w *bufio.Writer, m map[uint64]uint64) error
 		}
 	}
 	bytesPerRec := (bits.Len64(maxOffset) + 7) / 8
+	// Data is written twice, first to compute the checksum for the header
+	checksum := crc32.New(crcTable)
+	if err := idx.writeWithOffsets(checksum, m, bytesPerRec); err != nil {
+		return err
+	}
+	recsEnd := 16 + 1 + int(idx.keyCount)*idx.bytesPerRec
+	hdr := indexHeader{
+		version:      indexVersion1,
+		features:     idx.features,
+		bytesPerRec:  bytesPerRec,
+		keyCount:     idx.keyCount,
+		bucketCount:  idx.bucketCount,
+		bucketSize:   uint16(idx.bucketSize),
+		leafSize:     idx.leafSize,
+		salt:         idx.salt,
+		dataSize:     uint64(16 + 1 + int(idx.keyCount)*bytesPerRec + len(idx.data) - recsEnd),
+		dataChecksum: checksum.Sum32(),
+	}
+	if _, err := w.Write(hdr.encode()); err != nil {
+		return fmt.Errorf("write header: %w", err)
+	}
+	return idx.writeWithOffsets(w, m, bytesPerRec)
+}
+
+func (idx *Index) writeWithOffsets(w io.Writer, m map[uint64]uint64, bytesPerRec int) error {
 	var numBuf [8]byte
 	// Write baseDataID
 	binary.BigEndian.PutUint64(numBuf[:], idx.baseDataID)
@@ -285,7 +481,7 @@ func (idx *Index) RewriteWithOffsets(w *bufio.Writer, m map[uint64]uint64) error
 		return fmt.Errorf("write number of keys: %w", err)
 	}
 	// Write number of bytes per index record
-	if err := w.WriteByte(byte(bytesPerRec)); err != nil {
+	if _, err := w.Write([]byte{byte(bytesPerRec)}); err != nil {
 		return fmt.Errorf("write bytes per record: %w", err)
 	}
 	pos := 1 + 8 + idx.bytesPerRec
@@ -22,36 +22,36 @@ import (
 	"github.com/spaolacci/murmur3"
 )
 
-// IndexReader encapsulates Hash128 to allow concurrent access to Index
+// lookupBatchSize is the number of keys of LookupMany, whose buckets are located before walking their Golomb-Rice codes
+const lookupBatchSize = 64
+
+// IndexReader encapsulates hashing of the keys to allow concurrent access to Index.
+// It does not hold any locks, and is safe for concurrent use
 type IndexReader struct {
-	mu     sync.RWMutex
-	hasher murmur3.Hash128
-	index  *Index
+	hashers sync.Pool // Hashers for the keys consisting of two parts
+	salt    uint32
+	index   *Index
 }
 
 // NewIndexReader creates new IndexReader
 func NewIndexReader(index *Index) *IndexReader {
-	return &IndexReader{
-		hasher: murmur3.New128WithSeed(index.salt),
-		index:  index,
-	}
+	r := &IndexReader{salt: index.salt, index: index}
+	r.hashers.New = func() interface{} { return murmur3.New128WithSeed(r.salt) }
+	return r
 }
 
 func (r *IndexReader) sum(key []byte) (uint64, uint64) {
-	r.mu.Lock()
-	defer r.mu.Unlock()
-	r.hasher.Reset()
-	r.hasher.Write(key) //nolint:errcheck
-	return r.hasher.Sum128()
+	return murmur3.Sum128WithSeed(key, r.salt)
 }
 
 func (r *IndexReader) sum2(key1, key2 []byte) (uint64, uint64) {
-	r.mu.Lock()
-	defer r.mu.Unlock()
-	r.hasher.Reset()
-	r.hasher.Write(key1) //nolint:errcheck
-	r.hasher.Write(key2) //nolint:errcheck
-	return r.hasher.Sum128()
+	hasher := r.hashers.Get().(murmur3.Hash128)
+	hasher.Reset()
+	hasher.Write(key1) //nolint:errcheck
+	hasher.Write(key2) //nolint:errcheck
+	bucketHash, fingerprint := hasher.Sum128()
+	r.hashers.Put(hasher)
+	return bucketHash, fingerprint
 }
 
 // Lookup wraps index Lookup
@@ -70,3 +70,48 @@ func (r *IndexReader) Lookup2(key1, key2 []byte) uint64 {
 	}
 	return 0
 }
+
+// LookupExists wraps index LookupExists
+func (r *IndexReader) LookupExists(key []byte) (uint64, bool) {
+	bucketHash, fingerprint := r.sum(key)
+	if r.index != nil {
+		return r.index.LookupExists(bucketHash, fingerprint)
+	}
+	return 0, false
+}
+
+func (r *IndexReader) LookupExists2(key1, key2 []byte) (uint64, bool) {
+	bucketHash, fingerprint := r.sum2(key1, key2)
+	if r.index != nil {
+		return r.index.LookupExists(bucketHash, fingerprint)
+	}
+	return 0, false
+}
+
+// LookupMany looks up offsets of all the keys, and appends them to dst, in the order of the keys.
+// Keys are processed in batches: all the keys of a batch are hashed and their buckets are located first,
+// and only then Golomb-Rice codes of the buckets are walked, so that memory accesses of the keys overlap
+func (r *IndexReader) LookupMany(keys [][]byte, dst []uint64) []uint64 {
+	if r.index == nil || r.index.keyCount <= 1 {
+		for _, key := range keys {
+			dst = append(dst, r.Lookup(key))
+		}
+		return dst
+	}
+	var batch [lookupBatchSize]recLookup
+	for len(keys) > 0 {
+		n := len(keys)
+		if n > lookupBatchSize {
+			n = lookupBatchSize
+		}
+		for i, key := range keys[:n] {
+			bucketHash, fingerprint := r.sum(key)
+			r.index.locateBucket(&batch[i], bucketHash, fingerprint)
+		}
+		for i := range batch[:n] {
+			dst = append(dst, r.index.recOffset(r.index.descend(&batch[i])))
+		}
+		keys = keys[n:]
+	}
+	return dst
+}
@@ -18,11 +18,15 @@ package recsplit
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"fmt"
 	"os"
 	"path/filepath"
 	"testing"
 
+	"github.com/ledgerwatch/erigon-lib/compress"
+	"github.com/ledgerwatch/log/v3"
 	"github.com/stretchr/testify/require"
 )
 
@@ -70,6 +74,7 @@ func TestReWriteIndex(t *testing.T) {
 	require.NoError(t, f.Close())
 	reidx := MustOpen(reindexFile)
 	defer reidx.Close()
+	require.NoError(t, reidx.Verify())
 	for i := 0; i < 100; i++ {
 		reader := NewIndexReader(reidx)
 		offset := reader.Lookup([]byte(fmt.Sprintf("key %d", i)))
@@ -78,3 +83,155 @@ func TestReWriteIndex(t *testing.T) {
 		}
 	}
 }
+
+func TestIndexVersioning(t *testing.T) {
+	tmpDir := t.TempDir()
+	indexFile := filepath.Join(tmpDir, "index")
+	rs, err := NewRecSplit(RecSplitArgs{
+		KeyCount:        100,
+		BucketSize:      10,
+		Salt:            1,
+		TmpDir:          tmpDir,
+		IndexFile:       indexFile,
+		LeafSize:        8,
+		Enums:           true,
+		FingerprintBits: 8,
+	})
+	require.NoError(t, err)
+	for i := 0; i < 100; i++ {
+		require.NoError(t, rs.AddKey([]byte(fmt.Sprintf("key %d", i)), uint64(i*17)))
+	}
+	require.NoError(t, rs.Build())
+	rs.Close()
+	data, err := os.ReadFile(indexFile)
+	require.NoError(t, err)
+
+	checkLookups := func(idx *Index) {
+		reader := NewIndexReader(idx)
+		for i := 0; i < 100; i++ {
+			offset, ok := reader.LookupExists([]byte(fmt.Sprintf("key %d", i)))
+			require.True(t, ok)
+			require.Equal(t, uint64(i*17), idx.OrdinalLookup(offset))
+		}
+	}
+	idx, err := OpenIndex(indexFile)
+	require.NoError(t, err)
+	require.Equal(t, uint8(indexVersion1), idx.Version())
+	require.NoError(t, idx.Verify())
+	checkLookups(idx)
+	idx.Close()
+
+	// Legacy files are the data of versioned files without the header
+	legacyFile := filepath.Join(tmpDir, "legacy")
+	require.NoError(t, os.WriteFile(legacyFile, data[indexHeaderSize:], 0600))
+	idx, err = OpenIndex(legacyFile)
+	require.NoError(t, err)
+	require.Equal(t, uint8(0), idx.Version())
+	require.NoError(t, idx.Verify())
+	checkLookups(idx)
+	idx.Close()
+
+	damaged := func(name string, f func(data []byte) []byte) string {
+		file := filepath.Join(tmpDir, name)
+		require.NoError(t, os.WriteFile(file, f(append([]byte(nil), data...)), 0600))
+		return file
+	}
+	for name, f := range map[string]func([]byte) []byte{
+		"truncated": func(data []byte) []byte { return data[:len(data)-10] },
+		"header":    func(data []byte) []byte { data[30] ^= 1; return data }, // Salt
+		"version":   func(data []byte) []byte { data[4] = 2; return data },
+		"empty":     func(data []byte) []byte { return nil },
+		"foreign":   func(data []byte) []byte { return bytes.Repeat([]byte("foreign "), 8) },
+	} {
+		_, err = OpenIndex(damaged(name, f))
+		require.Error(t, err, name)
+	}
+	// Damage of the data is only detected by Verify
+	idx, err = OpenIndex(damaged("data", func(data []byte) []byte { data[indexHeaderSize+20] ^= 1; return data }))
+	require.NoError(t, err)
+	require.Error(t, idx.Verify())
+	idx.Close()
+}
+
+func TestOffsetIteratorAndRebuild(t *testing.T) {
+	tmpDir := t.TempDir()
+	// Segment of key-value pairs, where keys are indexed
+	segFile := filepath.Join(tmpDir, "segment")
+	c, err := compress.NewCompressor(context.Background(), "test", segFile, tmpDir, compress.MinPatternScore, 1, log.LvlDebug)
+	require.NoError(t, err)
+	for i := 0; i < 100; i++ {
+		require.NoError(t, c.AddWord([]byte(fmt.Sprintf("key %d", i))))
+		require.NoError(t, c.AddWord([]byte(fmt.Sprintf("value %d", i))))
+	}
+	require.NoError(t, c.Compress())
+	c.Close()
+	d, err := compress.NewDecompressor(segFile)
+	require.NoError(t, err)
+	defer d.Close()
+	var offsets []uint64 // Offsets of the keys
+	var offset uint64
+	g := d.MakeGetter()
+	for g.HasNext() {
+		offsets = append(offsets, offset)
+		g.Skip()
+		offset = g.Skip()
+	}
+
+	for _, enums := range []bool{false, true} {
+		indexFile := filepath.Join(tmpDir, fmt.Sprintf("index-%t", enums))
+		rs, err := NewRecSplit(RecSplitArgs{
+			KeyCount:        100,
+			BucketSize:      10,
+			Salt:            1,
+			TmpDir:          tmpDir,
+			IndexFile:       indexFile,
+			LeafSize:        8,
+			Enums:           enums,
+			FingerprintBits: 8,
+		})
+		require.NoError(t, err)
+		for i := 0; i < 100; i++ {
+			require.NoError(t, rs.AddKey([]byte(fmt.Sprintf("key %d", i)), offsets[i]))
+		}
+		require.NoError(t, rs.Build())
+		rs.Close()
+		idx := MustOpen(indexFile)
+
+		i := 0
+		for it := idx.OffsetIterator(); it.HasNext(); i++ {
+			ordinal, offset := it.Next()
+			require.Equal(t, uint64(i), ordinal)
+			require.Equal(t, offsets[i], offset)
+			if enums {
+				require.Equal(t, offset, idx.OrdinalLookup(ordinal))
+			}
+		}
+		require.Equal(t, 100, i)
+
+		// Rebuilding with the same salt reproduces the index
+		rebuiltFile := filepath.Join(tmpDir, fmt.Sprintf("rebuilt-%t", enums))
+		require.NoError(t, RebuildIndex(idx, d, RecSplitArgs{IndexFile: rebuiltFile, TmpDir: tmpDir}, nil))
+		data, err := os.ReadFile(indexFile)
+		require.NoError(t, err)
+		rebuilt, err := os.ReadFile(rebuiltFile)
+		require.NoError(t, err)
+		require.Equal(t, data, rebuilt)
+
+		// Re-salting
+		resaltedFile := filepath.Join(tmpDir, fmt.Sprintf("resalted-%t", enums))
+		require.NoError(t, RebuildIndex(idx, d, RecSplitArgs{IndexFile: resaltedFile, TmpDir: tmpDir, Salt: 2}, nil))
+		idx.Close()
+		idx = MustOpen(resaltedFile)
+		require.Equal(t, uint32(2), idx.Salt())
+		reader := NewIndexReader(idx)
+		for i := 0; i < 100; i++ {
+			offset, ok := reader.LookupExists([]byte(fmt.Sprintf("key %d", i)))
+			require.True(t, ok)
+			if enums {
+				offset = idx.OrdinalLookup(offset)
+			}
+			require.Equal(t, offsets[i], offset)
+		}
+		idx.Close()
+	}
+}
@@ -0,0 +1,181 @@
+/*
+   Copyright 2022 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package recsplit
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// KeyField is one field of composite key
+type KeyField struct {
+	Name  string
+	Width int // Width of the field in bytes, 0 for the field of variable width, which can only be the last one
+}
+
+// KeySchema describes composite keys, consisting of fields which are concatenated in the order of the schema.
+// Keys are encoded by the same schema when added to RecSplit (AddKeyParts) and when looked up
+// (IndexReader.LookupParts), so that the encoding on both sides is guaranteed to be identical
+type KeySchema struct {
+	fields []KeyField
+	width  int // Total width of the fields of fixed width
+}
+
+// NewKeySchema creates schema of the keys consisting of given fields. It panics if the schema is invalid,
+// because schemas are meant to be declared once, as package level variables
+func NewKeySchema(fields ...KeyField) *KeySchema {
+	if len(fields) == 0 {
+		panic("key schema without fields")
+	}
+	s := &KeySchema{fields: fields}
+	for i, field := range fields {
+		if field.Width < 0 || (field.Width == 0 && i != len(fields)-1) {
+			panic(fmt.Sprintf("field %s of key schema: invalid width %d", field.Name, field.Width))
+		}
+		s.width += field.Width
+	}
+	return s
+}
+
+// Width returns the width of the keys in bytes, not counting the last field if it is of variable width
+func (s *KeySchema) Width() int {
+	return s.width
+}
+
+// TxNumKeySchema is the schema of the keys of history files of state domains and of changeset files
+// of the aggregator, and of their indices: tx number followed by the key of account, storage or code
+var TxNumKeySchema = NewKeySchema(KeyField{Name: "txNum", Width: 8}, KeyField{Name: "key"})
+
+// KeyPart is the value of one field of composite key, created by U16, U32, U64 or Bytes
+type KeyPart struct {
+	bytes []byte
+	num   uint64
+	width int // Width of big-endian encoded number, 0 for bytes
+}
+
+// U16 is the value of 2-byte field, encoded in big-endian
+func U16(v uint16) KeyPart { return KeyPart{num: uint64(v), width: 2} }
+
+// U32 is the value of 4-byte field, encoded in big-endian
+func U32(v uint32) KeyPart { return KeyPart{num: uint64(v), width: 4} }
+
+// U64 is the value of 8-byte field, encoded in big-endian, such as block number or tx number
+func U64(v uint64) KeyPart { return KeyPart{num: v, width: 8} }
+
+// Bytes is the value of the field given as it is, such as address or hash
+func Bytes(b []byte) KeyPart { return KeyPart{bytes: b} }
+
+func (p KeyPart) len() int {
+	if p.width > 0 {
+		return p.width
+	}
+	return len(p.bytes)
+}
+
+// AppendKey appends composite key made of the parts to dst. There must be one part per field of the schema,
+// and each part must have the width of its field
+func (s *KeySchema) AppendKey(dst []byte, parts ...KeyPart) ([]byte, error) {
+	if len(parts) != len(s.fields) {
+		return dst, fmt.Errorf("expected %d key parts, got %d", len(s.fields), len(parts))
+	}
+	for i, part := range parts {
+		field := s.fields[i]
+		if field.Width > 0 && part.len() != field.Width {
+			return dst, fmt.Errorf("field %s of key: expected %d bytes, got %d", field.Name, field.Width, part.len())
+		}
+		if part.width == 0 {
+			dst = append(dst, part.bytes...)
+			continue
+		}
+		var numBuf [8]byte
+		binary.BigEndian.PutUint64(numBuf[:], part.num)
+		dst = append(dst, numBuf[8-part.width:]...)
+	}
+	return dst, nil
+}
+
+// Split returns the fields of the key encoded by the schema, as sub-slices of the key
+func (s *KeySchema) Split(key []byte) ([][]byte, error) {
+	if len(key) < s.width || (s.fields[len(s.fields)-1].Width > 0 && len(key) != s.width) {
+		return nil, fmt.Errorf("key of %d bytes does not match schema of %d bytes", len(key), s.width)
+	}
+	parts := make([][]byte, len(s.fields))
+	for i, field := range s.fields {
+		if field.Width == 0 {
+			parts[i], key = key, nil
+		} else {
+			parts[i], key = key[:field.Width], key[field.Width:]
+		}
+	}
+	return parts, nil
+}
+
+// AppendParts appends the parts of the key encoded by the schema to dst, numbers for the fields of 2, 4 and 8 bytes,
+// and bytes for the others. It is used to add keys read back from the files (where they were written by AppendKey)
+// with AddKeyParts
+func (s *KeySchema) AppendParts(dst []KeyPart, key []byte) ([]KeyPart, error) {
+	fields, err := s.Split(key)
+	if err != nil {
+		return dst, err
+	}
+	for i, field := range fields {
+		switch s.fields[i].Width {
+		case 2:
+			dst = append(dst, U16(binary.BigEndian.Uint16(field)))
+		case 4:
+			dst = append(dst, U32(binary.BigEndian.Uint32(field)))
+		case 8:
+			dst = append(dst, U64(binary.BigEndian.Uint64(field)))
+		default:
+			dst = append(dst, Bytes(field))
+		}
+	}
+	return dst, nil
+}
+
+// AddKeyParts adds the key composed of the parts according to the schema, see KeySchema.AppendKey.
+// Error is returned if the parts do not match the schema
+func (rs *RecSplit) AddKeyParts(schema *KeySchema, offset uint64, parts ...KeyPart) error {
+	var err error
+	if rs.partsBuf, err = schema.AppendKey(rs.partsBuf[:0], parts...); err != nil {
+		return err
+	}
+	return rs.AddKey(rs.partsBuf, offset)
+}
+
+// LookupParts looks up the key composed of the parts according to the schema. It panics if the parts
+// do not match the schema (in number or width), because such key could not have been added with AddKeyParts.
+// Parts which come from outside, rather than from the code using the schema, need to be checked with
+// KeySchema.AppendKey first
+func (r *IndexReader) LookupParts(schema *KeySchema, parts ...KeyPart) uint64 {
+	var buf [64]byte
+	key, err := schema.AppendKey(buf[:0], parts...)
+	if err != nil {
+		panic(err)
+	}
+	return r.Lookup(key)
+}
+
+// LookupExistsParts is LookupExists for the key composed of the parts. It panics like LookupParts
+func (r *IndexReader) LookupExistsParts(schema *KeySchema, parts ...KeyPart) (uint64, bool) {
+	var buf [64]byte
+	key, err := schema.AppendKey(buf[:0], parts...)
+	if err != nil {
+		panic(err)
+	}
+	return r.LookupExists(key)
+}
@@ -0,0 +1,82 @@
+/*
+   Copyright 2022 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package recsplit
+
+import (
+	"fmt"
+
+	"github.com/ledgerwatch/erigon-lib/compress"
+)
+
+// RebuildIndex creates new index in args.IndexFile for the same keys as the existing index idx, without reading
+// the source data again: the keys are read from the segment d, at the offsets stored in idx. It is used to repair
+// an index and to re-salt it. Bucket size, leaf size, seeds, base data ID, enums and fingerprints are taken from idx,
+// and only IndexFile, TmpDir, Salt, EtlBufLimit, EtlBudget, BuildAttempts and Workers are taken from args.
+// Salt 0 keeps the salt of idx, so that the same index is built again.
+// keyOf derives the key from the word found at the offset, nil means that the word itself is the key
+func RebuildIndex(idx *Index, d *compress.Decompressor, args RecSplitArgs, keyOf func(word []byte) []byte) error {
+	salt := args.Salt
+	if salt == 0 {
+		salt = idx.salt
+	}
+	startSeed := make([]uint64, len(idx.startSeed))
+	copy(startSeed, idx.startSeed)
+	rs, err := NewRecSplit(RecSplitArgs{
+		KeyCount:        int(idx.keyCount),
+		BucketSize:      idx.bucketSize,
+		Salt:            salt,
+		LeafSize:        idx.leafSize,
+		IndexFile:       args.IndexFile,
+		TmpDir:          args.TmpDir,
+		StartSeed:       startSeed,
+		Enums:           idx.enums,
+		BaseDataID:      idx.baseDataID,
+		EtlBufLimit:     args.EtlBufLimit,
+		EtlBudget:       args.EtlBudget,
+		FingerprintBits: idx.fingerprintBits,
+		BuildAttempts:   args.BuildAttempts,
+		Workers:         args.Workers,
+	})
+	if err != nil {
+		return fmt.Errorf("create recsplit: %w", err)
+	}
+	defer rs.Close()
+	g := d.MakeGetter()
+	var word []byte
+	for it := idx.OffsetIterator(); it.HasNext(); {
+		_, offset := it.Next()
+		if offset >= uint64(d.Size()) {
+			return fmt.Errorf("offset %d is outside of segment %s", offset, d.FilePath())
+		}
+		g.Reset(offset)
+		if !g.HasNext() {
+			return fmt.Errorf("no word at offset %d of segment %s", offset, d.FilePath())
+		}
+		word, _ = g.Next(word[:0])
+		key := word
+		if keyOf != nil {
+			key = keyOf(word)
+		}
+		if err = rs.AddKey(key, offset); err != nil {
+			return fmt.Errorf("add key at offset %d: %w", offset, err)
+		}
+	}
+	if err = rs.Build(); err != nil {
+		return fmt.Errorf("build: %w", err)
+	}
+	return nil
+}
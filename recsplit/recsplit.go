@@ -21,10 +21,13 @@ import (
 	"crypto/rand"
 	"encoding/binary"
 	"fmt"
+	"hash/crc32"
+	"io"
 	"io/ioutil"
 	"math"
 	"math/bits"
 	"os"
+	"sync"
 
 	"github.com/c2h5oh/datasize"
 	"github.com/ledgerwatch/erigon-lib/etl"
@@ -42,6 +45,14 @@ const RecSplitLogPrefix = "recsplit"
 
 const MaxLeafSize = 24
 
+// DefaultBuildAttempts is the number of attempts of Build with different salts, if RecSplitArgs.BuildAttempts is not set.
+// Collisions of 64-bit key hashes within a bucket are very rare, so repeated collisions mean duplicate keys
+const DefaultBuildAttempts = 3
+
+// DefaultFingerprintBits is the size of key fingerprints for indices which are looked up with keys that may be absent,
+// such as the indices of state files: 16 bits reject all but 1/65536 of absent keys for 2 bytes per key
+const DefaultFingerprintBits = 16
+
 /** David Stafford's (http://zimbry.blogspot.com/2011/09/better-bit-mixing-improving-on.html)
  * 13th variant of the 64-bit finalizer function in Austin Appleby's
  * MurmurHash3 (https://github.com/aappleby/smhasher).
@@ -68,15 +79,21 @@ type RecSplit struct {
 	bucketCount       uint64          // Number of buckets
 	hasher            murmur3.Hash128 // Salted hash function to use for splitting into initial buckets and mapping to 64-bit fingerprints
 	etlBufLimit       datasize.ByteSize
-	bucketCollector   *etl.Collector // Collector that sorts by buckets
-	enums             bool           // Whether to build two level index with perfect hash table pointing to enumeration and enumeration pointing to offsets
-	offsetCollector   *etl.Collector // Collector that sorts by offsets
-	built             bool           // Flag indicating that the hash function has been built and no more keys can be added
-	currentBucketIdx  uint64         // Current bucket being accumulated
-	currentBucket     []uint64       // 64-bit fingerprints of keys in the current bucket accumulated before the recsplit is performed for that bucket
-	currentBucketOffs []uint64       // Index offsets for the current bucket
-	maxOffset         uint64         // Maximum value of index offset to later decide how many bytes to use for the encoding
-	gr                GolombRice     // Helper object to encode the tree of hash function salts using Golomb-Rice code.
+	etlBudget         *etl.MemoryBudget  // Memory budget shared by the collectors with other concurrently running collectors
+	bucketCollector   *etl.Collector     // Collector that sorts by buckets
+	enums             bool               // Whether to build two level index with perfect hash table pointing to enumeration and enumeration pointing to offsets
+	offsetCollector   *etl.Collector     // Collector that sorts by offsets
+	keyCollector      *etl.Collector     // Collector that retains the keys in the order they were added, to retry Build with another salt
+	buildAttempts     int                // Number of attempts of Build with different salts before collision is reported
+	fingerprintBits   int                // Number of bits of key fingerprints for membership checks, 0 if they are not stored
+	fingerprints      *fingerprintWriter // Packs fingerprints of the keys in the order of records, during Build
+	built             bool               // Flag indicating that the hash function has been built and no more keys can be added
+	currentBucketIdx  uint64             // Current bucket being accumulated
+	currentBucket     []uint64           // 64-bit fingerprints of keys in the current bucket accumulated before the recsplit is performed for that bucket
+	currentBucketOffs []uint64           // Index offsets for the current bucket
+	currentBucketFps  []uint32           // Key fingerprints for the current bucket, if they are stored
+	maxOffset         uint64             // Maximum value of index offset to later decide how many bytes to use for the encoding
+	gr                GolombRice         // Helper object to encode the tree of hash function salts using Golomb-Rice code.
 	// Helper object to encode the sequence of cumulative number of keys in the buckets
 	// and the sequence of of cumulative bit offsets of buckets in the Golomb-Rice code.
 	ef                 eliasfano16.DoubleEliasFano
@@ -87,11 +104,12 @@ type RecSplit struct {
 	primaryAggrBound   uint16                 // The lower bound for primary key aggregation (computed from leafSize)
 	secondaryAggrBound uint16                 // The lower bound for secondary key aggregation (computed from leadSize)
 	startSeed          []uint64
-	golombRice         []uint32
-	buffer             []uint64
-	offsetBuffer       []uint64
-	count              []uint16
-	salt               uint32 // Murmur3 hash used for converting keys to 64-bit values and assigning to buckets
+	builder            *bucketBuilder // Splits buckets in sequential build, and keeps the table of Golomb-Rice parameters
+	bucket             bucket         // Bucket being split in sequential build
+	workers            int            // Number of workers splitting buckets, sequential build if less than 2
+	jobs               chan *bucket   // Buckets given to the workers, nil for sequential build
+	pending            []*bucket      // Buckets given to the workers and not yet written, in the order of their indices
+	salt               uint32         // Murmur3 hash used for converting keys to 64-bit values and assigning to buckets
 	collision          bool
 	tmpDir             string
 	indexFile          string
@@ -100,6 +118,10 @@ type RecSplit struct {
 	bytesPerRec        int
 	numBuf             [8]byte
 	bucketKeyBuf       [16]byte
+	bucketValBuf       [12]byte
+	keyNumBuf          [8]byte
+	keyBuf             []byte
+	partsBuf           []byte // Key composed by AddKeyParts
 	trace              bool
 	prevOffset         uint64 // Previously added offset (for calculating minDelta for Elias Fano encoding of "enum -> offset" index)
 	minDelta           uint64 // minDelta for Elias Fano encoding of "enum -> offset" index
@@ -116,6 +138,16 @@ type RecSplitArgs struct {
 	Enums       bool     // Whether two level index needs to be built, where perfect hash map points to an enumeration, and enumeration points to offsets
 	BaseDataID  uint64
 	EtlBufLimit datasize.ByteSize
+	EtlBudget   *etl.MemoryBudget // Optional memory budget shared with other collectors running concurrently
+	// FingerprintBits, if not 0, is the number of bits (up to 32) of key fingerprints stored in the index, so that
+	// Index.LookupExists can reject keys which were not added, with false positive rate of 2^-FingerprintBits
+	FingerprintBits int
+	// BuildAttempts is the number of attempts of Build, each with the next salt, before collision is reported.
+	// To retry, all the keys are retained on disk while they are added, unless BuildAttempts is 1. Default is DefaultBuildAttempts
+	BuildAttempts int
+	// Workers is the number of goroutines splitting the buckets during Build. The index is the same
+	// for any number of workers, 0 or 1 means sequential build
+	Workers int
 }
 
 // NewRecSplit creates a new RecSplit instance with given number of keys and given bucket size
@@ -146,10 +178,18 @@ func NewRecSplit(args RecSplitArgs) (*RecSplit, error) {
 	if rs.etlBufLimit == 0 {
 		rs.etlBufLimit = etl.BufferOptimalSize
 	}
-	rs.bucketCollector = etl.NewCollector(RecSplitLogPrefix, rs.tmpDir, etl.NewSortableBuffer(rs.etlBufLimit))
+	rs.etlBudget = args.EtlBudget
+	rs.bucketCollector = rs.newCollector()
 	rs.enums = args.Enums
 	if args.Enums {
-		rs.offsetCollector = etl.NewCollector(RecSplitLogPrefix, rs.tmpDir, etl.NewSortableBuffer(rs.etlBufLimit))
+		rs.offsetCollector = rs.newCollector()
+	}
+	rs.buildAttempts = args.BuildAttempts
+	if rs.buildAttempts == 0 {
+		rs.buildAttempts = DefaultBuildAttempts
+	}
+	if rs.buildAttempts > 1 {
+		rs.keyCollector = rs.newCollector()
 	}
 	rs.currentBucket = make([]uint64, 0, args.BucketSize)
 	rs.currentBucketOffs = make([]uint64, 0, args.BucketSize)
@@ -167,10 +207,21 @@ func NewRecSplit(args RecSplitArgs) (*RecSplit, error) {
 		rs.secondaryAggrBound = rs.primaryAggrBound * uint16(math.Ceil(0.21*float64(rs.leafSize)+9./10.))
 	}
 	rs.startSeed = args.StartSeed
-	rs.count = make([]uint16, rs.secondaryAggrBound)
+	rs.builder = rs.newBucketBuilder()
+	rs.workers = args.Workers
+	if args.FingerprintBits < 0 || args.FingerprintBits > 32 {
+		return nil, fmt.Errorf("fingerprint bits must be between 0 and 32: %d", args.FingerprintBits)
+	}
+	rs.fingerprintBits = args.FingerprintBits
 	return rs, nil
 }
 
+func (rs *RecSplit) newCollector() *etl.Collector {
+	collector := etl.NewCollector(RecSplitLogPrefix, rs.tmpDir, etl.NewSortableBuffer(rs.etlBufLimit))
+	collector.SetMemoryBudget(rs.etlBudget)
+	return collector
+}
+
 func (rs *RecSplit) Close() {
 	if rs.indexF != nil {
 		rs.indexF.Close()
@@ -181,6 +232,9 @@ func (rs *RecSplit) Close() {
 	if rs.offsetCollector != nil {
 		rs.offsetCollector.Close()
 	}
+	if rs.keyCollector != nil {
+		rs.keyCollector.Close()
+	}
 }
 
 func (rs *RecSplit) LogLvl(lvl log.Lvl) {
@@ -190,10 +244,14 @@ func (rs *RecSplit) LogLvl(lvl log.Lvl) {
 	if rs.offsetCollector != nil {
 		rs.offsetCollector.LogLvl(lvl)
 	}
+	if rs.keyCollector != nil {
+		rs.keyCollector.LogLvl(lvl)
+	}
 }
 
 func (rs *RecSplit) SetTrace(trace bool) {
 	rs.trace = trace
+	rs.builder.trace = trace
 }
 
 // remap converts the number x which is assumed to be uniformly distributed over the range [0..2^64) to the number that is uniformly
@@ -222,16 +280,25 @@ func (rs *RecSplit) ResetNextSalt() {
 	if rs.bucketCollector != nil {
 		rs.bucketCollector.Close()
 	}
-	rs.bucketCollector = etl.NewCollector(RecSplitLogPrefix, rs.tmpDir, etl.NewSortableBuffer(rs.etlBufLimit))
+	rs.bucketCollector = rs.newCollector()
 	if rs.offsetCollector != nil {
 		rs.offsetCollector.Close()
-		rs.offsetCollector = etl.NewCollector(RecSplitLogPrefix, rs.tmpDir, etl.NewSortableBuffer(rs.etlBufLimit))
+		rs.offsetCollector = rs.newCollector()
+	}
+	if rs.keyCollector != nil {
+		rs.keyCollector.Close()
+		rs.keyCollector = rs.newCollector()
 	}
 	rs.currentBucket = rs.currentBucket[:0]
 	rs.currentBucketOffs = rs.currentBucketOffs[:0]
+	rs.currentBucketFps = rs.currentBucketFps[:0]
 	rs.maxOffset = 0
 	rs.bucketSizeAcc = rs.bucketSizeAcc[:1] // First entry is always zero
 	rs.bucketPosAcc = rs.bucketPosAcc[:1]   // First entry is always zero
+	// Buckets written by the failed build are discarded, bucketPosAcc counts bits from the start again
+	rs.gr = GolombRice{data: rs.gr.data[:0]}
+	rs.prevOffset = 0
+	rs.minDelta = 0
 }
 
 func splitParams(m, leafSize, primaryAggrBound, secondaryAggrBound uint16) (fanout, unit uint16) {
@@ -286,21 +353,21 @@ func computeGolombRice(m uint16, table []uint32, leafSize, primaryAggrBound, sec
 // golombParam returns the optimal Golomb parameter to use for encoding
 // salt for the part of the hash function separating m elements. It is based on
 // calculations with assumptions that we draw hash functions at random
-func (rs *RecSplit) golombParam(m uint16) int {
-	s := uint16(len(rs.golombRice))
+func (bb *bucketBuilder) golombParam(m uint16) int {
+	s := uint16(len(bb.golombRice))
 	for m >= s {
-		rs.golombRice = append(rs.golombRice, 0)
+		bb.golombRice = append(bb.golombRice, 0)
 		// For the case where bucket is larger than planned
 		if s == 0 {
-			rs.golombRice[0] = (bijMemo[0] << 27) | bijMemo[0]
-		} else if s <= rs.leafSize {
-			rs.golombRice[s] = (bijMemo[s] << 27) | (uint32(1) << 16) | bijMemo[s]
+			bb.golombRice[0] = (bijMemo[0] << 27) | bijMemo[0]
+		} else if s <= bb.leafSize {
+			bb.golombRice[s] = (bijMemo[s] << 27) | (uint32(1) << 16) | bijMemo[s]
 		} else {
-			computeGolombRice(s, rs.golombRice, rs.leafSize, rs.primaryAggrBound, rs.secondaryAggrBound)
+			computeGolombRice(s, bb.golombRice, bb.leafSize, bb.primaryAggrBound, bb.secondaryAggrBound)
 		}
 		s++
 	}
-	return int(rs.golombRice[m] >> 27)
+	return int(bb.golombRice[m] >> 27)
 }
 
 // Add key to the RecSplit. There can be many more keys than what fits in RAM, and RecSplit
@@ -315,6 +382,11 @@ func (rs *RecSplit) AddKey(key []byte, offset uint64) error {
 	hi, lo := rs.hasher.Sum128()
 	binary.BigEndian.PutUint64(rs.bucketKeyBuf[:], remap(hi, rs.bucketCount))
 	binary.BigEndian.PutUint64(rs.bucketKeyBuf[8:], lo)
+	bucketVal := rs.bucketValBuf[:8]
+	if rs.fingerprintBits > 0 {
+		bucketVal = rs.bucketValBuf[:12]
+		binary.BigEndian.PutUint32(bucketVal[8:], keyFingerprint(hi, lo, rs.fingerprintBits))
+	}
 	binary.BigEndian.PutUint64(rs.numBuf[:], offset)
 	if offset > rs.maxOffset {
 		rs.maxOffset = offset
@@ -326,91 +398,231 @@ func (rs *RecSplit) AddKey(key []byte, offset uint64) error {
 		}
 	}
 
-	if rs.enums {
-		if err := rs.offsetCollector.Collect(rs.numBuf[:], nil); err != nil {
+	if rs.keyCollector != nil {
+		// Keys are retained in the order they are added (by their number), with their offsets
+		rs.keyBuf = append(append(rs.keyBuf[:0], rs.numBuf[:]...), key...)
+		binary.BigEndian.PutUint64(rs.keyNumBuf[:], rs.keysAdded)
+		if err := rs.keyCollector.Collect(rs.keyNumBuf[:], rs.keyBuf); err != nil {
 			return err
 		}
-		binary.BigEndian.PutUint64(rs.numBuf[:], rs.keysAdded)
-		if err := rs.bucketCollector.Collect(rs.bucketKeyBuf[:], rs.numBuf[:]); err != nil {
+	}
+	if rs.enums {
+		if err := rs.offsetCollector.Collect(rs.numBuf[:], nil); err != nil {
 			return err
 		}
+		binary.BigEndian.PutUint64(bucketVal, rs.keysAdded)
 	} else {
-		if err := rs.bucketCollector.Collect(rs.bucketKeyBuf[:], rs.numBuf[:]); err != nil {
-			return err
-		}
+		binary.BigEndian.PutUint64(bucketVal, offset)
+	}
+	if err := rs.bucketCollector.Collect(rs.bucketKeyBuf[:], bucketVal); err != nil {
+		return err
 	}
 	rs.keysAdded++
 	rs.prevOffset = offset
 	return nil
 }
 
-func (rs *RecSplit) recsplitCurrentBucket() error {
-	// Extend rs.bucketSizeAcc to accomodate current bucket index + 1
-	for len(rs.bucketSizeAcc) <= int(rs.currentBucketIdx)+1 {
-		rs.bucketSizeAcc = append(rs.bucketSizeAcc, rs.bucketSizeAcc[len(rs.bucketSizeAcc)-1])
+// bucket holds the keys of one bucket, and the result of splitting them: Golomb-Rice code of the bucket
+// (starting at bit 0) and the offsets and key fingerprints in the order of the records
+type bucket struct {
+	idx     uint64
+	keys    []uint64 // 64-bit fingerprints of the keys
+	offsets []uint64 // Index offsets of the keys
+	fps     []uint32 // Key fingerprints, nil if they are not stored
+	gr      GolombRice
+	recs    []uint64
+	recFps  []uint32
+	err     error
+	done    chan struct{} // Closed by the worker after splitting, nil for sequential build
+}
+
+// bucketBuilder applies recSplit algorithm to buckets. Sequential build uses one builder of the RecSplit,
+// and parallel build gives each worker its own one, so that workers do not share scratch buffers
+type bucketBuilder struct {
+	leafSize           uint16
+	primaryAggrBound   uint16
+	secondaryAggrBound uint16
+	startSeed          []uint64
+	golombRice         []uint32
+	buffer             []uint64
+	offsetBuffer       []uint64
+	fpBuffer           []uint32
+	count              []uint16
+	trace              bool
+}
+
+func (rs *RecSplit) newBucketBuilder() *bucketBuilder {
+	return &bucketBuilder{
+		leafSize:           rs.leafSize,
+		primaryAggrBound:   rs.primaryAggrBound,
+		secondaryAggrBound: rs.secondaryAggrBound,
+		startSeed:          rs.startSeed,
+		count:              make([]uint16, rs.secondaryAggrBound),
+		trace:              rs.trace,
 	}
-	rs.bucketSizeAcc[int(rs.currentBucketIdx)+1] += uint64(len(rs.currentBucket))
-	// Sets of size 0 and 1 are not further processed, just write them to index
-	if len(rs.currentBucket) > 1 {
-		for i, key := range rs.currentBucket[1:] {
-			if key == rs.currentBucket[i] {
-				rs.collision = true
-				return fmt.Errorf("%w: %x", ErrCollision, key)
-			}
+}
+
+func (rs *RecSplit) recsplitCurrentBucket() error {
+	if rs.jobs == nil {
+		b := &rs.bucket
+		b.idx, b.keys, b.offsets, b.fps = rs.currentBucketIdx, rs.currentBucket, rs.currentBucketOffs, rs.currentBucketFps
+		rs.builder.build(b)
+		if err := rs.writeBucket(b); err != nil {
+			return err
 		}
-		bitPos := rs.gr.bitCount
-		if rs.buffer == nil {
-			rs.buffer = make([]uint64, len(rs.currentBucket))
-			rs.offsetBuffer = make([]uint64, len(rs.currentBucketOffs))
-		} else {
-			for len(rs.buffer) < len(rs.currentBucket) {
-				rs.buffer = append(rs.buffer, 0)
-				rs.offsetBuffer = append(rs.offsetBuffer, 0)
-			}
+	} else {
+		// Current bucket buffers are reused for the next bucket, so the worker gets copies
+		b := &bucket{
+			idx:     rs.currentBucketIdx,
+			keys:    append([]uint64(nil), rs.currentBucket...),
+			offsets: append([]uint64(nil), rs.currentBucketOffs...),
+			done:    make(chan struct{}),
 		}
-		unary, err := rs.recsplit(0 /* level */, rs.currentBucket, rs.currentBucketOffs, nil /* unary */)
-		if err != nil {
+		if rs.fingerprintBits > 0 {
+			b.fps = append([]uint32(nil), rs.currentBucketFps...)
+		}
+		rs.pending = append(rs.pending, b)
+		rs.jobs <- b
+		if err := rs.writePending(2 * rs.workers); err != nil {
 			return err
 		}
-		rs.gr.appendUnaryAll(unary)
+	}
+	// clear for the next buckey
+	rs.currentBucket = rs.currentBucket[:0]
+	rs.currentBucketOffs = rs.currentBucketOffs[:0]
+	rs.currentBucketFps = rs.currentBucketFps[:0]
+	return nil
+}
+
+// startWorkers launches workers of parallel build. The returned function stops them
+func (rs *RecSplit) startWorkers() func() {
+	jobs := make(chan *bucket, rs.workers)
+	var wg sync.WaitGroup
+	for i := 0; i < rs.workers; i++ {
+		bb := rs.newBucketBuilder()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for b := range jobs {
+				bb.build(b)
+				close(b.done)
+			}
+		}()
+	}
+	rs.jobs = jobs
+	return func() {
+		close(jobs)
+		wg.Wait()
+		rs.jobs = nil
+		rs.pending = nil
+	}
+}
+
+// writePending waits for the oldest buckets given to the workers, and writes them, until at most keep buckets are pending
+func (rs *RecSplit) writePending(keep int) error {
+	for len(rs.pending) > keep {
+		b := rs.pending[0]
+		<-b.done
+		rs.pending[0] = nil
+		rs.pending = rs.pending[1:]
+		if err := rs.writeBucket(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeBucket appends split bucket to the index: its records to the index file, and its Golomb-Rice code to rs.gr.
+// Buckets are written in the order of their indices, regardless of the order in which they were split
+func (rs *RecSplit) writeBucket(b *bucket) error {
+	if b.err != nil {
+		rs.collision = true // Splitting only fails on duplicate keys
+		return b.err
+	}
+	// Extend rs.bucketSizeAcc to accomodate current bucket index + 1
+	for len(rs.bucketSizeAcc) <= int(b.idx)+1 {
+		rs.bucketSizeAcc = append(rs.bucketSizeAcc, rs.bucketSizeAcc[len(rs.bucketSizeAcc)-1])
+	}
+	rs.bucketSizeAcc[int(b.idx)+1] += uint64(len(b.keys))
+	if len(b.keys) > 1 {
+		// Table of Golomb-Rice parameters of the workers is not shared, but its size is written into the index
+		rs.builder.golombParam(uint16(len(b.keys)))
+		rs.gr.appendBits(&b.gr)
 		if rs.trace {
-			fmt.Printf("recsplitBucket(%d, %d, bitsize = %d)\n", rs.currentBucketIdx, len(rs.currentBucket), rs.gr.bitCount-bitPos)
+			fmt.Printf("recsplitBucket(%d, %d, bitsize = %d)\n", b.idx, len(b.keys), b.gr.bitCount)
 		}
-	} else {
-		for _, offset := range rs.currentBucketOffs {
-			binary.BigEndian.PutUint64(rs.numBuf[:], offset)
-			if _, err := rs.indexW.Write(rs.numBuf[8-rs.bytesPerRec:]); err != nil {
-				return err
-			}
+	}
+	for i, offset := range b.recs {
+		if err := rs.writeRec(offset, b.recFps, i); err != nil {
+			return err
 		}
 	}
 	// Extend rs.bucketPosAcc to accomodate current bucket index + 1
-	for len(rs.bucketPosAcc) <= int(rs.currentBucketIdx)+1 {
+	for len(rs.bucketPosAcc) <= int(b.idx)+1 {
 		rs.bucketPosAcc = append(rs.bucketPosAcc, rs.bucketPosAcc[len(rs.bucketPosAcc)-1])
 	}
-	rs.bucketPosAcc[int(rs.currentBucketIdx)+1] = uint64(rs.gr.Bits())
-	// clear for the next buckey
-	rs.currentBucket = rs.currentBucket[:0]
-	rs.currentBucketOffs = rs.currentBucketOffs[:0]
+	rs.bucketPosAcc[int(b.idx)+1] = uint64(rs.gr.Bits())
 	return nil
 }
 
-// recsplit applies recSplit algorithm to the given bucket
-func (rs *RecSplit) recsplit(level int, bucket []uint64, offsets []uint64, unary []uint64) ([]uint64, error) {
-	if rs.trace {
-		fmt.Printf("recsplit(%d, %d, %x)\n", level, len(bucket), bucket)
+// writeRec writes offset of the record, and fingerprint of its key (fps[i]), if fingerprints are stored
+func (rs *RecSplit) writeRec(offset uint64, fps []uint32, i int) error {
+	binary.BigEndian.PutUint64(rs.numBuf[:], offset)
+	if _, err := rs.indexW.Write(rs.numBuf[8-rs.bytesPerRec:]); err != nil {
+		return err
+	}
+	if rs.fingerprints != nil {
+		return rs.fingerprints.add(fps[i])
+	}
+	return nil
+}
+
+// build splits the keys of the bucket, filling its Golomb-Rice code and records
+func (bb *bucketBuilder) build(b *bucket) {
+	for i := range b.gr.data {
+		b.gr.data[i] = 0
+	}
+	b.gr.data, b.gr.bitCount = b.gr.data[:0], 0
+	b.recs, b.recFps, b.err = b.recs[:0], b.recFps[:0], nil
+	// Sets of size 0 and 1 are not further processed, just write them to index
+	if len(b.keys) <= 1 {
+		b.recs = append(b.recs, b.offsets...)
+		if b.fps != nil {
+			b.recFps = append(b.recFps, b.fps...)
+		}
+		return
+	}
+	for i, key := range b.keys[1:] {
+		if key == b.keys[i] {
+			b.err = fmt.Errorf("%w: %x", ErrCollision, key)
+			return
+		}
+	}
+	for len(bb.buffer) < len(b.keys) {
+		bb.buffer = append(bb.buffer, 0)
+		bb.offsetBuffer = append(bb.offsetBuffer, 0)
+		bb.fpBuffer = append(bb.fpBuffer, 0)
+	}
+	unary := bb.recsplit(b, 0 /* level */, b.keys, b.offsets, b.fps, nil /* unary */)
+	b.gr.appendUnaryAll(unary)
+}
+
+// recsplit applies recSplit algorithm to the part of the bucket b. Fingerprints of the keys (fps) are nil if they are not stored
+func (bb *bucketBuilder) recsplit(b *bucket, level int, keys []uint64, offsets []uint64, fps []uint32, unary []uint64) []uint64 {
+	if bb.trace {
+		fmt.Printf("recsplit(%d, %d, %x)\n", level, len(keys), keys)
 	}
 	// Pick initial salt for this level of recursive split
-	salt := rs.startSeed[level]
-	m := uint16(len(bucket))
-	if m <= rs.leafSize {
+	salt := bb.startSeed[level]
+	m := uint16(len(keys))
+	if m <= bb.leafSize {
 		// No need to build aggregation levels - just find find bijection
 		var mask uint32
 		for {
 			mask = 0
 			var fail bool
 			for i := uint16(0); !fail && i < m; i++ {
-				bit := uint32(1) << remap16(remix(bucket[i]+salt), m)
+				bit := uint32(1) << remap16(remix(keys[i]+salt), m)
 				if mask&bit != 0 {
 					fail = true
 				} else {
@@ -423,32 +635,33 @@ func (rs *RecSplit) recsplit(level int, bucket []uint64, offsets []uint64, unary
 			salt++
 		}
 		for i := uint16(0); i < m; i++ {
-			j := remap16(remix(bucket[i]+salt), m)
-			rs.offsetBuffer[j] = offsets[i]
-		}
-		for _, offset := range rs.offsetBuffer[:m] {
-			binary.BigEndian.PutUint64(rs.numBuf[:], offset)
-			if _, err := rs.indexW.Write(rs.numBuf[8-rs.bytesPerRec:]); err != nil {
-				return nil, err
+			j := remap16(remix(keys[i]+salt), m)
+			bb.offsetBuffer[j] = offsets[i]
+			if fps != nil {
+				bb.fpBuffer[j] = fps[i]
 			}
 		}
-		salt -= rs.startSeed[level]
-		log2golomb := rs.golombParam(m)
-		if rs.trace {
-			fmt.Printf("encode bij %d with log2golomn %d at p = %d\n", salt, log2golomb, rs.gr.bitCount)
+		b.recs = append(b.recs, bb.offsetBuffer[:m]...)
+		if fps != nil {
+			b.recFps = append(b.recFps, bb.fpBuffer[:m]...)
 		}
-		rs.gr.appendFixed(salt, log2golomb)
+		salt -= bb.startSeed[level]
+		log2golomb := bb.golombParam(m)
+		if bb.trace {
+			fmt.Printf("encode bij %d with log2golomn %d at p = %d\n", salt, log2golomb, b.gr.bitCount)
+		}
+		b.gr.appendFixed(salt, log2golomb)
 		unary = append(unary, salt>>log2golomb)
 	} else {
-		fanout, unit := splitParams(m, rs.leafSize, rs.primaryAggrBound, rs.secondaryAggrBound)
-		count := rs.count
+		fanout, unit := splitParams(m, bb.leafSize, bb.primaryAggrBound, bb.secondaryAggrBound)
+		count := bb.count
 		for {
 			for i := uint16(0); i < fanout-1; i++ {
 				count[i] = 0
 			}
 			var fail bool
 			for i := uint16(0); i < m; i++ {
-				count[remap16(remix(bucket[i]+salt), m)/unit]++
+				count[remap16(remix(keys[i]+salt), m)/unit]++
 			}
 			for i := uint16(0); i < fanout-1; i++ {
 				fail = fail || (count[i] != unit)
@@ -463,39 +676,45 @@ func (rs *RecSplit) recsplit(level int, bucket []uint64, offsets []uint64, unary
 			c += unit
 		}
 		for i := uint16(0); i < m; i++ {
-			j := remap16(remix(bucket[i]+salt), m) / unit
-			rs.buffer[count[j]] = bucket[i]
-			rs.offsetBuffer[count[j]] = offsets[i]
+			j := remap16(remix(keys[i]+salt), m) / unit
+			bb.buffer[count[j]] = keys[i]
+			bb.offsetBuffer[count[j]] = offsets[i]
+			if fps != nil {
+				bb.fpBuffer[count[j]] = fps[i]
+			}
 			count[j]++
 		}
-		copy(bucket, rs.buffer)
-		copy(offsets, rs.offsetBuffer)
-		salt -= rs.startSeed[level]
-		log2golomb := rs.golombParam(m)
-		if rs.trace {
-			fmt.Printf("encode fanout %d: %d with log2golomn %d at p = %d\n", fanout, salt, log2golomb, rs.gr.bitCount)
+		copy(keys, bb.buffer)
+		copy(offsets, bb.offsetBuffer)
+		copy(fps, bb.fpBuffer)
+		salt -= bb.startSeed[level]
+		log2golomb := bb.golombParam(m)
+		if bb.trace {
+			fmt.Printf("encode fanout %d: %d with log2golomn %d at p = %d\n", fanout, salt, log2golomb, b.gr.bitCount)
 		}
-		rs.gr.appendFixed(salt, log2golomb)
+		b.gr.appendFixed(salt, log2golomb)
 		unary = append(unary, salt>>log2golomb)
-		var err error
 		var i uint16
 		for i = 0; i < m-unit; i += unit {
-			if unary, err = rs.recsplit(level+1, bucket[i:i+unit], offsets[i:i+unit], unary); err != nil {
-				return nil, err
-			}
+			unary = bb.recsplit(b, level+1, keys[i:i+unit], offsets[i:i+unit], subFps(fps, i, i+unit), unary)
 		}
 		if m-i > 1 {
-			if unary, err = rs.recsplit(level+1, bucket[i:], offsets[i:], unary); err != nil {
-				return nil, err
-			}
+			unary = bb.recsplit(b, level+1, keys[i:], offsets[i:], subFps(fps, i, m), unary)
 		} else if m-i == 1 {
-			binary.BigEndian.PutUint64(rs.numBuf[:], offsets[i])
-			if _, err := rs.indexW.Write(rs.numBuf[8-rs.bytesPerRec:]); err != nil {
-				return nil, err
+			b.recs = append(b.recs, offsets[i])
+			if fps != nil {
+				b.recFps = append(b.recFps, fps[i])
 			}
 		}
 	}
-	return unary, nil
+	return unary
+}
+
+func subFps(fps []uint32, from, to uint16) []uint32 {
+	if fps == nil {
+		return nil
+	}
+	return fps[from:to]
 }
 
 // loadFuncBucket is required to satisfy the type etl.LoadFunc type, to use with collector.Load
@@ -512,6 +731,9 @@ func (rs *RecSplit) loadFuncBucket(k, v []byte, _ etl.CurrentTableReader, _ etl.
 	}
 	rs.currentBucket = append(rs.currentBucket, binary.BigEndian.Uint64(k[8:]))
 	rs.currentBucketOffs = append(rs.currentBucketOffs, binary.BigEndian.Uint64(v))
+	if rs.fingerprintBits > 0 {
+		rs.currentBucketFps = append(rs.currentBucketFps, binary.BigEndian.Uint32(v[8:]))
+	}
 	return nil
 }
 
@@ -522,8 +744,43 @@ func (rs *RecSplit) loadFuncOffset(k, _ []byte, _ etl.CurrentTableReader, _ etl.
 }
 
 // Build has to be called after all the keys have been added, and it initiates the process
-// of building the perfect hash function and writing index into a file
+// of building the perfect hash function and writing index into a file.
+// On collision, keys are added again with the next salt, and the build is retried, up to the configured
+// number of attempts (see RecSplitArgs.BuildAttempts). Error is returned and Collision reports true only
+// if all the attempts fail
 func (rs *RecSplit) Build() error {
+	for attempt := 1; ; attempt++ {
+		err := rs.build()
+		if err == nil {
+			if rs.keyCollector != nil {
+				rs.keyCollector.Close()
+				rs.keyCollector = nil
+			}
+			return nil
+		}
+		if !rs.collision || rs.keyCollector == nil || attempt >= rs.buildAttempts {
+			return err
+		}
+		log.Debug(fmt.Sprintf("[%s] Collision happened, restarting with next salt", RecSplitLogPrefix), "file", rs.indexFile, "attempt", attempt, "err", err)
+		if err = rs.readdWithNextSalt(); err != nil {
+			return err
+		}
+	}
+}
+
+// readdWithNextSalt resets the RecSplit with the next salt, and adds again the keys retained by keyCollector
+func (rs *RecSplit) readdWithNextSalt() error {
+	keys := rs.keyCollector
+	rs.keyCollector = nil
+	defer keys.Close()
+	rs.ResetNextSalt()
+	rs.keyCollector = rs.newCollector()
+	return keys.Load(nil, "", func(_, v []byte, _ etl.CurrentTableReader, _ etl.LoadNextFunc) error {
+		return rs.AddKey(v[8:], binary.BigEndian.Uint64(v))
+	}, etl.TransformArgs{})
+}
+
+func (rs *RecSplit) build() error {
 	tmpIdxFilePath := rs.indexFile + ".tmp"
 
 	if rs.built {
@@ -538,7 +795,12 @@ func (rs *RecSplit) Build() error {
 	}
 	defer rs.indexF.Sync()
 	defer rs.indexF.Close()
-	rs.indexW = bufio.NewWriterSize(rs.indexF, etl.BufIOSize)
+	// Space for the header, which is written after the data, when its size and checksum are known
+	if _, err = rs.indexF.Write(make([]byte, indexHeaderSize)); err != nil {
+		return fmt.Errorf("write header: %w", err)
+	}
+	checksum := crc32.New(crcTable)
+	rs.indexW = bufio.NewWriterSize(io.MultiWriter(rs.indexF, checksum), etl.BufIOSize)
 	defer rs.indexW.Flush()
 	// Write minimal app-specific dataID in this index file
 	binary.BigEndian.PutUint64(rs.numBuf[:], rs.baseDataID)
@@ -557,6 +819,18 @@ func (rs *RecSplit) Build() error {
 		return fmt.Errorf("write bytes per record: %w", err)
 	}
 
+	if rs.fingerprintBits > 0 {
+		if rs.fingerprints, err = newFingerprintWriter(rs.tmpDir, rs.fingerprintBits); err != nil {
+			return fmt.Errorf("create fingerprints file: %w", err)
+		}
+		defer func() {
+			rs.fingerprints.close()
+			rs.fingerprints = nil
+		}()
+	}
+	if rs.workers > 1 {
+		defer rs.startWorkers()()
+	}
 	rs.currentBucketIdx = math.MaxUint64 // To make sure 0 bucket is detected
 	defer rs.bucketCollector.Close()
 	if err := rs.bucketCollector.Load(nil, "", rs.loadFuncBucket, etl.TransformArgs{}); err != nil {
@@ -567,6 +841,9 @@ func (rs *RecSplit) Build() error {
 			return err
 		}
 	}
+	if err := rs.writePending(0); err != nil {
+		return err
+	}
 
 	if ASSERT {
 		rs.indexW.Flush()
@@ -617,14 +894,15 @@ func (rs *RecSplit) Build() error {
 			return fmt.Errorf("writing start seed: %w", err)
 		}
 	}
+	var features byte
 	if rs.enums {
-		if err := rs.indexW.WriteByte(1); err != nil {
-			return fmt.Errorf("writing enums = true: %w", err)
-		}
-	} else {
-		if err := rs.indexW.WriteByte(0); err != nil {
-			return fmt.Errorf("writing enums = true: %w", err)
-		}
+		features |= featureEnums
+	}
+	if rs.fingerprints != nil {
+		features |= featureFingerprints
+	}
+	if err := rs.indexW.WriteByte(features); err != nil {
+		return fmt.Errorf("writing features: %w", err)
 	}
 	if rs.enums {
 		// Write out elias fano for offsets
@@ -632,8 +910,13 @@ func (rs *RecSplit) Build() error {
 			return fmt.Errorf("writing elias fano for offsets: %w", err)
 		}
 	}
+	if rs.fingerprints != nil {
+		if err := rs.fingerprints.writeTo(rs.indexW); err != nil {
+			return fmt.Errorf("writing fingerprints: %w", err)
+		}
+	}
 	// Write out the size of golomb rice params
-	binary.BigEndian.PutUint16(rs.numBuf[:], uint16(len(rs.golombRice)))
+	binary.BigEndian.PutUint16(rs.numBuf[:], uint16(len(rs.builder.golombRice)))
 	if _, err := rs.indexW.Write(rs.numBuf[:4]); err != nil {
 		return fmt.Errorf("writing golomb rice param size: %w", err)
 	}
@@ -646,7 +929,28 @@ func (rs *RecSplit) Build() error {
 		return fmt.Errorf("writing elias fano: %w", err)
 	}
 
-	_ = rs.indexW.Flush()
+	if err := rs.indexW.Flush(); err != nil {
+		return fmt.Errorf("flush index: %w", err)
+	}
+	size, err := rs.indexF.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	hdr := indexHeader{
+		version:      indexVersion1,
+		features:     features,
+		bytesPerRec:  rs.bytesPerRec,
+		keyCount:     rs.keysAdded,
+		bucketCount:  rs.bucketCount,
+		bucketSize:   uint16(rs.bucketSize),
+		leafSize:     rs.leafSize,
+		salt:         rs.salt,
+		dataSize:     uint64(size - indexHeaderSize),
+		dataChecksum: checksum.Sum32(),
+	}
+	if _, err := rs.indexF.WriteAt(hdr.encode(), 0); err != nil {
+		return fmt.Errorf("write header: %w", err)
+	}
 	_ = rs.indexF.Sync()
 	_ = rs.indexF.Close()
 	if err := os.Rename(tmpIdxFilePath, rs.indexFile); err != nil {
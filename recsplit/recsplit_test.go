@@ -17,9 +17,16 @@
 package recsplit
 
 import (
+	"bytes"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"os"
 	"path/filepath"
+	"sync"
 	"testing"
+
+	"github.com/spaolacci/murmur3"
 )
 
 func TestRecSplit2(t *testing.T) {
@@ -180,3 +187,406 @@ func TestTwoLayerIndex(t *testing.T) {
 		}
 	}
 }
+
+func TestIndexLookupExists(t *testing.T) {
+	tmpDir := t.TempDir()
+	for _, enums := range []bool{false, true} {
+		for _, fpBits := range []int{0, 5, 16, 32} {
+			indexFile := filepath.Join(tmpDir, fmt.Sprintf("index-%t-%d", enums, fpBits))
+			rs, err := NewRecSplit(RecSplitArgs{
+				KeyCount:        1000,
+				BucketSize:      100,
+				Salt:            1,
+				TmpDir:          tmpDir,
+				IndexFile:       indexFile,
+				LeafSize:        8,
+				Enums:           enums,
+				FingerprintBits: fpBits,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 1000; i++ {
+				if err = rs.AddKey([]byte(fmt.Sprintf("key %d", i)), uint64(i*17)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := rs.Build(); err != nil {
+				t.Fatal(err)
+			}
+			rs.Close()
+			idx := MustOpen(indexFile)
+			if idx.HasFingerprints() != (fpBits > 0) {
+				t.Errorf("fingerprints %d: HasFingerprints %t", fpBits, idx.HasFingerprints())
+			}
+			reader := NewIndexReader(idx)
+			for i := 0; i < 1000; i++ {
+				key := []byte(fmt.Sprintf("key %d", i))
+				offset, ok := reader.LookupExists(key)
+				if !ok || offset != reader.Lookup(key) {
+					t.Errorf("fingerprints %d: key %d, expected %d, looked up %d %t", fpBits, i, reader.Lookup(key), offset, ok)
+				}
+				if enums && idx.OrdinalLookup(offset) != uint64(i*17) {
+					t.Errorf("fingerprints %d: key %d, expected offset %d, looked up %d", fpBits, i, i*17, idx.OrdinalLookup(offset))
+				}
+			}
+			var falsePositives int
+			for i := 0; i < 10000; i++ {
+				if _, ok := reader.LookupExists([]byte(fmt.Sprintf("absent %d", i))); ok {
+					falsePositives++
+				}
+			}
+			switch fpBits {
+			case 0:
+				if falsePositives != 10000 {
+					t.Errorf("without fingerprints all the keys are expected to exist, got %d", falsePositives)
+				}
+			case 5:
+				if falsePositives < 10000/32/2 || falsePositives > 10000/32*2 {
+					t.Errorf("fingerprints %d: unexpected number of false positives %d", fpBits, falsePositives)
+				}
+			default:
+				if falsePositives > 1 {
+					t.Errorf("fingerprints %d: unexpected number of false positives %d", fpBits, falsePositives)
+				}
+			}
+			idx.Close()
+		}
+	}
+}
+
+func TestRecSplitParallelBuild(t *testing.T) {
+	tmpDir := t.TempDir()
+	build := func(name string, enums bool, fpBits, workers int, keys []string) (string, error) {
+		indexFile := filepath.Join(tmpDir, name)
+		rs, err := NewRecSplit(RecSplitArgs{
+			KeyCount:        len(keys),
+			BucketSize:      10,
+			Salt:            1,
+			TmpDir:          tmpDir,
+			IndexFile:       indexFile,
+			LeafSize:        8,
+			Enums:           enums,
+			FingerprintBits: fpBits,
+			Workers:         workers,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rs.Close()
+		for i, key := range keys {
+			if err = rs.AddKey([]byte(key), uint64(i*17)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err = rs.Build(); err != nil && !rs.Collision() {
+			t.Fatal(err)
+		}
+		return indexFile, err
+	}
+	keys := make([]string, 5000)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key %d", i)
+	}
+	for _, enums := range []bool{false, true} {
+		for _, fpBits := range []int{0, 16} {
+			seqFile, _ := build(fmt.Sprintf("seq-%t-%d", enums, fpBits), enums, fpBits, 1, keys)
+			seq, err := os.ReadFile(seqFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, workers := range []int{2, 4, 7} {
+				parFile, _ := build(fmt.Sprintf("par-%t-%d-%d", enums, fpBits, workers), enums, fpBits, workers, keys)
+				par, err := os.ReadFile(parFile)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(seq, par) {
+					t.Errorf("enums %t, fingerprints %d: index built by %d workers differs from sequential build", enums, fpBits, workers)
+				}
+			}
+		}
+	}
+	if _, err := build("duplicate", false, 0, 4, append(keys, keys[100])); err == nil {
+		t.Errorf("test is expected to fail, duplicate key")
+	}
+}
+
+func TestIndexReaderConcurrent(t *testing.T) {
+	tmpDir := t.TempDir()
+	indexFile := filepath.Join(tmpDir, "index")
+	const keyCount = 1000
+	rs, err := NewRecSplit(RecSplitArgs{
+		KeyCount:   keyCount,
+		BucketSize: 100,
+		Salt:       1,
+		TmpDir:     tmpDir,
+		IndexFile:  indexFile,
+		LeafSize:   8,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := make([][]byte, keyCount)
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprintf("key %d", i))
+		if err = rs.AddKey(keys[i], uint64(i*17)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := rs.Build(); err != nil {
+		t.Fatal(err)
+	}
+	rs.Close()
+	idx := MustOpen(indexFile)
+	defer idx.Close()
+	reader := NewIndexReader(idx)
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i, key := range keys {
+				if offset := reader.Lookup(key); offset != uint64(i*17) {
+					t.Errorf("goroutine %d: expected offset %d, looked up %d", g, i*17, offset)
+				}
+				if offset := reader.Lookup2(key[:3], key[3:]); offset != uint64(i*17) {
+					t.Errorf("goroutine %d: expected offset %d, looked up %d with Lookup2", g, i*17, offset)
+				}
+			}
+			offsets := reader.LookupMany(keys[g:], nil)
+			if len(offsets) != keyCount-g {
+				t.Errorf("goroutine %d: expected %d offsets, got %d", g, keyCount-g, len(offsets))
+				return
+			}
+			for i, offset := range offsets {
+				if offset != uint64((i+g)*17) {
+					t.Errorf("goroutine %d: expected offset %d, looked up %d with LookupMany", g, (i+g)*17, offset)
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+}
+
+// collidingHasher maps key to the same 128-bit hash as another key, to force collision
+type collidingHasher struct {
+	murmur3.Hash128
+	key, as []byte
+	buf     []byte
+}
+
+func (h *collidingHasher) Reset() {
+	h.Hash128.Reset()
+	h.buf = h.buf[:0]
+}
+
+func (h *collidingHasher) Write(p []byte) (int, error) {
+	h.buf = append(h.buf, p...)
+	return h.Hash128.Write(p)
+}
+
+func (h *collidingHasher) Sum128() (uint64, uint64) {
+	if bytes.Equal(h.buf, h.key) {
+		h.Hash128.Reset()
+		h.Hash128.Write(h.as) //nolint:errcheck
+	}
+	return h.Hash128.Sum128()
+}
+
+func TestRecSplitBuildAttempts(t *testing.T) {
+	tmpDir := t.TempDir()
+	indexFile := filepath.Join(tmpDir, "index")
+	const keyCount = 1000
+	newRecSplit := func(attempts int, enums bool, extraKeys int) *RecSplit {
+		rs, err := NewRecSplit(RecSplitArgs{
+			KeyCount:      keyCount + extraKeys,
+			BucketSize:    100,
+			Salt:          1,
+			TmpDir:        tmpDir,
+			IndexFile:     indexFile,
+			LeafSize:      8,
+			Enums:         enums,
+			BuildAttempts: attempts,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rs
+	}
+	addKeys := func(rs *RecSplit) {
+		for i := 0; i < keyCount; i++ {
+			if err := rs.AddKey([]byte(fmt.Sprintf("key %d", i)), uint64(i*17)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	// Duplicate keys collide with any salt
+	for _, attempts := range []int{1, 2, 5} {
+		rs := newRecSplit(attempts, true, 1)
+		addKeys(rs)
+		if err := rs.AddKey([]byte("key 500"), keyCount*17); err != nil {
+			t.Fatal(err)
+		}
+		if err := rs.Build(); !errors.Is(err, ErrCollision) || !rs.Collision() {
+			t.Errorf("attempts %d: expected collision, got %v", attempts, err)
+		}
+		if rs.salt != uint32(attempts) {
+			t.Errorf("attempts %d: expected salt %d after all the attempts, got %d", attempts, attempts, rs.salt)
+		}
+		rs.Close()
+	}
+	// Two keys collide with the first salt only (next salt replaces the hasher). Collision is found after
+	// some buckets have been written, and all of them are written again with the next salt
+	for _, enums := range []bool{false, true} {
+		rs := newRecSplit(0, enums, 0)
+		rs.hasher = &collidingHasher{Hash128: rs.hasher, key: []byte("key 700"), as: []byte("key 3")}
+		addKeys(rs)
+		if err := rs.Build(); err != nil {
+			t.Fatalf("enums %t: %v", enums, err)
+		}
+		if rs.Collision() || rs.salt != 2 {
+			t.Errorf("enums %t: expected build with salt 2 after collision, got salt %d", enums, rs.salt)
+		}
+		rs.Close()
+		idx := MustOpen(indexFile)
+		reader := NewIndexReader(idx)
+		for i := 0; i < keyCount; i++ {
+			offset := reader.Lookup([]byte(fmt.Sprintf("key %d", i)))
+			if enums {
+				offset = idx.OrdinalLookup(offset)
+			}
+			if offset != uint64(i*17) {
+				t.Errorf("enums %t: key %d: expected offset %d, looked up %d", enums, i, i*17, offset)
+			}
+		}
+		idx.Close()
+	}
+}
+
+func TestKeySchema(t *testing.T) {
+	var (
+		historySchema = TxNumKeySchema
+		// Storage key: address, incarnation and location
+		storageSchema = NewKeySchema(KeyField{Name: "addr", Width: 20}, KeyField{Name: "incarnation", Width: 8}, KeyField{Name: "location", Width: 32})
+		// Block header: block number and hash
+		blockSchema = NewKeySchema(KeyField{Name: "blockNum", Width: 8}, KeyField{Name: "hash", Width: 32})
+	)
+	addr := bytes.Repeat([]byte{0xaa}, 20)
+	loc := bytes.Repeat([]byte{0xbb}, 32)
+	key, err := storageSchema.AppendKey([]byte{1}, Bytes(addr), U64(0x0102), Bytes(loc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := append(append(append([]byte{1}, addr...), 0, 0, 0, 0, 0, 0, 1, 2), loc...); !bytes.Equal(key, expected) {
+		t.Errorf("expected key [%x], got [%x]", expected, key)
+	}
+	if parts, err := storageSchema.Split(key[1:]); err != nil || !bytes.Equal(parts[0], addr) || !bytes.Equal(parts[2], loc) {
+		t.Errorf("split [%x]: %v, %v", key[1:], parts, err)
+	}
+	if _, err = storageSchema.AppendKey(nil, Bytes(addr), U32(1), Bytes(loc)); err == nil {
+		t.Errorf("expected error for 4-byte incarnation")
+	}
+	if _, err = storageSchema.AppendKey(nil, Bytes(addr), U64(1)); err == nil {
+		t.Errorf("expected error for missing location")
+	}
+	if _, err = historySchema.Split([]byte{1, 2, 3}); err == nil {
+		t.Errorf("expected error for too short key")
+	}
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Errorf("expected panic for variable width field which is not the last one")
+			}
+		}()
+		NewKeySchema(KeyField{Name: "key"}, KeyField{Name: "txNum", Width: 8})
+	}()
+
+	tmpDir := t.TempDir()
+	const keyCount = 100
+	for _, schema := range []*KeySchema{historySchema, storageSchema, blockSchema} {
+		indexFile := filepath.Join(tmpDir, fmt.Sprintf("index-%d", schema.Width()))
+		rs, err := NewRecSplit(RecSplitArgs{
+			KeyCount:        keyCount,
+			BucketSize:      10,
+			Salt:            1,
+			TmpDir:          tmpDir,
+			IndexFile:       indexFile,
+			LeafSize:        8,
+			FingerprintBits: 16,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		parts := func(i int) []KeyPart {
+			hash := bytes.Repeat([]byte{byte(i)}, 32)
+			switch schema {
+			case historySchema:
+				return []KeyPart{U64(uint64(i / 3)), Bytes(addr[:i%20])}
+			case storageSchema:
+				return []KeyPart{Bytes(addr), U64(uint64(i % 2)), Bytes(hash)}
+			default:
+				return []KeyPart{U64(uint64(i)), Bytes(hash)}
+			}
+		}
+		if err = rs.AddKeyParts(schema, 0, U64(1)); err == nil {
+			t.Errorf("schema of %d bytes: expected error for parts not matching the schema", schema.Width())
+		}
+		var key []byte
+		var readParts []KeyPart
+		for i := 0; i < keyCount; i++ {
+			if i%2 == 0 {
+				if err = rs.AddKeyParts(schema, uint64(i*17), parts(i)...); err != nil {
+					t.Fatal(err)
+				}
+				continue
+			}
+			// Keys read back from a file are added by their parts too
+			if key, err = schema.AppendKey(key[:0], parts(i)...); err != nil {
+				t.Fatal(err)
+			}
+			if readParts, err = schema.AppendParts(readParts[:0], key); err != nil {
+				t.Fatal(err)
+			}
+			if err = rs.AddKeyParts(schema, uint64(i*17), readParts...); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err = rs.Build(); err != nil {
+			t.Fatal(err)
+		}
+		rs.Close()
+		idx := MustOpen(indexFile)
+		reader := NewIndexReader(idx)
+		for i := 0; i < keyCount; i++ {
+			if offset := reader.LookupParts(schema, parts(i)...); offset != uint64(i*17) {
+				t.Errorf("schema of %d bytes: expected offset %d, looked up %d", schema.Width(), i*17, offset)
+			}
+			if offset, ok := reader.LookupExistsParts(schema, parts(i)...); !ok || offset != uint64(i*17) {
+				t.Errorf("schema of %d bytes: expected offset %d, looked up %d, %t", schema.Width(), i*17, offset, ok)
+			}
+			if schema == historySchema {
+				// Same encoding as the keys assembled by hand
+				var txKey [8]byte
+				binary.BigEndian.PutUint64(txKey[:], uint64(i/3))
+				if offset := reader.Lookup2(txKey[:], addr[:i%20]); offset != uint64(i*17) {
+					t.Errorf("expected offset %d, looked up %d with Lookup2", i*17, offset)
+				}
+			}
+		}
+		for _, lookup := range []func(){
+			func() { reader.LookupParts(schema, U16(1)) },
+			func() { reader.LookupExistsParts(schema, U16(1)) },
+		} {
+			func() {
+				defer func() {
+					if recover() == nil {
+						t.Errorf("schema of %d bytes: expected panic for parts not matching the schema", schema.Width())
+					}
+				}()
+				lookup()
+			}()
+		}
+		idx.Close()
+	}
+}
@@ -21,8 +21,8 @@ import (
 
 	"sync"
 
-	"github.com/RoaringBitmap/roaring/roaring64"
 	"github.com/ledgerwatch/erigon-lib/kv"
+	"github.com/ledgerwatch/erigon-lib/recsplit/eliasfano32"
 )
 
 // Reconstruction of the aggregator in another package, `aggregator`
@@ -158,10 +158,10 @@ type AggCollation struct {
 	accounts   Collation
 	storage    Collation
 	code       Collation
-	logAddrs   map[string]*roaring64.Bitmap
-	logTopics  map[string]*roaring64.Bitmap
-	tracesFrom map[string]*roaring64.Bitmap
-	tracesTo   map[string]*roaring64.Bitmap
+	logAddrs   map[string]*eliasfano32.Builder
+	logTopics  map[string]*eliasfano32.Builder
+	tracesFrom map[string]*eliasfano32.Builder
+	tracesTo   map[string]*eliasfano32.Builder
 }
 
 func (c AggCollation) Close() {
@@ -30,7 +30,6 @@ import (
 	"strings"
 	"time"
 
-	"github.com/RoaringBitmap/roaring/roaring64"
 	"github.com/google/btree"
 	"github.com/ledgerwatch/erigon-lib/common"
 	"github.com/ledgerwatch/erigon-lib/compress"
@@ -45,6 +44,10 @@ var (
 	historyValCountKey = []byte("ValCount")
 )
 
+// valuesKeySamplesEvery is how often keys of values files are sampled, so that values can be found by key
+// with binary search over the samples
+const valuesKeySamplesEvery = 16
+
 // filesItem corresponding to a pair of files (.dat and .idx)
 type filesItem struct {
 	startTxNum   uint64
@@ -86,6 +89,14 @@ func (ft FileType) String() string {
 	}
 }
 
+// keySchema returns the schema of the keys of the files of this type, nil if keys are not composite
+func (ft FileType) keySchema() *recsplit.KeySchema {
+	if ft == History {
+		return recsplit.TxNumKeySchema
+	}
+	return nil
+}
+
 func ParseFileType(s string) (FileType, bool) {
 	switch s {
 	case "values":
@@ -475,18 +486,27 @@ func (d *Domain) IteratePrefix(prefix []byte, it func(k, v []byte)) error {
 	}
 	d.files[Values].Ascend(func(i btree.Item) bool {
 		item := i.(*filesItem)
-		if item.index.Empty() {
-			return true
-		}
-		offset := item.indexReader.Lookup(prefix)
 		// Creating dedicated getter because the one in the item may be used to delete storage, for example
 		g := item.decompressor.MakeGetter()
-		g.Reset(offset)
-		if g.HasNext() {
-			if keyMatch, _ := g.Match(prefix); !keyMatch {
+		if item.decompressor.HasKeySamples() {
+			// Range scan seeks to the first key with the prefix, even if the prefix itself is not a key
+			if found, err := g.SeekPrefix(prefix); err != nil || !found {
+				return true
+			}
+			if keyMatch, _ := g.Match(prefix); keyMatch {
+				g.Skip()
+			}
+		} else {
+			if item.index.Empty() {
 				return true
 			}
-			g.Skip()
+			g.Reset(item.indexReader.Lookup(prefix))
+			if g.HasNext() {
+				if keyMatch, _ := g.Match(prefix); !keyMatch {
+					return true
+				}
+				g.Skip()
+			}
 		}
 		if g.HasNext() {
 			key, _ := g.Next(nil)
@@ -551,7 +571,7 @@ type Collation struct {
 	historyPath  string
 	historyComp  *compress.Compressor
 	historyCount int
-	indexBitmaps map[string]*roaring64.Bitmap
+	efBuilders   map[string]*eliasfano32.Builder
 }
 
 func (c Collation) Close() {
@@ -584,6 +604,9 @@ func (d *Domain) collate(step uint64, txFrom, txTo uint64, roTx kv.Tx) (Collatio
 	if valuesComp, err = compress.NewCompressor(context.Background(), "collate values", valuesPath, d.dir, compress.MinPatternScore, 1, log.LvlDebug); err != nil {
 		return Collation{}, fmt.Errorf("create %s values compressor: %w", d.filenameBase, err)
 	}
+	if err = valuesComp.SetKeySamples(valuesKeySamplesEvery, 2); err != nil {
+		return Collation{}, fmt.Errorf("create %s values compressor: %w", d.filenameBase, err)
+	}
 	keysCursor, err := roTx.CursorDupSort(d.keysTable)
 	if err != nil {
 		return Collation{}, fmt.Errorf("create %s keys cursor: %w", d.filenameBase, err)
@@ -636,7 +659,7 @@ func (d *Domain) collate(step uint64, txFrom, txTo uint64, roTx kv.Tx) (Collatio
 		return Collation{}, fmt.Errorf("create %s history cursor: %w", d.filenameBase, err)
 	}
 	defer historyKeysCursor.Close()
-	indexBitmaps := map[string]*roaring64.Bitmap{}
+	efBuilders := map[string]*eliasfano32.Builder{}
 	historyCount := 0
 	var txKey [8]byte
 	binary.BigEndian.PutUint64(txKey[:], txFrom)
@@ -647,7 +670,9 @@ func (d *Domain) collate(step uint64, txFrom, txTo uint64, roTx kv.Tx) (Collatio
 		if txNum >= txTo {
 			break
 		}
-		historyKey = append(append(historyKey[:0], k...), v[:len(v)-8]...)
+		if historyKey, err = recsplit.TxNumKeySchema.AppendKey(historyKey[:0], recsplit.U64(txNum), recsplit.Bytes(v[:len(v)-8])); err != nil {
+			return Collation{}, fmt.Errorf("%s history key [%x]: %w", d.filenameBase, k, err)
+		}
 		if err = historyComp.AddUncompressedWord(historyKey); err != nil {
 			return Collation{}, fmt.Errorf("add %s history key [%x]: %w", d.filenameBase, k, err)
 		}
@@ -663,13 +688,13 @@ func (d *Domain) collate(step uint64, txFrom, txTo uint64, roTx kv.Tx) (Collatio
 			return Collation{}, fmt.Errorf("add %s history val [%x]=>[%x]: %w", d.filenameBase, k, val, err)
 		}
 		historyCount++
-		var bitmap *roaring64.Bitmap
+		var efBuilder *eliasfano32.Builder
 		var ok bool
-		if bitmap, ok = indexBitmaps[string(v[:len(v)-8])]; !ok {
-			bitmap = roaring64.New()
-			indexBitmaps[string(v[:len(v)-8])] = bitmap
+		if efBuilder, ok = efBuilders[string(v[:len(v)-8])]; !ok {
+			efBuilder = eliasfano32.NewBuilder()
+			efBuilders[string(v[:len(v)-8])] = efBuilder
 		}
-		bitmap.Add(txNum)
+		efBuilder.Add(txNum)
 	}
 	if err != nil {
 		return Collation{}, fmt.Errorf("iterate over %s history cursor: %w", d.filenameBase, err)
@@ -682,7 +707,7 @@ func (d *Domain) collate(step uint64, txFrom, txTo uint64, roTx kv.Tx) (Collatio
 		historyPath:  historyPath,
 		historyComp:  historyComp,
 		historyCount: historyCount,
-		indexBitmaps: indexBitmaps,
+		efBuilders:   efBuilders,
 	}, nil
 }
 
@@ -766,7 +791,7 @@ func (d *Domain) buildFiles(step uint64, collation Collation) (StaticFiles, erro
 	if valuesDecomp, err = compress.NewDecompressor(collation.valuesPath); err != nil {
 		return StaticFiles{}, fmt.Errorf("open %s values decompressor: %w", d.filenameBase, err)
 	}
-	if valuesIdx, err = buildIndex(valuesDecomp, valuesIdxPath, d.dir, collation.valuesCount, false /* values */); err != nil {
+	if valuesIdx, err = buildIndex(valuesDecomp, valuesIdxPath, d.dir, collation.valuesCount, false /* values */, nil /* schema */); err != nil {
 		return StaticFiles{}, fmt.Errorf("build %s values idx: %w", d.filenameBase, err)
 	}
 	historyIdxPath := filepath.Join(d.dir, fmt.Sprintf("%s-history.%d-%d.idx", d.filenameBase, step, step+1))
@@ -778,7 +803,7 @@ func (d *Domain) buildFiles(step uint64, collation Collation) (StaticFiles, erro
 	if historyDecomp, err = compress.NewDecompressor(collation.historyPath); err != nil {
 		return StaticFiles{}, fmt.Errorf("open %s history decompressor: %w", d.filenameBase, err)
 	}
-	if historyIdx, err = buildIndex(historyDecomp, historyIdxPath, d.dir, collation.historyCount, true /* values */); err != nil {
+	if historyIdx, err = buildIndex(historyDecomp, historyIdxPath, d.dir, collation.historyCount, true /* values */, History.keySchema()); err != nil {
 		return StaticFiles{}, fmt.Errorf("build %s history idx: %w", d.filenameBase, err)
 	}
 	// Build history ef
@@ -788,8 +813,8 @@ func (d *Domain) buildFiles(step uint64, collation Collation) (StaticFiles, erro
 		return StaticFiles{}, fmt.Errorf("create %s ef history compressor: %w", d.filenameBase, err)
 	}
 	var buf []byte
-	keys := make([]string, 0, len(collation.indexBitmaps))
-	for key := range collation.indexBitmaps {
+	keys := make([]string, 0, len(collation.efBuilders))
+	for key := range collation.efBuilders {
 		keys = append(keys, key)
 	}
 	slices.Sort(keys)
@@ -797,14 +822,7 @@ func (d *Domain) buildFiles(step uint64, collation Collation) (StaticFiles, erro
 		if err = efHistoryComp.AddUncompressedWord([]byte(key)); err != nil {
 			return StaticFiles{}, fmt.Errorf("add %s ef history key [%x]: %w", d.filenameBase, key, err)
 		}
-		bitmap := collation.indexBitmaps[key]
-		ef := eliasfano32.NewEliasFano(bitmap.GetCardinality(), bitmap.Maximum())
-		it := bitmap.Iterator()
-		for it.HasNext() {
-			ef.AddOffset(it.Next())
-		}
-		ef.Build()
-		buf = ef.AppendBytes(buf[:0])
+		buf = collation.efBuilders[key].AppendBytes(buf[:0])
 		if err = efHistoryComp.AddUncompressedWord(buf); err != nil {
 			return StaticFiles{}, fmt.Errorf("add %s ef history val: %w", d.filenameBase, err)
 		}
@@ -818,7 +836,7 @@ func (d *Domain) buildFiles(step uint64, collation Collation) (StaticFiles, erro
 		return StaticFiles{}, fmt.Errorf("open %s ef history decompressor: %w", d.filenameBase, err)
 	}
 	efHistoryIdxPath := filepath.Join(d.dir, fmt.Sprintf("%s-efhistory.%d-%d.idx", d.filenameBase, step, step+1))
-	if efHistoryIdx, err = buildIndex(efHistoryDecomp, efHistoryIdxPath, d.dir, len(keys), false /* values */); err != nil {
+	if efHistoryIdx, err = buildIndex(efHistoryDecomp, efHistoryIdxPath, d.dir, len(keys), false /* values */, nil /* schema */); err != nil {
 		return StaticFiles{}, fmt.Errorf("build %s ef history idx: %w", d.filenameBase, err)
 	}
 	closeComp = false
@@ -832,7 +850,9 @@ func (d *Domain) buildFiles(step uint64, collation Collation) (StaticFiles, erro
 	}, nil
 }
 
-func buildIndex(d *compress.Decompressor, idxPath, dir string, count int, values bool) (*recsplit.Index, error) {
+// buildIndex indexes the keys of the key-value file. Keys of the files with schema (history files, with
+// recsplit.TxNumKeySchema) are added by their parts, the same way they are looked up; nil schema adds keys as they are
+func buildIndex(d *compress.Decompressor, idxPath, dir string, count int, values bool, schema *recsplit.KeySchema) (*recsplit.Index, error) {
 	var rs *recsplit.RecSplit
 	var err error
 	if rs, err = recsplit.NewRecSplit(recsplit.RecSplitArgs{
@@ -844,40 +864,35 @@ func buildIndex(d *compress.Decompressor, idxPath, dir string, count int, values
 		StartSeed: []uint64{0x106393c187cae21a, 0x6453cec3f7376937, 0x643e521ddbd2be98, 0x3740c6412f6572cb, 0x717d47562f1ce470, 0x4cd6eb4c63befb7c, 0x9bfd8c5e18c8da73,
 			0x082f20e10092a9a3, 0x2ada2ce68d21defc, 0xe33cb4f3e7c6466b, 0x3980be458c509c59, 0xc466fd9584828e8c, 0x45f0aabe1a61ede6, 0xf6e7b8b33ad9b98d,
 			0x4ef95e25f4b4983d, 0x81175195173b92d3, 0x4e50927d8dd15978, 0x1ea2099d1fafae7f, 0x425c8a06fbaaa815, 0xcd4216006c74052a},
-		IndexFile: idxPath,
+		IndexFile:       idxPath,
+		FingerprintBits: recsplit.DefaultFingerprintBits,
 	}); err != nil {
 		return nil, fmt.Errorf("create recsplit: %w", err)
 	}
 	defer rs.Close()
 	word := make([]byte, 0, 256)
+	var parts []recsplit.KeyPart
 	var keyPos, valPos uint64
 	g := d.MakeGetter()
-	for {
-		g.Reset(0)
-		for g.HasNext() {
-			word, valPos = g.Next(word[:0])
-			if values {
-				if err = rs.AddKey(word, valPos); err != nil {
-					return nil, fmt.Errorf("add idx key [%x]: %w", word, err)
-				}
-			} else {
-				if err = rs.AddKey(word, keyPos); err != nil {
-					return nil, fmt.Errorf("add idx key [%x]: %w", word, err)
-				}
-			}
-			// Skip value
-			keyPos = g.Skip()
+	for g.HasNext() {
+		word, valPos = g.Next(word[:0])
+		offset := keyPos
+		if values {
+			offset = valPos
 		}
-		if err = rs.Build(); err != nil {
-			if rs.Collision() {
-				log.Info("Building recsplit. Collision happened. It's ok. Restarting...")
-				rs.ResetNextSalt()
-			} else {
-				return nil, fmt.Errorf("build idx: %w", err)
-			}
-		} else {
-			break
+		if schema == nil {
+			err = rs.AddKey(word, offset)
+		} else if parts, err = schema.AppendParts(parts[:0], word); err == nil {
+			err = rs.AddKeyParts(schema, offset, parts...)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("add idx key [%x]: %w", word, err)
 		}
+		// Skip value
+		keyPos = g.Skip()
+	}
+	if err = rs.Build(); err != nil {
+		return nil, fmt.Errorf("build idx: %w", err)
 	}
 	var idx *recsplit.Index
 	if idx, err = recsplit.OpenIndex(idxPath); err != nil {
@@ -990,12 +1005,22 @@ func (d *Domain) readFromFiles(fType FileType, filekey []byte) ([]byte, bool) {
 	var found bool
 	d.files[fType].Descend(func(i btree.Item) bool {
 		item := i.(*filesItem)
-		if item.index.Empty() {
+		g := item.getter
+		// Point reads go by the index, which takes constant time. Key samples, which need a scan of up to
+		// valuesKeySamplesEvery records, are only used for the files without index
+		if item.index != nil && !item.index.Empty() {
+			offset, ok := item.indexReader.LookupExists(filekey)
+			if !ok {
+				return true
+			}
+			g.Reset(offset)
+		} else if item.decompressor.HasKeySamples() {
+			if ok, err := g.Seek(filekey); err != nil || !ok {
+				return true
+			}
+		} else {
 			return true
 		}
-		offset := item.indexReader.Lookup(filekey)
-		g := item.getter
-		g.Reset(offset)
 		if g.HasNext() {
 			if keyMatch, _ := g.Match(filekey); keyMatch {
 				val, _ = g.Next(nil)
@@ -1028,12 +1053,15 @@ func (d *Domain) historyBeforeTxNum(key []byte, txNum uint64, roTx kv.Tx) ([]byt
 	d.files[EfHistory].AscendGreaterOrEqual(&search, func(i btree.Item) bool {
 		item := i.(*filesItem)
 		anyItem = true
-		offset := item.indexReader.Lookup(key)
+		offset, ok := item.indexReader.LookupExists(key)
+		if !ok {
+			return true
+		}
 		g := item.getter
 		g.Reset(offset)
 		if k, _ := g.NextUncompressed(); bytes.Equal(k, key) {
 			eliasVal, _ := g.NextUncompressed()
-			ef, _ := eliasfano32.ReadEliasFano(eliasVal)
+			ef, _ := eliasfano32.ReadSequence(eliasVal)
 			//start := time.Now()
 			n, ok := ef.Search(txNum)
 			//d.stats.EfSearchTime += time.Since(start)
@@ -1058,7 +1086,10 @@ func (d *Domain) historyBeforeTxNum(key []byte, txNum uint64, roTx kv.Tx) ([]byt
 				if item.index.Empty() {
 					return true
 				}
-				offset := item.indexReader.Lookup(key)
+				offset, ok := item.indexReader.LookupExists(key)
+				if !ok {
+					return true
+				}
 				g := item.getter
 				g.Reset(offset)
 				if g.HasNext() {
@@ -1113,8 +1144,6 @@ func (d *Domain) historyBeforeTxNum(key []byte, txNum uint64, roTx kv.Tx) ([]byt
 		}
 		return nil, false, nil
 	}
-	var txKey [8]byte
-	binary.BigEndian.PutUint64(txKey[:], foundTxNum)
 	var historyItem *filesItem
 	search.startTxNum = foundStartTxNum
 	search.endTxNum = foundEndTxNum
@@ -1123,7 +1152,7 @@ func (d *Domain) historyBeforeTxNum(key []byte, txNum uint64, roTx kv.Tx) ([]byt
 	} else {
 		return nil, false, fmt.Errorf("no %s file found for [%x]", d.filenameBase, key)
 	}
-	offset := historyItem.indexReader.Lookup2(txKey[:], key)
+	offset := historyItem.indexReader.LookupParts(recsplit.TxNumKeySchema, recsplit.U64(foundTxNum), recsplit.Bytes(key))
 	g := historyItem.getter
 	g.Reset(offset)
 	if d.compressVals {
@@ -90,9 +90,9 @@ func TestCollationBuild(t *testing.T) {
 	require.Equal(t, 2, c.valuesCount)
 	require.True(t, strings.HasSuffix(c.historyPath, "base-history.0-1.dat"))
 	require.Equal(t, 3, c.historyCount)
-	require.Equal(t, 2, len(c.indexBitmaps))
-	require.Equal(t, []uint64{3}, c.indexBitmaps["key2"].ToArray())
-	require.Equal(t, []uint64{2, 6}, c.indexBitmaps["key1"].ToArray())
+	require.Equal(t, 2, len(c.efBuilders))
+	require.Equal(t, []uint64{3}, efValues(c.efBuilders["key2"]))
+	require.Equal(t, []uint64{2, 6}, efValues(c.efBuilders["key1"]))
 
 	sf, err := d.buildFiles(0, c)
 	require.NoError(t, err)
@@ -27,7 +27,6 @@ import (
 	"regexp"
 	"strconv"
 
-	"github.com/RoaringBitmap/roaring/roaring64"
 	"github.com/google/btree"
 	"github.com/ledgerwatch/erigon-lib/compress"
 	"github.com/ledgerwatch/erigon-lib/kv"
@@ -186,7 +185,7 @@ type InvertedIterator struct {
 	key                  []byte
 	startTxNum, endTxNum uint64
 	stack                []*filesItem
-	efIt                 *eliasfano32.EliasFanoIter
+	efIt                 eliasfano32.Iterator
 	next                 uint64
 	hasNextInFiles       bool
 	hasNextInDb          bool
@@ -215,8 +214,8 @@ func (it *InvertedIterator) advanceInFiles() {
 			g.Reset(offset)
 			if k, _ := g.NextUncompressed(); bytes.Equal(k, it.key) {
 				eliasVal, _ := g.NextUncompressed()
-				ef, _ := eliasfano32.ReadEliasFano(eliasVal)
-				it.efIt = ef.Iterator()
+				ef, _ := eliasfano32.ReadSequence(eliasVal)
+				it.efIt = ef.Iter()
 			}
 		}
 		for it.efIt.HasNext() {
@@ -326,13 +325,13 @@ func (ii *InvertedIndex) IterateRange(key []byte, startTxNum, endTxNum uint64, r
 	return it
 }
 
-func (ii *InvertedIndex) collate(txFrom, txTo uint64, roTx kv.Tx) (map[string]*roaring64.Bitmap, error) {
+func (ii *InvertedIndex) collate(txFrom, txTo uint64, roTx kv.Tx) (map[string]*eliasfano32.Builder, error) {
 	keysCursor, err := roTx.CursorDupSort(ii.keysTable)
 	if err != nil {
 		return nil, fmt.Errorf("create %s keys cursor: %w", ii.filenameBase, err)
 	}
 	defer keysCursor.Close()
-	indexBitmaps := map[string]*roaring64.Bitmap{}
+	efBuilders := map[string]*eliasfano32.Builder{}
 	var txKey [8]byte
 	binary.BigEndian.PutUint64(txKey[:], txFrom)
 	var k, v []byte
@@ -341,18 +340,18 @@ func (ii *InvertedIndex) collate(txFrom, txTo uint64, roTx kv.Tx) (map[string]*r
 		if txNum >= txTo {
 			break
 		}
-		var bitmap *roaring64.Bitmap
+		var efBuilder *eliasfano32.Builder
 		var ok bool
-		if bitmap, ok = indexBitmaps[string(v)]; !ok {
-			bitmap = roaring64.New()
-			indexBitmaps[string(v)] = bitmap
+		if efBuilder, ok = efBuilders[string(v)]; !ok {
+			efBuilder = eliasfano32.NewBuilder()
+			efBuilders[string(v)] = efBuilder
 		}
-		bitmap.Add(txNum)
+		efBuilder.Add(txNum)
 	}
 	if err != nil {
 		return nil, fmt.Errorf("iterate over %s keys cursor: %w", ii.filenameBase, err)
 	}
-	return indexBitmaps, nil
+	return efBuilders, nil
 }
 
 type InvertedFiles struct {
@@ -369,7 +368,7 @@ func (sf InvertedFiles) Close() {
 	}
 }
 
-func (ii *InvertedIndex) buildFiles(step uint64, bitmaps map[string]*roaring64.Bitmap) (InvertedFiles, error) {
+func (ii *InvertedIndex) buildFiles(step uint64, efBuilders map[string]*eliasfano32.Builder) (InvertedFiles, error) {
 	var decomp *compress.Decompressor
 	var index *recsplit.Index
 	var comp *compress.Compressor
@@ -396,8 +395,8 @@ func (ii *InvertedIndex) buildFiles(step uint64, bitmaps map[string]*roaring64.B
 		return InvertedFiles{}, fmt.Errorf("create %s compressor: %w", ii.filenameBase, err)
 	}
 	var buf []byte
-	keys := make([]string, 0, len(bitmaps))
-	for key := range bitmaps {
+	keys := make([]string, 0, len(efBuilders))
+	for key := range efBuilders {
 		keys = append(keys, key)
 	}
 	slices.Sort(keys)
@@ -405,14 +404,7 @@ func (ii *InvertedIndex) buildFiles(step uint64, bitmaps map[string]*roaring64.B
 		if err = comp.AddUncompressedWord([]byte(key)); err != nil {
 			return InvertedFiles{}, fmt.Errorf("add %s key [%x]: %w", ii.filenameBase, key, err)
 		}
-		bitmap := bitmaps[key]
-		ef := eliasfano32.NewEliasFano(bitmap.GetCardinality(), bitmap.Maximum())
-		it := bitmap.Iterator()
-		for it.HasNext() {
-			ef.AddOffset(it.Next())
-		}
-		ef.Build()
-		buf = ef.AppendBytes(buf[:0])
+		buf = efBuilders[key].AppendBytes(buf[:0])
 		if err = comp.AddUncompressedWord(buf); err != nil {
 			return InvertedFiles{}, fmt.Errorf("add %s val: %w", ii.filenameBase, err)
 		}
@@ -426,7 +418,7 @@ func (ii *InvertedIndex) buildFiles(step uint64, bitmaps map[string]*roaring64.B
 		return InvertedFiles{}, fmt.Errorf("open %s decompressor: %w", ii.filenameBase, err)
 	}
 	idxPath := filepath.Join(ii.dir, fmt.Sprintf("%s.%d-%d.idx", ii.filenameBase, txNumFrom/ii.aggregationStep, txNumTo/ii.aggregationStep))
-	if index, err = buildIndex(decomp, idxPath, ii.dir, len(keys), false /* values */); err != nil {
+	if index, err = buildIndex(decomp, idxPath, ii.dir, len(keys), false /* values */, nil /* schema */); err != nil {
 		return InvertedFiles{}, fmt.Errorf("build %s idx: %w", ii.filenameBase, err)
 	}
 	closeComp = false
@@ -47,6 +47,14 @@ func testDbAndInvertedIndex(t *testing.T) (string, kv.RwDB, *InvertedIndex) {
 	return path, db, ii
 }
 
+func efValues(efBuilder *eliasfano32.Builder) []uint64 {
+	var values []uint64
+	for it := efBuilder.Iterator(); it.HasNext(); {
+		values = append(values, it.Next())
+	}
+	return values
+}
+
 func TestInvIndexCollationBuild(t *testing.T) {
 	_, db, ii := testDbAndInvertedIndex(t)
 	defer db.Close()
@@ -80,9 +88,9 @@ func TestInvIndexCollationBuild(t *testing.T) {
 	bs, err := ii.collate(0, 7, roTx)
 	require.NoError(t, err)
 	require.Equal(t, 3, len(bs))
-	require.Equal(t, []uint64{3}, bs["key2"].ToArray())
-	require.Equal(t, []uint64{2, 6}, bs["key1"].ToArray())
-	require.Equal(t, []uint64{6}, bs["key3"].ToArray())
+	require.Equal(t, []uint64{3}, efValues(bs["key2"]))
+	require.Equal(t, []uint64{2, 6}, efValues(bs["key1"]))
+	require.Equal(t, []uint64{6}, efValues(bs["key3"]))
 
 	sf, err := ii.buildFiles(0, bs)
 	require.NoError(t, err)
@@ -356,3 +364,47 @@ func TestInvIndexScanFiles(t *testing.T) {
 	mergeInverted(t, db, ii, txs)
 	checkRanges(t, db, ii, txs)
 }
+
+func TestMergeEfs(t *testing.T) {
+	encode := func(txNums []uint64) []byte {
+		ef := eliasfano32.NewEliasFano(uint64(len(txNums)), txNums[len(txNums)-1])
+		for _, txNum := range txNums {
+			ef.AddOffset(txNum)
+		}
+		ef.Build()
+		return ef.AppendBytes(nil)
+	}
+	for _, tc := range []struct {
+		name        string
+		step        uint64 // Distance between tx numbers of the clusters
+		partitioned bool
+	}{
+		{name: "uniform", step: 1000},
+		{name: "clustered", step: 1, partitioned: true},
+	} {
+		// Clusters of tx numbers in the beginning of every million
+		var pre, cur, all []uint64
+		for c := uint64(0); c < 8; c++ {
+			for i := uint64(0); i < 200; i++ {
+				txNum := c*1_000_000 + i*tc.step
+				if c < 4 {
+					pre = append(pre, txNum)
+				} else {
+					cur = append(cur, txNum)
+				}
+				all = append(all, txNum)
+			}
+		}
+		merged, err := mergeEfs(encode(pre), encode(cur), []byte{0xff})
+		require.NoError(t, err)
+		require.Equal(t, byte(0xff), merged[0])
+		require.Equal(t, tc.partitioned, eliasfano32.IsPartitioned(merged[1:]), tc.name)
+		ef, n := eliasfano32.ReadSequence(merged[1:])
+		require.Equal(t, len(merged)-1, n, tc.name)
+		var txNums []uint64
+		for it := ef.Iter(); it.HasNext(); {
+			txNums = append(txNums, it.Next())
+		}
+		require.Equal(t, all, txNums, tc.name)
+	}
+}
@@ -206,20 +206,33 @@ func (ii *InvertedIndex) staticFilesInRange(startTxNum, endTxNum uint64) ([]*fil
 	return files, startJ
 }
 
+// mergeEfs merges two sequences of tx numbers, and appends the result to buf, encoded either by plain
+// or by partitioned Elias-Fano, whichever is smaller
 func mergeEfs(preval, val, buf []byte) ([]byte, error) {
-	preef, _ := eliasfano32.ReadEliasFano(preval)
-	ef, _ := eliasfano32.ReadEliasFano(val)
-	preIt := preef.Iterator()
-	efIt := ef.Iterator()
+	preef, _ := eliasfano32.ReadSequence(preval)
+	ef, _ := eliasfano32.ReadSequence(val)
+	preIt := preef.Iter()
+	efIt := ef.Iter()
 	newEf := eliasfano32.NewEliasFano(preef.Count()+ef.Count(), ef.Max())
+	newPef := eliasfano32.NewPartitionedEliasFano(preef.Count()+ef.Count(), ef.Max())
 	for preIt.HasNext() {
-		newEf.AddOffset(preIt.Next())
+		v := preIt.Next()
+		newEf.AddOffset(v)
+		newPef.AddOffset(v)
 	}
 	for efIt.HasNext() {
-		newEf.AddOffset(efIt.Next())
+		v := efIt.Next()
+		newEf.AddOffset(v)
+		newPef.AddOffset(v)
 	}
 	newEf.Build()
-	return newEf.AppendBytes(buf), nil
+	newPef.Build()
+	start := len(buf)
+	buf = newEf.AppendBytes(buf)
+	if pefSize := newPef.Size(); pefSize < len(buf)-start {
+		buf = newPef.AppendBytes(buf[:start])
+	}
+	return buf, nil
 }
 
 func (d *Domain) mergeFiles(files [][NumberOfTypes]*filesItem, r DomainRanges, maxSpan uint64) ([NumberOfTypes]*filesItem, error) {
@@ -278,6 +291,11 @@ func (d *Domain) mergeFiles(files [][NumberOfTypes]*filesItem, r DomainRanges, m
 				return outItems, fmt.Errorf("merge %s history compressor: %w", d.filenameBase, err)
 			}
 		}
+		if fType == Values {
+			if err = comp.SetKeySamples(valuesKeySamplesEvery, 2); err != nil {
+				return outItems, fmt.Errorf("merge %s values compressor: %w", d.filenameBase, err)
+			}
+		}
 		var cp CursorHeap
 		heap.Init(&cp)
 		for _, filesByType := range files {
@@ -433,35 +451,31 @@ func (d *Domain) mergeFiles(files [][NumberOfTypes]*filesItem, r DomainRanges, m
 				StartSeed: []uint64{0x106393c187cae21a, 0x6453cec3f7376937, 0x643e521ddbd2be98, 0x3740c6412f6572cb, 0x717d47562f1ce470, 0x4cd6eb4c63befb7c, 0x9bfd8c5e18c8da73,
 					0x082f20e10092a9a3, 0x2ada2ce68d21defc, 0xe33cb4f3e7c6466b, 0x3980be458c509c59, 0xc466fd9584828e8c, 0x45f0aabe1a61ede6, 0xf6e7b8b33ad9b98d,
 					0x4ef95e25f4b4983d, 0x81175195173b92d3, 0x4e50927d8dd15978, 0x1ea2099d1fafae7f, 0x425c8a06fbaaa815, 0xcd4216006c74052a},
-				IndexFile: idxPath,
+				IndexFile:       idxPath,
+				FingerprintBits: recsplit.DefaultFingerprintBits,
 			}); err != nil {
 				return outItems, fmt.Errorf("merge %s remove vals recsplit %s [%d-%d]: %w", d.filenameBase, fType.String(), startTxNum, endTxNum, err)
 			}
 			g1 := outItem.decompressor.MakeGetter()
 			var key []byte
-			for {
-				g.Reset(0)
-				g1.Reset(0)
-				var lastOffset uint64
-				for g.HasNext() {
-					key, _ = g.NextUncompressed()
-					g.Skip() // Skip value
-					_, pos := g1.Next(nil)
-					if err = rs.AddKey(key, lastOffset); err != nil {
-						return outItems, fmt.Errorf("merge %s remove vals recsplit add key %s [%d-%d]: %w", d.filenameBase, fType.String(), startTxNum, endTxNum, err)
-					}
-					lastOffset = pos
+			var parts []recsplit.KeyPart
+			g.Reset(0)
+			var lastOffset uint64
+			for g.HasNext() {
+				key, _ = g.NextUncompressed()
+				g.Skip() // Skip value
+				_, pos := g1.Next(nil)
+				// Values are only removed from history files, keys are added by parts of recsplit.TxNumKeySchema
+				if parts, err = recsplit.TxNumKeySchema.AppendParts(parts[:0], key); err == nil {
+					err = rs.AddKeyParts(recsplit.TxNumKeySchema, lastOffset, parts...)
 				}
-				if err = rs.Build(); err != nil {
-					if rs.Collision() {
-						log.Info("Building reduceHistoryFiles. Collision happened. It's ok. Restarting...")
-						rs.ResetNextSalt()
-					} else {
-						return outItems, fmt.Errorf("merge %s remove vals recsplit build %s [%d-%d]: %w", d.filenameBase, fType.String(), startTxNum, endTxNum, err)
-					}
-				} else {
-					break
+				if err != nil {
+					return outItems, fmt.Errorf("merge %s remove vals recsplit add key %s [%d-%d]: %w", d.filenameBase, fType.String(), startTxNum, endTxNum, err)
 				}
+				lastOffset = pos
+			}
+			if err = rs.Build(); err != nil {
+				return outItems, fmt.Errorf("merge %s remove vals recsplit build %s [%d-%d]: %w", d.filenameBase, fType.String(), startTxNum, endTxNum, err)
 			}
 			decomp.Close()
 			decomp = nil
@@ -475,7 +489,7 @@ func (d *Domain) mergeFiles(files [][NumberOfTypes]*filesItem, r DomainRanges, m
 			if outItem.decompressor, err = compress.NewDecompressor(datPath); err != nil {
 				return outItems, fmt.Errorf("merge %s decompressor %s [%d-%d]: %w", d.filenameBase, fType.String(), startTxNum, endTxNum, err)
 			}
-			if outItem.index, err = buildIndex(outItem.decompressor, idxPath, d.dir, count, fType == History /* values */); err != nil {
+			if outItem.index, err = buildIndex(outItem.decompressor, idxPath, d.dir, count, fType == History /* values */, fType.keySchema()); err != nil {
 				return outItems, fmt.Errorf("merge %s buildIndex %s [%d-%d]: %w", d.filenameBase, fType.String(), startTxNum, endTxNum, err)
 			}
 		}
@@ -594,7 +608,7 @@ func (ii *InvertedIndex) mergeFiles(files []*filesItem, startTxNum, endTxNum uin
 	if outItem.decompressor, err = compress.NewDecompressor(datPath); err != nil {
 		return nil, fmt.Errorf("merge %s decompressor [%d-%d]: %w", ii.filenameBase, startTxNum, endTxNum, err)
 	}
-	if outItem.index, err = buildIndex(outItem.decompressor, idxPath, ii.dir, count, false /* values */); err != nil {
+	if outItem.index, err = buildIndex(outItem.decompressor, idxPath, ii.dir, count, false /* values */, nil /* schema */); err != nil {
 		return nil, fmt.Errorf("merge %s buildIndex [%d-%d]: %w", ii.filenameBase, startTxNum, endTxNum, err)
 	}
 	outItem.getter = outItem.decompressor.MakeGetter()
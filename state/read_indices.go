@@ -20,8 +20,8 @@ import (
 	"fmt"
 	"sync"
 
-	"github.com/RoaringBitmap/roaring/roaring64"
 	"github.com/ledgerwatch/erigon-lib/kv"
+	"github.com/ledgerwatch/erigon-lib/recsplit/eliasfano32"
 )
 
 type ReadIndices struct {
@@ -96,9 +96,9 @@ func (ri *ReadIndices) SetTxNum(txNum uint64) {
 }
 
 type RCollation struct {
-	accounts map[string]*roaring64.Bitmap
-	storage  map[string]*roaring64.Bitmap
-	code     map[string]*roaring64.Bitmap
+	accounts map[string]*eliasfano32.Builder
+	storage  map[string]*eliasfano32.Builder
+	code     map[string]*eliasfano32.Builder
 }
 
 func (c RCollation) Close() {
@@ -19,7 +19,6 @@ package state
 import (
 	"bytes"
 	"container/heap"
-	"encoding/binary"
 	"fmt"
 
 	"github.com/google/btree"
@@ -74,7 +73,7 @@ func (dc *DomainContext) GetNoState(key []byte, txNum uint64) ([]byte, bool, uin
 		g.Reset(offset)
 		if k, _ := g.NextUncompressed(); bytes.Equal(k, key) {
 			eliasVal, _ := g.NextUncompressed()
-			ef, _ := eliasfano32.ReadEliasFano(eliasVal)
+			ef, _ := eliasfano32.ReadSequence(eliasVal)
 			if n, ok := ef.Search(txNum); ok {
 				foundTxNum = n
 				foundEndTxNum = item.endTxNum
@@ -89,8 +88,6 @@ func (dc *DomainContext) GetNoState(key []byte, txNum uint64) ([]byte, bool, uin
 		return true
 	})
 	if found {
-		var txKey [8]byte
-		binary.BigEndian.PutUint64(txKey[:], foundTxNum)
 		var historyItem *filesItem
 		var search filesItem
 		search.startTxNum = foundStartTxNum
@@ -100,7 +97,7 @@ func (dc *DomainContext) GetNoState(key []byte, txNum uint64) ([]byte, bool, uin
 		} else {
 			return nil, false, 0, fmt.Errorf("no %s file found for [%x]", dc.d.filenameBase, key)
 		}
-		offset := historyItem.indexReader.Lookup2(txKey[:], key)
+		offset := historyItem.indexReader.LookupParts(recsplit.TxNumKeySchema, recsplit.U64(foundTxNum), recsplit.Bytes(key))
 		g := historyItem.getter
 		g.Reset(offset)
 		if dc.d.compressVals {
@@ -129,7 +126,7 @@ func (dc *DomainContext) MaxTxNum(key []byte) (bool, uint64) {
 		g.Reset(offset)
 		if k, _ := g.NextUncompressed(); bytes.Equal(k, key) {
 			eliasVal, _ := g.NextUncompressed()
-			ef, _ := eliasfano32.ReadEliasFano(eliasVal)
+			ef, _ := eliasfano32.ReadSequence(eliasVal)
 			found = true
 			foundTxNum = ef.Max()
 			return false
@@ -220,7 +217,7 @@ func (si *ScanIterator) advance() {
 		}
 		if !bytes.Equal(key, si.key) {
 			si.key = key
-			ef, _ := eliasfano32.ReadEliasFano(val)
+			ef, _ := eliasfano32.ReadSequence(val)
 			max := ef.Max()
 			if max < si.uptoTxNum {
 				si.nextTxNum = max
@@ -297,11 +294,9 @@ func (hi *HistoryIterator) advance() {
 			}
 		}
 		if !bytes.Equal(hi.key, key) {
-			ef, _ := eliasfano32.ReadEliasFano(val)
+			ef, _ := eliasfano32.ReadSequence(val)
 			if n, ok := ef.Search(hi.txNum); ok {
 				hi.key = key
-				var txKey [8]byte
-				binary.BigEndian.PutUint64(txKey[:], n)
 				var historyItem *filesItem
 				var search filesItem
 				search.startTxNum = top.startTxNum
@@ -311,7 +306,7 @@ func (hi *HistoryIterator) advance() {
 				} else {
 					panic(fmt.Errorf("no %s file found for [%x]", hi.dc.d.filenameBase, hi.key))
 				}
-				offset := historyItem.indexReader.Lookup2(txKey[:], hi.key)
+				offset := historyItem.indexReader.LookupParts(recsplit.TxNumKeySchema, recsplit.U64(n), recsplit.Bytes(hi.key))
 				g := historyItem.getter
 				g.Reset(offset)
 				if hi.compressVals {